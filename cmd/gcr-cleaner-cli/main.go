@@ -19,9 +19,12 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
+	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -39,33 +42,78 @@ var (
 )
 
 var (
-	logLevel = os.Getenv("GCRCLEANER_LOG")
+	logLevel  = os.Getenv("GCRCLEANER_LOG")
+	logFormat = os.Getenv("GCRCLEANER_LOG_FORMAT")
 )
 
 var (
-	reposMap = make(map[string]struct{}, 4)
-
-	tokenPtr         = flag.String("token", os.Getenv("GCRCLEANER_TOKEN"), "Authentication token")
-	recursivePtr     = flag.Bool("recursive", false, "Clean all sub-repositories under the -repo root")
-	gracePtr         = flag.Duration("grace", 0, "Grace period")
-	repoSkipFilter   = flag.String("repo-skip-filter", "", "Keep repos with names that match this regular expression")
-	repoPrefixFilter = flag.String("repo-prefix-filter", "", "Delete only in repos with names that match this regular expression")
-	tagFilterAny     = flag.String("tag-filter-any", "", "Delete images where any tag matches this regular expression")
-	tagFilterAll     = flag.String("tag-filter-all", "", "Delete images where all tags match this regular expression")
-	tagKeepFilterAny = flag.String("tag-keep-filter", "", "Keep images where any tag matches this regular expression")
-	keepPtr          = flag.Int64("keep", 0, "Minimum to keep")
-	dryRunPtr        = flag.Bool("dry-run", false, "Do a noop on delete api call")
-	concurrencyPtr   = flag.Int64("concurrency", 20, "Concurrent requests (defaults to number of CPUs)")
-	versionPtr       = flag.Bool("version", false, "Print version information and exit")
+	reposMap     = make(map[string]struct{}, 4)
+	reposExclude []string
+	keepDigests  []string
+	keepLabels   []string
+	tagKeepExact []string
+	reposMatch   []string
+	inUseImages  []string
+	registries   []string
+
+	tagFilterNumberMin *int64
+	tagFilterNumberMax *int64
+
+	tokenPtr               = flag.String("token", os.Getenv("GCRCLEANER_TOKEN"), "Authentication token")
+	credentialsFilePtr     = flag.String("credentials-file", os.Getenv("GCRCLEANER_CREDENTIALS_FILE"), "Path to a credentials file, such as a service account key, to use instead of the default credentials")
+	impersonatePtr         = flag.String("impersonate-service-account", os.Getenv("GCRCLEANER_IMPERSONATE_SERVICE_ACCOUNT"), "Service account to impersonate for Google registries and APIs")
+	recursivePtr           = flag.Bool("recursive", false, "Clean all sub-repositories under the -repo root")
+	maxDepthPtr            = flag.Int("max-depth", -1, "Maximum number of path segments below each -repo that -recursive descends (-1 for no limit)")
+	recursiveBestEffortPtr = flag.Bool("recursive-best-effort", false, "With -recursive, skip registries that cannot be listed instead of failing")
+	gracePtr               = flag.Duration("grace", 0, "Grace period")
+	minAgePtr              = flag.Duration("min-age", 0, "Never delete images uploaded more recently than this, regardless of any filter")
+	beforePtr              = flag.String("before", "", "Only delete images older than this RFC3339 timestamp, instead of -grace")
+	timeSourcePtr          = flag.String("time-source", "uploaded", "Image timestamp compared against the grace period, either \"uploaded\" or \"created\"")
+	uploadedAfterPtr       = flag.String("uploaded-after", "", "Only delete images uploaded after this RFC3339 timestamp")
+	uploadedBeforePtr      = flag.String("uploaded-before", "", "Only delete images uploaded before this RFC3339 timestamp")
+	repoSkipFilter         = flag.String("repo-skip-filter", "", "Keep repos with names that match this regular expression")
+	repoPrefixFilter       = flag.String("repo-prefix-filter", "", "Delete only in repos with names that match this regular expression")
+	tagFilterAny           = flag.String("tag-filter-any", "", "Delete images where any tag matches this regular expression")
+	tagFilterAll           = flag.String("tag-filter-all", "", "Delete images where all tags match this regular expression")
+	tagFilterAllMatchEmpty = flag.Bool("tag-filter-all-match-empty", false, "Allow -tag-filter-all to match images with no tags")
+	tagFilterNone          = flag.String("tag-filter-none", "", "Delete images where no tags match this regular expression")
+	tagKeepFilterAny       = flag.String("tag-keep-filter", "", "Keep images where any tag matches this regular expression")
+	tagFilterSemver        = flag.String("tag-filter-semver", "", "Delete images where any tag satisfies this semver constraint (e.g. \"< 1.0.0\")")
+	tagKeepSemver          = flag.String("tag-keep-semver", "", "Keep images where any tag satisfies this semver constraint (e.g. \">= 2.0.0\")")
+	tagKeepSemverHighest   = flag.Int("tag-keep-semver-highest", 0, "Keep images with this many of the highest semver tags in each repository")
+	tagFilterNumber        = flag.String("tag-filter-number", "", "Delete images where any tag's number, captured by the first group of this regular expression, is within -tag-filter-number-min and -tag-filter-number-max (e.g. \"^build-(\\d+)$\")")
+	patternKind            = flag.String("pattern-kind", "regex", "Syntax of the filter patterns, either \"regex\" or \"glob\"")
+	globMatchSlash         = flag.Bool("glob-match-slash", false, "Allow glob wildcards to match a \"/\"")
+	caseInsensitive        = flag.Bool("case-insensitive", false, "Match all filters without regard to case")
+	keepPtr                = flag.Int64("keep", 0, "Minimum to keep")
+	minManifestsPtr        = flag.Int("min-manifests", 0, "Leave repositories with fewer manifests than this untouched")
+	keepScopePtr           = flag.String("keep-scope", "candidates", "Images counted by -keep, either \"candidates\" (images selected for deletion) or \"all\" (every image)")
+	keepTaggedPtr          = flag.Int64("keep-tagged", -1, "Minimum tagged images to keep, counted separately from untagged images (-1 to use -keep)")
+	keepUntaggedPtr        = flag.Int64("keep-untagged", -1, "Minimum untagged images to keep, counted separately from tagged images (-1 to use -keep)")
+	untaggedOnlyPtr        = flag.Bool("untagged-only", false, "Only delete untagged images, ignoring tag filters")
+	keepSignaturesPtr      = flag.Bool("keep-signatures", false, "Keep cosign signatures and attestations of kept images")
+	orphanedSigsOnlyPtr    = flag.Bool("orphaned-signatures-only", false, "Only delete cosign signatures and attestations whose image no longer exists")
+	platformFilterPtr      = flag.String("platform-filter", "", "Delete platform manifests of kept image indexes whose platform (e.g. linux/arm64) matches this regular expression")
+	keepGroupByPtr         = flag.String("keep-group-by", "", "Apply -keep to each group of images whose tags share this regular expression's first capture group")
+	dryRunPtr              = flag.Bool("dry-run", false, "Do a noop on delete api call")
+	deleteMaxAttemptsPtr   = flag.Int("delete-max-attempts", 3, "Maximum attempts for each deletion that fails with a transient error")
+	maxDeletesPerSecPtr    = flag.Float64("max-deletes-per-second", 0, "Maximum delete and list calls per second to the registry (0 for no limit)")
+	deleteRetryDelayPtr    = flag.Duration("delete-retry-base-delay", 500*time.Millisecond, "Delay before the first retry of a failed deletion, doubled for each retry")
+	deleteJitterPtr        = flag.Duration("delete-jitter", 0, "Delay each deletion by a random duration of up to this, to stagger deletions of shared layers (0 for no jitter)")
+	repoTimeoutPtr         = flag.Duration("repo-timeout", 0, "Maximum time to clean each repository (0 for no limit)")
+	httpTimeoutPtr         = flag.Duration("http-timeout", 0, "Maximum time for each request to a registry (0 for no limit)")
+	concurrencyPtr         = flag.Int64("concurrency", 20, "Concurrent requests (defaults to number of CPUs)")
+	versionPtr             = flag.Bool("version", false, "Print version information and exit")
 )
 
 func main() {
-	logger := gcrcleaner.NewLogger(logLevel, stderr, stdout)
+	logger := gcrcleaner.NewLogger(logLevel, stderr, stdout,
+		gcrcleaner.WithLogFormat(gcrcleaner.LogFormat(logFormat)))
 
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
 
-	flag.Func("repo", "Repository name", func(s string) error {
+	flag.Func("repo", "Repository name, which may contain glob wildcards (e.g. gcr.io/my-project/team-*)", func(s string) error {
 		parts := strings.Split(s, ",")
 		for _, p := range parts {
 			if t := strings.TrimSpace(p); t != "" {
@@ -75,6 +123,38 @@ func main() {
 		return nil
 	})
 
+	flag.Func("repo-exclude", "Never clean this repository or its children, which may contain glob wildcards (may be repeated)", stringListFlag(&reposExclude))
+
+	flag.Func("registry", "Registry that is not Container Registry or Artifact Registry, such as Harbor or Quay, authenticated with the Docker config (may be repeated)", stringListFlag(&registries))
+
+	flag.Func("keep-digest", "Never delete this digest or digest prefix (may be repeated)", stringListFlag(&keepDigests))
+
+	flag.Func("keep-label", "Never delete images with this key=value label or annotation (may be repeated)", stringListFlag(&keepLabels))
+
+	flag.Func("tag-filter-number-min", "Minimum number for -tag-filter-number, inclusive", func(s string) error {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		tagFilterNumberMin = &n
+		return nil
+	})
+
+	flag.Func("tag-filter-number-max", "Maximum number for -tag-filter-number, inclusive", func(s string) error {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		tagFilterNumberMax = &n
+		return nil
+	})
+
+	flag.Func("repo-match", "Delete only in the repository with this exact name (may be repeated)", stringListFlag(&reposMatch))
+
+	flag.Func("in-use-image", "Keep this in-use image reference, matched by exact digest or exact tag (may be repeated)", stringListFlag(&inUseImages))
+
+	flag.Func("tag-keep-exact", "Keep images with this exact tag (may be repeated)", stringListFlag(&tagKeepExact))
+
 	flag.Usage = func() {
 		w := flag.CommandLine.Output()
 		fmt.Fprintf(w, "Usage of %s:\n\n", os.Args[0])
@@ -124,32 +204,121 @@ func realMain(ctx context.Context, logger *gcrcleaner.Logger) error {
 	}
 	sort.Strings(repos)
 
-	repoKeeper, err := gcrcleaner.BuildItemFilter(*repoSkipFilter, "")
+	filterOpts := []gcrcleaner.ItemFilterOption{
+		gcrcleaner.WithPatternKind(gcrcleaner.PatternKind(*patternKind)),
+		gcrcleaner.WithGlobMatchSlash(*globMatchSlash),
+		gcrcleaner.WithCaseInsensitive(*caseInsensitive),
+		gcrcleaner.WithAllMatchEmpty(*tagFilterAllMatchEmpty),
+	}
+
+	repoKeeper, err := gcrcleaner.BuildItemFilter(*repoSkipFilter, "", filterOpts...)
 	if err != nil {
 		return fmt.Errorf("failed to parse repo keep filter: %w", err)
 	}
 	logger.Debug("CLI: created repo keep filter any", "filter", repoSkipFilter)
 
-	repoPrefixFilter, err := gcrcleaner.BuildItemFilter(*repoSkipFilter, "")
+	repoPrefixFilter, err := gcrcleaner.BuildItemFilter(*repoPrefixFilter, "", filterOpts...)
 	if err != nil {
 		return fmt.Errorf("failed to parse repo prefix filter: %w", err)
 	}
-	logger.Debug("CLI: created repo prefix filter any", "filter", repoSkipFilter)
+	logger.Debug("CLI: created repo prefix filter any", "filter", repoPrefixFilter.Name())
 
-	tagFilter, err := gcrcleaner.BuildItemFilter(*tagFilterAny, *tagFilterAll)
+	tagFilter, err := gcrcleaner.BuildItemFilter(*tagFilterAny, *tagFilterAll,
+		append([]gcrcleaner.ItemFilterOption{gcrcleaner.WithNone(*tagFilterNone)}, filterOpts...)...)
 	if err != nil {
 		return fmt.Errorf("failed to parse tag filter: %w", err)
 	}
 	logger.Debug("CLI: created tag filter any", "filter", tagFilterAny)
 	logger.Debug("CLI: created tag filter all", "filter", tagFilterAll)
+	logger.Debug("CLI: created tag filter none", "filter", tagFilterNone)
+
+	if *tagFilterSemver != "" {
+		if _, ok := tagFilter.(*gcrcleaner.ItemFilterNull); !ok {
+			return fmt.Errorf("failed to parse tag filter: only one tag filter type may be specified")
+		}
+
+		tagFilter, err = gcrcleaner.BuildSemverFilter(*tagFilterSemver)
+		if err != nil {
+			return fmt.Errorf("failed to parse tag filter: %w", err)
+		}
+		logger.Debug("CLI: created tag filter semver", "filter", tagFilterSemver)
+	}
 
-	tagKeepFilter, err := gcrcleaner.BuildItemFilter(*tagKeepFilterAny, "")
+	if *tagFilterNumber != "" || tagFilterNumberMin != nil || tagFilterNumberMax != nil {
+		if _, ok := tagFilter.(*gcrcleaner.ItemFilterNull); !ok {
+			return fmt.Errorf("failed to parse tag filter: only one tag filter type may be specified")
+		}
+
+		tagFilter, err = gcrcleaner.BuildNumberRangeFilter(*tagFilterNumber, tagFilterNumberMin, tagFilterNumberMax)
+		if err != nil {
+			return fmt.Errorf("failed to parse tag filter: %w", err)
+		}
+		logger.Debug("CLI: created tag filter number", "filter", tagFilter.Name())
+	}
+
+	tagKeepFilter, err := gcrcleaner.BuildItemFilter(*tagKeepFilterAny, "", filterOpts...)
 	if err != nil {
 		return fmt.Errorf("failed to parse tag keep filter: %w", err)
 	}
 	logger.Debug("CLI: created tag keep filter any", "filter", tagKeepFilterAny)
 
-	podFilter := gcrcleaner.NewAssetPodFilter(repos)
+	if *tagKeepSemver != "" {
+		if _, ok := tagKeepFilter.(*gcrcleaner.ItemFilterNull); !ok {
+			return fmt.Errorf("failed to parse tag keep filter: only one tag keep filter type may be specified")
+		}
+
+		tagKeepFilter, err = gcrcleaner.BuildSemverFilter(*tagKeepSemver)
+		if err != nil {
+			return fmt.Errorf("failed to parse tag keep filter: %w", err)
+		}
+		logger.Debug("CLI: created tag keep filter semver", "filter", tagKeepSemver)
+	}
+
+	if len(tagKeepExact) > 0 {
+		exact := gcrcleaner.NewItemFilterExact(tagKeepExact)
+		if _, ok := tagKeepFilter.(*gcrcleaner.ItemFilterNull); ok {
+			tagKeepFilter = exact
+		} else {
+			tagKeepFilter = gcrcleaner.NewItemFilterOr(tagKeepFilter, exact)
+		}
+		logger.Debug("CLI: created tag keep filter exact", "filter", tagKeepFilter.Name())
+	}
+
+	var repoMatchFilter gcrcleaner.ItemFilter
+	if len(reposMatch) > 0 {
+		repoMatchFilter = gcrcleaner.NewItemFilterExact(reposMatch)
+		logger.Debug("CLI: created repo match filter", "filter", repoMatchFilter.Name())
+	}
+
+	var platformFilter gcrcleaner.ItemFilter
+	if *platformFilterPtr != "" {
+		platformFilter, err = gcrcleaner.BuildItemFilter(*platformFilterPtr, "", filterOpts...)
+		if err != nil {
+			return fmt.Errorf("failed to parse platform filter: %w", err)
+		}
+		logger.Debug("CLI: created platform filter", "filter", platformFilterPtr)
+	}
+
+	keepLabelsMap, err := gcrcleaner.ParseKeepLabels(keepLabels)
+	if err != nil {
+		return fmt.Errorf("failed to parse -keep-label: %w", err)
+	}
+
+	var keepGroupBy *regexp.Regexp
+	if *keepGroupByPtr != "" {
+		keepGroupBy, err = regexp.Compile(*keepGroupByPtr)
+		if err != nil {
+			return fmt.Errorf("failed to parse keep group: %w", err)
+		}
+	}
+
+	var podFilter gcrcleaner.PodFilter = gcrcleaner.NewAssetPodFilter(repos)
+	if len(inUseImages) > 0 {
+		podFilter, err = gcrcleaner.NewStaticPodFilter(inUseImages)
+		if err != nil {
+			return err
+		}
+	}
 
 	keychain := gcrauthn.NewMultiKeychain(
 		bearerkeychain.New(*tokenPtr),
@@ -157,7 +326,24 @@ func realMain(ctx context.Context, logger *gcrcleaner.Logger) error {
 		gcrgoogle.Keychain,
 	)
 
-	cleaner, err := gcrcleaner.NewCleaner(keychain, logger, *concurrencyPtr)
+	var cleanerOpts []gcrcleaner.CleanerOption
+	if *credentialsFilePtr != "" {
+		cleanerOpts = append(cleanerOpts, gcrcleaner.WithCredentialsFile(*credentialsFilePtr))
+	}
+	if v := os.Getenv("GCRCLEANER_CREDENTIALS_JSON"); v != "" {
+		cleanerOpts = append(cleanerOpts, gcrcleaner.WithCredentialsJSON([]byte(v)))
+	}
+	if *impersonatePtr != "" {
+		cleanerOpts = append(cleanerOpts, gcrcleaner.WithImpersonation(*impersonatePtr))
+	}
+	for _, registry := range registries {
+		cleanerOpts = append(cleanerOpts, gcrcleaner.WithRegistry(registry, nil))
+	}
+	if *httpTimeoutPtr > 0 {
+		cleanerOpts = append(cleanerOpts, gcrcleaner.WithHTTPClient(&http.Client{Timeout: *httpTimeoutPtr}))
+	}
+
+	cleaner, err := gcrcleaner.NewCleaner(keychain, logger, *concurrencyPtr, cleanerOpts...)
 	if err != nil {
 		return fmt.Errorf("failed to create cleaner: %w", err)
 	}
@@ -169,12 +355,107 @@ func realMain(ctx context.Context, logger *gcrcleaner.Logger) error {
 		sub = sub * -1
 	}
 	since := time.Now().UTC().Add(sub)
+	if v := *beforePtr; v != "" {
+		since, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			return fmt.Errorf("failed to parse -before %q as RFC3339: %w", v, err)
+		}
+		since = since.UTC()
+	}
+
+	var minAgeCutoff time.Time
+	if *minAgePtr > 0 {
+		minAgeCutoff = time.Now().UTC().Add(-*minAgePtr)
+	}
+
+	timeSource := gcrcleaner.TimeSource(*timeSourcePtr)
+	if err := timeSource.Validate(); err != nil {
+		return fmt.Errorf("failed to parse -time-source: %w", err)
+	}
+	if timeSource == gcrcleaner.TimeSourcePulled {
+		return fmt.Errorf("failed to parse -time-source: %q is only supported by the Go library", timeSource)
+	}
+
+	keepScope := gcrcleaner.KeepScope(*keepScopePtr)
+	if err := keepScope.Validate(); err != nil {
+		return fmt.Errorf("failed to parse -keep-scope: %w", err)
+	}
+
+	var uploadedAfter, uploadedBefore time.Time
+	if v := *uploadedAfterPtr; v != "" {
+		uploadedAfter, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			return fmt.Errorf("failed to parse -uploaded-after %q as RFC3339: %w", v, err)
+		}
+	}
+	if v := *uploadedBeforePtr; v != "" {
+		uploadedBefore, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			return fmt.Errorf("failed to parse -uploaded-before %q as RFC3339: %w", v, err)
+		}
+	}
+
+	var keepTagged, keepUntagged *int64
+	if *keepTaggedPtr >= 0 {
+		keepTagged = keepTaggedPtr
+	}
+	if *keepUntaggedPtr >= 0 {
+		keepUntagged = keepUntaggedPtr
+	}
+
+	// Gather the repositories. Patterns can match repositories that were also
+	// given explicitly, so ensure each repository is only cleaned once.
+	repos, err = cleaner.ExpandRepositories(ctx, gcrcleaner.UniqueRepositories(repos))
+	if err != nil {
+		return err
+	}
+	repos = gcrcleaner.UniqueRepositories(repos)
+
+	cleanOpts := &gcrcleaner.CleanOptions{
+		Since:                  since,
+		TimeSource:             timeSource,
+		MinAgeCutoff:           minAgeCutoff,
+		UploadedAfter:          uploadedAfter,
+		UploadedBefore:         uploadedBefore,
+		MinManifests:           *minManifestsPtr,
+		Keep:                   *keepPtr,
+		KeepScope:              keepScope,
+		KeepTagged:             keepTagged,
+		KeepUntagged:           keepUntagged,
+		KeepGroupBy:            keepGroupBy,
+		RepoKeepFilter:         repoKeeper,
+		RepoPrefixFilter:       repoPrefixFilter,
+		RepoMatchFilter:        repoMatchFilter,
+		TagFilter:              tagFilter,
+		TagKeepFilter:          tagKeepFilter,
+		PodFilter:              podFilter,
+		KeepDigests:            keepDigests,
+		KeepLabels:             keepLabelsMap,
+		TagKeepSemverHighest:   *tagKeepSemverHighest,
+		KeepSignatures:         *keepSignaturesPtr,
+		PlatformFilter:         platformFilter,
+		UntaggedOnly:           *untaggedOnlyPtr,
+		OrphanedSignaturesOnly: *orphanedSigsOnlyPtr,
+		DryRun:                 *dryRunPtr,
+
+		DeleteMaxAttempts:    *deleteMaxAttemptsPtr,
+		DeleteRetryBaseDelay: *deleteRetryDelayPtr,
+		DeleteJitter:         *deleteJitterPtr,
+		MaxRequestsPerSecond: *maxDeletesPerSecPtr,
+		ListBestEffort:       *recursiveBestEffortPtr,
+		RepoTimeout:          *repoTimeoutPtr,
+	}
+
+	// Build the rate limiter once, so it is shared by listing child repositories
+	// and cleaning every repository.
+	cleanOpts = cleanOpts.WithSharedLimiter()
 
-	// Gather the repositories.
 	if *recursivePtr {
 		logger.Debug("gathering child repositories recursively")
 
-		allRepos, err := cleaner.ListChildRepositories(ctx, repos)
+		// Nested roots are folded into their ancestor, since its children include
+		// them. Every root is still used to limit the depth.
+		allRepos, err := cleaner.ListChildRepositoriesWithOptions(ctx, gcrcleaner.CollapseRepositories(repos), cleanOpts)
 		if err != nil {
 			return err
 		}
@@ -183,8 +464,15 @@ func realMain(ctx context.Context, logger *gcrcleaner.Logger) error {
 			"out", allRepos)
 
 		// This is safe because ListChildRepositories is guaranteed to include at
-		// least the list repos given to it.
-		repos = allRepos
+		// least the list repos given to it. Skip children that the repo keep
+		// filter excludes, so their manifests are never listed.
+		allRepos = gcrcleaner.LimitChildRepositoryDepth(repos, allRepos, *maxDepthPtr)
+		repos = gcrcleaner.PruneChildRepositories(repos, allRepos, repoKeeper)
+	}
+
+	repos, err = gcrcleaner.ExcludeRepositories(repos, reposExclude)
+	if err != nil {
+		return fmt.Errorf("failed to parse -repo-exclude: %w", err)
 	}
 
 	// Log dry-run mode.
@@ -198,9 +486,10 @@ func realMain(ctx context.Context, logger *gcrcleaner.Logger) error {
 
 	// Do the deletion.
 	var errs []error
+	freed := &gcrcleaner.FreedBytes{}
 	for i, repo := range repos {
 		fmt.Fprintf(stdout, "%s\n", repo)
-		deleted, err := cleaner.Clean(ctx, repo, since, *keepPtr, repoKeeper, repoPrefixFilter, tagFilter, tagKeepFilter, podFilter, *dryRunPtr)
+		deleted, decisions, err := cleaner.CleanWithOptions(ctx, repo, cleanOpts)
 		if err != nil {
 			errs = append(errs, err)
 		}
@@ -213,10 +502,43 @@ func realMain(ctx context.Context, logger *gcrcleaner.Logger) error {
 			fmt.Fprintf(stdout, "  ✗ no refs were deleted\n")
 		}
 
+		// Refs deleted before a failure are listed above, but the estimate is
+		// only meaningful when the entire plan was carried out.
+		if err == nil {
+			freed.Add(gcrcleaner.EstimateFreedBytes(decisions))
+		}
+
+		// Explain each decision in dry-run mode to help debug filters.
+		if *dryRunPtr {
+			for _, d := range decisions {
+				fmt.Fprintf(stdout, "    %s (%s)\n", d.Digest, d.Reason)
+			}
+		}
+
 		if i != len(repos)-1 {
 			fmt.Fprintf(stdout, "\n")
 		}
 	}
 
+	fmt.Fprintf(stdout, "\nEstimated bytes freed: %d", freed.Bytes)
+	if freed.UnknownCount > 0 {
+		fmt.Fprintf(stdout, " (plus %d ref(s) of unknown size)", freed.UnknownCount)
+	}
+	fmt.Fprintf(stdout, "\n")
+
 	return gcrcleaner.ErrsToError(errs)
 }
+
+// stringListFlag returns a flag function that appends each entry of a
+// comma-separated list to dst, ignoring empty entries, so the flag may be
+// given more than once.
+func stringListFlag(dst *[]string) func(string) error {
+	return func(s string) error {
+		for _, p := range strings.Split(s, ",") {
+			if t := strings.TrimSpace(p); t != "" {
+				*dst = append(*dst, t)
+			}
+		}
+		return nil
+	}
+}
@@ -17,11 +17,14 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -30,6 +33,7 @@ import (
 	"github.com/GoogleCloudPlatform/gcr-cleaner/pkg/gcrcleaner"
 	gcrauthn "github.com/google/go-containerregistry/pkg/authn"
 	gcrgoogle "github.com/google/go-containerregistry/pkg/v1/google"
+	"google.golang.org/api/option"
 )
 
 var (
@@ -39,6 +43,7 @@ var (
 
 var (
 	logLevel    = os.Getenv("GCRCLEANER_LOG")
+	logFormat   = os.Getenv("GCRCLEANER_LOG_FORMAT")
 	concurrency = func() int64 {
 		v := os.Getenv("GCRCLEANER_CONCURRENCY")
 		if v == "" {
@@ -51,10 +56,83 @@ var (
 		}
 		return i
 	}()
+	cacheTTL = func() time.Duration {
+		v := os.Getenv("GCRCLEANER_CACHE_TTL")
+		if v == "" {
+			return 5 * time.Minute
+		}
+
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			panic(fmt.Errorf("failed to parse cache ttl: %w", err))
+		}
+		return d
+	}()
+	pubSubTimeout = func() time.Duration {
+		v := os.Getenv("GCRCLEANER_PUBSUB_TIMEOUT")
+		if v == "" {
+			return time.Hour
+		}
+
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			panic(fmt.Errorf("failed to parse pubsub timeout: %w", err))
+		}
+		return d
+	}()
+	shutdownTimeout = func() time.Duration {
+		v := os.Getenv("GCRCLEANER_SHUTDOWN_TIMEOUT")
+		if v == "" {
+			return 9 * time.Second
+		}
+
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			panic(fmt.Errorf("failed to parse shutdown timeout: %w", err))
+		}
+		return d
+	}()
+	jobTimeout = func() time.Duration {
+		v := os.Getenv("GCRCLEANER_JOB_TIMEOUT")
+		if v == "" {
+			return time.Hour
+		}
+
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			panic(fmt.Errorf("failed to parse job timeout: %w", err))
+		}
+		return d
+	}()
+	httpTimeout = func() time.Duration {
+		v := os.Getenv("GCRCLEANER_HTTP_TIMEOUT")
+		if v == "" {
+			return 0
+		}
+
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			panic(fmt.Errorf("failed to parse http timeout: %w", err))
+		}
+		return d
+	}()
+	jobTTL = func() time.Duration {
+		v := os.Getenv("GCRCLEANER_JOB_TTL")
+		if v == "" {
+			return time.Hour
+		}
+
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			panic(fmt.Errorf("failed to parse job ttl: %w", err))
+		}
+		return d
+	}()
 )
 
 func main() {
-	logger := gcrcleaner.NewLogger(logLevel, stderr, stdout)
+	logger := gcrcleaner.NewLogger(logLevel, stderr, stdout,
+		gcrcleaner.WithLogFormat(gcrcleaner.LogFormat(logFormat)))
 
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
@@ -83,21 +161,128 @@ func realMain(ctx context.Context, logger *gcrcleaner.Logger) error {
 		gcrgoogle.Keychain,
 	)
 
-	cleaner, err := gcrcleaner.NewCleaner(keychain, logger, concurrency)
+	// Use explicit credentials instead of the default credentials if
+	// configured. They are also used for the result sink.
+	var cleanerOpts []gcrcleaner.CleanerOption
+	var clientOpts []option.ClientOption
+	if path := os.Getenv("GCRCLEANER_CREDENTIALS_FILE"); path != "" {
+		cleanerOpts = append(cleanerOpts, gcrcleaner.WithCredentialsFile(path))
+		clientOpts = append(clientOpts, option.WithCredentialsFile(path))
+	}
+	if v := os.Getenv("GCRCLEANER_CREDENTIALS_JSON"); v != "" {
+		cleanerOpts = append(cleanerOpts, gcrcleaner.WithCredentialsJSON([]byte(v)))
+		clientOpts = append(clientOpts, option.WithCredentialsJSON([]byte(v)))
+	}
+	if sa := os.Getenv("GCRCLEANER_IMPERSONATE_SERVICE_ACCOUNT"); sa != "" {
+		cleanerOpts = append(cleanerOpts, gcrcleaner.WithImpersonation(sa))
+	}
+
+	// Other registries authenticate with the Docker config, like "docker login".
+	for _, registry := range splitList(os.Getenv("GCRCLEANER_REGISTRIES")) {
+		cleanerOpts = append(cleanerOpts, gcrcleaner.WithRegistry(registry, nil))
+	}
+
+	// Registry calls honor HTTPS_PROXY and NO_PROXY, and can be limited to a
+	// timeout.
+	if httpTimeout > 0 {
+		cleanerOpts = append(cleanerOpts, gcrcleaner.WithHTTPClient(&http.Client{Timeout: httpTimeout}))
+	}
+
+	cleaner, err := gcrcleaner.NewCleaner(keychain, logger, concurrency, cleanerOpts...)
 	if err != nil {
 		return fmt.Errorf("failed to create cleaner: %w", err)
 	}
 
-	cleanerServer, err := gcrcleaner.NewServer(cleaner)
+	serverOpts := []gcrcleaner.ServerOption{
+		gcrcleaner.WithJobTTL(jobTTL),
+		gcrcleaner.WithJobTimeout(jobTimeout),
+		gcrcleaner.WithPubSubTimeout(pubSubTimeout),
+	}
+
+	// Verify OIDC tokens if configured, in addition to any platform IAM.
+	if audience := os.Getenv("GCRCLEANER_OIDC_AUDIENCE"); audience != "" {
+		emails := splitList(os.Getenv("GCRCLEANER_OIDC_ALLOWED_EMAILS"))
+		serverOpts = append(serverOpts, gcrcleaner.WithOIDCAuth(audience, emails...))
+	}
+
+	// Require payloads to confirm deletion if configured, so shared
+	// deployments default to a dry run.
+	if os.Getenv("GCRCLEANER_REQUIRE_CONFIRM") == "true" {
+		serverOpts = append(serverOpts, gcrcleaner.WithRequireConfirm(true))
+	}
+
+	// Only accept PubSub messages from the given subscriptions if configured.
+	if v := os.Getenv("GCRCLEANER_ALLOWED_SUBSCRIPTIONS"); v != "" {
+		serverOpts = append(serverOpts, gcrcleaner.WithAllowedSubscriptions(splitList(v)...))
+	}
+
+	// Publish the result of each PubSub clean if configured, since those cleans
+	// run in the background and are otherwise only visible in the logs.
+	if topic := os.Getenv("GCRCLEANER_RESULTS_TOPIC"); topic != "" {
+		sink, err := gcrcleaner.NewPubSubResultSink(ctx, topic, clientOpts...)
+		if err != nil {
+			return fmt.Errorf("failed to create result sink: %w", err)
+		}
+		serverOpts = append(serverOpts, gcrcleaner.WithResultSink(sink))
+	}
+
+	// POST the result of every clean to a webhook if configured.
+	if webhookURL := os.Getenv("GCRCLEANER_RESULTS_WEBHOOK"); webhookURL != "" {
+		webhook, err := gcrcleaner.NewWebhookResultSink(webhookURL)
+		if err != nil {
+			return fmt.Errorf("failed to create webhook: %w", err)
+		}
+		serverOpts = append(serverOpts, gcrcleaner.WithNotifier(webhook))
+	}
+
+	// Post a human-readable summary of every clean to Slack if configured.
+	if slackURL := os.Getenv("GCRCLEANER_SLACK_WEBHOOK"); slackURL != "" {
+		slack, err := gcrcleaner.NewSlackResultSink(slackURL)
+		if err != nil {
+			return fmt.Errorf("failed to create slack notifier: %w", err)
+		}
+		serverOpts = append(serverOpts, gcrcleaner.WithNotifier(slack))
+	}
+
+	cleanerServer, err := gcrcleaner.NewServer(cleaner, serverOpts...)
 	if err != nil {
 		return fmt.Errorf("failed to create server: %w", err)
 	}
 
-	cache := gcrcleaner.NewTimerCache(5 * time.Minute)
+	// Deduplicate PubSub messages in Redis if configured, so duplicates are
+	// detected across instances and restarts.
+	var cache gcrcleaner.Cache
+	if addr := os.Getenv("GCRCLEANER_REDIS_ADDR"); addr != "" {
+		redisOpts := []gcrcleaner.RedisCacheOption{
+			gcrcleaner.WithRedisPassword(os.Getenv("GCRCLEANER_REDIS_PASSWORD")),
+			gcrcleaner.WithRedisFailOpen(os.Getenv("GCRCLEANER_REDIS_FAIL_CLOSED") != "true"),
+			gcrcleaner.WithRedisLogger(logger),
+		}
+
+		caFile := os.Getenv("GCRCLEANER_REDIS_CA_FILE")
+		if os.Getenv("GCRCLEANER_REDIS_TLS") == "true" || caFile != "" {
+			tlsConfig, err := redisTLSConfig(caFile)
+			if err != nil {
+				return err
+			}
+			redisOpts = append(redisOpts, gcrcleaner.WithRedisTLS(tlsConfig))
+		}
+
+		cache = gcrcleaner.NewRedisCache(addr, cacheTTL, redisOpts...)
+	} else {
+		cache = gcrcleaner.NewTimerCache(cacheTTL)
+	}
+	defer cache.Stop()
 
 	mux := http.NewServeMux()
-	mux.Handle("/http", cleanerServer.HTTPHandler())
-	mux.Handle("/pubsub", cleanerServer.PubSubHandler(cache))
+	mux.Handle("/http", cleanerServer.Authenticate(cleanerServer.HTTPHandler()))
+	mux.Handle("/stream", cleanerServer.Authenticate(cleanerServer.StreamHandler()))
+	mux.Handle("/pubsub", cleanerServer.Authenticate(cleanerServer.PubSubHandler(cache)))
+	mux.Handle("/jobs", cleanerServer.Authenticate(cleanerServer.StartJobHandler()))
+	mux.Handle("/jobs/", cleanerServer.Authenticate(cleanerServer.JobStatusHandler()))
+	mux.Handle("/metrics", cleanerServer.MetricsHandler())
+	mux.Handle("/healthz", cleanerServer.HealthHandler())
+	mux.Handle("/readyz", cleanerServer.ReadyHandler())
 
 	server := &http.Server{
 		Addr:    addr,
@@ -121,13 +306,60 @@ func realMain(ctx context.Context, logger *gcrcleaner.Logger) error {
 		return fmt.Errorf("server exited: %w", err)
 	}
 
-	logger.Info("server received stop, shutting down")
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	// Stopping the HTTP server and draining the cleans started by pubsub
+	// requests and jobs share one deadline, so together they fit in the
+	// platform's grace period. They run at the same time, so a long synchronous
+	// clean cannot stop the background cleans from being waited on, which would
+	// otherwise be stopped in the middle of deleting.
+	logger.Info("server received stop, shutting down", "timeout", shutdownTimeout.String())
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
 	defer cancel()
 
+	drainErrCh := make(chan error, 1)
+	go func() {
+		drainErrCh <- cleanerServer.Shutdown(ctx)
+	}()
+
 	if err := server.Shutdown(ctx); err != nil {
-		return fmt.Errorf("failed to shutdown server: %w", err)
+		logger.Error("failed to shutdown server", "error", err)
 	}
 
+	if err := <-drainErrCh; err != nil {
+		return fmt.Errorf("failed to drain background cleans: %w", err)
+	}
 	return nil
 }
+
+// splitList splits a comma-separated list, ignoring empty entries.
+func splitList(v string) []string {
+	var list []string
+	for _, entry := range strings.Split(v, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
+
+// redisTLSConfig builds the TLS configuration for Redis. If caFile is given,
+// the server certificate must be signed by one of the PEM certificates in it,
+// such as the server CA of a Memorystore instance. Otherwise the system roots
+// are used.
+func redisTLSConfig(caFile string) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile == "" {
+		return cfg, nil
+	}
+
+	b, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read redis CA file: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("failed to parse redis CA file %s: no PEM certificates", caFile)
+	}
+	cfg.RootCAs = pool
+	return cfg, nil
+}
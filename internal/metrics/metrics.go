@@ -0,0 +1,303 @@
+// Package metrics defines a minimal registry of counters and histograms that
+// are exported in the Prometheus text exposition format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// collector is a metric that can write itself in the text exposition format.
+type collector interface {
+	name() string
+	write(w io.Writer) error
+}
+
+// Registry is a collection of metrics. It is safe for concurrent use.
+type Registry struct {
+	lock       sync.Mutex
+	collectors []collector
+}
+
+// NewRegistry creates a new, empty registry.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// register adds the collector to the registry. It panics if a metric with the
+// same name is already registered, since that is a programming error.
+func (r *Registry) register(c collector) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for _, existing := range r.collectors {
+		if existing.name() == c.name() {
+			panic(fmt.Sprintf("metric %q is already registered", c.name()))
+		}
+	}
+	r.collectors = append(r.collectors, c)
+}
+
+// Write writes all metrics in the registry in the text exposition format,
+// sorted by name.
+func (r *Registry) Write(w io.Writer) error {
+	r.lock.Lock()
+	collectors := make([]collector, len(r.collectors))
+	copy(collectors, r.collectors)
+	r.lock.Unlock()
+
+	sort.Slice(collectors, func(i, j int) bool {
+		return collectors[i].name() < collectors[j].name()
+	})
+
+	for _, c := range collectors {
+		if err := c.write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Handler returns an http handler that serves the registry.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := r.Write(w); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+// CounterVec is a set of counters partitioned by label values.
+type CounterVec struct {
+	n      string
+	help   string
+	labels []string
+
+	lock   sync.Mutex
+	values map[string]*counterValue
+}
+
+type counterValue struct {
+	labelValues []string
+	value       float64
+}
+
+// NewCounterVec creates and registers a new counter with the given labels.
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{
+		n:      name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]*counterValue),
+	}
+	r.register(c)
+	return c
+}
+
+// Add adds v to the counter with the given label values. It panics if the
+// number of label values does not match the number of labels or if v is
+// negative.
+func (c *CounterVec) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		panic(fmt.Sprintf("counter %q cannot decrease", c.n))
+	}
+	key := c.key(labelValues)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	cv, ok := c.values[key]
+	if !ok {
+		cv = &counterValue{labelValues: labelValues}
+		c.values[key] = cv
+	}
+	cv.value += v
+}
+
+// Inc increments the counter with the given label values by one.
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Value returns the current value of the counter with the given label values.
+func (c *CounterVec) Value(labelValues ...string) float64 {
+	key := c.key(labelValues)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if cv, ok := c.values[key]; ok {
+		return cv.value
+	}
+	return 0
+}
+
+func (c *CounterVec) key(labelValues []string) string {
+	if len(labelValues) != len(c.labels) {
+		panic(fmt.Sprintf("counter %q expects %d label values, got %d",
+			c.n, len(c.labels), len(labelValues)))
+	}
+	return strings.Join(labelValues, "\xff")
+}
+
+func (c *CounterVec) name() string {
+	return c.n
+}
+
+func (c *CounterVec) write(w io.Writer) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.n, escapeHelp(c.help), c.n); err != nil {
+		return err
+	}
+	for _, k := range keys {
+		cv := c.values[k]
+		if _, err := fmt.Fprintf(w, "%s%s %s\n", c.n, formatLabels(c.labels, cv.labelValues, "", ""), formatFloat(cv.value)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Histogram samples observations into cumulative buckets.
+type Histogram struct {
+	n       string
+	help    string
+	buckets []float64
+
+	lock   sync.Mutex
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// DefaultBuckets are the default histogram buckets, in seconds, which are
+// suitable for request durations.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600}
+
+// NewHistogram creates and registers a new histogram. If buckets is empty,
+// DefaultBuckets is used.
+func (r *Registry) NewHistogram(name, help string, buckets []float64) *Histogram {
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+	sorted := make([]float64, len(buckets))
+	copy(sorted, buckets)
+	sort.Float64s(sorted)
+
+	h := &Histogram{
+		n:       name,
+		help:    help,
+		buckets: sorted,
+		counts:  make([]uint64, len(sorted)),
+	}
+	r.register(h)
+	return h
+}
+
+// Observe adds a single observation to the histogram.
+func (h *Histogram) Observe(v float64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// Count returns the number of observations.
+func (h *Histogram) Count() uint64 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.count
+}
+
+// Sum returns the sum of all observations.
+func (h *Histogram) Sum() float64 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.sum
+}
+
+func (h *Histogram) name() string {
+	return h.n
+}
+
+func (h *Histogram) write(w io.Writer) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.n, escapeHelp(h.help), h.n); err != nil {
+		return err
+	}
+	for i, b := range h.buckets {
+		if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", h.n, formatLabels(nil, nil, "le", formatFloat(b)), h.counts[i]); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n%s_sum %s\n%s_count %d\n",
+		h.n, formatLabels(nil, nil, "le", "+Inf"), h.count,
+		h.n, formatFloat(h.sum),
+		h.n, h.count); err != nil {
+		return err
+	}
+	return nil
+}
+
+// formatLabels formats the label pairs, plus an optional extra label, as
+// {k="v",...}. It returns the empty string if there are no labels.
+func formatLabels(names, values []string, extraName, extraValue string) string {
+	pairs := make([]string, 0, len(names)+1)
+	for i, n := range names {
+		pairs = append(pairs, n+`="`+escapeLabelValue(values[i])+`"`)
+	}
+	if extraName != "" {
+		pairs = append(pairs, extraName+`="`+escapeLabelValue(extraValue)+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// labelValueEscaper escapes label values. The text exposition format only
+// defines escapes for backslash, double-quote, and line feed; every other byte,
+// including non-ASCII UTF-8, is written as-is.
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(s string) string {
+	return labelValueEscaper.Replace(s)
+}
+
+// helpEscaper escapes help text, which only defines escapes for backslash and
+// line feed.
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
@@ -0,0 +1,194 @@
+package metrics
+
+import (
+	"bytes"
+	"math"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCounterVec_Write(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name  string
+		help  string
+		value string
+		exp   string
+	}{
+		{
+			name:  "plain",
+			help:  "Total things.",
+			value: "gcr.io/my-project/my-repo",
+			exp: "# HELP things_total Total things.\n" +
+				"# TYPE things_total counter\n" +
+				"things_total{repo=\"gcr.io/my-project/my-repo\"} 2\n",
+		},
+		{
+			name:  "escapes_label_value",
+			help:  "Total things.",
+			value: "a\\b\"c\nd",
+			exp: "# HELP things_total Total things.\n" +
+				"# TYPE things_total counter\n" +
+				"things_total{repo=\"a\\\\b\\\"c\\nd\"} 2\n",
+		},
+		{
+			name:  "does_not_escape_other_bytes",
+			help:  "Total things.",
+			value: "tab\there ünïcode ☃",
+			exp: "# HELP things_total Total things.\n" +
+				"# TYPE things_total counter\n" +
+				"things_total{repo=\"tab\there ünïcode ☃\"} 2\n",
+		},
+		{
+			name:  "escapes_help",
+			help:  "Total \"things\" in a\\b\nwith newline.",
+			value: "x",
+			exp: "# HELP things_total Total \"things\" in a\\\\b\\nwith newline.\n" +
+				"# TYPE things_total counter\n" +
+				"things_total{repo=\"x\"} 2\n",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			r := NewRegistry()
+			c := r.NewCounterVec("things_total", tc.help, "repo")
+			c.Inc(tc.value)
+			c.Add(1, tc.value)
+
+			var b bytes.Buffer
+			if err := r.Write(&b); err != nil {
+				t.Fatal(err)
+			}
+			if got, want := b.String(), tc.exp; got != want {
+				t.Errorf("expected\n%s\nto be\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestCounterVec_Sorted(t *testing.T) {
+	t.Parallel()
+
+	r := NewRegistry()
+	c := r.NewCounterVec("b_total", "B.", "code")
+	c.Inc("500")
+	c.Inc("200")
+	r.NewCounterVec("a_total", "A.")
+
+	var b bytes.Buffer
+	if err := r.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	exp := "# HELP a_total A.\n" +
+		"# TYPE a_total counter\n" +
+		"# HELP b_total B.\n" +
+		"# TYPE b_total counter\n" +
+		"b_total{code=\"200\"} 1\n" +
+		"b_total{code=\"500\"} 1\n"
+	if got, want := b.String(), exp; got != want {
+		t.Errorf("expected\n%s\nto be\n%s", got, want)
+	}
+}
+
+func TestHistogram_Write(t *testing.T) {
+	t.Parallel()
+
+	r := NewRegistry()
+	h := r.NewHistogram("duration_seconds", "Durations.", []float64{1, 0.5})
+	h.Observe(0.25)
+	h.Observe(0.75)
+	h.Observe(2)
+
+	var b bytes.Buffer
+	if err := r.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	exp := "# HELP duration_seconds Durations.\n" +
+		"# TYPE duration_seconds histogram\n" +
+		"duration_seconds_bucket{le=\"0.5\"} 1\n" +
+		"duration_seconds_bucket{le=\"1\"} 2\n" +
+		"duration_seconds_bucket{le=\"+Inf\"} 3\n" +
+		"duration_seconds_sum 3\n" +
+		"duration_seconds_count 3\n"
+	if got, want := b.String(), exp; got != want {
+		t.Errorf("expected\n%s\nto be\n%s", got, want)
+	}
+}
+
+func TestFormatFloat(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		in  float64
+		exp string
+	}{
+		{1, "1"},
+		{0.25, "0.25"},
+		{1e21, "1e+21"},
+		{math.Inf(1), "+Inf"},
+		{math.Inf(-1), "-Inf"},
+		{math.NaN(), "NaN"},
+	}
+
+	for _, tc := range cases {
+		if got, want := formatFloat(tc.in), tc.exp; got != want {
+			t.Errorf("expected %q to be %q", got, want)
+		}
+	}
+}
+
+func TestRegistry_Panics(t *testing.T) {
+	t.Parallel()
+
+	t.Run("duplicate", func(t *testing.T) {
+		t.Parallel()
+
+		defer func() {
+			if recover() == nil {
+				t.Errorf("expected panic")
+			}
+		}()
+
+		r := NewRegistry()
+		r.NewCounterVec("a_total", "A.")
+		r.NewHistogram("a_total", "A.", nil)
+	})
+
+	t.Run("label_count", func(t *testing.T) {
+		t.Parallel()
+
+		defer func() {
+			if recover() == nil {
+				t.Errorf("expected panic")
+			}
+		}()
+
+		r := NewRegistry()
+		r.NewCounterVec("a_total", "A.", "repo").Inc()
+	})
+}
+
+func TestRegistry_Handler(t *testing.T) {
+	t.Parallel()
+
+	r := NewRegistry()
+	r.NewCounterVec("a_total", "A.").Inc()
+
+	w := httptest.NewRecorder()
+	r.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	if got, want := w.Header().Get("Content-Type"), "text/plain; version=0.0.4; charset=utf-8"; got != want {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+	if got, want := w.Body.String(), "# HELP a_total A.\n# TYPE a_total counter\na_total 1\n"; got != want {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+}
@@ -0,0 +1,108 @@
+// Package ratelimit defines a token bucket rate limiter.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Limiter is a token bucket rate limiter. It is safe for concurrent use. A nil
+// Limiter never limits.
+type Limiter struct {
+	rate  float64
+	burst float64
+
+	lock   sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// New creates a new limiter that allows perSecond events per second, with
+// bursts of up to burst events. If burst is less than 1, it defaults to 1. If
+// perSecond is not positive, it returns nil, which never limits.
+func New(perSecond float64, burst int) *Limiter {
+	if perSecond <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &Limiter{
+		rate:   perSecond,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Wait blocks until an event is allowed or until the provided context is
+// cancelled. It only returns an error if the context is cancelled.
+func (l *Limiter) Wait(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+
+	for {
+		delay := l.take(time.Now())
+		if delay <= 0 {
+			return nil
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("failed to wait for rate limiter: %w", ctx.Err())
+		case <-timer.C:
+		}
+	}
+}
+
+// take refills the bucket and attempts to take a token. If a token is
+// available, it returns 0. Otherwise it returns the time until the next token
+// is available.
+func (l *Limiter) take(now time.Time) time.Duration {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if elapsed := now.Sub(l.last); elapsed > 0 {
+		l.tokens += elapsed.Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+		l.last = now
+	}
+
+	if l.tokens >= 1 {
+		l.tokens--
+		return 0
+	}
+
+	return time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+}
+
+// Transport returns an http.RoundTripper that waits on the limiter before each
+// request. If the limiter is nil, inner is returned unchanged.
+func Transport(inner http.RoundTripper, l *Limiter) http.RoundTripper {
+	if l == nil {
+		return inner
+	}
+	return &transport{inner: inner, limiter: l}
+}
+
+type transport struct {
+	inner   http.RoundTripper
+	limiter *Limiter
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.limiter.Wait(req.Context()); err != nil {
+		return nil, err
+	}
+	return t.inner.RoundTrip(req)
+}
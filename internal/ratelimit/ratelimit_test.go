@@ -0,0 +1,169 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNew(t *testing.T) {
+	t.Parallel()
+
+	if l := New(0, 1); l != nil {
+		t.Errorf("expected %v to be nil", l)
+	}
+	if l := New(-1, 1); l != nil {
+		t.Errorf("expected %v to be nil", l)
+	}
+
+	l := New(1, 0)
+	if got, want := l.burst, float64(1); got != want {
+		t.Errorf("expected burst %v to be %v", got, want)
+	}
+}
+
+func TestLimiter_Take(t *testing.T) {
+	t.Parallel()
+
+	start := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	l := New(2, 3)
+	l.last = start
+
+	cases := []struct {
+		name string
+		at   time.Duration
+		exp  time.Duration
+	}{
+		// The bucket starts full, so the burst is allowed immediately.
+		{name: "burst_1", at: 0, exp: 0},
+		{name: "burst_2", at: 0, exp: 0},
+		{name: "burst_3", at: 0, exp: 0},
+		{name: "empty", at: 0, exp: 500 * time.Millisecond},
+		{name: "partial_refill", at: 250 * time.Millisecond, exp: 250 * time.Millisecond},
+		{name: "refilled", at: 500 * time.Millisecond, exp: 0},
+
+		// Refills are capped at the burst.
+		{name: "capped_1", at: 10 * time.Second, exp: 0},
+		{name: "capped_2", at: 10 * time.Second, exp: 0},
+		{name: "capped_3", at: 10 * time.Second, exp: 0},
+		{name: "capped_empty", at: 10 * time.Second, exp: 500 * time.Millisecond},
+
+		// Time going backwards does not refill or change the last refill.
+		{name: "backwards", at: 5 * time.Second, exp: 500 * time.Millisecond},
+	}
+
+	// The cases share the limiter, so they run in order.
+	for _, tc := range cases {
+		if got, want := l.take(start.Add(tc.at)), tc.exp; got != want {
+			t.Errorf("%s: expected %s to be %s", tc.name, got, want)
+		}
+	}
+}
+
+func TestLimiter_Wait(t *testing.T) {
+	t.Parallel()
+
+	t.Run("nil", func(t *testing.T) {
+		t.Parallel()
+
+		var l *Limiter
+		if err := l.Wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("blocks", func(t *testing.T) {
+		t.Parallel()
+
+		l := New(50, 1)
+		if err := l.Wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		// The bucket is empty, so the next event waits for a token rather than
+		// failing.
+		start := time.Now()
+		if err := l.Wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := time.Since(start), 10*time.Millisecond; got < want {
+			t.Errorf("expected wait %s to be at least %s", got, want)
+		}
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		t.Parallel()
+
+		l := New(1.0/3600, 1)
+		if err := l.Wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(10*time.Millisecond, cancel)
+
+		start := time.Now()
+		err := l.Wait(ctx)
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("expected %v to be %v", err, context.Canceled)
+		}
+		if got, want := time.Since(start), 5*time.Second; got > want {
+			t.Errorf("expected wait %s to be at most %s", got, want)
+		}
+	})
+}
+
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestTransport(t *testing.T) {
+	t.Parallel()
+
+	var calls int32
+	inner := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		atomic.AddInt32(&calls, 1)
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+	})
+
+	t.Run("nil", func(t *testing.T) {
+		t.Parallel()
+
+		if got := Transport(inner, nil); got == nil {
+			t.Errorf("expected transport")
+		} else if _, ok := got.(*transport); ok {
+			t.Errorf("expected the inner transport to be returned unchanged")
+		}
+	})
+
+	t.Run("waits", func(t *testing.T) {
+		t.Parallel()
+
+		rt := Transport(inner, New(1.0/3600, 1))
+
+		req := httptest.NewRequest(http.MethodGet, "https://gcr.io/v2/", nil)
+		resp, err := rt.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		// The next request waits for a token until its context is cancelled, and
+		// is never sent.
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(10*time.Millisecond, cancel)
+
+		if _, err := rt.RoundTrip(req.WithContext(ctx)); !errors.Is(err, context.Canceled) {
+			t.Errorf("expected %v to be %v", err, context.Canceled)
+		}
+		if got, want := atomic.LoadInt32(&calls), int32(1); got != want {
+			t.Errorf("expected %d calls to be %d", got, want)
+		}
+	})
+}
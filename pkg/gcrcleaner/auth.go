@@ -0,0 +1,114 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"google.golang.org/api/idtoken"
+)
+
+const (
+	authorizationHeader = "Authorization"
+	bearerPrefix        = "Bearer "
+)
+
+// oidcConfig is the configuration for verifying OIDC tokens.
+type oidcConfig struct {
+	// audience is the required audience of the token.
+	audience string
+
+	// allowedEmails is the set of emails tokens are accepted from. If empty,
+	// tokens with any email are accepted.
+	allowedEmails map[string]struct{}
+}
+
+// WithOIDCAuth requires requests to the handlers wrapped by Authenticate to
+// include an "Authorization: Bearer" header with a Google-signed OIDC token for
+// the given audience, typically the URL of the service. If any emails are
+// given, the token must also belong to one of them, such as the service account
+// of a Cloud Scheduler job or Pub/Sub push subscription. The default is to not
+// verify tokens.
+func WithOIDCAuth(audience string, allowedEmails ...string) ServerOption {
+	return func(s *Server) {
+		cfg := &oidcConfig{audience: audience}
+		if len(allowedEmails) > 0 {
+			cfg.allowedEmails = make(map[string]struct{}, len(allowedEmails))
+			for _, email := range allowedEmails {
+				cfg.allowedEmails[strings.ToLower(email)] = struct{}{}
+			}
+		}
+		s.oidc = cfg
+	}
+}
+
+// Authenticate wraps the handler to verify the request's OIDC token, if the
+// server was created with WithOIDCAuth. Requests without a valid token are
+// rejected with a 401. Otherwise, the handler is returned unchanged.
+func (s *Server) Authenticate(next http.Handler) http.Handler {
+	if s.oidc == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := s.verifyToken(r.Context(), r); err != nil {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			s.handleError(w, fmt.Errorf("unauthorized: %w", err), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// verifyToken verifies the bearer token on the request.
+func (s *Server) verifyToken(ctx context.Context, r *http.Request) error {
+	header := r.Header.Get(authorizationHeader)
+	if header == "" {
+		return fmt.Errorf("missing %s header", authorizationHeader)
+	}
+	if len(header) < len(bearerPrefix) || !strings.EqualFold(header[:len(bearerPrefix)], bearerPrefix) {
+		return fmt.Errorf("%s header is not a bearer token", authorizationHeader)
+	}
+	token := strings.TrimSpace(header[len(bearerPrefix):])
+
+	payload, err := s.validateToken(ctx, token, s.oidc.audience)
+	if err != nil {
+		return fmt.Errorf("invalid token: %w", err)
+	}
+
+	if len(s.oidc.allowedEmails) == 0 {
+		return nil
+	}
+
+	email, _ := payload.Claims["email"].(string)
+	if email == "" {
+		return fmt.Errorf("token has no email")
+	}
+	if verified, _ := payload.Claims["email_verified"].(bool); !verified {
+		return fmt.Errorf("token email %q is not verified", email)
+	}
+	if _, ok := s.oidc.allowedEmails[strings.ToLower(email)]; !ok {
+		return fmt.Errorf("token email %q is not allowed", email)
+	}
+	return nil
+}
+
+// validateIDToken validates a Google-signed ID token.
+func validateIDToken(ctx context.Context, token, audience string) (*idtoken.Payload, error) {
+	return idtoken.Validate(ctx, token, audience)
+}
@@ -0,0 +1,145 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"google.golang.org/api/idtoken"
+)
+
+func TestServer_Authenticate(t *testing.T) {
+	t.Parallel()
+
+	// The fake validator accepts tokens of the form "valid:<email>" for the
+	// "my-audience" audience.
+	validate := func(_ context.Context, token, audience string) (*idtoken.Payload, error) {
+		if audience != "my-audience" {
+			return nil, fmt.Errorf("audience mismatch")
+		}
+
+		var email string
+		if _, err := fmt.Sscanf(token, "valid:%s", &email); err != nil {
+			return nil, fmt.Errorf("invalid signature")
+		}
+		return &idtoken.Payload{
+			Audience: audience,
+			Claims: map[string]any{
+				"email":          email,
+				"email_verified": true,
+			},
+		}, nil
+	}
+
+	cases := []struct {
+		name   string
+		opts   []ServerOption
+		header string
+		status int
+	}{
+		{
+			name:   "disabled",
+			status: http.StatusOK,
+		},
+		{
+			name:   "missing_header",
+			opts:   []ServerOption{WithOIDCAuth("my-audience")},
+			status: http.StatusUnauthorized,
+		},
+		{
+			name:   "not_bearer",
+			opts:   []ServerOption{WithOIDCAuth("my-audience")},
+			header: "Basic dXNlcjpwYXNz",
+			status: http.StatusUnauthorized,
+		},
+		{
+			name:   "invalid_token",
+			opts:   []ServerOption{WithOIDCAuth("my-audience")},
+			header: "Bearer nope",
+			status: http.StatusUnauthorized,
+		},
+		{
+			name:   "wrong_audience",
+			opts:   []ServerOption{WithOIDCAuth("other-audience")},
+			header: "Bearer valid:a@example.com",
+			status: http.StatusUnauthorized,
+		},
+		{
+			name:   "valid",
+			opts:   []ServerOption{WithOIDCAuth("my-audience")},
+			header: "Bearer valid:a@example.com",
+			status: http.StatusOK,
+		},
+		{
+			name:   "allowed_email",
+			opts:   []ServerOption{WithOIDCAuth("my-audience", "A@example.com")},
+			header: "bearer valid:a@example.com",
+			status: http.StatusOK,
+		},
+		{
+			name:   "not_allowed_email",
+			opts:   []ServerOption{WithOIDCAuth("my-audience", "b@example.com")},
+			header: "Bearer valid:a@example.com",
+			status: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			server := testServer(t)
+			for _, opt := range tc.opts {
+				opt(server)
+			}
+			server.validateToken = validate
+
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})
+
+			r := httptest.NewRequest("POST", "/http", nil)
+			if tc.header != "" {
+				r.Header.Set(authorizationHeader, tc.header)
+			}
+			w := httptest.NewRecorder()
+			server.Authenticate(next).ServeHTTP(w, r)
+
+			if got, want := w.Code, tc.status; got != want {
+				t.Fatalf("expected status %d to be %d: %s", got, want, w.Body.String())
+			}
+
+			if tc.status == http.StatusUnauthorized {
+				var resp errorResp
+				if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+					t.Fatal(err)
+				}
+				if resp.Error == "" {
+					t.Errorf("expected an error message")
+				}
+				if got, want := resp.ErrorCode, ErrorCodeUnauthenticated; got != want {
+					t.Errorf("expected error code %q to be %q", got, want)
+				}
+			}
+		})
+	}
+}
@@ -15,8 +15,12 @@
 package gcrcleaner
 
 import (
+	"context"
+	"crypto/tls"
 	"sync"
 	"time"
+
+	goredis "github.com/redis/go-redis/v9"
 )
 
 // Cache is an interface used by the PubSub() function to prevent duplicate
@@ -32,23 +36,35 @@ type Cache interface {
 }
 
 // timerCache is a Cache implementation that caches items for a configurable
-// period of time.
+// period of time. Expired items are ignored by Insert and are removed by a
+// periodic sweep, so memory use is bounded by the number of items inserted
+// within the lifetime.
 type timerCache struct {
-	lock     sync.RWMutex
-	data     map[string]struct{}
+	lock     sync.Mutex
+	data     map[string]time.Time
 	lifetime time.Duration
 
+	// now returns the current time. It is a field so tests can replace it.
+	now func() time.Time
+
 	stopCh  chan struct{}
 	stopped bool
 }
 
-// NewTimerCache creates a new timer-based cache.
+// NewTimerCache creates a new timer-based cache. Items expire after the given
+// lifetime. If lifetime is not positive, nothing is cached.
 func NewTimerCache(lifetime time.Duration) *timerCache {
-	return &timerCache{
-		data:     make(map[string]struct{}),
+	c := &timerCache{
+		data:     make(map[string]time.Time),
 		lifetime: lifetime,
+		now:      time.Now,
 		stopCh:   make(chan struct{}),
 	}
+
+	if lifetime > 0 {
+		go c.sweepEvery(lifetime)
+	}
+	return c
 }
 
 // Stop stops the cache.
@@ -61,39 +77,260 @@ func (c *timerCache) Stop() {
 	c.lock.Unlock()
 }
 
-// Insert adds the item to the cache. If the item already existed in the cache,
-// this function returns false.
+// Insert adds the item to the cache. If the item already existed in the cache
+// and has not expired, this function returns true.
 func (c *timerCache) Insert(s string) bool {
-	// Read only
-	c.lock.RLock()
-	if _, ok := c.data[s]; ok {
-		c.lock.RUnlock()
-		return true
+	if c.lifetime <= 0 {
+		return false
 	}
-	c.lock.RUnlock()
 
-	// Full insert
 	c.lock.Lock()
-	if _, ok := c.data[s]; ok {
-		c.lock.Unlock()
+	defer c.lock.Unlock()
+
+	now := c.now()
+	if expiresAt, ok := c.data[s]; ok && now.Before(expiresAt) {
 		return true
 	}
 
-	c.data[s] = struct{}{}
-	c.lock.Unlock()
+	c.data[s] = now.Add(c.lifetime)
+	return false
+}
 
-	// Start a timeout to delete the item from the cache.
-	go c.timeout(s)
+// sweepEvery removes expired items at the given interval until the cache is
+// stopped.
+func (c *timerCache) sweepEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 
-	return false
+	for {
+		select {
+		case <-ticker.C:
+			c.sweep()
+		case <-c.stopCh:
+			return
+		}
+	}
+}
+
+// sweep removes expired items.
+func (c *timerCache) sweep() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := c.now()
+	for k, expiresAt := range c.data {
+		if !now.Before(expiresAt) {
+			delete(c.data, k)
+		}
+	}
+}
+
+const (
+	// defaultRedisKeyPrefix is the default prefix for keys in Redis.
+	defaultRedisKeyPrefix = "gcrcleaner:pubsub:"
+
+	// defaultRedisTimeout is the default timeout for Redis calls.
+	defaultRedisTimeout = 2 * time.Second
+)
+
+// redisClient is the subset of a Redis client that redisCache uses.
+type redisClient interface {
+	SetNX(ctx context.Context, key, value string, ttl time.Duration) (bool, error)
+	Close() error
+}
+
+var _ redisClient = (*goRedisClient)(nil)
+
+// goRedisClient is a redisClient backed by go-redis.
+type goRedisClient struct {
+	client *goredis.Client
+}
+
+// SetNX sets the key to the value with the given TTL, only if the key does not
+// already exist. It returns true if the key was set. The TTL is at least 1ms,
+// since go-redis treats a zero TTL as no expiration.
+func (c *goRedisClient) SetNX(ctx context.Context, key, value string, ttl time.Duration) (bool, error) {
+	if ttl < time.Millisecond {
+		ttl = time.Millisecond
+	}
+	return c.client.SetNX(ctx, key, value, ttl).Result()
+}
+
+// Close closes the client's connections.
+func (c *goRedisClient) Close() error {
+	return c.client.Close()
+}
+
+// redisCache is a Cache implementation backed by Redis, so it is shared across
+// instances and survives restarts. Items expire after a configurable period of
+// time.
+type redisCache struct {
+	client   redisClient
+	lifetime time.Duration
+
+	password  string
+	tlsConfig *tls.Config
+	keyPrefix string
+	timeout   time.Duration
+	failOpen  bool
+	logger    *Logger
+}
+
+// RedisCacheOption is an option to NewRedisCache.
+type RedisCacheOption func(c *redisCache)
+
+// WithRedisPassword sets the password used to authenticate to Redis.
+func WithRedisPassword(password string) RedisCacheOption {
+	return func(c *redisCache) {
+		c.password = password
+	}
+}
+
+// WithRedisTLS makes the cache connect to Redis over TLS with the given
+// configuration. Memorystore instances with in-transit encryption require TLS
+// and present a certificate signed by the instance's own certificate authority,
+// so cfg.RootCAs must include it. The default is to not use TLS.
+func WithRedisTLS(cfg *tls.Config) RedisCacheOption {
+	return func(c *redisCache) {
+		c.tlsConfig = cfg
+	}
+}
+
+// WithRedisKeyPrefix sets the prefix for keys stored in Redis. The default is
+// "gcrcleaner:pubsub:".
+func WithRedisKeyPrefix(prefix string) RedisCacheOption {
+	return func(c *redisCache) {
+		c.keyPrefix = prefix
+	}
+}
+
+// WithRedisTimeout sets the timeout for each call to Redis. The default is 2s.
+func WithRedisTimeout(timeout time.Duration) RedisCacheOption {
+	return func(c *redisCache) {
+		c.timeout = timeout
+	}
+}
+
+// WithRedisFailOpen controls what Insert returns if Redis is unavailable. If
+// true (the default), the item is treated as new, so the message is processed
+// and may be processed more than once. If false, the item is treated as
+// existing, so the message is dropped.
+func WithRedisFailOpen(v bool) RedisCacheOption {
+	return func(c *redisCache) {
+		c.failOpen = v
+	}
+}
+
+// WithRedisLogger sets the logger used to report Redis errors. The default is
+// to not log.
+func WithRedisLogger(logger *Logger) RedisCacheOption {
+	return func(c *redisCache) {
+		c.logger = logger
+	}
+}
+
+// NewRedisCache creates a new cache backed by the Redis server at addr
+// ("host:port"). Items are cached for the given lifetime.
+func NewRedisCache(addr string, lifetime time.Duration, opts ...RedisCacheOption) *redisCache {
+	c := &redisCache{
+		lifetime:  lifetime,
+		keyPrefix: defaultRedisKeyPrefix,
+		timeout:   defaultRedisTimeout,
+		failOpen:  true,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	c.client = &goRedisClient{
+		client: goredis.NewClient(&goredis.Options{
+			Addr:         addr,
+			Password:     c.password,
+			TLSConfig:    c.tlsConfig,
+			DialTimeout:  c.timeout,
+			ReadTimeout:  c.timeout,
+			WriteTimeout: c.timeout,
+
+			// A retried SETNX whose first attempt succeeded would report the item
+			// as existing, and the message would be dropped.
+			MaxRetries: -1,
+		}),
+	}
+	return c
+}
+
+// Stop stops the cache and closes the connection to Redis.
+func (c *redisCache) Stop() {
+	c.client.Close()
 }
 
-func (c *timerCache) timeout(s string) {
-	select {
-	case <-time.After(c.lifetime):
+// Insert adds the item to the cache. If the item already existed in the cache,
+// this function returns true. If Redis is unavailable, the result depends on
+// WithRedisFailOpen.
+func (c *redisCache) Insert(s string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	set, err := c.client.SetNX(ctx, c.keyPrefix+s, "1", c.lifetime)
+	if err != nil {
+		if c.logger != nil {
+			c.logger.Error("failed to insert into redis cache",
+				"key", s,
+				"fail_open", c.failOpen,
+				"error", err)
+		}
+		return !c.failOpen
+	}
+	return !set
+}
+
+// imageCache caches lists of container images by key. Entries do not expire on
+// their own. Instead, callers provide the maximum age they are willing to accept
+// when reading.
+type imageCache struct {
+	lock    sync.RWMutex
+	entries map[string]*imageCacheEntry
+}
+
+type imageCacheEntry struct {
+	images    []string
+	fetchedAt time.Time
+}
+
+// newImageCache creates a new image cache.
+func newImageCache() *imageCache {
+	return &imageCache{
+		entries: make(map[string]*imageCacheEntry),
+	}
+}
+
+// Get returns the images for the key if they were stored less than maxAge ago.
+// Stale entries are removed.
+func (c *imageCache) Get(key string, maxAge time.Duration) ([]string, bool) {
+	c.lock.RLock()
+	entry, ok := c.entries[key]
+	c.lock.RUnlock()
+	if !ok {
+		return nil, false
+	}
+
+	if time.Since(entry.fetchedAt) >= maxAge {
 		c.lock.Lock()
-		delete(c.data, s)
+		if c.entries[key] == entry {
+			delete(c.entries, key)
+		}
 		c.lock.Unlock()
-	case <-c.stopCh:
+		return nil, false
 	}
+	return entry.images, true
+}
+
+// Set stores the images for the key.
+func (c *imageCache) Set(key string, images []string) {
+	c.lock.Lock()
+	c.entries[key] = &imageCacheEntry{
+		images:    images,
+		fetchedAt: time.Now(),
+	}
+	c.lock.Unlock()
 }
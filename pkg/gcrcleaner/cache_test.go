@@ -0,0 +1,215 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTimerCache(t *testing.T) {
+	t.Parallel()
+
+	c := NewTimerCache(time.Minute)
+	t.Cleanup(c.Stop)
+
+	// Use a fake clock that only advances when told to.
+	var nowLock sync.Mutex
+	now := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	c.now = func() time.Time {
+		nowLock.Lock()
+		defer nowLock.Unlock()
+		return now
+	}
+	advance := func(d time.Duration) {
+		nowLock.Lock()
+		now = now.Add(d)
+		nowLock.Unlock()
+	}
+
+	if exists := c.Insert("a"); exists {
+		t.Errorf("expected first insert of a to not exist")
+	}
+	if exists := c.Insert("a"); !exists {
+		t.Errorf("expected second insert of a to exist")
+	}
+
+	advance(30 * time.Second)
+	if exists := c.Insert("b"); exists {
+		t.Errorf("expected first insert of b to not exist")
+	}
+
+	// a has expired, but b has not.
+	advance(31 * time.Second)
+	if exists := c.Insert("b"); !exists {
+		t.Errorf("expected b to exist before expiring")
+	}
+
+	c.sweep()
+	c.lock.Lock()
+	_, hasA := c.data["a"]
+	_, hasB := c.data["b"]
+	c.lock.Unlock()
+	if hasA {
+		t.Errorf("expected a to be swept")
+	}
+	if !hasB {
+		t.Errorf("expected b to not be swept")
+	}
+
+	if exists := c.Insert("a"); exists {
+		t.Errorf("expected a to not exist after expiring")
+	}
+}
+
+func TestTimerCache_NoLifetime(t *testing.T) {
+	t.Parallel()
+
+	c := NewTimerCache(0)
+	t.Cleanup(c.Stop)
+
+	c.Insert("a")
+	if exists := c.Insert("a"); exists {
+		t.Errorf("expected nothing to be cached")
+	}
+}
+
+func TestImageCache(t *testing.T) {
+	t.Parallel()
+
+	c := newImageCache()
+
+	if _, ok := c.Get("key", time.Hour); ok {
+		t.Errorf("expected empty cache to miss")
+	}
+
+	images := []string{"gcr.io/my-project/my-image:latest"}
+	c.Set("key", images)
+
+	got, ok := c.Get("key", time.Hour)
+	if !ok {
+		t.Fatalf("expected cache to hit")
+	}
+	if !reflect.DeepEqual(got, images) {
+		t.Errorf("expected %q to be %q", got, images)
+	}
+
+	// An entry older than the max age is a miss and is removed.
+	if _, ok := c.Get("key", 0); ok {
+		t.Errorf("expected stale entry to miss")
+	}
+	if _, ok := c.Get("key", time.Hour); ok {
+		t.Errorf("expected stale entry to be removed")
+	}
+}
+
+// fakeRedisClient is a redisClient that stores keys in memory. It ignores the
+// expiration.
+type fakeRedisClient struct {
+	lock sync.Mutex
+	data map[string]string
+	ttls map[string]time.Duration
+}
+
+func (f *fakeRedisClient) SetNX(_ context.Context, key, value string, ttl time.Duration) (bool, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if _, ok := f.data[key]; ok {
+		return false, nil
+	}
+	f.data[key] = value
+	f.ttls[key] = ttl
+	return true, nil
+}
+
+func (f *fakeRedisClient) Close() error {
+	return nil
+}
+
+func TestRedisCache(t *testing.T) {
+	t.Parallel()
+
+	client := &fakeRedisClient{
+		data: make(map[string]string),
+		ttls: make(map[string]time.Duration),
+	}
+
+	c := NewRedisCache("127.0.0.1:0", time.Minute)
+	c.client = client
+	t.Cleanup(c.Stop)
+
+	if exists := c.Insert("a"); exists {
+		t.Errorf("expected first insert of a to not exist")
+	}
+	if exists := c.Insert("a"); !exists {
+		t.Errorf("expected second insert of a to exist")
+	}
+	if exists := c.Insert("b"); exists {
+		t.Errorf("expected first insert of b to not exist")
+	}
+
+	client.lock.Lock()
+	ttl, ok := client.ttls[defaultRedisKeyPrefix+"a"]
+	client.lock.Unlock()
+	if !ok {
+		t.Errorf("expected key to have prefix %q", defaultRedisKeyPrefix)
+	}
+	if got, want := ttl, time.Minute; got != want {
+		t.Errorf("expected ttl %s to be %s", got, want)
+	}
+}
+
+func TestRedisCache_Unavailable(t *testing.T) {
+	t.Parallel()
+
+	// Reserve an address, then close it so connections are refused.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	cases := []struct {
+		name     string
+		failOpen bool
+		exp      bool
+	}{
+		{name: "fail_open", failOpen: true, exp: false},
+		{name: "fail_closed", failOpen: false, exp: true},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c := NewRedisCache(addr, time.Minute,
+				WithRedisFailOpen(tc.failOpen),
+				WithRedisTimeout(time.Second))
+			t.Cleanup(c.Stop)
+
+			if got, want := c.Insert("a"), tc.exp; got != want {
+				t.Errorf("expected %t to be %t", got, want)
+			}
+		})
+	}
+}
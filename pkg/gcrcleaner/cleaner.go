@@ -17,18 +17,28 @@ package gcrcleaner
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"regexp"
 	"sort"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/GoogleCloudPlatform/gcr-cleaner/internal/ratelimit"
 	"github.com/GoogleCloudPlatform/gcr-cleaner/internal/version"
 	"github.com/GoogleCloudPlatform/gcr-cleaner/internal/worker"
 	gcrauthn "github.com/google/go-containerregistry/pkg/authn"
 	gcrname "github.com/google/go-containerregistry/pkg/name"
 	gcrgoogle "github.com/google/go-containerregistry/pkg/v1/google"
 	gcrremote "github.com/google/go-containerregistry/pkg/v1/remote"
+	gcrtransport "github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	gcrtypes "github.com/google/go-containerregistry/pkg/v1/types"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
 )
 
 // dockerExistence is date of the first release of Docker[1] (then dotCloud) and
@@ -40,6 +50,18 @@ import (
 // [2]: https://buildpacks.io/docs/features/reproducibility/
 var dockerExistence = time.Date(2013, time.March, 20, 0, 0, 0, 0, time.UTC)
 
+const (
+	// defaultDeleteMaxAttempts is the default maximum number of attempts for a
+	// single deletion.
+	defaultDeleteMaxAttempts = 3
+
+	// defaultDeleteRetryBaseDelay is the default delay before the first retry.
+	defaultDeleteRetryBaseDelay = 500 * time.Millisecond
+
+	// maxDeleteRetryDelay is the maximum delay between retries.
+	maxDeleteRetryDelay = 30 * time.Second
+)
+
 // userAgent is the HTTP user agent.
 var userAgent = fmt.Sprintf("%s/%s (+https://github.com/GoogleCloudPlatform/gcr-cleaner)",
 	version.Name, version.Version)
@@ -49,57 +71,755 @@ type Cleaner struct {
 	keychain    gcrauthn.Keychain
 	logger      *Logger
 	concurrency int64
+
+	// credentials are the explicitly configured credentials. If nil, the
+	// default credentials are used.
+	credentials *google.Credentials
+
+	// tokenSource is the token source for Google APIs. If nil, the default
+	// credentials are used.
+	tokenSource oauth2.TokenSource
+
+	// registries are the registries given to WithRegistry.
+	registries map[string]struct{}
+
+	// transport is the transport for registry calls. If nil, the default
+	// transport is used.
+	transport http.RoundTripper
+
+	// labels caches the labels of manifests fetched for KeepLabels.
+	labels *labelCache
+
+	// pullTimes lists the last pull times for TimeSourcePulled. If nil, the
+	// upload time is used instead.
+	pullTimes PullTimeLister
 }
 
 // NewCleaner creates a new GCR cleaner with the given token provider and
 // concurrency.
-func NewCleaner(keychain gcrauthn.Keychain, logger *Logger, concurrency int64) (*Cleaner, error) {
-	return &Cleaner{
+func NewCleaner(keychain gcrauthn.Keychain, logger *Logger, concurrency int64, opts ...CleanerOption) (*Cleaner, error) {
+	var cfg cleanerConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	c := &Cleaner{
 		keychain:    keychain,
 		concurrency: concurrency,
 		logger:      logger,
-	}, nil
+		transport:   cfg.registryTransport(),
+		labels:      newLabelCache(),
+		pullTimes:   cfg.pullTimes,
+	}
+
+	ctx := context.Background()
+
+	credentials, err := cfg.credentials(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if credentials != nil {
+		c.credentials = credentials
+		c.tokenSource = credentials.TokenSource
+	}
+
+	if sa := cfg.impersonateServiceAccount; sa != "" {
+		ts, err := newImpersonatedTokenSource(ctx, sa, credentials)
+		if err != nil {
+			return nil, err
+		}
+		c.tokenSource = ts
+	}
+
+	// The configured credentials take precedence for Google registries.
+	if c.tokenSource != nil {
+		c.keychain = newTokenSourceKeychain(c.tokenSource)
+		if keychain != nil {
+			c.keychain = gcrauthn.NewMultiKeychain(c.keychain, keychain)
+		}
+	}
+
+	// Authenticators given for other registries take precedence over the
+	// keychain.
+	if len(cfg.registries) > 0 {
+		c.registries = make(map[string]struct{}, len(cfg.registries))
+		for registry := range cfg.registries {
+			c.registries[registry] = struct{}{}
+		}
+
+		registryChain := &registryKeychain{auths: cfg.registries}
+		if c.keychain != nil {
+			c.keychain = gcrauthn.NewMultiKeychain(registryChain, c.keychain)
+		} else {
+			c.keychain = registryChain
+		}
+	}
+
+	return c, nil
+}
+
+// withLogger returns a copy of the cleaner that logs to the given logger.
+func (c *Cleaner) withLogger(logger *Logger) *Cleaner {
+	cp := *c
+	cp.logger = logger
+	return &cp
+}
+
+// Decision is the outcome of evaluating a single manifest for deletion.
+type Decision struct {
+	Digest string   `json:"digest"`
+	Tags   []string `json:"tags,omitempty"`
+	Delete bool     `json:"delete"`
+	Reason string   `json:"reason"`
+
+	// Group is the keep group the manifest was assigned to, if grouping is
+	// enabled and the manifest was a deletion candidate.
+	Group string `json:"group,omitempty"`
+
+	// Platform is the platform of a manifest in a kept image index that was
+	// selected by the platform filter.
+	Platform string `json:"platform,omitempty"`
+
+	// Size is the size of the image in bytes as reported by the registry. It is
+	// zero if the registry did not report a size.
+	Size uint64 `json:"size,omitempty"`
+
+	// Uploaded and Created are the manifest's timestamps. They are omitted from
+	// the JSON to keep dry run responses small.
+	Uploaded time.Time `json:"-"`
+	Created  time.Time `json:"-"`
+}
+
+// Actions summarize a decision.
+const (
+	ActionDelete = "delete"
+	ActionKeep   = "keep"
+	ActionSkip   = "skip"
+)
+
+// Action returns whether the manifest was deleted (or would have been for dry
+// runs), kept by a keep setting, or skipped because it was not eligible, such
+// as being too new or in use. The reason gives the details.
+func (d *Decision) Action() string {
+	switch {
+	case d.Delete:
+		return ActionDelete
+	case strings.HasPrefix(d.Reason, "skipped:"):
+		return ActionSkip
+	default:
+		return ActionKeep
+	}
+}
+
+// filterDecisions returns the decisions with the given reason.
+func filterDecisions(decisions []*Decision, reason string) []*Decision {
+	var out []*Decision
+	for _, d := range decisions {
+		if d != nil && d.Reason == reason {
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
+// CountDeletions returns the number of manifests the results deleted, or would
+// have deleted for dry runs.
+func CountDeletions(results []*RepoResult) int {
+	var count int
+	for _, result := range results {
+		for _, d := range result.Decisions {
+			if d != nil && d.Delete {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+// FreedBytes is an estimate of the storage reclaimed by deleting manifests.
+// Registries do not report sizes for all manifests (for example, manifest
+// lists), so the number of deleted manifests with an unknown size is tracked
+// separately instead of being counted as zero. Layers shared between images
+// are counted once per image, so this is an upper bound.
+type FreedBytes struct {
+	Bytes        uint64 `json:"bytes"`
+	UnknownCount int    `json:"unknown_count"`
+}
+
+// EstimateFreedBytes sums the sizes of the deleted manifests in decisions.
+func EstimateFreedBytes(decisions []*Decision) *FreedBytes {
+	var fb FreedBytes
+	for _, d := range decisions {
+		fb.add(d)
+	}
+	return &fb
+}
+
+// Add adds the other estimate to this one.
+func (fb *FreedBytes) Add(other *FreedBytes) {
+	if other == nil {
+		return
+	}
+	fb.Bytes += other.Bytes
+	fb.UnknownCount += other.UnknownCount
+}
+
+// add adds the decision's size, if it is a deletion.
+func (fb *FreedBytes) add(d *Decision) {
+	if d == nil || !d.Delete {
+		return
+	}
+	if d.Size == 0 {
+		fb.UnknownCount++
+		return
+	}
+	fb.Bytes += d.Size
+}
+
+// Reasons for keeping or deleting a manifest. Reasons that reference a filter
+// are suffixed with the filter name.
+const (
+	ReasonMinAge         = "skipped: newer than min_age"
+	ReasonKeepDigest     = "kept by keep_digests"
+	ReasonTooNew         = "skipped: newer than grace"
+	ReasonOutsideWindow  = "skipped: outside upload window"
+	ReasonInUse          = "skipped: in use"
+	ReasonRepoKeep       = "kept by repo_keep_filter"
+	ReasonRepoNotMatch   = "skipped: not in repos_match"
+	ReasonUntagged       = "untagged"
+	ReasonTagged         = "skipped: tagged (untagged_only)"
+	ReasonTagKeep        = "kept by tag keep filter"
+	ReasonTagFilter      = "matched tag filter"
+	ReasonRepoMatch      = "matched repository_match_prefix"
+	ReasonNoMatch        = "skipped: no filter matches"
+	ReasonKeepCount      = "kept by keep count"
+	ReasonSignature      = "kept by keep_signatures"
+	ReasonIndexChild     = "kept by referencing image index"
+	ReasonIndexFailed    = "kept: referencing image index could not be fetched"
+	ReasonPlatform       = "matched platform filter"
+	ReasonKeepLabel      = "kept by keep_labels"
+	ReasonLabelFailed    = "kept: labels could not be fetched"
+	ReasonMinManifests   = "skipped: fewer than min_manifests"
+	ReasonOrphanedSig    = "orphaned signature"
+	ReasonNotOrphanedSig = "skipped: not an orphaned signature"
+	ReasonUnknownCreated = "skipped: unknown created time"
+	ReasonSemverHighest  = "kept by tag_keep_semver_highest"
+)
+
+// KeepScope is the set of manifests that the keep counts apply to.
+type KeepScope string
+
+const (
+	// KeepScopeCandidates keeps the newest manifests that the filters selected
+	// for deletion. Manifests that are kept for any other reason, such as being
+	// newer than the cutoff or matching a keep filter, do not count. It is the
+	// default.
+	KeepScopeCandidates KeepScope = "candidates"
+
+	// KeepScopeAll keeps the newest manifests in the repository, whether or not
+	// the filters selected them. Manifests kept for another reason still count,
+	// so fewer deletion candidates are kept.
+	KeepScopeAll KeepScope = "all"
+)
+
+// Validate returns an error if the keep scope is not known. The empty string is
+// valid and means KeepScopeCandidates.
+func (k KeepScope) Validate() error {
+	switch k {
+	case KeepScopeCandidates, KeepScopeAll, "":
+		return nil
+	default:
+		return fmt.Errorf("unknown keep scope %q: must be %q or %q",
+			k, KeepScopeCandidates, KeepScopeAll)
+	}
+}
+
+// TimeSource is the manifest timestamp compared against the cutoff time.
+type TimeSource string
+
+const (
+	// TimeSourceUploaded compares the time the manifest was uploaded to the
+	// registry. This is the default.
+	TimeSourceUploaded TimeSource = "uploaded"
+
+	// TimeSourceCreated compares the time the image was created, as reported by
+	// the image config.
+	TimeSourceCreated TimeSource = "created"
+
+	// TimeSourcePulled compares the time the manifest was last pulled, as
+	// reported by the cleaner's PullTimeLister. Manifests without a pull time
+	// fall back to the upload time. Manifests are also kept most recently
+	// pulled first.
+	TimeSourcePulled TimeSource = "pulled"
+)
+
+// Validate returns an error if the time source is not known. The empty string
+// is valid and means TimeSourceUploaded.
+func (t TimeSource) Validate() error {
+	switch t {
+	case TimeSourceUploaded, TimeSourceCreated, TimeSourcePulled, "":
+		return nil
+	default:
+		return fmt.Errorf("unknown time source %q: must be %q, %q, or %q",
+			t, TimeSourceUploaded, TimeSourceCreated, TimeSourcePulled)
+	}
+}
+
+// time returns the manifest's timestamp for the time source. The created time
+// falls back to the upload time if it is missing or predates Docker, such as
+// for reproducible builds, since it would otherwise always be past the grace.
+// The pulled time falls back to the upload time if the manifest has no pull
+// time.
+func (t TimeSource) time(m *manifest) time.Time {
+	switch t {
+	case TimeSourceCreated:
+		if created := m.Info.Created; !created.IsZero() && !created.Before(dockerExistence) {
+			return created.UTC()
+		}
+	case TimeSourcePulled:
+		if !m.Pulled.IsZero() {
+			return m.Pulled
+		}
+	}
+	return m.Info.Uploaded.UTC()
+}
+
+// CleanOptions are the options for cleaning a single repository.
+type CleanOptions struct {
+	// Since is the cutoff time. Manifests newer than this time, according to
+	// TimeSource, are never deleted.
+	Since time.Time
+
+	// TimeSource is the manifest timestamp compared against Since. The default
+	// is TimeSourceUploaded.
+	TimeSource TimeSource
+
+	// MinAgeCutoff, if given, is an absolute floor on deletion. Manifests
+	// uploaded after it are never deleted, regardless of Since, the filters, or
+	// any other setting. It is checked before everything else, so such
+	// manifests are reported with ReasonMinAge.
+	MinAgeCutoff time.Time
+
+	// UploadedAfter and UploadedBefore restrict deletion to manifests uploaded
+	// within the window. A zero value leaves that side of the window open. The
+	// window is applied in addition to Since.
+	UploadedAfter  time.Time
+	UploadedBefore time.Time
+
+	// MinManifests, if given, leaves repositories with fewer manifests than it
+	// untouched. Every manifest in them is skipped with ReasonMinManifests.
+	MinManifests int
+
+	// Keep is the minimum number of deletion candidates to keep.
+	Keep int64
+
+	// KeepScope is the set of manifests that Keep, KeepTagged, and KeepUntagged
+	// count. The default is KeepScopeCandidates. KeepScopeAll is not supported
+	// with KeepRoots, which always counts candidates.
+	KeepScope KeepScope
+
+	// KeepTagged and KeepUntagged, if either is given, keep tagged and untagged
+	// deletion candidates in two independent buckets instead of one. Each is the
+	// number of the newest candidates with (or without) tags to keep. If only one
+	// is given, the other bucket keeps Keep candidates.
+	KeepTagged   *int64
+	KeepUntagged *int64
+
+	// KeepGroupBy groups manifests by the first capture group (or the entire
+	// match, if there are no groups) of the first tag that matches. Keep is then
+	// applied to each group independently. Manifests without a matching tag
+	// share a single group.
+	KeepGroupBy *regexp.Regexp
+
+	// KeepRoots, if given, makes CleanRepos apply the keep counts across all of
+	// the repositories under each root instead of to each repository
+	// independently, keeping the newest candidates of the root's union. Each
+	// repository counts towards the first root that it is, or is a child of.
+	// Repositories that are not under any root keep independently.
+	KeepRoots []string
+
+	// RepoKeepFilter keeps all manifests in matching repositories. If nil, no
+	// repositories are kept.
+	RepoKeepFilter ItemFilter
+
+	// RepoPrefixFilter selects tagged manifests in matching repositories for
+	// deletion. If nil, no repositories are selected.
+	RepoPrefixFilter ItemFilter
+
+	// RepoMatchFilter, if given, restricts deletion to manifests in matching
+	// repositories. Manifests in other repositories are kept. Unlike
+	// RepoPrefixFilter, it never selects a manifest for deletion by itself.
+	RepoMatchFilter ItemFilter
+
+	// TagFilter selects tagged manifests with matching tags for deletion. If
+	// nil, no tags are selected.
+	TagFilter ItemFilter
+
+	// TagKeepFilter keeps tagged manifests with matching tags. If nil, no tags
+	// are kept.
+	TagKeepFilter ItemFilter
+
+	// PodFilter keeps manifests that are currently in use. If nil, no
+	// manifests are considered in use.
+	PodFilter PodFilter
+
+	// KeepDigests is a list of digests, or digest prefixes, that are never
+	// deleted. Entries without an algorithm are assumed to be sha256.
+	KeepDigests []string
+
+	// DeleteMaxAttempts is the maximum number of attempts for each deletion
+	// that fails with a retryable status code (429 or 5xx). The default is 3.
+	DeleteMaxAttempts int
+
+	// DeleteRetryBaseDelay is the delay before the first retry. It doubles for
+	// each subsequent retry and is jittered. The default is 500ms.
+	DeleteRetryBaseDelay time.Duration
+
+	// DeleteJitter, if given, delays each deletion by a random duration of up to
+	// DeleteJitter. It staggers concurrent deletions of images that share layers
+	// across repositories, which can otherwise contend in the registry. Unlike
+	// MaxRequestsPerSecond, it does not limit the overall rate. The default is
+	// no jitter.
+	DeleteJitter time.Duration
+
+	// MaxRequestsPerSecond caps the rate of delete and list calls to the
+	// registry, including retries. Calls block until they are allowed. CleanRepos
+	// shares one limit across all of its repositories. Callers of
+	// CleanWithOptions must use WithSharedLimiter to share a limit across calls,
+	// otherwise each call is limited separately. The default is no limit.
+	MaxRequestsPerSecond float64
+
+	// ListBestEffort makes ListChildRepositoriesPartial return the repositories
+	// it could list, along with an error for each registry it could not, instead
+	// of failing. The default is to fail if any registry cannot be listed.
+	ListBestEffort bool
+
+	// UntaggedOnly restricts deletion to manifests without any tags. Tag and
+	// repository filters are ignored.
+	UntaggedOnly bool
+
+	// PlatformFilter selects platform manifests in kept image indexes by their
+	// platform, such as "linux/arm64" or "linux/arm/v7". Platform manifests are
+	// normally kept while an index that references them is kept. If every kept
+	// index that references a platform manifest lists it with a matching
+	// platform, it is instead deleted if it is older than Since and not kept by
+	// another filter. Keep counts do not apply to it, since its index is kept.
+	//
+	// The indexes are not modified, so pulling a deleted platform from them
+	// fails. Layers are never deleted directly, so layers shared with other
+	// manifests are unaffected. Some registries refuse to delete manifests that
+	// are referenced by an index.
+	PlatformFilter ItemFilter
+
+	// KeepLabels keeps manifests whose image config labels or manifest
+	// annotations include any of these keys with the same value. The labels are
+	// only fetched for manifests that would otherwise be deleted, at the cost of
+	// one or two extra registry calls each, and are cached by digest. If they
+	// cannot be fetched, the manifest is kept.
+	KeepLabels map[string]string
+
+	// TagKeepSemverHighest, if positive, keeps the manifests with this many of
+	// the highest tags in each repository that are semantic versions, ordered
+	// by semver precedence regardless of when they were uploaded. Tags that are
+	// not semantic versions are ignored.
+	TagKeepSemverHighest int
+
+	// KeepSignatures keeps cosign signatures and attestations (tagged
+	// "sha256-<digest>.sig" and "sha256-<digest>.att") whenever the image they
+	// reference is kept.
+	KeepSignatures bool
+
+	// OrphanedSignaturesOnly restricts deletion to cosign signatures and
+	// attestations whose referenced image no longer exists in the repository.
+	// Every other manifest is skipped. The tag and repository prefix filters
+	// and keep counts do not apply, but the other settings that keep manifests,
+	// such as Since and PodFilter, still do.
+	OrphanedSignaturesOnly bool
+
+	// DryRun disables the actual deletion.
+	DryRun bool
+
+	// MaxDelete is the maximum number of manifests CleanRepos may delete across
+	// all repositories. Every repository is listed and evaluated first, and if
+	// more than MaxDelete manifests would be deleted, CleanRepos returns an error
+	// without deleting anything. Otherwise exactly the manifests that were
+	// evaluated are deleted, without listing again. Zero means no limit.
+	MaxDelete int
+
+	// Metrics records the results of cleaning. If nil, nothing is recorded.
+	Metrics *Metrics
+
+	// RepoTimeout is the maximum time to clean each repository. When it is
+	// exceeded, in-flight registry calls are cancelled and the repository fails
+	// with a timeout error, along with the refs deleted before the timeout. When
+	// CleanRepos evaluates every repository before deleting (MaxDelete or
+	// KeepRoots), evaluating and deleting are each limited separately. Zero
+	// means no limit.
+	RepoTimeout time.Duration
+
+	// ContinueOnError makes CleanRepos continue with the remaining repositories
+	// when a repository fails to clean. The error is returned in the
+	// repository's RepoResult instead.
+	ContinueOnError bool
+
+	// OnRepoDone is called by CleanRepos after each repository is cleaned
+	// successfully, or fails to clean with ContinueOnError set. It may be called
+	// concurrently.
+	OnRepoDone func(result *RepoResult)
+
+	// RepoOptions, if given, overrides the options for each repository, such as
+	// to keep more images in specific repositories. It is called with the
+	// repository and a copy of the options to modify. Keep counts applied across
+	// repositories with KeepRoots use the options before they are overridden.
+	RepoOptions func(repo string, opts *CleanOptions)
+
+	// limiter is the rate limiter built from MaxRequestsPerSecond.
+	limiter *ratelimit.Limiter
+
+	// deferKeep disables the keep counts, so they can be applied across
+	// repositories afterwards.
+	deferKeep bool
+
+	// keptByCount, if non-nil, replaces the keep counts with the set of
+	// "repo@digest" refs selected across repositories.
+	keptByCount map[string]struct{}
+}
+
+// WithSharedLimiter returns a copy of the options with a rate limiter built
+// from MaxRequestsPerSecond. Every call to CleanWithOptions and
+// ListChildRepositoriesWithOptions with the returned options shares the one
+// limit. If the options already have a limiter or no limit is configured, they
+// are returned unchanged.
+func (o *CleanOptions) WithSharedLimiter() *CleanOptions {
+	if o.limiter != nil || o.MaxRequestsPerSecond <= 0 {
+		return o
+	}
+
+	burst := int(math.Ceil(o.MaxRequestsPerSecond))
+	cp := *o
+	cp.limiter = ratelimit.New(o.MaxRequestsPerSecond, burst)
+	return &cp
+}
+
+// repoContext returns a context that is cancelled after RepoTimeout, if it is
+// set.
+func (o *CleanOptions) repoContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if o.RepoTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, o.RepoTimeout)
+}
+
+// timeoutError annotates the error if it was caused by RepoTimeout expiring on
+// repoCtx, rather than by ctx being cancelled.
+func (o *CleanOptions) timeoutError(ctx, repoCtx context.Context, repo string, err error) error {
+	if err == nil || o.RepoTimeout <= 0 || ctx.Err() != nil {
+		return err
+	}
+	if !errors.Is(repoCtx.Err(), context.DeadlineExceeded) {
+		return err
+	}
+	return fmt.Errorf("repo %s timed out after %s: %w", repo, o.RepoTimeout, err)
+}
+
+// forRepo returns the options for the repository, as overridden by
+// RepoOptions, with any nil filters defaulted.
+func (o *CleanOptions) forRepo(repo string) *CleanOptions {
+	if o.RepoOptions == nil {
+		return o.withDefaultFilters()
+	}
+
+	cp := *o
+	cp.RepoOptions = nil
+	o.RepoOptions(repo, &cp)
+	return cp.withDefaultFilters()
+}
+
+// withDefaultFilters returns the options with nil filters replaced by filters
+// that never match, so that the zero value of CleanOptions can be used.
+func (o *CleanOptions) withDefaultFilters() *CleanOptions {
+	if o.RepoKeepFilter != nil && o.RepoPrefixFilter != nil && o.TagFilter != nil &&
+		o.TagKeepFilter != nil && o.PodFilter != nil {
+		return o
+	}
+
+	cp := *o
+	if cp.RepoKeepFilter == nil {
+		cp.RepoKeepFilter = &ItemFilterNull{}
+	}
+	if cp.RepoPrefixFilter == nil {
+		cp.RepoPrefixFilter = &ItemFilterNull{}
+	}
+	if cp.TagFilter == nil {
+		cp.TagFilter = &ItemFilterNull{}
+	}
+	if cp.TagKeepFilter == nil {
+		cp.TagKeepFilter = &ItemFilterNull{}
+	}
+	if cp.PodFilter == nil {
+		cp.PodFilter = &PodFilterNull{}
+	}
+	return &cp
 }
 
 // Clean deletes old images from GCR that are (un)tagged and older than "since"
 // and higher than the "keep" amount.
+//
+// Deprecated: Use CleanWithOptions, which supports every option and also
+// returns the decision made for every manifest.
 func (c *Cleaner) Clean(ctx context.Context, repo string, since time.Time, keep int64, repoKeepMatcher ItemFilter, repoPrefixFilter ItemFilter, tagFilter ItemFilter, tagKeepFilter ItemFilter, podFilter PodFilter, dryRun bool) ([]string, error) {
+	deleted, _, err := c.CleanWithOptions(ctx, repo, &CleanOptions{
+		Since:            since,
+		Keep:             keep,
+		RepoKeepFilter:   repoKeepMatcher,
+		RepoPrefixFilter: repoPrefixFilter,
+		TagFilter:        tagFilter,
+		TagKeepFilter:    tagKeepFilter,
+		PodFilter:        podFilter,
+		DryRun:           dryRun,
+	})
+	return deleted, err
+}
+
+// CleanWithOptions deletes old images from GCR that are (un)tagged and older
+// than opts.Since and higher than the opts.Keep amount. In addition to the list
+// of deleted refs, it returns the decision made for every manifest in the
+// repository. If deleting fails, such as when opts.RepoTimeout is exceeded, the
+// refs deleted before the failure are returned along with the error.
+func (c *Cleaner) CleanWithOptions(ctx context.Context, repo string, opts *CleanOptions) ([]string, []*Decision, error) {
+	deleted, decisions, _, err := c.cleanRecorded(ctx, repo, opts)
+	return deleted, decisions, err
+}
+
+// cleanRecorded is like CleanWithOptions, but it also returns how long each
+// phase took.
+func (c *Cleaner) cleanRecorded(ctx context.Context, repo string, opts *CleanOptions) ([]string, []*Decision, *RepoTiming, error) {
+	deleted, decisions, timing, err := c.clean(ctx, repo, opts)
+	opts.Metrics.recordClean(repo, deleted, decisions, opts.DryRun, err)
+	return deleted, decisions, timing, err
+}
+
+// tagResolver returns a function that resolves a tag to the digest it
+// currently references, for WithTagResolver.
+func (c *Cleaner) tagResolver(ctx context.Context) func(tag gcrname.Tag) (string, error) {
+	return func(tag gcrname.Tag) (string, error) {
+		desc, err := gcrremote.Head(tag, c.remoteOptions(ctx)...)
+		if err != nil {
+			return "", fmt.Errorf("failed to resolve tag %s: %w", tag, err)
+		}
+		return desc.Digest.String(), nil
+	}
+}
+
+// DeleteManifest deletes a single manifest from the repository by its digest,
+// without evaluating any filters. Like CleanWithOptions, its tags are deleted
+// first, and deletions are retried and rate limited according to opts, which
+// may be nil. For dry runs, nothing is deleted. It returns the digest reference
+// that was (or would have been) deleted.
+func (c *Cleaner) DeleteManifest(ctx context.Context, repo, digest string, opts *CleanOptions) (string, error) {
+	if opts == nil {
+		opts = &CleanOptions{}
+	}
+	opts = opts.WithSharedLimiter()
+
+	gcrrepo, err := gcrname.NewRepository(repo)
+	if err != nil {
+		return "", fmt.Errorf("failed to get repo %s: %w", repo, err)
+	}
+	if _, err := gcrname.NewDigest(gcrrepo.Name() + "@" + digest); err != nil {
+		return "", fmt.Errorf("invalid digest %q: %w", digest, err)
+	}
+
+	// The manifest's tags must be deleted before the manifest, so list the
+	// repository to find them.
+	thirdParty := c.isThirdPartyRegistry(repo)
+	infos, err := c.list(ctx, gcrrepo, thirdParty, opts)
+	if err != nil {
+		return "", err
+	}
+	info, ok := infos[digest]
+	if !ok {
+		return "", fmt.Errorf("manifest %s does not exist in repo %s", digest, gcrrepo.Name())
+	}
+
+	if _, err := c.execute(ctx, &repoPlan{
+		gcrrepo:    gcrrepo,
+		thirdParty: thirdParty,
+		toDelete:   []*manifest{{Repo: gcrrepo.Name(), Digest: digest, Info: info}},
+	}, opts); err != nil {
+		return "", err
+	}
+	return gcrrepo.Digest(digest).String(), nil
+}
+
+// clean implements CleanWithOptions.
+func (c *Cleaner) clean(ctx context.Context, repo string, opts *CleanOptions) ([]string, []*Decision, *RepoTiming, error) {
+	opts = opts.WithSharedLimiter().forRepo(repo)
+
+	repoCtx, cancel := opts.repoContext(ctx)
+	defer cancel()
+
+	start := time.Now()
+	plan, err := c.plan(repoCtx, repo, opts)
+	timing := &RepoTiming{Plan: time.Since(start)}
+	if err != nil {
+		return nil, nil, timing, opts.timeoutError(ctx, repoCtx, repo, err)
+	}
+
+	start = time.Now()
+	deleted, err := c.execute(repoCtx, plan, opts)
+	timing.Delete = time.Since(start)
+	if err != nil {
+		return deleted, plan.decisions, timing, opts.timeoutError(ctx, repoCtx, repo, err)
+	}
+	return deleted, plan.decisions, timing, nil
+}
+
+// repoPlan is the decision made for every manifest in a repository, before any
+// manifest is deleted.
+type repoPlan struct {
+	gcrrepo gcrname.Repository
+
+	// thirdParty is true if the repository is in a registry given to
+	// WithRegistry.
+	thirdParty bool
+
+	manifests []*manifest
+	decisions []*Decision
+	toDelete  []*manifest
+}
+
+// plan lists the manifests in the repository and decides which to delete,
+// without deleting anything.
+func (c *Cleaner) plan(ctx context.Context, repo string, opts *CleanOptions) (*repoPlan, error) {
 	gcrrepo, err := gcrname.NewRepository(repo)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get repo %s: %w", repo, err)
 	}
 	c.logger.Debug("computed repo", "repo", gcrrepo.Name())
 
-	tags, err := gcrgoogle.List(gcrrepo,
-		gcrgoogle.WithContext(ctx),
-		gcrgoogle.WithUserAgent(userAgent),
-		gcrgoogle.WithAuthFromKeychain(c.keychain))
+	thirdParty := c.isThirdPartyRegistry(repo)
+	infos, err := c.list(ctx, gcrrepo, thirdParty, opts)
 	if err != nil {
-		return nil, fmt.Errorf("failed to list tags for repo %s: %w", repo, err)
+		return nil, err
 	}
 
-	var manifests = make([]*manifest, 0, len(tags.Manifests))
-	for k, m := range tags.Manifests {
-		manifests = append(manifests, &manifest{repo, k, m})
+	var manifests = make([]*manifest, 0, len(infos))
+	for k, m := range infos {
+		manifests = append(manifests, &manifest{
+			Repo:           repo,
+			Digest:         k,
+			Info:           m,
+			UnknownCreated: thirdParty && !knownCreated(m.Created),
+		})
 	}
 
-	// Sort manifests. If either of the containers were created before Docker even
-	// existed, we fall back to the upload date. This can happen with some
-	// community build tools. If two containers were created at the same time, we
-	// fall back to the upload date. Otherwise, we sort by the container creation
-	// date.
-	sort.Slice(manifests, func(i, j int) bool {
-		jCreated, jUploaded := manifests[j].Info.Created, manifests[j].Info.Uploaded
-		iCreated, iUploaded := manifests[i].Info.Created, manifests[i].Info.Uploaded
-
-		// If either container has a CreateTime that predates Docker's existence, or
-		// the contains have the same creation time, fallback to the uploaded time.
-		if jCreated.Before(dockerExistence) || iCreated.Before(dockerExistence) || jCreated.Equal(iCreated) {
-			return jUploaded.Before(iUploaded)
-		}
+	if opts.TimeSource == TimeSourcePulled {
+		c.applyPullTimes(ctx, repo, manifests)
+	}
 
-		return jCreated.Before(iCreated)
-	})
+	// Sort manifests, newest first.
+	sortManifests(manifests, opts.TimeSource)
 
 	// Generate an ordered map
 	manifestListForLog := make([]map[string]any, 0, len(manifests))
@@ -113,55 +833,122 @@ func (c *Cleaner) Clean(ctx context.Context, repo string, since time.Time, keep
 		})
 	}
 	c.logger.Debug("computed all manifests",
-		"keep", keep,
+		"keep", opts.Keep,
 		"manifests", manifestListForLog)
 
-	// Create the worker.
-	w := worker.New[string](c.concurrency)
+	// Small repositories are left untouched, so nothing else is evaluated.
+	if opts.belowMinManifests(len(manifests)) {
+		c.logger.Info("skipping repo with fewer manifests than min manifests",
+			"repo", repo,
+			"manifests", len(manifests),
+			"min_manifests", opts.MinManifests)
 
-	var keepCount = int64(0)
-	var digestsToDelete []string
-	var toRetry []string
-	var toRetryLock sync.Mutex
+		decisions := make([]*Decision, 0, len(manifests))
+		for _, m := range manifests {
+			decisions = append(decisions, m.decision(false, ReasonMinManifests))
+		}
+		return &repoPlan{
+			gcrrepo:    gcrrepo,
+			thirdParty: thirdParty,
+			manifests:  manifests,
+			decisions:  decisions,
+		}, nil
+	}
 
-	// Delete all the manifests.
-	for _, m := range manifests {
-		m := m
+	// Decide which manifests to delete. Manifests referenced by image indexes
+	// are not deleted while the index is kept.
+	decisions, toDelete, err := c.decideWithIndexes(ctx, gcrrepo, manifests, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve image indexes for repo %s: %w", repo, err)
+	}
 
-		c.logger.Debug("processing manifest",
-			"repo", repo,
-			"digest", m.Digest,
-			"tags", m.Info.Tags,
-			"created", m.Info.Created.Format(time.RFC3339),
-			"uploaded", m.Info.Uploaded.Format(time.RFC3339))
+	return &repoPlan{
+		gcrrepo:    gcrrepo,
+		thirdParty: thirdParty,
+		manifests:  manifests,
+		decisions:  decisions,
+		toDelete:   toDelete,
+	}, nil
+}
 
-		// Do nothing if this is not a candidate.
-		if !c.shouldDelete(m, since, repoKeepMatcher, repoPrefixFilter, tagFilter, tagKeepFilter, podFilter) {
-			c.logger.Debug("skipping deletion because of filters",
-				"repo", repo,
-				"digest", m.Digest,
-				"tags", m.Info.Tags)
-			continue
+// list lists the manifests in the repository, keyed by digest.
+func (c *Cleaner) list(ctx context.Context, gcrrepo gcrname.Repository, thirdParty bool, opts *CleanOptions) (map[string]gcrgoogle.ManifestInfo, error) {
+	if err := opts.limiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+
+	// Other registries do not support listing manifests with their timestamps,
+	// so they are listed one tag at a time.
+	if thirdParty {
+		infos, err := c.listThirdParty(ctx, gcrrepo, opts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list tags for repo %s: %w", gcrrepo.Name(), err)
 		}
+		return infos, nil
+	}
 
-		// Keep a certain amount of images.
-		if keepCount < keep {
-			c.logger.Debug("skipping deletion because of keep count",
-				"repo", repo,
-				"digest", m.Digest,
-				"keep", keep,
-				"keep_count", keepCount,
-				"created", m.Info.Created.Format(time.RFC3339),
-				"uploaded", m.Info.Uploaded.Format(time.RFC3339))
+	infos, err := c.listGoogle(ctx, gcrrepo, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tags for repo %s: %w", gcrrepo.Name(), err)
+	}
+	return infos, nil
+}
 
-			keepCount++
-			continue
+// replan decides again for the manifests that were already listed by plan,
+// without listing the repository again.
+func (c *Cleaner) replan(ctx context.Context, plan *repoPlan, opts *CleanOptions) (*repoPlan, error) {
+	decisions, toDelete, err := c.decideWithIndexes(ctx, plan.gcrrepo, plan.manifests, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve image indexes for repo %s: %w", plan.gcrrepo.Name(), err)
+	}
+
+	return &repoPlan{
+		gcrrepo:    plan.gcrrepo,
+		thirdParty: plan.thirdParty,
+		manifests:  plan.manifests,
+		decisions:  decisions,
+		toDelete:   toDelete,
+	}, nil
+}
+
+// execute deletes the manifests the plan decided to delete, and returns the
+// deleted refs. For dry runs, nothing is deleted, but the refs that would have
+// been deleted are returned.
+func (c *Cleaner) execute(ctx context.Context, plan *repoPlan, opts *CleanOptions) ([]string, error) {
+	gcrrepo, toDelete := plan.gcrrepo, plan.toDelete
+	repo := gcrrepo.Name()
+
+	// Create the worker.
+	w := worker.New[string](c.concurrency)
+
+	// On failure, wait for the deletions that already started, so the refs
+	// that were deleted can still be returned.
+	fail := func(err error) ([]string, error) {
+		results, _ := w.Done(context.Background())
+		deleted := make([]string, 0, len(results))
+		for _, result := range results {
+			if result.Error == nil && result.Value != "" {
+				deleted = append(deleted, result.Value)
+			}
 		}
+		sort.Strings(deleted)
+		return deleted, err
+	}
+
+	var toRetry []string
+	var toRetryLock sync.Mutex
 
-		// Make note that we need to delete this digest.
+	// Delete all tags before attempting to delete the digests later. Other
+	// registries often do not support deleting tags, but deleting the digest
+	// also removes its tags.
+	digestsToDelete := make([]string, 0, len(toDelete))
+	for _, m := range toDelete {
+		m := m
 		digestsToDelete = append(digestsToDelete, m.Digest)
+		if plan.thirdParty {
+			continue
+		}
 
-		// Delete all tags before attempting to delete the digests later.
 		for _, tag := range m.Info.Tags {
 			tag := tag
 
@@ -172,14 +959,14 @@ func (c *Cleaner) Clean(ctx context.Context, repo string, since time.Time, keep
 					"tag", tag)
 
 				tagged := gcrrepo.Tag(tag)
-				if !dryRun {
-					if err := c.deleteOne(ctx, tagged); err != nil {
+				if !opts.DryRun {
+					if err := c.deleteOne(ctx, tagged, opts); err != nil {
 						return "", fmt.Errorf("failed to delete tag %s: %w", tagged, err)
 					}
 				}
 				return tagged.Identifier(), nil
 			}); err != nil {
-				return nil, err
+				return fail(err)
 			}
 		}
 	}
@@ -187,7 +974,7 @@ func (c *Cleaner) Clean(ctx context.Context, repo string, since time.Time, keep
 	// Delete the digest. This is only safe after all the tags have been
 	// deleted, so wait for that to finish first.
 	if err := w.Wait(ctx); err != nil {
-		return nil, err
+		return fail(err)
 	}
 	for _, digest := range digestsToDelete {
 		digest := digest
@@ -198,8 +985,8 @@ func (c *Cleaner) Clean(ctx context.Context, repo string, since time.Time, keep
 				"digest", digest)
 
 			grcdigest := gcrrepo.Digest(digest)
-			if !dryRun {
-				if err := c.deleteOne(ctx, grcdigest); err != nil {
+			if !opts.DryRun {
+				if err := c.deleteOne(ctx, grcdigest, opts); err != nil {
 					// We cannot delete fat manifests which still have images. There's no
 					// easy way to build a DAG of these, so just push them onto the end
 					// and retry again later.
@@ -226,13 +1013,13 @@ func (c *Cleaner) Clean(ctx context.Context, repo string, since time.Time, keep
 			}
 			return grcdigest.Identifier(), nil
 		}); err != nil {
-			return nil, err
+			return fail(err)
 		}
 	}
 
 	// Wait for all those deletions to finish.
 	if err := w.Wait(ctx); err != nil {
-		return nil, err
+		return fail(err)
 	}
 
 	// Perform any retries.
@@ -257,8 +1044,8 @@ func (c *Cleaner) Clean(ctx context.Context, repo string, since time.Time, keep
 					"digest", digest)
 
 				grcdigest := gcrrepo.Digest(digest)
-				if !dryRun {
-					if err := c.deleteOne(ctx, grcdigest); err != nil {
+				if !opts.DryRun {
+					if err := c.deleteOne(ctx, grcdigest, opts); err != nil {
 						// We cannot delete fat manifests which still have images. There's no
 						// easy way to build a DAG of these, so just push them onto the end
 						// and retry again later.
@@ -281,21 +1068,22 @@ func (c *Cleaner) Clean(ctx context.Context, repo string, since time.Time, keep
 				}
 				return grcdigest.Identifier(), nil
 			}); err != nil {
-				return nil, err
+				return fail(err)
 			}
 		}
 
 		// Wait for all those deletions to finish.
 		if err := w.Wait(ctx); err != nil {
-			return nil, err
+			return fail(err)
 		}
 
 		// Update to the new retry list.
 		toRetry = toRetryCopy
 	}
 
-	// Wait for everything to finish.
-	results, err := w.Done(ctx)
+	// Wait for everything to finish. Deletions stop when ctx is done, so this
+	// waits without ctx to gather the refs that were deleted before then.
+	results, err := w.Done(context.Background())
 	if err != nil {
 		return nil, err
 	}
@@ -316,7 +1104,8 @@ func (c *Cleaner) Clean(ctx context.Context, repo string, since time.Time, keep
 
 	// Aggregate any errors.
 	if err := ErrsToError(errs); err != nil {
-		return nil, err
+		sort.Strings(deleted)
+		return deleted, err
 	}
 
 	// Return the list of deleted entries.
@@ -324,49 +1113,1024 @@ func (c *Cleaner) Clean(ctx context.Context, repo string, since time.Time, keep
 	return deleted, nil
 }
 
-type manifest struct {
-	Repo   string
-	Digest string
-	Info   gcrgoogle.ManifestInfo
-}
-
-// deleteOne deletes a single repo ref using the supplied auth.
-func (c *Cleaner) deleteOne(ctx context.Context, ref gcrname.Reference) error {
-	if err := gcrremote.Delete(ref,
-		gcrremote.WithContext(ctx),
-		gcrremote.WithUserAgent(userAgent),
-		gcrremote.WithAuthFromKeychain(c.keychain),
-		gcrremote.WithJobs(int(c.concurrency))); err != nil {
-		return err
+// decideWithIndexes returns the decision for each of the manifests, which must
+// be sorted newest first, and the manifests to delete. Image indexes are only
+// fetched once they are kept and there are deletion candidates they could
+// reference. Since keeping an index can keep the indexes it references, this
+// repeats until no new kept index needs to be fetched.
+//
+// If a kept index cannot be fetched, the manifests it references are unknown,
+// so every untagged manifest that is not an index is kept instead of failing
+// the repository. Only context errors are returned.
+func (c *Cleaner) decideWithIndexes(ctx context.Context, gcrrepo gcrname.Repository, manifests []*manifest, opts *CleanOptions) ([]*Decision, []*manifest, error) {
+	repo := gcrrepo.Name()
+	facts := &repoFacts{
+		indexChildren: make(map[string][]string),
+		platforms:     make(map[string]string),
+		labelKept:     make(map[string]string),
 	}
 
-	return nil
-}
-
-// shouldDelete returns true if the manifest was created before the given
-// timestamp and either has no tags or has tags that match the given filter.
-func (c *Cleaner) shouldDelete(m *manifest, since time.Time, repoSkipFilter ItemFilter, repoPrefixFilter ItemFilter, tagFilter ItemFilter, tagKeepFilter ItemFilter, podFilter PodFilter) bool {
-	// Immediately exclude images that have been uploaded after the given time.
-	if uploaded := m.Info.Uploaded.UTC(); uploaded.After(since) {
-		c.logger.Debug("should not delete",
-			"repo", m.Repo,
-			"digest", m.Digest,
-			"reason", "too new",
-			"since", since.Format(time.RFC3339),
-			"created", m.Info.Created.Format(time.RFC3339),
-			"uploaded", uploaded.Format(time.RFC3339),
-			"delta", uploaded.Sub(since).String())
-		return false
-	}
+	labelFetched := make(map[string]struct{})
+	fetched := make(map[string]struct{})
+	for {
+		decisions, toDelete := c.decideAll(repo, manifests, opts, facts)
+		if len(toDelete) == 0 {
+			return decisions, toDelete, nil
+		}
 
-	if podFilter.Matches(m.Repo, m.Digest, m.Info.Tags) {
-		c.logger.Debug("should not delete",
+		// Labels are only fetched for manifests that would otherwise be deleted.
+		// Keeping one changes the keep counts, so decide again afterwards.
+		if len(opts.KeepLabels) > 0 {
+			var unfetched []string
+			for _, m := range toDelete {
+				if _, ok := labelFetched[m.Digest]; ok {
+					continue
+				}
+				labelFetched[m.Digest] = struct{}{}
+				unfetched = append(unfetched, m.Digest)
+			}
+
+			if len(unfetched) > 0 {
+				results, err := c.manifestLabels(ctx, gcrrepo, unfetched, opts)
+				if err != nil {
+					return nil, nil, err
+				}
+				for _, result := range results {
+					if result.err != nil {
+						c.logger.Warn("failed to fetch labels, keeping manifest",
+							"repo", repo,
+							"digest", result.digest,
+							"error", result.err)
+						facts.labelKept[result.digest] = ReasonLabelFailed
+						continue
+					}
+
+					if label := matchKeepLabel(result.labels, opts.KeepLabels); label != "" {
+						c.logger.Debug("skipping deletion because of keep label",
+							"repo", repo,
+							"digest", result.digest,
+							"label", label)
+						facts.labelKept[result.digest] = ReasonKeepLabel
+					}
+				}
+				continue
+			}
+		}
+
+		// Decisions are in the same order as the manifests.
+		var indexes []string
+		for i, m := range manifests {
+			if decisions[i].Delete || !isIndexMediaType(m.Info.MediaType) {
+				continue
+			}
+			if _, ok := fetched[m.Digest]; ok {
+				continue
+			}
+			fetched[m.Digest] = struct{}{}
+			indexes = append(indexes, m.Digest)
+		}
+		if len(indexes) == 0 {
+			return decisions, toDelete, nil
+		}
+
+		results, err := c.indexChildren(ctx, gcrrepo, indexes, opts)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, result := range results {
+			if result.err != nil {
+				c.logger.Warn("failed to fetch image index, keeping untagged manifests it may reference",
+					"repo", repo,
+					"digest", result.digest,
+					"error", result.err)
+				facts.failedIndexes = append(facts.failedIndexes, result.digest)
+				continue
+			}
+
+			// Platform manifests selected by the platform filter do not depend
+			// on the index.
+			for i, child := range result.children {
+				platform := result.platforms[i]
+				if opts.PlatformFilter != nil && platform != "" && opts.PlatformFilter.Matches([]string{platform}) {
+					facts.platforms[child] = platform
+					continue
+				}
+				facts.indexChildren[result.digest] = append(facts.indexChildren[result.digest], child)
+			}
+		}
+	}
+}
+
+// repoFacts is what was learned about the manifests in a repository by
+// fetching them, in addition to what the listing reports.
+type repoFacts struct {
+	// indexChildren maps the digests of image indexes (manifest lists) to the
+	// digests of the manifests they reference.
+	indexChildren map[string][]string
+
+	// failedIndexes are the digests of indexes that could not be fetched, which
+	// are treated as referencing every untagged manifest that is not an index.
+	failedIndexes []string
+
+	// platforms maps the digests of platform manifests that were selected by
+	// the platform filter to their platform.
+	platforms map[string]string
+
+	// labelKept maps the digests of manifests kept by their labels to the
+	// reason.
+	labelKept map[string]string
+}
+
+// decideAll returns the decision for each of the manifests, which must be
+// sorted newest first, and the manifests to delete. If facts is nil, nothing
+// beyond the listing is known.
+//
+// Some manifests depend on another manifest: the platform manifests in an
+// index, and (if enabled) cosign signatures and attestations. Every manifest is
+// first decided in order, so the keep counts go to the newest manifests, and
+// then manifests are kept if any manifest they depend on is kept.
+func (c *Cleaner) decideAll(repo string, manifests []*manifest, opts *CleanOptions, facts *repoFacts) ([]*Decision, []*manifest) {
+	if facts == nil {
+		facts = &repoFacts{}
+	}
+
+	var keepCounts = make(map[string]int64, 4)
+	var decisions = make([]*Decision, 0, len(manifests))
+
+	type dependency struct {
+		digest string
+		reason string
+	}
+	dependencies := make(map[string][]*dependency)
+	for index, children := range facts.indexChildren {
+		for _, child := range children {
+			dependencies[child] = append(dependencies[child], &dependency{index, ReasonIndexChild})
+		}
+	}
+	for _, index := range facts.failedIndexes {
+		for _, m := range manifests {
+			if len(m.Info.Tags) > 0 || isIndexMediaType(m.Info.MediaType) {
+				continue
+			}
+			dependencies[m.Digest] = append(dependencies[m.Digest], &dependency{index, ReasonIndexFailed})
+		}
+	}
+	if opts.KeepSignatures {
+		for sig, refs := range cosignReferences(manifests) {
+			for _, ref := range refs {
+				dependencies[sig] = append(dependencies[sig], &dependency{ref, ReasonSignature})
+			}
+		}
+	}
+
+	var semverKept map[string]struct{}
+	if opts.TagKeepSemverHighest > 0 {
+		semverKept = highestSemverDigests(manifests, opts.TagKeepSemverHighest)
+	}
+
+	var orphans map[string]struct{}
+	if opts.OrphanedSignaturesOnly {
+		orphans = orphanedSignatures(manifests)
+	}
+
+	for _, m := range manifests {
+		c.logger.Debug("processing manifest",
+			"repo", repo,
+			"digest", m.Digest,
+			"tags", m.Info.Tags,
+			"created", m.Info.Created.Format(time.RFC3339),
+			"uploaded", m.Info.Uploaded.Format(time.RFC3339))
+
+		var d *Decision
+		if reason, ok := facts.labelKept[m.Digest]; ok {
+			d = m.decision(false, reason)
+		} else if _, ok := semverKept[m.Digest]; ok {
+			c.logger.Debug("skipping deletion because of highest semver tags",
+				"repo", repo,
+				"digest", m.Digest,
+				"tags", m.Info.Tags)
+			d = m.decision(false, ReasonSemverHighest)
+		} else if opts.OrphanedSignaturesOnly {
+			d = c.decideOrphanedSignature(repo, m, opts, orphans)
+		} else if platform, ok := facts.platforms[m.Digest]; ok {
+			d = c.decidePlatform(repo, m, opts, platform)
+		} else {
+			d = c.decide(repo, m, opts, keepCounts)
+		}
+		decisions = append(decisions, d)
+	}
+
+	kept := make(map[string]struct{}, len(manifests))
+	for _, d := range decisions {
+		if !d.Delete {
+			kept[d.Digest] = struct{}{}
+		}
+	}
+
+	// Keep manifests that depend on a kept manifest. Dependencies can be chained
+	// (for example, the signature of a platform manifest), so repeat until
+	// nothing changes.
+	for changed := true; changed; {
+		changed = false
+
+		for i, m := range manifests {
+			if !decisions[i].Delete {
+				continue
+			}
+
+			for _, dep := range dependencies[m.Digest] {
+				if _, ok := kept[dep.digest]; ok {
+					c.logger.Debug("skipping deletion because a dependent manifest is kept",
+						"repo", repo,
+						"digest", m.Digest,
+						"tags", m.Info.Tags,
+						"kept_digest", dep.digest,
+						"reason", dep.reason)
+					decisions[i] = m.decision(false, dep.reason)
+					kept[m.Digest] = struct{}{}
+					changed = true
+					break
+				}
+			}
+		}
+	}
+
+	var toDelete []*manifest
+	for i, m := range manifests {
+		if decisions[i].Delete {
+			toDelete = append(toDelete, m)
+		}
+	}
+	return decisions, toDelete
+}
+
+// isIndexMediaType returns true if the media type is an image index or
+// manifest list.
+func isIndexMediaType(mediaType string) bool {
+	switch gcrtypes.MediaType(mediaType) {
+	case gcrtypes.OCIImageIndex, gcrtypes.DockerManifestList:
+		return true
+	default:
+		return false
+	}
+}
+
+// indexResult is the result of fetching a single image index.
+type indexResult struct {
+	digest   string
+	children []string
+
+	// platforms are the platforms of the children, in the same order. They are
+	// empty for children without a platform.
+	platforms []string
+
+	err error
+}
+
+// indexChildren fetches each of the given image indexes and returns the digests
+// of the manifests they reference. Errors fetching an index are returned in its
+// result. Only context errors are returned directly.
+func (c *Cleaner) indexChildren(ctx context.Context, gcrrepo gcrname.Repository, indexes []string, opts *CleanOptions) ([]*indexResult, error) {
+	w := worker.New[*indexResult](c.concurrency)
+	for _, digest := range indexes {
+		digest := digest
+
+		if err := w.Do(ctx, func() (*indexResult, error) {
+			if err := opts.limiter.Wait(ctx); err != nil {
+				return nil, err
+			}
+
+			ref := gcrrepo.Digest(digest)
+			idx, err := gcrremote.Index(ref, c.remoteOptions(ctx)...)
+			if err != nil {
+				return &indexResult{digest: digest, err: fmt.Errorf("failed to get index %s: %w", ref, err)}, nil
+			}
+
+			im, err := idx.IndexManifest()
+			if err != nil {
+				return &indexResult{digest: digest, err: fmt.Errorf("failed to parse index %s: %w", ref, err)}, nil
+			}
+
+			children := make([]string, 0, len(im.Manifests))
+			platforms := make([]string, 0, len(im.Manifests))
+			for _, desc := range im.Manifests {
+				children = append(children, desc.Digest.String())
+
+				var platform string
+				if desc.Platform != nil {
+					platform = desc.Platform.String()
+				}
+				platforms = append(platforms, platform)
+			}
+			return &indexResult{digest: digest, children: children, platforms: platforms}, nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	results, err := w.Done(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]*indexResult, 0, len(results))
+	for _, result := range results {
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		out = append(out, result.Value)
+	}
+	return out, nil
+}
+
+// decide returns the decision for the manifest, applying the filters and then
+// the keep count. The keep counts are updated if the manifest is kept because
+// of the keep count.
+func (c *Cleaner) decide(repo string, m *manifest, opts *CleanOptions, keepCounts map[string]int64) *Decision {
+	// Do nothing if this is not a candidate.
+	shouldDelete, reason := c.shouldDelete(m, opts)
+	if !shouldDelete {
+		c.logger.Debug("skipping deletion because of filters",
+			"repo", repo,
+			"digest", m.Digest,
+			"tags", m.Info.Tags,
+			"reason", reason)
+
+		// Manifests that are already kept still count towards the keep count
+		// when it applies to every manifest.
+		if opts.KeepScope == KeepScopeAll && !opts.deferKeep && opts.keptByCount == nil {
+			bucket, keep := opts.keepBucket(m, keepGroup(m, opts.KeepGroupBy))
+			if keepCounts[bucket] < keep {
+				keepCounts[bucket]++
+			}
+		}
+		return m.decision(false, reason)
+	}
+
+	// Keep a certain amount of images. When grouping is enabled, the keep
+	// count applies to each group independently.
+	group := keepGroup(m, opts.KeepGroupBy)
+	if opts.deferKeep || opts.keptByCount != nil {
+		_, kept := opts.keptByCount[m.Repo+"@"+m.Digest]
+		if kept {
+			c.logger.Debug("skipping deletion because of keep count across repositories",
+				"repo", repo,
+				"digest", m.Digest,
+				"keep_group", group)
+		}
+
+		d := m.decision(!kept, reason)
+		if kept {
+			d.Reason = ReasonKeepCount
+		}
+		d.Group = group
+		return d
+	}
+
+	bucket, keep := opts.keepBucket(m, group)
+	if keepCounts[bucket] < keep {
+		c.logger.Debug("skipping deletion because of keep count",
+			"repo", repo,
+			"digest", m.Digest,
+			"keep", keep,
+			"keep_count", keepCounts[bucket],
+			"keep_group", group,
+			"created", m.Info.Created.Format(time.RFC3339),
+			"uploaded", m.Info.Uploaded.Format(time.RFC3339))
+
+		keepCounts[bucket]++
+		d := m.decision(false, ReasonKeepCount)
+		d.Group = group
+		return d
+	}
+
+	// Make note that we need to delete this digest.
+	d := m.decision(true, reason)
+	d.Group = group
+	return d
+}
+
+// decidePlatform returns the decision for a platform manifest in a kept image
+// index that was selected by the platform filter. The filters still apply, but
+// the keep counts do not, since the index is kept.
+func (c *Cleaner) decidePlatform(repo string, m *manifest, opts *CleanOptions, platform string) *Decision {
+	shouldDelete, reason := c.shouldDelete(m, opts)
+	if shouldDelete {
+		c.logger.Debug("deleting platform manifest from kept image index",
+			"repo", repo,
+			"digest", m.Digest,
+			"platform", platform)
+		reason = ReasonPlatform
+	}
+
+	d := m.decision(shouldDelete, reason)
+	d.Platform = platform
+	return d
+}
+
+// cosignTagRe matches the tags cosign uses for signatures and attestations,
+// which are named after the digest of the image they reference.
+var cosignTagRe = regexp.MustCompile(`^(sha256)-([0-9a-f]{64})\.(sig|att)$`)
+
+// cosignReferences returns a map of the digests of cosign signature and
+// attestation manifests to the digests of the images they reference.
+func cosignReferences(manifests []*manifest) map[string][]string {
+	refs := make(map[string][]string)
+	for _, m := range manifests {
+		for _, tag := range m.Info.Tags {
+			match := cosignTagRe.FindStringSubmatch(tag)
+			if match == nil {
+				continue
+			}
+			refs[m.Digest] = append(refs[m.Digest], match[1]+":"+match[2])
+		}
+	}
+	return refs
+}
+
+// orphanedSignatures returns the digests of the cosign signature and
+// attestation manifests whose referenced images are not in the manifests.
+func orphanedSignatures(manifests []*manifest) map[string]struct{} {
+	existing := make(map[string]struct{}, len(manifests))
+	for _, m := range manifests {
+		existing[m.Digest] = struct{}{}
+	}
+
+	orphans := make(map[string]struct{})
+	for sig, refs := range cosignReferences(manifests) {
+		orphaned := true
+		for _, ref := range refs {
+			if _, ok := existing[ref]; ok {
+				orphaned = false
+				break
+			}
+		}
+		if orphaned {
+			orphans[sig] = struct{}{}
+		}
+	}
+	return orphans
+}
+
+// decideOrphanedSignature decides a single manifest when only orphaned
+// signatures are deleted. Other manifests are skipped, and keep counts do not
+// apply.
+func (c *Cleaner) decideOrphanedSignature(repo string, m *manifest, opts *CleanOptions, orphans map[string]struct{}) *Decision {
+	if _, ok := orphans[m.Digest]; !ok {
+		return m.decision(false, ReasonNotOrphanedSig)
+	}
+
+	shouldDelete, reason := c.shouldDelete(m, opts)
+	if !shouldDelete {
+		c.logger.Debug("skipping deletion of orphaned signature because of filters",
+			"repo", repo,
+			"digest", m.Digest,
+			"tags", m.Info.Tags,
+			"reason", reason)
+	}
+	return m.decision(shouldDelete, reason)
+}
+
+// RepoResult is the result of cleaning a single repository.
+type RepoResult struct {
+	Repo      string
+	Deleted   []string
+	Decisions []*Decision
+
+	// Err is the error cleaning the repository. It is only set if
+	// ContinueOnError is set, otherwise CleanRepos returns the error instead.
+	// Deleted holds any refs deleted before the error.
+	Err error
+
+	// Timing is how long each phase of cleaning the repository took, including
+	// for dry runs and failures.
+	Timing *RepoTiming
+}
+
+// RepoTiming is how long each phase of cleaning a repository took.
+type RepoTiming struct {
+	// Plan is the time spent listing the manifests and deciding which to
+	// delete, including fetching image indexes and labels.
+	Plan time.Duration
+
+	// Delete is the time spent deleting. It is close to zero for dry runs.
+	Delete time.Duration
+}
+
+// Total is the total time spent on the repository.
+func (t *RepoTiming) Total() time.Duration {
+	return t.Plan + t.Delete
+}
+
+// CleanRepos cleans each of the given repositories, running up to concurrency
+// repositories in parallel. If concurrency is less than 1, it defaults to the
+// number of CPU cores. Results are returned in the same order as repos. If any
+// repository fails to clean, no new repositories are started and the first
+// error is returned, unless ContinueOnError is set.
+func (c *Cleaner) CleanRepos(ctx context.Context, repos []string, concurrency int64, opts *CleanOptions) ([]*RepoResult, error) {
+	// Build the limiter once so it is shared across all repositories.
+	opts = opts.WithSharedLimiter()
+
+	if opts.MaxDelete <= 0 && len(opts.KeepRoots) == 0 {
+		return eachRepo(ctx, repos, concurrency, func(ctx context.Context, i int, repo string) (*RepoResult, error) {
+			c.logger.Info("deleting refs for repo", "repo", repo)
+
+			deleted, decisions, timing, err := c.cleanRecorded(ctx, repo, opts)
+			if err != nil {
+				return c.repoFailed(ctx, repo, deleted, timing, err, opts)
+			}
+			return c.repoDone(repo, deleted, decisions, timing, opts), nil
+		})
+	}
+
+	// Evaluate every repository before deleting anything, so the cap is checked
+	// against the complete set of deletions and the keep counts can be applied
+	// across repositories.
+	planOpts := opts
+	if len(opts.KeepRoots) > 0 {
+		cp := *opts
+		cp.deferKeep = true
+		planOpts = &cp
+	}
+
+	// Each repository is only handled by one goroutine in each phase, so the
+	// timings do not need a lock.
+	timings := make([]*RepoTiming, len(repos))
+
+	// Repositories that fail to be evaluated are skipped, and have a nil plan.
+	failed := make([]*RepoResult, len(repos))
+	planFailed := func(ctx context.Context, i int, repo string, err error) (*repoPlan, error) {
+		opts.Metrics.recordClean(repo, nil, nil, opts.DryRun, err)
+		result, err := c.repoFailed(ctx, repo, nil, timings[i], err, opts)
+		failed[i] = result
+		return nil, err
+	}
+
+	plans, err := eachRepo(ctx, repos, concurrency, func(ctx context.Context, i int, repo string) (*repoPlan, error) {
+		c.logger.Info("evaluating refs for repo", "repo", repo)
+
+		repoOpts := planOpts.forRepo(repo)
+		repoCtx, cancel := repoOpts.repoContext(ctx)
+		defer cancel()
+
+		start := time.Now()
+		plan, err := c.plan(repoCtx, repo, repoOpts)
+		timings[i] = &RepoTiming{Plan: time.Since(start)}
+		if err != nil {
+			return planFailed(ctx, i, repo, repoOpts.timeoutError(ctx, repoCtx, repo, err))
+		}
+		return plan, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(opts.KeepRoots) > 0 {
+		cp := *opts
+		cp.keptByCount = keepAcrossRepos(repos, plans, opts)
+
+		plans, err = eachRepo(ctx, repos, concurrency, func(ctx context.Context, i int, repo string) (*repoPlan, error) {
+			if plans[i] == nil {
+				return nil, nil
+			}
+
+			repoOpts := cp.forRepo(repo)
+			repoCtx, cancel := repoOpts.repoContext(ctx)
+			defer cancel()
+
+			start := time.Now()
+			plan, err := c.replan(repoCtx, plans[i], repoOpts)
+			timings[i].Plan += time.Since(start)
+			if err != nil {
+				return planFailed(ctx, i, repo, repoOpts.timeoutError(ctx, repoCtx, repo, err))
+			}
+			return plan, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.MaxDelete > 0 {
+		planned := make([]*RepoResult, 0, len(plans))
+		for i, plan := range plans {
+			if plan != nil {
+				planned = append(planned, &RepoResult{Repo: repos[i], Decisions: plan.decisions})
+			}
+		}
+		if err := checkMaxDelete(planned, opts.MaxDelete); err != nil {
+			return nil, err
+		}
+	}
+
+	// Delete exactly what was evaluated.
+	return eachRepo(ctx, repos, concurrency, func(ctx context.Context, i int, repo string) (*RepoResult, error) {
+		if plans[i] == nil {
+			return failed[i], nil
+		}
+		return c.executeRepo(ctx, repo, plans[i], timings[i], opts)
+	})
+}
+
+// executeRepo deletes what was planned for the repository and records the
+// result. The time spent deleting is added to timing.
+func (c *Cleaner) executeRepo(ctx context.Context, repo string, plan *repoPlan, timing *RepoTiming, opts *CleanOptions) (*RepoResult, error) {
+	c.logger.Info("deleting refs for repo", "repo", repo)
+
+	repoOpts := opts.forRepo(repo)
+	repoCtx, cancel := repoOpts.repoContext(ctx)
+	defer cancel()
+
+	start := time.Now()
+	deleted, err := c.execute(repoCtx, plan, repoOpts)
+	timing.Delete = time.Since(start)
+	err = repoOpts.timeoutError(ctx, repoCtx, repo, err)
+	opts.Metrics.recordClean(repo, deleted, plan.decisions, opts.DryRun, err)
+	if err != nil {
+		return c.repoFailed(ctx, repo, deleted, timing, err, opts)
+	}
+	return c.repoDone(repo, deleted, plan.decisions, timing, opts), nil
+}
+
+// repoFailed handles an error cleaning the repository. If ContinueOnError is
+// set, the error and any refs deleted before it are reported to OnRepoDone and
+// returned in the result, so the remaining repositories are still cleaned.
+// Cancellation is always returned.
+func (c *Cleaner) repoFailed(ctx context.Context, repo string, deleted []string, timing *RepoTiming, err error, opts *CleanOptions) (*RepoResult, error) {
+	if !opts.ContinueOnError || ctx.Err() != nil {
+		return nil, err
+	}
+
+	c.logger.Error("failed to clean repo, continuing with the remaining repos",
+		"repo", repo,
+		"error", err)
+
+	result := &RepoResult{Repo: repo, Deleted: deleted, Err: err, Timing: timing}
+	if opts.OnRepoDone != nil {
+		opts.OnRepoDone(result)
+	}
+	return result, nil
+}
+
+// keepAcrossRepos applies the keep counts across the deletion candidates of
+// every repository under the same root, and returns the "repo@digest" refs to
+// keep. The plans must have been made with the keep counts deferred.
+func keepAcrossRepos(repos []string, plans []*repoPlan, opts *CleanOptions) map[string]struct{} {
+	candidates := make(map[string][]*manifest)
+	for i, plan := range plans {
+		if plan == nil {
+			continue
+		}
+		root := keepRoot(repos[i], opts.KeepRoots)
+		candidates[root] = append(candidates[root], plan.toDelete...)
+	}
+
+	kept := make(map[string]struct{})
+	for _, manifests := range candidates {
+		sortManifests(manifests, opts.TimeSource)
+
+		keepCounts := make(map[string]int64, 4)
+		for _, m := range manifests {
+			bucket, keep := opts.keepBucket(m, keepGroup(m, opts.KeepGroupBy))
+			if keepCounts[bucket] < keep {
+				keepCounts[bucket]++
+				kept[m.Repo+"@"+m.Digest] = struct{}{}
+			}
+		}
+	}
+	return kept
+}
+
+// keepRoot returns the first root that the repository is, or is a child of. If
+// there is none, the repository is its own root.
+func keepRoot(repo string, roots []string) string {
+	for _, root := range roots {
+		if repo == root || strings.HasPrefix(repo, root+"/") {
+			return root
+		}
+	}
+	return repo
+}
+
+// repoDone builds the result for a repository that was cleaned successfully
+// and reports it to OnRepoDone.
+func (c *Cleaner) repoDone(repo string, deleted []string, decisions []*Decision, timing *RepoTiming, opts *CleanOptions) *RepoResult {
+	result := &RepoResult{
+		Repo:      repo,
+		Deleted:   deleted,
+		Decisions: decisions,
+		Timing:    timing,
+	}
+	if opts.OnRepoDone != nil {
+		opts.OnRepoDone(result)
+	}
+	return result
+}
+
+// checkMaxDelete returns an error if the results delete more than max
+// manifests.
+func checkMaxDelete(results []*RepoResult, max int) error {
+	if count := CountDeletions(results); count > max {
+		return fmt.Errorf("refusing to delete %d manifests, which exceeds max_delete of %d", count, max)
+	}
+	return nil
+}
+
+// eachRepo calls fn for each repository, with at most concurrency calls in
+// flight. The results are in the same order as repos. The first error cancels
+// the remaining repositories and is returned.
+func eachRepo[T any](ctx context.Context, repos []string, concurrency int64, fn func(ctx context.Context, i int, repo string) (T, error)) ([]T, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	w := worker.New[T](concurrency)
+
+	// firstErr is the first error encountered. Other repositories that are in
+	// flight will likely fail with a cancellation error, which is less useful.
+	var firstErr error
+	var firstErrLock sync.Mutex
+
+	for i, repo := range repos {
+		i, repo := i, repo
+
+		// Stop dispatching if the context was cancelled, either by the caller or
+		// because an earlier repository failed.
+		if ctx.Err() != nil {
+			break
+		}
+
+		if err := w.Do(ctx, func() (T, error) {
+			result, err := fn(ctx, i, repo)
+			if err != nil {
+				err = fmt.Errorf("failed to clean repo %q: %w", repo, err)
+
+				firstErrLock.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				firstErrLock.Unlock()
+
+				cancel()
+			}
+			return result, err
+		}); err != nil {
+			// The context was cancelled while waiting for a free worker, which is
+			// handled after all work has finished.
+			break
+		}
+	}
+
+	// Wait for everything to finish. This intentionally does not use the
+	// cancellable context, since in-flight work must finish before the results
+	// can be read.
+	results, err := w.Done(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	out := make([]T, 0, len(results))
+	for _, result := range results {
+		out = append(out, result.Value)
+	}
+
+	// Report cancellation from the caller, which may have prevented some
+	// repositories from being cleaned.
+	if len(out) < len(repos) {
+		if err := ctx.Err(); err != nil {
+			return nil, fmt.Errorf("failed to clean all repos: %w", err)
+		}
+	}
+	return out, nil
+}
+
+type manifest struct {
+	Repo   string
+	Digest string
+	Info   gcrgoogle.ManifestInfo
+
+	// Pulled is the time the manifest was last pulled. It is only set for
+	// TimeSourcePulled, and is zero if the pull time is unknown.
+	Pulled time.Time
+
+	// UnknownCreated is true if the manifest is in a registry given to
+	// WithRegistry and its image does not record a real created time, so its
+	// age cannot be determined.
+	UnknownCreated bool
+}
+
+// decision builds a Decision for the manifest.
+func (m *manifest) decision(shouldDelete bool, reason string) *Decision {
+	return &Decision{
+		Digest: m.Digest,
+		Tags:   m.Info.Tags,
+		Delete: shouldDelete,
+		Reason: reason,
+		Size:   m.Info.Size,
+
+		Uploaded: m.Info.Uploaded.UTC(),
+		Created:  m.Info.Created.UTC(),
+	}
+}
+
+// deleteOne deletes a single repo ref using the supplied auth. Deletions that
+// fail with a retryable status code are retried with exponential backoff and
+// jitter, up to the maximum number of attempts in opts.
+func (c *Cleaner) deleteOne(ctx context.Context, ref gcrname.Reference, opts *CleanOptions) error {
+	maxAttempts := opts.DeleteMaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = defaultDeleteMaxAttempts
+	}
+
+	baseDelay := opts.DeleteRetryBaseDelay
+	if baseDelay <= 0 {
+		baseDelay = defaultDeleteRetryBaseDelay
+	}
+
+	if err := waitJitter(ctx, opts.DeleteJitter); err != nil {
+		return fmt.Errorf("failed to wait before deletion: %w", err)
+	}
+
+	for attempt := 1; ; attempt++ {
+		if err := opts.limiter.Wait(ctx); err != nil {
+			return err
+		}
+
+		err := gcrremote.Delete(ref, append(c.remoteOptions(ctx),
+			gcrremote.WithJobs(int(c.concurrency)))...)
+		if err == nil {
+			return nil
+		}
+
+		// The ref may have been deleted concurrently, such as by another clean,
+		// which is the desired outcome. Permission errors will never succeed, so
+		// they are reported with a clearer message.
+		switch registryStatusCode(err) {
+		case http.StatusNotFound:
+			c.logger.Debug("ref already deleted", "ref", ref.String())
+			return nil
+		case http.StatusForbidden:
+			return fmt.Errorf("permission denied deleting %s: the credentials must be allowed to delete images in the repository: %w", ref, err)
+		}
+
+		if attempt >= maxAttempts || !isRetryableError(err) {
+			return err
+		}
+
+		delay := retryDelay(baseDelay, attempt)
+		c.logger.Debug("retrying deletion",
+			"ref", ref.String(),
+			"attempt", attempt,
+			"max_attempts", maxAttempts,
+			"delay", delay.String(),
+			"error", err)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("failed to retry deletion: %w", ctx.Err())
+		case <-timer.C:
+		}
+	}
+}
+
+// registryStatusCode returns the status code of the registry error, or 0 if the
+// error is not a registry error.
+func registryStatusCode(err error) int {
+	var terr *gcrtransport.Error
+	if !errors.As(err, &terr) {
+		return 0
+	}
+	return terr.StatusCode
+}
+
+// isRetryableError returns true if the error is a registry error with a status
+// code that indicates a transient failure. Errors like 403 and 404 are never
+// retried.
+func isRetryableError(err error) bool {
+	switch registryStatusCode(err) {
+	case http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// retryDelay returns the delay before the next attempt, which is the base
+// delay doubled for each previous attempt and capped at maxDeleteRetryDelay.
+// The returned value is jittered to between half and all of that delay.
+func retryDelay(base time.Duration, attempt int) time.Duration {
+	delay := base
+	for i := 1; i < attempt && delay < maxDeleteRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDeleteRetryDelay {
+		delay = maxDeleteRetryDelay
+	}
+
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// waitJitter waits for a random duration of up to max, or until the context is
+// done. It returns immediately if max is not positive.
+func waitJitter(ctx context.Context, max time.Duration) error {
+	if max <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(time.Duration(rand.Int63n(int64(max) + 1)))
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// shouldDelete returns true if the manifest was created before the given
+// timestamp and either has no tags or has tags that match the given filter. It
+// also returns the reason for the decision.
+func (c *Cleaner) shouldDelete(m *manifest, opts *CleanOptions) (bool, string) {
+	since := opts.Since
+	repoSkipFilter, repoPrefixFilter := opts.RepoKeepFilter, opts.RepoPrefixFilter
+	tagFilter, tagKeepFilter := opts.TagFilter, opts.TagKeepFilter
+
+	// Manifests whose age is unknown could have been pushed moments ago, so
+	// they are never deleted. This takes precedence over everything below.
+	if m.UnknownCreated {
+		c.logger.Debug("should not delete",
+			"repo", m.Repo,
+			"digest", m.Digest,
+			"reason", "unknown created time",
+			"created", m.Info.Created.Format(time.RFC3339))
+		return false, ReasonUnknownCreated
+	}
+
+	// Recently uploaded manifests are never deleted, regardless of any other
+	// setting. This takes precedence over everything below.
+	if cutoff := opts.MinAgeCutoff; !cutoff.IsZero() && m.Info.Uploaded.After(cutoff) {
+		c.logger.Debug("should not delete",
+			"repo", m.Repo,
+			"digest", m.Digest,
+			"reason", "newer than min age",
+			"min_age_cutoff", cutoff.Format(time.RFC3339),
+			"uploaded", m.Info.Uploaded.Format(time.RFC3339))
+		return false, ReasonMinAge
+	}
+
+	// Protected digests are never deleted, regardless of any other setting.
+	if matchesDigest(m.Digest, opts.KeepDigests) {
+		c.logger.Debug("should not delete",
+			"repo", m.Repo,
+			"digest", m.Digest,
+			"reason", "matches keep digests")
+		return false, ReasonKeepDigest
+	}
+
+	// Immediately exclude images that are newer than the given time.
+	if t := opts.TimeSource.time(m); t.After(since) {
+		c.logger.Debug("should not delete",
+			"repo", m.Repo,
+			"digest", m.Digest,
+			"reason", "too new",
+			"since", since.Format(time.RFC3339),
+			"time_source", opts.TimeSource,
+			"created", m.Info.Created.Format(time.RFC3339),
+			"uploaded", m.Info.Uploaded.Format(time.RFC3339),
+			"delta", t.Sub(since).String())
+		return false, ReasonTooNew
+	}
+
+	if uploaded := m.Info.Uploaded.UTC(); !inWindow(uploaded, opts.UploadedAfter, opts.UploadedBefore) {
+		c.logger.Debug("should not delete",
+			"repo", m.Repo,
+			"digest", m.Digest,
+			"reason", "outside upload window",
+			"uploaded", uploaded.Format(time.RFC3339),
+			"uploaded_after", opts.UploadedAfter.Format(time.RFC3339),
+			"uploaded_before", opts.UploadedBefore.Format(time.RFC3339))
+		return false, ReasonOutsideWindow
+	}
+
+	if opts.PodFilter.Matches(m.Repo, m.Digest, m.Info.Tags) {
+		c.logger.Debug("should not delete",
 			"repo", m.Repo,
 			"digest", m.Digest,
 			"reason", "in use",
 			"tags", m.Info.Tags,
 		)
-		return false
+		return false, ReasonInUse
 	}
 
 	if repoSkipFilter.Matches([]string{m.Repo}) {
@@ -375,7 +2139,38 @@ func (c *Cleaner) shouldDelete(m *manifest, since time.Time, repoSkipFilter Item
 			"digest", m.Digest,
 			"reason", "matches repo skip filter",
 			"repo_skip_filter", repoSkipFilter.Name())
-		return false
+		return false, ReasonRepoKeep
+	}
+
+	if repoMatchFilter := opts.RepoMatchFilter; repoMatchFilter != nil && !repoMatchFilter.Matches([]string{m.Repo}) {
+		c.logger.Debug("should not delete",
+			"repo", m.Repo,
+			"digest", m.Digest,
+			"reason", "does not match repos match filter",
+			"repo_match_filter", repoMatchFilter.Name())
+		return false, ReasonRepoNotMatch
+	}
+
+	// Orphaned signatures are deleted regardless of the tag filters, since only
+	// they are considered in that mode.
+	if opts.OrphanedSignaturesOnly {
+		c.logger.Debug("should delete",
+			"repo", m.Repo,
+			"digest", m.Digest,
+			"reason", "orphaned signature",
+			"tags", m.Info.Tags)
+		return true, ReasonOrphanedSig
+	}
+
+	// When only deleting untagged manifests, keep anything with a tag before
+	// considering the tag filters.
+	if opts.UntaggedOnly && len(m.Info.Tags) > 0 {
+		c.logger.Debug("should not delete",
+			"repo", m.Repo,
+			"digest", m.Digest,
+			"reason", "tagged and untagged only",
+			"tags", m.Info.Tags)
+		return false, ReasonTagged
 	}
 
 	// If there are no tags, it should be deleted.
@@ -384,21 +2179,35 @@ func (c *Cleaner) shouldDelete(m *manifest, since time.Time, repoSkipFilter Item
 			"repo", m.Repo,
 			"digest", m.Digest,
 			"reason", "no tags")
-		return true
+		return true, ReasonUntagged
 	}
 
 	// If tagged images are allowed and the given filter matches the list of tags,
 	// and the repository matches the given filter, then this is a deletion
 	// The default tag filter is to reject all strings.
 	// The default repo filter is to accept all strings.
-	if (tagFilter.Matches(m.Info.Tags) || repoPrefixFilter.Matches([]string{m.Repo})) && !tagKeepFilter.Matches(m.Info.Tags) {
+	tagMatches := tagFilter.Matches(m.Info.Tags)
+	if tagMatches || repoPrefixFilter.Matches([]string{m.Repo}) {
+		if tagKeepFilter.Matches(m.Info.Tags) {
+			c.logger.Debug("should not delete",
+				"repo", m.Repo,
+				"digest", m.Digest,
+				"reason", "matches tag keep filter",
+				"tags", m.Info.Tags,
+				"tag_keep_filter", tagKeepFilter.Name())
+			return false, ReasonTagKeep + " " + tagKeepFilter.Name()
+		}
+
 		c.logger.Debug("should delete",
 			"repo", m.Repo,
 			"digest", m.Digest,
 			"reason", "matches tag and repo filter but does not match tag keep filter",
 			"tags", m.Info.Tags,
 			"tag_filter", tagFilter.Name())
-		return true
+		if tagMatches {
+			return true, ReasonTagFilter + " " + tagFilter.Name()
+		}
+		return true, ReasonRepoMatch + " " + repoPrefixFilter.Name()
 	}
 
 	// If we got this far, it'ts not a viable deletion candidate.
@@ -406,13 +2215,320 @@ func (c *Cleaner) shouldDelete(m *manifest, since time.Time, repoSkipFilter Item
 		"repo", m.Repo,
 		"digest", m.Digest,
 		"reason", "no filter matches")
+	return false, ReasonNoMatch
+}
+
+// sortManifests sorts the manifests newest first. If either of the containers
+// were created before Docker even existed, we fall back to the upload date.
+// This can happen with some community build tools. If two containers were
+// created at the same time, we fall back to the upload date. Otherwise, we sort
+// by the container creation date. Manifests with the same timestamps are sorted
+// by digest, so the order (and therefore which manifests keep protects) is the
+// same on every run. For TimeSourcePulled, manifests are sorted most recently
+// pulled first instead, and the above only breaks ties.
+func sortManifests(manifests []*manifest, source TimeSource) {
+	sort.SliceStable(manifests, func(i, j int) bool {
+		if source == TimeSourcePulled {
+			iPulled, jPulled := source.time(manifests[i]), source.time(manifests[j])
+			if !iPulled.Equal(jPulled) {
+				return jPulled.Before(iPulled)
+			}
+		}
+
+		jCreated, jUploaded := manifests[j].Info.Created, manifests[j].Info.Uploaded
+		iCreated, iUploaded := manifests[i].Info.Created, manifests[i].Info.Uploaded
+
+		// If either container has a CreateTime that predates Docker's existence, or
+		// the contains have the same creation time, fallback to the uploaded time.
+		if jCreated.Before(dockerExistence) || iCreated.Before(dockerExistence) || jCreated.Equal(iCreated) {
+			if !jUploaded.Equal(iUploaded) {
+				return jUploaded.Before(iUploaded)
+			}
+			return manifests[i].Digest < manifests[j].Digest
+		}
+
+		return jCreated.Before(iCreated)
+	})
+}
+
+// belowMinManifests returns true if a repository with n manifests has fewer
+// than MinManifests, and is therefore left untouched.
+func (o *CleanOptions) belowMinManifests(n int) bool {
+	return o.MinManifests > 0 && n < o.MinManifests
+}
+
+// keepBucket returns the key that the manifest's keep count is tracked under,
+// and the number of manifests to keep in it. Tagged and untagged manifests are
+// only counted separately if KeepTagged or KeepUntagged is given.
+func (o *CleanOptions) keepBucket(m *manifest, group string) (string, int64) {
+	if o.KeepTagged == nil && o.KeepUntagged == nil {
+		return group, o.Keep
+	}
+
+	if len(m.Info.Tags) > 0 {
+		if o.KeepTagged != nil {
+			return "tagged/" + group, *o.KeepTagged
+		}
+		return "tagged/" + group, o.Keep
+	}
+
+	if o.KeepUntagged != nil {
+		return "untagged/" + group, *o.KeepUntagged
+	}
+	return "untagged/" + group, o.Keep
+}
+
+// keepGroup returns the keep group for the manifest. Tags are considered in
+// sorted order so the result is deterministic.
+func keepGroup(m *manifest, re *regexp.Regexp) string {
+	if re == nil {
+		return ""
+	}
+
+	tags := make([]string, len(m.Info.Tags))
+	copy(tags, m.Info.Tags)
+	sort.Strings(tags)
+
+	for _, tag := range tags {
+		if match := re.FindStringSubmatch(tag); match != nil {
+			if len(match) > 1 {
+				return match[1]
+			}
+			return match[0]
+		}
+	}
+	return ""
+}
+
+// inWindow returns true if t is strictly after "after" and strictly before
+// "before". Zero values are treated as unbounded.
+func inWindow(t, after, before time.Time) bool {
+	if !after.IsZero() && !t.After(after) {
+		return false
+	}
+	if !before.IsZero() && !t.Before(before) {
+		return false
+	}
+	return true
+}
+
+// matchesDigest returns true if the digest is equal to, or prefixed by, any of
+// the given digests. Entries without an algorithm are assumed to be sha256.
+func matchesDigest(digest string, digests []string) bool {
+	for _, d := range digests {
+		if d == "" {
+			continue
+		}
+		if !strings.Contains(d, ":") {
+			d = "sha256:" + d
+		}
+		if strings.HasPrefix(digest, d) {
+			return true
+		}
+	}
+	return false
+}
+
+// UniqueRepositories returns the sorted, de-duplicated list of repositories.
+// Surrounding whitespace and trailing slashes are removed first, so
+// "gcr.io/p/a/" and "gcr.io/p/a" are the same repository. Empty entries are
+// dropped.
+func UniqueRepositories(repos []string) []string {
+	reposMap := make(map[string]struct{}, len(repos))
+	for _, repo := range repos {
+		repo = strings.TrimRight(strings.TrimSpace(repo), "/")
+		if repo != "" {
+			reposMap[repo] = struct{}{}
+		}
+	}
+
+	out := make([]string, 0, len(reposMap))
+	for repo := range reposMap {
+		out = append(out, repo)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// CollapseRepositories returns the unique roots without the roots that are
+// children of another root, since listing the ancestor's children already
+// includes them. For example, "gcr.io/p/a/b" is folded into "gcr.io/p/a". The
+// result is sorted.
+func CollapseRepositories(roots []string) []string {
+	roots = UniqueRepositories(roots)
+
+	collapsed := make([]string, 0, len(roots))
+	for _, root := range roots {
+		isChild := false
+		for _, other := range roots {
+			if other != root && isChildRepository(root, other) {
+				isChild = true
+				break
+			}
+		}
+
+		if !isChild {
+			collapsed = append(collapsed, root)
+		}
+	}
+	return collapsed
+}
+
+// ExcludeRepositories returns repos without the repositories matching any of
+// the exclusions. Each exclusion is a repository, or a pattern with the same
+// syntax as ExpandRepositories, and excludes the matching repositories and all
+// of their children. For example, "gcr.io/p/team/legacy" excludes
+// "gcr.io/p/team/legacy" and "gcr.io/p/team/legacy/app".
+func ExcludeRepositories(repos, exclude []string) ([]string, error) {
+	prefixes, patterns, err := parseRepositoryMatchers(exclude)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]string, 0, len(repos))
+	for _, repo := range repos {
+		if !isExcludedRepository(repo, prefixes, patterns) {
+			out = append(out, repo)
+		}
+	}
+	return out, nil
+}
+
+// parseRepositoryMatchers splits the repositories into plain repositories and
+// compiled patterns, for use with isExcludedRepository.
+func parseRepositoryMatchers(repos []string) ([]string, []*regexp.Regexp, error) {
+	var prefixes []string
+	var patterns []*regexp.Regexp
+	for _, repo := range UniqueRepositories(repos) {
+		if !isRepositoryPattern(repo) {
+			prefixes = append(prefixes, repo)
+			continue
+		}
+
+		_, re, err := parseRepositoryPattern(repo)
+		if err != nil {
+			return nil, nil, err
+		}
+		patterns = append(patterns, re)
+	}
+	return prefixes, patterns, nil
+}
+
+// isExcludedRepository returns true if the repository, or any of its parents,
+// is one of the prefixes or matches one of the patterns.
+func isExcludedRepository(repo string, prefixes []string, patterns []*regexp.Regexp) bool {
+	for _, prefix := range prefixes {
+		if isChildRepository(repo, prefix) {
+			return true
+		}
+	}
+
+	for _, re := range patterns {
+		for i := range repo {
+			if repo[i] == '/' && re.MatchString(repo[:i]) {
+				return true
+			}
+		}
+		if re.MatchString(repo) {
+			return true
+		}
+	}
 	return false
 }
 
+// PruneChildRepositories returns the repos found by ListChildRepositories
+// without the children matching keepFilter, so they are never listed for
+// manifests. Nothing in them would be deleted. The roots themselves are always
+// included.
+//
+// Children are not pruned by the repository prefix filter, since manifests in
+// repositories that do not match it are still deleted if they are untagged or
+// match the tag filters.
+func PruneChildRepositories(roots, repos []string, keepFilter ItemFilter) []string {
+	rootsMap := make(map[string]struct{}, len(roots))
+	for _, root := range roots {
+		rootsMap[root] = struct{}{}
+	}
+
+	pruned := make([]string, 0, len(repos))
+	for _, repo := range repos {
+		if _, ok := rootsMap[repo]; ok {
+			pruned = append(pruned, repo)
+			continue
+		}
+
+		if keepFilter != nil && keepFilter.Matches([]string{repo}) {
+			continue
+		}
+		pruned = append(pruned, repo)
+	}
+	return pruned
+}
+
+// LimitChildRepositoryDepth returns the repos found by ListChildRepositories
+// that are at most maxDepth path segments below any of the roots. A depth of 0
+// includes only the roots, 1 also includes their direct children, and so on.
+// Depth is counted from the root as given, so for a root of "gcr.io/p", the
+// repository "gcr.io/p/a/b" is at depth 2. If maxDepth is negative, repos is
+// returned unchanged.
+func LimitChildRepositoryDepth(roots, repos []string, maxDepth int) []string {
+	if maxDepth < 0 {
+		return repos
+	}
+
+	limited := make([]string, 0, len(repos))
+	for _, repo := range repos {
+		for _, root := range roots {
+			if !isChildRepository(repo, root) {
+				continue
+			}
+
+			rest := strings.TrimPrefix(strings.TrimPrefix(repo, strings.TrimSuffix(root, "/")), "/")
+			depth := 0
+			if rest != "" {
+				depth = strings.Count(rest, "/") + 1
+			}
+
+			if depth <= maxDepth {
+				limited = append(limited, repo)
+				break
+			}
+		}
+	}
+	return limited
+}
+
 // ListChildRepositories lists all child repositores for the given roots. Roots
 // can be entire registries (e.g. us-docker.pkg.dev) or a subpath within a
 // registry (e.g. gcr.io/my-project/my-container).
 func (c *Cleaner) ListChildRepositories(ctx context.Context, roots []string) ([]string, error) {
+	return c.ListChildRepositoriesWithOptions(ctx, roots, &CleanOptions{})
+}
+
+// ListChildRepositoriesWithOptions is like ListChildRepositories, but it limits
+// the rate of catalog requests by opts.MaxRequestsPerSecond. Use
+// WithSharedLimiter to share the limit with the cleans that follow. If
+// opts.ListBestEffort is true, registries that cannot be listed are logged and
+// skipped; use ListChildRepositoriesPartial to get their errors instead.
+func (c *Cleaner) ListChildRepositoriesWithOptions(ctx context.Context, roots []string, opts *CleanOptions) ([]string, error) {
+	repos, warnings, err := c.ListChildRepositoriesPartial(ctx, roots, opts)
+	if err != nil {
+		return nil, err
+	}
+	for _, warning := range warnings {
+		c.logger.Warn("skipping registry that could not be listed", "error", warning)
+	}
+	return repos, nil
+}
+
+// ListChildRepositoriesPartial is like ListChildRepositoriesWithOptions, but if
+// opts.ListBestEffort is true, a registry that cannot be listed, such as
+// because of a permissions error, does not fail the listing. Instead, it
+// returns the repositories in the other registries along with an error for
+// each registry that could not be listed, so the caller can decide whether to
+// proceed. Invalid roots always fail.
+func (c *Cleaner) ListChildRepositoriesPartial(ctx context.Context, roots []string, opts *CleanOptions) ([]string, []error, error) {
+	opts = opts.WithSharedLimiter()
 	c.logger.Debug("finding all child repositories", "roots", roots)
 
 	// registriesMap is a cache of registries to all the repos in that registry.
@@ -436,7 +2552,7 @@ func (c *Cleaner) ListChildRepositories(ctx context.Context, roots []string) ([]
 		default:
 			repo, err := gcrname.NewRepository(root, gcrname.StrictValidation)
 			if err != nil {
-				return nil, fmt.Errorf("failed to parse root repository %q: %w", root, err)
+				return nil, nil, fmt.Errorf("failed to parse root repository %q: %w", root, err)
 			}
 
 			registryName = repo.RegistryStr()
@@ -444,7 +2560,7 @@ func (c *Cleaner) ListChildRepositories(ctx context.Context, roots []string) ([]
 
 		registry, err := gcrname.NewRegistry(registryName)
 		if err != nil {
-			return nil, fmt.Errorf("failed to parse registry name %q: %w", registryName, err)
+			return nil, nil, fmt.Errorf("failed to parse registry name %q: %w", registryName, err)
 		}
 		registriesMap[registryName] = &registry
 	}
@@ -462,11 +2578,9 @@ func (c *Cleaner) ListChildRepositories(ctx context.Context, roots []string) ([]
 				"registry", registry.Name())
 
 			// List all repos in the registry.
-			allRepos, err := gcrremote.Catalog(ctx, *registry,
-				gcrremote.WithContext(ctx),
-				gcrremote.WithUserAgent(userAgent),
-				gcrremote.WithAuthFromKeychain(c.keychain),
-				gcrremote.WithJobs(int(c.concurrency)))
+			allRepos, err := gcrremote.Catalog(ctx, *registry, append(c.remoteOptions(ctx),
+				gcrremote.WithTransport(ratelimit.Transport(c.httpTransport(), opts.limiter)),
+				gcrremote.WithJobs(int(c.concurrency)))...)
 			if err != nil {
 				return nil, fmt.Errorf("failed to list child repositories for registry %s: %w", registry, err)
 			}
@@ -485,7 +2599,7 @@ func (c *Cleaner) ListChildRepositories(ctx context.Context, roots []string) ([]
 
 				hasPrefix := false
 				for _, root := range roots {
-					if strings.HasPrefix(fullRepoName, root) {
+					if isChildRepository(fullRepoName, root) {
 						hasPrefix = true
 						break
 					}
@@ -505,14 +2619,14 @@ func (c *Cleaner) ListChildRepositories(ctx context.Context, roots []string) ([]
 			}
 			return candidateRepos, nil
 		}); err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 	}
 
 	// Wait for everything to finish.
 	results, err := w.Done(ctx)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	// Gather the results.
@@ -531,9 +2645,9 @@ func (c *Cleaner) ListChildRepositories(ctx context.Context, roots []string) ([]
 		}
 	}
 
-	// Aggregate any errors.
-	if err := ErrsToError(errs); err != nil {
-		return nil, err
+	// Aggregate any errors, unless the caller accepts a partial listing.
+	if len(errs) > 0 && !opts.ListBestEffort {
+		return nil, nil, ErrsToError(errs)
 	}
 
 	// De-duplicate and sort the list.
@@ -542,7 +2656,103 @@ func (c *Cleaner) ListChildRepositories(ctx context.Context, roots []string) ([]
 		repos = append(repos, repo)
 	}
 	sort.Strings(repos)
-	return repos, nil
+
+	if len(errs) == 0 {
+		return repos, nil, nil
+	}
+
+	// Sort the errors too, since the registries are listed in parallel.
+	sort.Slice(errs, func(i, j int) bool {
+		return errs[i].Error() < errs[j].Error()
+	})
+	return repos, errs, nil
+}
+
+// isRepositoryPattern returns true if the repository contains a glob wildcard.
+func isRepositoryPattern(repo string) bool {
+	return strings.ContainsAny(repo, "*?[")
+}
+
+// parseRepositoryPattern splits a repository glob, such as
+// "gcr.io/my-project/team-*", into the parent repository that contains all
+// possible matches ("gcr.io/my-project") and the compiled pattern. Wildcards do
+// not match a "/", so each segment only matches a single path segment. The
+// registry cannot contain wildcards.
+func parseRepositoryPattern(pattern string) (string, *regexp.Regexp, error) {
+	parts := strings.Split(pattern, "/")
+
+	static := 0
+	for static < len(parts) && !isRepositoryPattern(parts[static]) {
+		static++
+	}
+	if static == 0 {
+		return "", nil, fmt.Errorf("invalid repository pattern %q: registry cannot contain wildcards", pattern)
+	}
+
+	expr, err := globToRegex(pattern, false)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid repository pattern %q: %w", pattern, err)
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid repository pattern %q: %w", pattern, err)
+	}
+
+	return strings.Join(parts[:static], "/"), re, nil
+}
+
+// ExpandRepositories expands any repositories that contain glob wildcards, such
+// as "gcr.io/my-project/team-*", into the matching repositories. Unlike
+// ListChildRepositories, wildcards only match a single path segment, so nested
+// repositories are not included unless the pattern has a segment for them.
+// Repositories without wildcards are returned as-is. The result is
+// de-duplicated and sorted.
+func (c *Cleaner) ExpandRepositories(ctx context.Context, repos []string) ([]string, error) {
+	reposMap := make(map[string]struct{}, len(repos))
+
+	var parents []string
+	var patterns []*regexp.Regexp
+	for _, repo := range repos {
+		if !isRepositoryPattern(repo) {
+			reposMap[repo] = struct{}{}
+			continue
+		}
+
+		parent, re, err := parseRepositoryPattern(repo)
+		if err != nil {
+			return nil, err
+		}
+		parents = append(parents, parent)
+		patterns = append(patterns, re)
+	}
+
+	if len(patterns) > 0 {
+		children, err := c.ListChildRepositories(ctx, parents)
+		if err != nil {
+			return nil, fmt.Errorf("failed to expand repository patterns: %w", err)
+		}
+
+		for _, child := range children {
+			for _, re := range patterns {
+				if re.MatchString(child) {
+					reposMap[child] = struct{}{}
+					break
+				}
+			}
+		}
+
+		c.logger.Debug("expanded repository patterns",
+			"in", repos,
+			"parents", parents,
+			"children", children)
+	}
+
+	out := make([]string, 0, len(reposMap))
+	for repo := range reposMap {
+		out = append(out, repo)
+	}
+	sort.Strings(out)
+	return out, nil
 }
 
 // ErrsToError converts a list of errors into a single error. If the list is
@@ -15,8 +15,29 @@
 package gcrcleaner
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	gcrauthn "github.com/google/go-containerregistry/pkg/authn"
+	gcrname "github.com/google/go-containerregistry/pkg/name"
+	gcrgoogle "github.com/google/go-containerregistry/pkg/v1/google"
+	gcrtransport "github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	gcrtypes "github.com/google/go-containerregistry/pkg/v1/types"
 )
 
 func TestErrsToError(t *testing.T) {
@@ -68,3 +89,2789 @@ func TestErrsToError(t *testing.T) {
 		})
 	}
 }
+
+func TestInWindow(t *testing.T) {
+	t.Parallel()
+
+	jan := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	feb := time.Date(2024, time.February, 1, 0, 0, 0, 0, time.UTC)
+	mar := time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		name          string
+		t             time.Time
+		after, before time.Time
+		exp           bool
+	}{
+		{
+			name: "unbounded",
+			t:    feb,
+			exp:  true,
+		},
+		{
+			name:   "inside",
+			t:      feb,
+			after:  jan,
+			before: mar,
+			exp:    true,
+		},
+		{
+			name:  "before_after",
+			t:     jan,
+			after: feb,
+			exp:   false,
+		},
+		{
+			name:   "after_before",
+			t:      mar,
+			before: feb,
+			exp:    false,
+		},
+		{
+			name:  "on_boundary",
+			t:     feb,
+			after: feb,
+			exp:   false,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got, want := inWindow(tc.t, tc.after, tc.before), tc.exp; got != want {
+				t.Errorf("expected %s in (%s, %s) to be %t", tc.t, tc.after, tc.before, want)
+			}
+		})
+	}
+}
+
+func TestKeepGroup(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name string
+		re   *regexp.Regexp
+		tags []string
+		exp  string
+	}{
+		{
+			name: "nil_re",
+			re:   nil,
+			tags: []string{"service-a-abc123"},
+			exp:  "",
+		},
+		{
+			name: "capture_group",
+			re:   regexp.MustCompile(`^(.+)-[0-9a-f]+$`),
+			tags: []string{"service-a-abc123"},
+			exp:  "service-a",
+		},
+		{
+			name: "no_capture_group",
+			re:   regexp.MustCompile(`^service-[a-z]`),
+			tags: []string{"service-b-abc123"},
+			exp:  "service-b",
+		},
+		{
+			name: "sorted_tags",
+			re:   regexp.MustCompile(`^(.+)-[0-9a-f]+$`),
+			tags: []string{"service-b-abc123", "service-a-abc123"},
+			exp:  "service-a",
+		},
+		{
+			name: "no_match",
+			re:   regexp.MustCompile(`^(.+)-[0-9a-f]+$`),
+			tags: []string{"latest"},
+			exp:  "",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			m := &manifest{Info: gcrgoogle.ManifestInfo{Tags: tc.tags}}
+			if got, want := keepGroup(m, tc.re), tc.exp; got != want {
+				t.Errorf("expected %q to be %q", got, want)
+			}
+		})
+	}
+}
+
+func TestEstimateFreedBytes(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name      string
+		decisions []*Decision
+		exp       FreedBytes
+	}{
+		{
+			name:      "empty",
+			decisions: nil,
+			exp:       FreedBytes{},
+		},
+		{
+			name: "sums_deleted",
+			decisions: []*Decision{
+				{Delete: true, Size: 100},
+				{Delete: true, Size: 50},
+				{Delete: false, Size: 1000},
+			},
+			exp: FreedBytes{Bytes: 150},
+		},
+		{
+			name: "unknown_size",
+			decisions: []*Decision{
+				{Delete: true, Size: 100},
+				{Delete: true},
+				{Delete: false},
+			},
+			exp: FreedBytes{Bytes: 100, UnknownCount: 1},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got, want := *EstimateFreedBytes(tc.decisions), tc.exp; got != want {
+				t.Errorf("expected %#v to be %#v", got, want)
+			}
+		})
+	}
+}
+
+func TestCleanRepos(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	logger := NewLogger("error", io.Discard, io.Discard)
+	cleaner, err := NewCleaner(nil, logger, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("empty", func(t *testing.T) {
+		t.Parallel()
+
+		results, err := cleaner.CleanRepos(ctx, nil, 2, &CleanOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := len(results), 0; got != want {
+			t.Errorf("expected %d results to be %d", got, want)
+		}
+	})
+
+	t.Run("invalid_repo", func(t *testing.T) {
+		t.Parallel()
+
+		_, err := cleaner.CleanRepos(ctx, []string{"INVALID"}, 2, &CleanOptions{})
+		if err == nil {
+			t.Fatal("expected error")
+		}
+		if got, want := err.Error(), `failed to clean repo "INVALID"`; !strings.Contains(got, want) {
+			t.Errorf("expected %q to contain %q", got, want)
+		}
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, cancel := context.WithCancel(ctx)
+		cancel()
+
+		_, err := cleaner.CleanRepos(ctx, []string{"gcr.io/my-project/my-repo"}, 2, &CleanOptions{})
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("expected %v to be %v", err, context.Canceled)
+		}
+	})
+}
+
+func TestIsRetryableError(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name string
+		err  error
+		exp  bool
+	}{
+		{
+			name: "not_transport",
+			err:  fmt.Errorf("oops"),
+			exp:  false,
+		},
+		{
+			name: "too_many_requests",
+			err:  &gcrtransport.Error{StatusCode: 429},
+			exp:  true,
+		},
+		{
+			name: "service_unavailable",
+			err:  &gcrtransport.Error{StatusCode: 503},
+			exp:  true,
+		},
+		{
+			name: "wrapped",
+			err:  fmt.Errorf("failed: %w", &gcrtransport.Error{StatusCode: 503}),
+			exp:  true,
+		},
+		{
+			name: "forbidden",
+			err:  &gcrtransport.Error{StatusCode: 403},
+			exp:  false,
+		},
+		{
+			name: "not_found",
+			err:  &gcrtransport.Error{StatusCode: 404},
+			exp:  false,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got, want := isRetryableError(tc.err), tc.exp; got != want {
+				t.Errorf("expected %v to be %t", tc.err, want)
+			}
+		})
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name     string
+		base     time.Duration
+		attempt  int
+		min, max time.Duration
+	}{
+		{
+			name:    "first",
+			base:    100 * time.Millisecond,
+			attempt: 1,
+			min:     50 * time.Millisecond,
+			max:     100 * time.Millisecond,
+		},
+		{
+			name:    "third",
+			base:    100 * time.Millisecond,
+			attempt: 3,
+			min:     200 * time.Millisecond,
+			max:     400 * time.Millisecond,
+		},
+		{
+			name:    "capped",
+			base:    time.Second,
+			attempt: 100,
+			min:     maxDeleteRetryDelay / 2,
+			max:     maxDeleteRetryDelay,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			for i := 0; i < 100; i++ {
+				got := retryDelay(tc.base, tc.attempt)
+				if got < tc.min || got > tc.max {
+					t.Fatalf("expected %s to be between %s and %s", got, tc.min, tc.max)
+				}
+			}
+		})
+	}
+}
+
+// fakeDeleteRegistry is a registry that responds to manifest deletions with
+// the given status codes in order, repeating the last one.
+type fakeDeleteRegistry struct {
+	statuses []int
+	deletes  int32
+	deleted  chan struct{}
+}
+
+func (f *fakeDeleteRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	n := int(atomic.AddInt32(&f.deletes, 1))
+	if f.deleted != nil {
+		select {
+		case f.deleted <- struct{}{}:
+		default:
+		}
+	}
+
+	status := f.statuses[len(f.statuses)-1]
+	if n <= len(f.statuses) {
+		status = f.statuses[n-1]
+	}
+	w.WriteHeader(status)
+}
+
+func TestCleaner_DeleteOne(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name     string
+		statuses []int
+		attempts int32
+		status   int
+		err      string
+	}{
+		{
+			name:     "success",
+			statuses: []int{http.StatusAccepted},
+			attempts: 1,
+		},
+		{
+			name:     "retries_too_many_requests",
+			statuses: []int{http.StatusTooManyRequests, http.StatusAccepted},
+			attempts: 2,
+		},
+		{
+			name:     "retries_server_errors",
+			statuses: []int{http.StatusInternalServerError, http.StatusServiceUnavailable, http.StatusAccepted},
+			attempts: 3,
+		},
+		{
+			name:     "gives_up",
+			statuses: []int{http.StatusServiceUnavailable},
+			attempts: 3,
+			status:   http.StatusServiceUnavailable,
+		},
+		{
+			name:     "not_found_is_deleted",
+			statuses: []int{http.StatusNotFound, http.StatusAccepted},
+			attempts: 1,
+		},
+		{
+			name:     "retried_then_not_found",
+			statuses: []int{http.StatusServiceUnavailable, http.StatusNotFound},
+			attempts: 2,
+		},
+		{
+			name:     "no_retry_forbidden",
+			statuses: []int{http.StatusForbidden, http.StatusAccepted},
+			attempts: 1,
+			status:   http.StatusForbidden,
+			err:      "permission denied deleting",
+		},
+		{
+			name:     "no_retry_bad_request",
+			statuses: []int{http.StatusBadRequest, http.StatusAccepted},
+			attempts: 1,
+			status:   http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			registry := &fakeDeleteRegistry{statuses: tc.statuses}
+			srv := httptest.NewServer(registry)
+			t.Cleanup(srv.Close)
+
+			ref, err := gcrname.ParseReference(strings.TrimPrefix(srv.URL, "http://") + "/my-repo:my-tag")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			cleaner := &Cleaner{
+				keychain:    gcrauthn.NewMultiKeychain(),
+				logger:      NewLogger("error", io.Discard, io.Discard),
+				concurrency: 1,
+			}
+
+			err = cleaner.deleteOne(context.Background(), ref, &CleanOptions{
+				DeleteMaxAttempts:    3,
+				DeleteRetryBaseDelay: time.Millisecond,
+			})
+			if tc.status == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				var terr *gcrtransport.Error
+				if !errors.As(err, &terr) {
+					t.Fatalf("expected %v to be a transport error", err)
+				}
+				if got, want := terr.StatusCode, tc.status; got != want {
+					t.Errorf("expected %d to be %d", got, want)
+				}
+				if got, want := err.Error(), tc.err; !strings.Contains(got, want) {
+					t.Errorf("expected %q to contain %q", got, want)
+				}
+			}
+
+			if got, want := atomic.LoadInt32(&registry.deletes), tc.attempts; got != want {
+				t.Errorf("expected %d attempts to be %d", got, want)
+			}
+		})
+	}
+
+	t.Run("context_canceled", func(t *testing.T) {
+		t.Parallel()
+
+		registry := &fakeDeleteRegistry{
+			statuses: []int{http.StatusServiceUnavailable},
+			deleted:  make(chan struct{}, 1),
+		}
+		srv := httptest.NewServer(registry)
+		t.Cleanup(srv.Close)
+
+		ref, err := gcrname.ParseReference(strings.TrimPrefix(srv.URL, "http://") + "/my-repo:my-tag")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cleaner := &Cleaner{
+			keychain:    gcrauthn.NewMultiKeychain(),
+			logger:      NewLogger("error", io.Discard, io.Discard),
+			concurrency: 1,
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			<-registry.deleted
+			cancel()
+		}()
+
+		err = cleaner.deleteOne(ctx, ref, &CleanOptions{
+			DeleteMaxAttempts:    5,
+			DeleteRetryBaseDelay: time.Minute,
+		})
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected %v to be %v", err, context.Canceled)
+		}
+		if got, want := atomic.LoadInt32(&registry.deletes), int32(1); got != want {
+			t.Errorf("expected %d attempts to be %d", got, want)
+		}
+	})
+}
+
+func TestWaitJitter(t *testing.T) {
+	t.Parallel()
+
+	t.Run("none", func(t *testing.T) {
+		t.Parallel()
+
+		if err := waitJitter(context.Background(), 0); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("bounded", func(t *testing.T) {
+		t.Parallel()
+
+		start := time.Now()
+		for i := 0; i < 10; i++ {
+			if err := waitJitter(context.Background(), 5*time.Millisecond); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got, max := time.Since(start), 10*5*time.Millisecond+time.Second; got > max {
+			t.Errorf("expected %s to be at most %s", got, max)
+		}
+	})
+
+	t.Run("context_canceled", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		if err := waitJitter(ctx, time.Hour); !errors.Is(err, context.Canceled) {
+			t.Errorf("expected %v to be %v", err, context.Canceled)
+		}
+	})
+}
+
+func TestCleanOptions_WithSharedLimiter(t *testing.T) {
+	t.Parallel()
+
+	t.Run("unlimited", func(t *testing.T) {
+		t.Parallel()
+
+		opts := &CleanOptions{}
+		if got := opts.WithSharedLimiter(); got != opts || got.limiter != nil {
+			t.Errorf("expected unlimited options to be unchanged")
+		}
+	})
+
+	t.Run("shared", func(t *testing.T) {
+		t.Parallel()
+
+		opts := &CleanOptions{MaxRequestsPerSecond: 5}
+		limited := opts.WithSharedLimiter()
+		if limited.limiter == nil {
+			t.Fatal("expected limiter")
+		}
+		if opts.limiter != nil {
+			t.Errorf("expected original options to be unmodified")
+		}
+		if got := limited.WithSharedLimiter(); got != limited {
+			t.Errorf("expected limiter to be reused")
+		}
+	})
+}
+
+func TestFilterDecisions(t *testing.T) {
+	t.Parallel()
+
+	inUse := &Decision{Digest: "sha256:a", Reason: ReasonInUse}
+	decisions := []*Decision{
+		{Digest: "sha256:b", Reason: ReasonTooNew},
+		inUse,
+		{Digest: "sha256:c", Delete: true, Reason: ReasonUntagged},
+	}
+
+	got := filterDecisions(decisions, ReasonInUse)
+	if len(got) != 1 || got[0] != inUse {
+		t.Errorf("expected %v to be [%v]", got, inUse)
+	}
+
+	if got := filterDecisions(decisions, ReasonKeepDigest); len(got) != 0 {
+		t.Errorf("expected %v to be empty", got)
+	}
+}
+
+func TestDecision_Action(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name     string
+		decision *Decision
+		exp      string
+	}{
+		{
+			name:     "delete",
+			decision: &Decision{Delete: true, Reason: ReasonUntagged},
+			exp:      ActionDelete,
+		},
+		{
+			name:     "keep_count",
+			decision: &Decision{Reason: ReasonKeepCount},
+			exp:      ActionKeep,
+		},
+		{
+			name:     "index_failed",
+			decision: &Decision{Reason: ReasonIndexFailed},
+			exp:      ActionKeep,
+		},
+		{
+			name:     "too_new",
+			decision: &Decision{Reason: ReasonTooNew},
+			exp:      ActionSkip,
+		},
+		{
+			name:     "in_use",
+			decision: &Decision{Reason: ReasonInUse},
+			exp:      ActionSkip,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got, want := tc.decision.Action(), tc.exp; got != want {
+				t.Errorf("expected %q to be %q", got, want)
+			}
+		})
+	}
+}
+
+func TestDecideAll_KeepSignatures(t *testing.T) {
+	t.Parallel()
+
+	keptDigest := "sha256:" + strings.Repeat("a", 64)
+	deletedDigest := "sha256:" + strings.Repeat("b", 64)
+	keptSig := "sha256:" + strings.Repeat("c", 64)
+	keptAtt := "sha256:" + strings.Repeat("d", 64)
+	deletedSig := "sha256:" + strings.Repeat("e", 64)
+
+	old := time.Date(2023, time.October, 1, 0, 0, 0, 0, time.UTC)
+	since := time.Date(2023, time.November, 1, 0, 0, 0, 0, time.UTC)
+
+	tagFilter, err := BuildItemFilter("", "", WithNone("^v"), WithAllMatchEmpty(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifests := []*manifest{
+		{Digest: keptDigest, Info: gcrgoogle.ManifestInfo{Uploaded: old, Tags: []string{"v1"}}},
+		{Digest: deletedDigest, Info: gcrgoogle.ManifestInfo{Uploaded: old, Tags: []string{"pr-1"}}},
+		{Digest: keptSig, Info: gcrgoogle.ManifestInfo{Uploaded: old, Tags: []string{"sha256-" + strings.Repeat("a", 64) + ".sig"}}},
+		{Digest: keptAtt, Info: gcrgoogle.ManifestInfo{Uploaded: old, Tags: []string{"sha256-" + strings.Repeat("a", 64) + ".att"}}},
+		{Digest: deletedSig, Info: gcrgoogle.ManifestInfo{Uploaded: old, Tags: []string{"sha256-" + strings.Repeat("b", 64) + ".sig"}}},
+	}
+
+	cases := []struct {
+		name           string
+		keepSignatures bool
+		expDeleted     []string
+	}{
+		{
+			name:           "keep_signatures",
+			keepSignatures: true,
+			expDeleted:     []string{deletedDigest, deletedSig},
+		},
+		{
+			name:           "default",
+			keepSignatures: false,
+			expDeleted:     []string{deletedDigest, keptSig, keptAtt, deletedSig},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			cleaner := &Cleaner{logger: NewLogger("error", io.Discard, io.Discard)}
+			decisions, toDelete := cleaner.decideAll("gcr.io/my-project/my-image", manifests, &CleanOptions{
+				Since:            since,
+				RepoKeepFilter:   &ItemFilterNull{},
+				RepoPrefixFilter: &ItemFilterNull{},
+				TagFilter:        tagFilter,
+				TagKeepFilter:    &ItemFilterNull{},
+				PodFilter:        &PodFilterNull{},
+				KeepSignatures:   tc.keepSignatures,
+			}, nil)
+
+			if got, want := len(decisions), len(manifests); got != want {
+				t.Fatalf("expected %d decisions to be %d", got, want)
+			}
+			for i, d := range decisions {
+				if got, want := d.Digest, manifests[i].Digest; got != want {
+					t.Errorf("expected decision %d digest %q to be %q", i, got, want)
+				}
+			}
+
+			deleted := make([]string, 0, len(toDelete))
+			for _, m := range toDelete {
+				deleted = append(deleted, m.Digest)
+			}
+			sort.Strings(deleted)
+			exp := append([]string(nil), tc.expDeleted...)
+			sort.Strings(exp)
+			if !reflect.DeepEqual(deleted, exp) {
+				t.Errorf("expected deleted %q to be %q", deleted, exp)
+			}
+		})
+	}
+}
+
+func TestDecideAll_TagKeepSemverHighest(t *testing.T) {
+	t.Parallel()
+
+	old := time.Date(2023, time.October, 1, 0, 0, 0, 0, time.UTC)
+	since := time.Date(2023, time.November, 1, 0, 0, 0, 0, time.UTC)
+
+	// The manifests are sorted newest first, but the highest versions were
+	// uploaded earliest, so keeping them does not depend on upload time.
+	manifests := []*manifest{
+		{Digest: "sha256:latest", Info: gcrgoogle.ManifestInfo{Uploaded: old.Add(6 * time.Hour), Tags: []string{"latest", "main"}}},
+		{Digest: "sha256:rc", Info: gcrgoogle.ManifestInfo{Uploaded: old.Add(5 * time.Hour), Tags: []string{"v2.0.0-rc.2"}}},
+		{Digest: "sha256:old", Info: gcrgoogle.ManifestInfo{Uploaded: old.Add(4 * time.Hour), Tags: []string{"1.0.0"}}},
+		{Digest: "sha256:rc1", Info: gcrgoogle.ManifestInfo{Uploaded: old.Add(3 * time.Hour), Tags: []string{"2.0.0-rc.1"}}},
+		{Digest: "sha256:v1.10", Info: gcrgoogle.ManifestInfo{Uploaded: old.Add(2 * time.Hour), Tags: []string{"v1.10.0", "1.10"}}},
+		{Digest: "sha256:v2", Info: gcrgoogle.ManifestInfo{Uploaded: old.Add(1 * time.Hour), Tags: []string{"2.0.0"}}},
+		{Digest: "sha256:untagged", Info: gcrgoogle.ManifestInfo{Uploaded: old}},
+	}
+
+	tagFilter, err := BuildItemFilter(".*", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cleaner := &Cleaner{logger: NewLogger("error", io.Discard, io.Discard)}
+	decisions, _ := cleaner.decideAll("gcr.io/my-project/my-image", manifests, &CleanOptions{
+		Since:                since,
+		RepoKeepFilter:       &ItemFilterNull{},
+		RepoPrefixFilter:     &ItemFilterNull{},
+		TagFilter:            tagFilter,
+		TagKeepFilter:        &ItemFilterNull{},
+		PodFilter:            &PodFilterNull{},
+		TagKeepSemverHighest: 3,
+	}, nil)
+
+	// 2.0.0 is highest, then the prereleases of 2.0.0 in order. 1.10.0 is higher
+	// than 1.0.0 but is not in the top 3, and "1.10" is not a semantic version.
+	exp := map[string]string{
+		"sha256:latest":   ReasonTagFilter,
+		"sha256:rc":       ReasonSemverHighest,
+		"sha256:old":      ReasonTagFilter,
+		"sha256:rc1":      ReasonSemverHighest,
+		"sha256:v1.10":    ReasonTagFilter,
+		"sha256:v2":       ReasonSemverHighest,
+		"sha256:untagged": ReasonUntagged,
+	}
+	for _, d := range decisions {
+		if got, want := d.Reason, exp[d.Digest]; !strings.HasPrefix(got, want) {
+			t.Errorf("expected %s reason %q to be %q", d.Digest, got, want)
+		}
+		if got, want := d.Delete, exp[d.Digest] != ReasonSemverHighest; got != want {
+			t.Errorf("expected %s delete %t to be %t", d.Digest, got, want)
+		}
+	}
+}
+
+func TestDecideAll_OrphanedSignaturesOnly(t *testing.T) {
+	t.Parallel()
+
+	imageDigest := "sha256:" + strings.Repeat("a", 64)
+	untaggedDigest := "sha256:" + strings.Repeat("b", 64)
+	keptSig := "sha256:" + strings.Repeat("c", 64)
+	orphanSig := "sha256:" + strings.Repeat("d", 64)
+	orphanAtt := "sha256:" + strings.Repeat("e", 64)
+	newOrphan := "sha256:" + strings.Repeat("f", 64)
+
+	old := time.Date(2023, time.October, 1, 0, 0, 0, 0, time.UTC)
+	since := time.Date(2023, time.November, 1, 0, 0, 0, 0, time.UTC)
+	recent := time.Date(2023, time.December, 1, 0, 0, 0, 0, time.UTC)
+
+	manifests := []*manifest{
+		{Digest: imageDigest, Info: gcrgoogle.ManifestInfo{Uploaded: old, Tags: []string{"v1"}}},
+		{Digest: untaggedDigest, Info: gcrgoogle.ManifestInfo{Uploaded: old}},
+		{Digest: keptSig, Info: gcrgoogle.ManifestInfo{Uploaded: old, Tags: []string{"sha256-" + strings.Repeat("a", 64) + ".sig"}}},
+		{Digest: orphanSig, Info: gcrgoogle.ManifestInfo{Uploaded: old, Tags: []string{"sha256-" + strings.Repeat("1", 64) + ".sig"}}},
+		{Digest: orphanAtt, Info: gcrgoogle.ManifestInfo{Uploaded: old, Tags: []string{"sha256-" + strings.Repeat("2", 64) + ".att"}}},
+		{Digest: newOrphan, Info: gcrgoogle.ManifestInfo{Uploaded: recent, Tags: []string{"sha256-" + strings.Repeat("3", 64) + ".sig"}}},
+	}
+
+	cleaner := &Cleaner{logger: NewLogger("error", io.Discard, io.Discard)}
+	decisions, toDelete := cleaner.decideAll("gcr.io/my-project/my-image", manifests, &CleanOptions{
+		Since:                  since,
+		Keep:                   10,
+		RepoKeepFilter:         &ItemFilterNull{},
+		RepoPrefixFilter:       &ItemFilterNull{},
+		TagFilter:              &ItemFilterNull{},
+		TagKeepFilter:          &ItemFilterNull{},
+		PodFilter:              &PodFilterNull{},
+		OrphanedSignaturesOnly: true,
+	}, nil)
+
+	expReasons := []string{
+		ReasonNotOrphanedSig,
+		ReasonNotOrphanedSig,
+		ReasonNotOrphanedSig,
+		ReasonOrphanedSig,
+		ReasonOrphanedSig,
+		ReasonTooNew,
+	}
+	if got, want := len(decisions), len(expReasons); got != want {
+		t.Fatalf("expected %d decisions to be %d", got, want)
+	}
+	for i, d := range decisions {
+		if got, want := d.Reason, expReasons[i]; got != want {
+			t.Errorf("expected decision %d reason %q to be %q", i, got, want)
+		}
+	}
+
+	deleted := make([]string, 0, len(toDelete))
+	for _, m := range toDelete {
+		deleted = append(deleted, m.Digest)
+	}
+	sort.Strings(deleted)
+	if exp := []string{orphanSig, orphanAtt}; !reflect.DeepEqual(deleted, exp) {
+		t.Errorf("expected deleted %q to be %q", deleted, exp)
+	}
+}
+
+func TestDecideAll_KeepScope(t *testing.T) {
+	t.Parallel()
+
+	since := time.Date(2023, time.November, 1, 0, 0, 0, 0, time.UTC)
+	newer := since.Add(time.Hour)
+	older := since.Add(-time.Hour)
+
+	// Newest first: two images inside the cutoff, then four candidates.
+	manifests := make([]*manifest, 0, 6)
+	for i, uploaded := range []time.Time{newer, newer, older, older, older, older} {
+		manifests = append(manifests, &manifest{
+			Digest: fmt.Sprintf("sha256:%064d", i),
+			Info:   gcrgoogle.ManifestInfo{Uploaded: uploaded},
+		})
+	}
+
+	cases := []struct {
+		name    string
+		scope   KeepScope
+		keep    int64
+		reasons []string
+	}{
+		{
+			name: "default_candidates",
+			keep: 3,
+			reasons: []string{
+				ReasonTooNew, ReasonTooNew,
+				ReasonKeepCount, ReasonKeepCount, ReasonKeepCount, ReasonUntagged,
+			},
+		},
+		{
+			name:  "candidates",
+			scope: KeepScopeCandidates,
+			keep:  3,
+			reasons: []string{
+				ReasonTooNew, ReasonTooNew,
+				ReasonKeepCount, ReasonKeepCount, ReasonKeepCount, ReasonUntagged,
+			},
+		},
+		{
+			name:  "all",
+			scope: KeepScopeAll,
+			keep:  3,
+			reasons: []string{
+				ReasonTooNew, ReasonTooNew,
+				ReasonKeepCount, ReasonUntagged, ReasonUntagged, ReasonUntagged,
+			},
+		},
+		{
+			name:  "all_fewer_than_kept",
+			scope: KeepScopeAll,
+			keep:  2,
+			reasons: []string{
+				ReasonTooNew, ReasonTooNew,
+				ReasonUntagged, ReasonUntagged, ReasonUntagged, ReasonUntagged,
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			cleaner := &Cleaner{logger: NewLogger("error", io.Discard, io.Discard)}
+			decisions, _ := cleaner.decideAll("gcr.io/my-project/my-image", manifests, &CleanOptions{
+				Since:            since,
+				Keep:             tc.keep,
+				KeepScope:        tc.scope,
+				RepoKeepFilter:   &ItemFilterNull{},
+				RepoPrefixFilter: &ItemFilterNull{},
+				TagFilter:        &ItemFilterNull{},
+				TagKeepFilter:    &ItemFilterNull{},
+				PodFilter:        &PodFilterNull{},
+			}, nil)
+
+			reasons := make([]string, 0, len(decisions))
+			for _, d := range decisions {
+				reasons = append(reasons, d.Reason)
+			}
+			if got, want := reasons, tc.reasons; !reflect.DeepEqual(got, want) {
+				t.Errorf("expected %q to be %q", got, want)
+			}
+		})
+	}
+}
+
+func TestDecideAll_KeepTaggedUntagged(t *testing.T) {
+	t.Parallel()
+
+	since := time.Date(2023, time.November, 1, 0, 0, 0, 0, time.UTC)
+
+	// Manifests are sorted newest first, alternating tagged and untagged.
+	digests := make([]string, 6)
+	manifests := make([]*manifest, 0, len(digests))
+	for i := range digests {
+		digests[i] = fmt.Sprintf("sha256:%064d", i)
+
+		var tags []string
+		if i%2 == 0 {
+			tags = []string{fmt.Sprintf("pr-%d", i)}
+		}
+		manifests = append(manifests, &manifest{
+			Digest: digests[i],
+			Info: gcrgoogle.ManifestInfo{
+				Uploaded: since.Add(-time.Duration(i+1) * time.Hour),
+				Tags:     tags,
+			},
+		})
+	}
+
+	tagFilter, err := BuildItemFilter("^pr-", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	int64Ptr := func(v int64) *int64 { return &v }
+
+	cases := []struct {
+		name         string
+		keep         int64
+		keepTagged   *int64
+		keepUntagged *int64
+		expKept      []string
+	}{
+		{
+			name:    "keep",
+			keep:    2,
+			expKept: []string{digests[0], digests[1]},
+		},
+		{
+			name:         "both",
+			keepTagged:   int64Ptr(2),
+			keepUntagged: int64Ptr(1),
+			expKept:      []string{digests[0], digests[1], digests[2]},
+		},
+		{
+			name:         "untagged_only",
+			keep:         1,
+			keepUntagged: int64Ptr(2),
+			expKept:      []string{digests[0], digests[1], digests[3]},
+		},
+		{
+			name:       "tagged_zero",
+			keep:       1,
+			keepTagged: int64Ptr(0),
+			expKept:    []string{digests[1]},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			cleaner := &Cleaner{logger: NewLogger("error", io.Discard, io.Discard)}
+			decisions, _ := cleaner.decideAll("gcr.io/my-project/my-image", manifests, &CleanOptions{
+				Since:            since,
+				Keep:             tc.keep,
+				KeepTagged:       tc.keepTagged,
+				KeepUntagged:     tc.keepUntagged,
+				RepoKeepFilter:   &ItemFilterNull{},
+				RepoPrefixFilter: &ItemFilterNull{},
+				TagFilter:        tagFilter,
+				TagKeepFilter:    &ItemFilterNull{},
+				PodFilter:        &PodFilterNull{},
+			}, nil)
+
+			kept := make([]string, 0, len(decisions))
+			for _, d := range decisions {
+				if !d.Delete {
+					if got, want := d.Reason, ReasonKeepCount; got != want {
+						t.Errorf("expected %q to be %q", got, want)
+					}
+					kept = append(kept, d.Digest)
+				}
+			}
+			if !reflect.DeepEqual(kept, tc.expKept) {
+				t.Errorf("expected kept %q to be %q", kept, tc.expKept)
+			}
+		})
+	}
+}
+
+func TestSortManifests(t *testing.T) {
+	t.Parallel()
+
+	created := time.Date(2023, time.October, 1, 0, 0, 0, 0, time.UTC)
+	uploaded := time.Date(2023, time.October, 2, 0, 0, 0, 0, time.UTC)
+	newer := uploaded.Add(time.Hour)
+
+	// Every manifest has identical timestamps except the newest, so the order
+	// of the others only depends on the digest.
+	a := "sha256:" + strings.Repeat("a", 64)
+	b := "sha256:" + strings.Repeat("b", 64)
+	c := "sha256:" + strings.Repeat("c", 64)
+	d := "sha256:" + strings.Repeat("d", 64)
+	newest := "sha256:" + strings.Repeat("f", 64)
+
+	input := []*manifest{
+		{Digest: c, Info: gcrgoogle.ManifestInfo{Created: created, Uploaded: uploaded}},
+		{Digest: a, Info: gcrgoogle.ManifestInfo{Created: created, Uploaded: uploaded}},
+		{Digest: newest, Info: gcrgoogle.ManifestInfo{Created: created, Uploaded: newer}},
+		{Digest: d, Info: gcrgoogle.ManifestInfo{Created: created, Uploaded: uploaded}},
+		{Digest: b, Info: gcrgoogle.ManifestInfo{Created: created, Uploaded: uploaded}},
+	}
+	exp := []string{newest, a, b, c, d}
+
+	since := uploaded.Add(24 * time.Hour)
+	cleaner := &Cleaner{logger: NewLogger("error", io.Discard, io.Discard)}
+
+	// Try every rotation of the input, since sort.Slice is not stable.
+	for i := range input {
+		manifests := append(append([]*manifest(nil), input[i:]...), input[:i]...)
+		sortManifests(manifests, TimeSourceUploaded)
+
+		got := make([]string, 0, len(manifests))
+		for _, m := range manifests {
+			got = append(got, m.Digest)
+		}
+		if !reflect.DeepEqual(got, exp) {
+			t.Errorf("rotation %d: expected %q to be %q", i, got, exp)
+		}
+
+		// Keep always protects the same manifests.
+		decisions, _ := cleaner.decideAll("gcr.io/my-project/my-image", manifests, &CleanOptions{
+			Since:            since,
+			Keep:             2,
+			RepoKeepFilter:   &ItemFilterNull{},
+			RepoPrefixFilter: &ItemFilterNull{},
+			TagFilter:        &ItemFilterNull{},
+			TagKeepFilter:    &ItemFilterNull{},
+			PodFilter:        &PodFilterNull{},
+		}, nil)
+
+		var kept []string
+		for _, d := range decisions {
+			if !d.Delete {
+				kept = append(kept, d.Digest)
+			}
+		}
+		if got, want := kept, exp[:2]; !reflect.DeepEqual(got, want) {
+			t.Errorf("rotation %d: expected kept %q to be %q", i, got, want)
+		}
+	}
+}
+
+func TestDecideAll_IndexChildren(t *testing.T) {
+	t.Parallel()
+
+	keptIndex := "sha256:" + strings.Repeat("1", 64)
+	amd64 := "sha256:" + strings.Repeat("2", 64)
+	arm64 := "sha256:" + strings.Repeat("3", 64)
+	deletedIndex := "sha256:" + strings.Repeat("4", 64)
+	orphan := "sha256:" + strings.Repeat("5", 64)
+
+	old := time.Date(2023, time.October, 1, 0, 0, 0, 0, time.UTC)
+	since := time.Date(2023, time.November, 1, 0, 0, 0, 0, time.UTC)
+
+	tagFilter, err := BuildItemFilter(".*", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tagKeepFilter, err := BuildItemFilter("^v1$", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifests := []*manifest{
+		{Digest: keptIndex, Info: gcrgoogle.ManifestInfo{
+			Uploaded: old, Tags: []string{"v1"}, MediaType: string(gcrtypes.OCIImageIndex),
+		}},
+		{Digest: amd64, Info: gcrgoogle.ManifestInfo{
+			Uploaded: old, MediaType: string(gcrtypes.OCIManifestSchema1),
+		}},
+		{Digest: arm64, Info: gcrgoogle.ManifestInfo{
+			Uploaded: old, MediaType: string(gcrtypes.OCIManifestSchema1),
+		}},
+		{Digest: deletedIndex, Info: gcrgoogle.ManifestInfo{
+			Uploaded: old, Tags: []string{"pr-1"}, MediaType: string(gcrtypes.DockerManifestList),
+		}},
+		{Digest: orphan, Info: gcrgoogle.ManifestInfo{
+			Uploaded: old, MediaType: string(gcrtypes.DockerManifestSchema2),
+		}},
+	}
+
+	indexChildren := map[string][]string{
+		keptIndex:    {amd64, arm64},
+		deletedIndex: {orphan},
+	}
+
+	cleaner := &Cleaner{logger: NewLogger("error", io.Discard, io.Discard)}
+	decisions, toDelete := cleaner.decideAll("gcr.io/my-project/my-image", manifests, &CleanOptions{
+		Since:            since,
+		RepoKeepFilter:   &ItemFilterNull{},
+		RepoPrefixFilter: &ItemFilterNull{},
+		TagFilter:        tagFilter,
+		TagKeepFilter:    tagKeepFilter,
+		PodFilter:        &PodFilterNull{},
+	}, &repoFacts{indexChildren: indexChildren})
+
+	reasons := make(map[string]string, len(decisions))
+	for _, d := range decisions {
+		reasons[d.Digest] = d.Reason
+	}
+	for _, digest := range []string{amd64, arm64} {
+		if got, want := reasons[digest], ReasonIndexChild; got != want {
+			t.Errorf("expected %s reason %q to be %q", digest, got, want)
+		}
+	}
+
+	deleted := make([]string, 0, len(toDelete))
+	for _, m := range toDelete {
+		deleted = append(deleted, m.Digest)
+	}
+	sort.Strings(deleted)
+	if exp := []string{deletedIndex, orphan}; !reflect.DeepEqual(deleted, exp) {
+		t.Errorf("expected deleted %q to be %q", deleted, exp)
+	}
+}
+
+func TestDecideAll_KeepOrder(t *testing.T) {
+	t.Parallel()
+
+	newest := "sha256:" + strings.Repeat("1", 64)
+	older := "sha256:" + strings.Repeat("2", 64)
+	index := "sha256:" + strings.Repeat("3", 64)
+
+	old := time.Date(2023, time.October, 1, 0, 0, 0, 0, time.UTC)
+	since := time.Date(2023, time.November, 1, 0, 0, 0, 0, time.UTC)
+
+	tagFilter, err := BuildItemFilter(".*", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// In each case, the newest manifest depends on a deleted manifest, so it is
+	// subject to the keep count like any other manifest.
+	cases := []struct {
+		name           string
+		newestTags     []string
+		olderTags      []string
+		indexChildren  map[string][]string
+		failedIndexes  []string
+		keepSignatures bool
+	}{
+		{
+			name:          "index_child",
+			indexChildren: map[string][]string{index: {newest}},
+		},
+		{
+			name:          "failed_index",
+			olderTags:     []string{"pr-2"},
+			failedIndexes: []string{index},
+		},
+		{
+			name:           "signature",
+			newestTags:     []string{"sha256-" + strings.Repeat("3", 64) + ".sig"},
+			olderTags:      []string{"pr-2"},
+			keepSignatures: true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			manifests := []*manifest{
+				{Digest: newest, Info: gcrgoogle.ManifestInfo{
+					Uploaded: old, Tags: tc.newestTags, MediaType: string(gcrtypes.OCIManifestSchema1),
+				}},
+				{Digest: older, Info: gcrgoogle.ManifestInfo{
+					Uploaded: old, Tags: tc.olderTags, MediaType: string(gcrtypes.OCIManifestSchema1),
+				}},
+				{Digest: index, Info: gcrgoogle.ManifestInfo{
+					Uploaded: old, Tags: []string{"pr-1"}, MediaType: string(gcrtypes.OCIImageIndex),
+				}},
+			}
+
+			cleaner := &Cleaner{logger: NewLogger("error", io.Discard, io.Discard)}
+			decisions, toDelete := cleaner.decideAll("gcr.io/my-project/my-image", manifests, &CleanOptions{
+				Since:            since,
+				Keep:             1,
+				RepoKeepFilter:   &ItemFilterNull{},
+				RepoPrefixFilter: &ItemFilterNull{},
+				TagFilter:        tagFilter,
+				TagKeepFilter:    &ItemFilterNull{},
+				PodFilter:        &PodFilterNull{},
+				KeepSignatures:   tc.keepSignatures,
+			}, &repoFacts{indexChildren: tc.indexChildren, failedIndexes: tc.failedIndexes})
+
+			if got, want := decisions[0].Reason, ReasonKeepCount; got != want {
+				t.Errorf("expected newest reason %q to be %q", got, want)
+			}
+
+			deleted := make([]string, 0, len(toDelete))
+			for _, m := range toDelete {
+				deleted = append(deleted, m.Digest)
+			}
+			if exp := []string{older, index}; !reflect.DeepEqual(deleted, exp) {
+				t.Errorf("expected deleted %q to be %q", deleted, exp)
+			}
+		})
+	}
+}
+
+// fakeIndexRegistry is a registry that serves the given image indexes by
+// digest and records which were fetched. Other manifests are not found.
+// fakeListRegistry serves the same manifests, with the same tags, for every
+// repository in the catalog, and counts the list and delete calls.
+type fakeListRegistry struct {
+	catalog   []string
+	manifests []string
+	tags      []string
+
+	// failRepos are the repositories whose tags cannot be listed.
+	failRepos []string
+
+	// failCatalog makes the catalog return a 403.
+	failCatalog bool
+
+	// slowRepos are the repositories whose tags take 10s to list, and
+	// slowDigests are the digests that take 10s to delete, unless the request
+	// is cancelled first.
+	slowRepos   []string
+	slowDigests []string
+
+	lists   int32
+	deletes int32
+
+	lock   sync.Mutex
+	listed []string
+}
+
+func (f *fakeListRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/v2/":
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodDelete:
+		for _, digest := range f.slowDigests {
+			if strings.HasSuffix(r.URL.Path, "/manifests/"+digest) {
+				f.wait(r)
+			}
+		}
+		atomic.AddInt32(&f.deletes, 1)
+		w.WriteHeader(http.StatusAccepted)
+	case r.URL.Path == "/v2/_catalog":
+		if f.failCatalog {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{
+			"repositories": f.catalog,
+		})
+	case strings.HasSuffix(r.URL.Path, "/tags/list"):
+		atomic.AddInt32(&f.lists, 1)
+
+		repo := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/v2/"), "/tags/list")
+		f.lock.Lock()
+		f.listed = append(f.listed, repo)
+		f.lock.Unlock()
+
+		for _, fail := range f.failRepos {
+			if repo == fail {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+		}
+		for _, slow := range f.slowRepos {
+			if repo == slow {
+				f.wait(r)
+			}
+		}
+
+		tags := f.tags
+		if tags == nil {
+			tags = []string{}
+		}
+
+		manifests := make(map[string]any, len(f.manifests))
+		for _, digest := range f.manifests {
+			manifests[digest] = map[string]any{
+				"mediaType":      string(gcrtypes.DockerManifestSchema2),
+				"tag":            tags,
+				"timeCreatedMs":  "1600000000000",
+				"timeUploadedMs": "1600000000000",
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]any{
+			"manifest": manifests,
+		})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestCleaner_CleanWithOptions_NilFilters(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name       string
+		opts       *CleanOptions
+		expDeleted int
+	}{
+		{
+			name:       "zero",
+			opts:       &CleanOptions{},
+			expDeleted: 0,
+		},
+		{
+			name:       "since",
+			opts:       &CleanOptions{Since: time.Now().UTC(), DryRun: true},
+			expDeleted: 2,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			registry := &fakeListRegistry{
+				manifests: []string{
+					"sha256:" + strings.Repeat("1", 64),
+					"sha256:" + strings.Repeat("2", 64),
+				},
+			}
+			srv := httptest.NewServer(registry)
+			t.Cleanup(srv.Close)
+
+			host := strings.TrimPrefix(srv.URL, "http://")
+			cleaner, err := NewCleaner(gcrauthn.NewMultiKeychain(), NewLogger("error", io.Discard, io.Discard), 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			deleted, decisions, err := cleaner.CleanWithOptions(context.Background(), host+"/proj/a", tc.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := len(decisions), 2; got != want {
+				t.Errorf("expected %d decisions to be %d", got, want)
+			}
+			if got, want := len(deleted), tc.expDeleted; got != want {
+				t.Errorf("expected %d deleted to be %d", got, want)
+			}
+			if got, want := atomic.LoadInt32(&registry.deletes), int32(0); got != want {
+				t.Errorf("expected %d deletes to be %d", got, want)
+			}
+		})
+	}
+}
+
+func TestCleaner_DeleteManifest(t *testing.T) {
+	t.Parallel()
+
+	digest := "sha256:" + strings.Repeat("1", 64)
+
+	cases := []struct {
+		name    string
+		digest  string
+		dryRun  bool
+		err     string
+		deletes int32
+	}{
+		{
+			name:    "deletes_tags_and_digest",
+			digest:  digest,
+			deletes: 3,
+		},
+		{
+			name:    "dry_run",
+			digest:  digest,
+			dryRun:  true,
+			deletes: 0,
+		},
+		{
+			name:   "missing",
+			digest: "sha256:" + strings.Repeat("3", 64),
+			err:    "does not exist",
+		},
+		{
+			name:   "invalid",
+			digest: "latest",
+			err:    "invalid digest",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			registry := &fakeListRegistry{
+				manifests: []string{digest, "sha256:" + strings.Repeat("2", 64)},
+				tags:      []string{"v1", "latest"},
+			}
+			srv := httptest.NewServer(registry)
+			t.Cleanup(srv.Close)
+
+			host := strings.TrimPrefix(srv.URL, "http://")
+			repo := host + "/my-project/a"
+
+			cleaner := &Cleaner{
+				keychain:    gcrauthn.NewMultiKeychain(),
+				logger:      NewLogger("error", io.Discard, io.Discard),
+				concurrency: 1,
+			}
+
+			ref, err := cleaner.DeleteManifest(context.Background(), repo, tc.digest, &CleanOptions{
+				DryRun: tc.dryRun,
+			})
+			if tc.err != "" {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				if got, want := err.Error(), tc.err; !strings.Contains(got, want) {
+					t.Errorf("expected %q to contain %q", got, want)
+				}
+				if got, want := atomic.LoadInt32(&registry.deletes), int32(0); got != want {
+					t.Errorf("expected %d deletes to be %d", got, want)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got, want := ref, repo+"@"+tc.digest; got != want {
+				t.Errorf("expected %q to be %q", got, want)
+			}
+			if got, want := atomic.LoadInt32(&registry.deletes), tc.deletes; got != want {
+				t.Errorf("expected %d deletes to be %d", got, want)
+			}
+		})
+	}
+}
+
+// wait blocks for 10s or until the request is cancelled.
+func (f *fakeListRegistry) wait(r *http.Request) {
+	select {
+	case <-r.Context().Done():
+	case <-time.After(10 * time.Second):
+	}
+}
+
+func TestCleanRepos_MaxDelete(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name      string
+		maxDelete int
+		dryRun    bool
+		err       string
+		deletes   int32
+	}{
+		{
+			name:      "under_cap",
+			maxDelete: 4,
+			deletes:   4,
+		},
+		{
+			name:      "over_cap",
+			maxDelete: 3,
+			err:       "refusing to delete 4 manifests, which exceeds max_delete of 3",
+		},
+		{
+			name:      "dry_run_over_cap",
+			maxDelete: 3,
+			dryRun:    true,
+			err:       "refusing to delete 4 manifests",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			registry := &fakeListRegistry{
+				manifests: []string{
+					"sha256:" + strings.Repeat("1", 64),
+					"sha256:" + strings.Repeat("2", 64),
+				},
+			}
+			srv := httptest.NewServer(registry)
+			t.Cleanup(srv.Close)
+
+			host := strings.TrimPrefix(srv.URL, "http://")
+			repos := []string{host + "/my-project/a", host + "/my-project/b"}
+
+			cleaner := &Cleaner{
+				keychain:    gcrauthn.NewMultiKeychain(),
+				logger:      NewLogger("error", io.Discard, io.Discard),
+				concurrency: 1,
+			}
+
+			var done int32
+			results, err := cleaner.CleanRepos(context.Background(), repos, 2, &CleanOptions{
+				Since:            time.Now(),
+				RepoKeepFilter:   &ItemFilterNull{},
+				RepoPrefixFilter: &ItemFilterNull{},
+				TagFilter:        &ItemFilterNull{},
+				TagKeepFilter:    &ItemFilterNull{},
+				PodFilter:        &PodFilterNull{},
+				MaxDelete:        tc.maxDelete,
+				DryRun:           tc.dryRun,
+				OnRepoDone: func(result *RepoResult) {
+					atomic.AddInt32(&done, 1)
+				},
+			})
+			if tc.err != "" {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				if got, want := err.Error(), tc.err; !strings.Contains(got, want) {
+					t.Errorf("expected %q to contain %q", got, want)
+				}
+				if got, want := atomic.LoadInt32(&done), int32(0); got != want {
+					t.Errorf("expected %d repos done to be %d", got, want)
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, want := CountDeletions(results), 4; got != want {
+					t.Errorf("expected %d deletions to be %d", got, want)
+				}
+			}
+
+			// Each repository is listed once, even when it is cleaned.
+			if got, want := atomic.LoadInt32(&registry.lists), int32(len(repos)); got != want {
+				t.Errorf("expected %d lists to be %d", got, want)
+			}
+			if got, want := atomic.LoadInt32(&registry.deletes), tc.deletes; got != want {
+				t.Errorf("expected %d deletes to be %d", got, want)
+			}
+		})
+	}
+}
+
+func TestCleanRepos_RepoTimeout(t *testing.T) {
+	t.Parallel()
+
+	fast := "sha256:" + strings.Repeat("1", 64)
+	slow := "sha256:" + strings.Repeat("2", 64)
+
+	cases := []struct {
+		name        string
+		maxDelete   int
+		slowRepos   []string
+		slowDigests []string
+		deleted     []string
+	}{
+		{
+			name:      "list",
+			slowRepos: []string{"my-project/a"},
+		},
+		{
+			name:      "list_max_delete",
+			maxDelete: 10,
+			slowRepos: []string{"my-project/a"},
+		},
+		{
+			name:        "delete",
+			slowDigests: []string{slow},
+			deleted:     []string{fast},
+		},
+		{
+			name:        "delete_max_delete",
+			maxDelete:   10,
+			slowDigests: []string{slow},
+			deleted:     []string{fast},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			registry := &fakeListRegistry{
+				manifests:   []string{fast, slow},
+				slowRepos:   tc.slowRepos,
+				slowDigests: tc.slowDigests,
+			}
+			srv := httptest.NewServer(registry)
+			t.Cleanup(srv.Close)
+
+			host := strings.TrimPrefix(srv.URL, "http://")
+			repos := []string{host + "/my-project/a"}
+			if len(tc.slowRepos) > 0 {
+				repos = append(repos, host+"/my-project/b")
+			}
+
+			cleaner := &Cleaner{
+				keychain:    gcrauthn.NewMultiKeychain(),
+				logger:      NewLogger("error", io.Discard, io.Discard),
+				concurrency: 1,
+			}
+
+			start := time.Now()
+			results, err := cleaner.CleanRepos(context.Background(), repos, 1, &CleanOptions{
+				Since:             time.Now(),
+				RepoKeepFilter:    &ItemFilterNull{},
+				RepoPrefixFilter:  &ItemFilterNull{},
+				TagFilter:         &ItemFilterNull{},
+				TagKeepFilter:     &ItemFilterNull{},
+				PodFilter:         &PodFilterNull{},
+				MaxDelete:         tc.maxDelete,
+				DeleteMaxAttempts: 1,
+				RepoTimeout:       100 * time.Millisecond,
+				ContinueOnError:   true,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, max := time.Since(start), 5*time.Second; got > max {
+				t.Errorf("expected %s to be less than %s", got, max)
+			}
+
+			if got, want := len(results), len(repos); got != want {
+				t.Fatalf("expected %d results to be %d", got, want)
+			}
+			if err := results[0].Err; err == nil || !strings.Contains(err.Error(), "timed out") {
+				t.Errorf("expected %v to be a timeout", err)
+			}
+			if got, want := results[0].Deleted, tc.deleted; !reflect.DeepEqual(got, want) {
+				t.Errorf("expected %q to be %q", got, want)
+			}
+
+			// Other repositories are still cleaned.
+			for _, result := range results[1:] {
+				if result.Err != nil {
+					t.Errorf("expected no error for %s: %s", result.Repo, result.Err)
+				}
+				if got, want := len(result.Deleted), 2; got != want {
+					t.Errorf("expected %d deleted to be %d", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestCleanRepos_ContinueOnError(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name            string
+		continueOnError bool
+		maxDelete       int
+		err             bool
+	}{
+		{
+			name: "stop",
+			err:  true,
+		},
+		{
+			name:            "continue",
+			continueOnError: true,
+		},
+		{
+			name:            "continue_max_delete",
+			continueOnError: true,
+			maxDelete:       10,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			registry := &fakeListRegistry{
+				manifests: []string{"sha256:" + strings.Repeat("1", 64)},
+				failRepos: []string{"my-project/a"},
+			}
+			srv := httptest.NewServer(registry)
+			t.Cleanup(srv.Close)
+
+			host := strings.TrimPrefix(srv.URL, "http://")
+			repos := []string{host + "/my-project/a", host + "/my-project/b"}
+
+			cleaner := &Cleaner{
+				keychain:    gcrauthn.NewMultiKeychain(),
+				logger:      NewLogger("error", io.Discard, io.Discard),
+				concurrency: 1,
+			}
+
+			var done int32
+			results, err := cleaner.CleanRepos(context.Background(), repos, 1, &CleanOptions{
+				Since:            time.Now(),
+				RepoKeepFilter:   &ItemFilterNull{},
+				RepoPrefixFilter: &ItemFilterNull{},
+				TagFilter:        &ItemFilterNull{},
+				TagKeepFilter:    &ItemFilterNull{},
+				PodFilter:        &PodFilterNull{},
+				MaxDelete:        tc.maxDelete,
+				ContinueOnError:  tc.continueOnError,
+				DryRun:           true,
+				OnRepoDone: func(result *RepoResult) {
+					atomic.AddInt32(&done, 1)
+				},
+			})
+			if tc.err {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got, want := len(results), 2; got != want {
+				t.Fatalf("expected %d results to be %d", got, want)
+			}
+			if results[0].Err == nil {
+				t.Errorf("expected error for %s", results[0].Repo)
+			}
+			if got, want := len(results[1].Deleted), 1; got != want {
+				t.Errorf("expected %d deleted to be %d", got, want)
+			}
+			if got, want := atomic.LoadInt32(&done), int32(2); got != want {
+				t.Errorf("expected %d repos done to be %d", got, want)
+			}
+		})
+	}
+}
+
+func TestCleanRepos_RepoOptions(t *testing.T) {
+	t.Parallel()
+
+	registry := newTestRegistry(t)
+	registry.push(t, registry.repo(t, "my-project/a"),
+		testImage(t, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), nil, nil), "old")
+	bDigest := registry.push(t, registry.repo(t, "my-project/b"),
+		testImage(t, time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC), nil, nil), "old")
+
+	tagFilter, err := BuildItemFilter(".*", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	host := registry.host
+	logger := NewLogger("error", io.Discard, io.Discard)
+	cleaner, err := NewCleaner(gcrauthn.NewMultiKeychain(), logger, 1, WithRegistry(host, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repos := []string{host + "/my-project/a", host + "/my-project/b"}
+	results, err := cleaner.CleanRepos(context.Background(), repos, 1, &CleanOptions{
+		Since:            time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC),
+		RepoKeepFilter:   &ItemFilterNull{},
+		RepoPrefixFilter: &ItemFilterNull{},
+		TagFilter:        tagFilter,
+		TagKeepFilter:    &ItemFilterNull{},
+		PodFilter:        &PodFilterNull{},
+		MaxDelete:        10,
+		RepoOptions: func(repo string, opts *CleanOptions) {
+			if repo == host+"/my-project/a" {
+				opts.DryRun = true
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := CountDeletions(results), 2; got != want {
+		t.Errorf("expected %d deletions to be %d", got, want)
+	}
+
+	// Every repo is planned before deleting when there is a max delete. The
+	// per-repo dry run also applies when deleting, so only the manifest in the
+	// second repo is deleted.
+	if got, want := registry.deleted(), []string{bDigest}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected deletes %q to be %q", got, want)
+	}
+}
+
+func TestCleanRepos_KeepRoots(t *testing.T) {
+	t.Parallel()
+
+	digest1 := "sha256:" + strings.Repeat("1", 64)
+	digest2 := "sha256:" + strings.Repeat("2", 64)
+
+	cases := []struct {
+		name      string
+		keepRoots []string
+		maxDelete int
+		exp       [][]string
+	}{
+		{
+			name: "per_repo",
+			exp:  [][]string{{digest2}, {digest2}},
+		},
+		{
+			name:      "across_root",
+			keepRoots: []string{"my-project"},
+			exp:       [][]string{{digest2}, {digest1, digest2}},
+		},
+		{
+			name:      "across_root_max_delete",
+			keepRoots: []string{"my-project"},
+			maxDelete: 3,
+			exp:       [][]string{{digest2}, {digest1, digest2}},
+		},
+		{
+			name:      "not_under_root",
+			keepRoots: []string{"other-project"},
+			exp:       [][]string{{digest2}, {digest2}},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			registry := &fakeListRegistry{
+				manifests: []string{digest1, digest2},
+			}
+			srv := httptest.NewServer(registry)
+			t.Cleanup(srv.Close)
+
+			host := strings.TrimPrefix(srv.URL, "http://")
+			repos := []string{host + "/my-project/a", host + "/my-project/b"}
+
+			keepRoots := make([]string, 0, len(tc.keepRoots))
+			for _, root := range tc.keepRoots {
+				keepRoots = append(keepRoots, host+"/"+root)
+			}
+
+			cleaner := &Cleaner{
+				keychain:    gcrauthn.NewMultiKeychain(),
+				logger:      NewLogger("error", io.Discard, io.Discard),
+				concurrency: 1,
+			}
+
+			results, err := cleaner.CleanRepos(context.Background(), repos, 2, &CleanOptions{
+				Since:            time.Now(),
+				Keep:             1,
+				KeepRoots:        keepRoots,
+				RepoKeepFilter:   &ItemFilterNull{},
+				RepoPrefixFilter: &ItemFilterNull{},
+				TagFilter:        &ItemFilterNull{},
+				TagKeepFilter:    &ItemFilterNull{},
+				PodFilter:        &PodFilterNull{},
+				MaxDelete:        tc.maxDelete,
+				DryRun:           true,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := make([][]string, 0, len(results))
+			for _, result := range results {
+				got = append(got, result.Deleted)
+			}
+			if want := tc.exp; !reflect.DeepEqual(got, want) {
+				t.Errorf("expected %q to be %q", got, want)
+			}
+
+			// Each repository is listed once, even when keep is applied across
+			// repositories.
+			if got, want := atomic.LoadInt32(&registry.lists), int32(len(repos)); got != want {
+				t.Errorf("expected %d lists to be %d", got, want)
+			}
+		})
+	}
+}
+
+type fakeIndexRegistry struct {
+	indexes map[string][]byte
+	fail    map[string]bool
+
+	lock    sync.Mutex
+	fetched []string
+}
+
+func (f *fakeIndexRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/v2/" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	digest := path.Base(r.URL.Path)
+	f.lock.Lock()
+	f.fetched = append(f.fetched, digest)
+	f.lock.Unlock()
+
+	b, ok := f.indexes[digest]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if f.fail[digest] {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", string(gcrtypes.OCIImageIndex))
+	w.Header().Set("Docker-Content-Digest", digest)
+	w.Write(b)
+}
+
+// testIndex returns an OCI image index that references the given digests, and
+// its digest.
+func testIndex(tb testing.TB, children ...string) (string, []byte) {
+	tb.Helper()
+
+	manifests := make([]map[string]any, 0, len(children))
+	for _, child := range children {
+		manifests = append(manifests, map[string]any{
+			"mediaType": string(gcrtypes.OCIManifestSchema1),
+			"digest":    child,
+			"size":      1,
+		})
+	}
+
+	b, err := json.Marshal(map[string]any{
+		"schemaVersion": 2,
+		"mediaType":     string(gcrtypes.OCIImageIndex),
+		"manifests":     manifests,
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(b)), b
+}
+
+func TestDecideWithIndexes(t *testing.T) {
+	t.Parallel()
+
+	amd64 := "sha256:" + strings.Repeat("2", 64)
+	arm64 := "sha256:" + strings.Repeat("3", 64)
+	orphan := "sha256:" + strings.Repeat("5", 64)
+	keptIndex, keptIndexBody := testIndex(t, amd64, arm64)
+	deletedIndex, deletedIndexBody := testIndex(t, orphan)
+
+	old := time.Date(2023, time.October, 1, 0, 0, 0, 0, time.UTC)
+	recent := time.Date(2023, time.November, 10, 0, 0, 0, 0, time.UTC)
+	since := time.Date(2023, time.November, 1, 0, 0, 0, 0, time.UTC)
+
+	tagFilter, err := BuildItemFilter(".*", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tagKeepFilter, err := BuildItemFilter("^v1$", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifestsUploaded := func(uploaded time.Time) []*manifest {
+		return []*manifest{
+			{Digest: keptIndex, Info: gcrgoogle.ManifestInfo{
+				Uploaded: uploaded, Tags: []string{"v1"}, MediaType: string(gcrtypes.OCIImageIndex),
+			}},
+			{Digest: amd64, Info: gcrgoogle.ManifestInfo{
+				Uploaded: uploaded, MediaType: string(gcrtypes.OCIManifestSchema1),
+			}},
+			{Digest: arm64, Info: gcrgoogle.ManifestInfo{
+				Uploaded: uploaded, MediaType: string(gcrtypes.OCIManifestSchema1),
+			}},
+			{Digest: deletedIndex, Info: gcrgoogle.ManifestInfo{
+				Uploaded: uploaded, Tags: []string{"pr-1"}, MediaType: string(gcrtypes.OCIImageIndex),
+			}},
+			{Digest: orphan, Info: gcrgoogle.ManifestInfo{
+				Uploaded: uploaded, MediaType: string(gcrtypes.OCIManifestSchema1),
+			}},
+		}
+	}
+
+	cases := []struct {
+		name     string
+		uploaded time.Time
+		fail     bool
+		fetched  []string
+		reasons  map[string]string
+		toDelete []string
+	}{
+		{
+			name:     "no_candidates",
+			uploaded: recent,
+			fetched:  []string{},
+			toDelete: []string{},
+		},
+		{
+			name:     "kept_index",
+			uploaded: old,
+			fetched:  []string{keptIndex},
+			reasons: map[string]string{
+				amd64: ReasonIndexChild,
+				arm64: ReasonIndexChild,
+			},
+			toDelete: []string{deletedIndex, orphan},
+		},
+		{
+			name:     "failed_index",
+			uploaded: old,
+			fail:     true,
+			fetched:  []string{keptIndex},
+			reasons: map[string]string{
+				amd64:  ReasonIndexFailed,
+				arm64:  ReasonIndexFailed,
+				orphan: ReasonIndexFailed,
+			},
+			toDelete: []string{deletedIndex},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			registry := &fakeIndexRegistry{
+				indexes: map[string][]byte{
+					keptIndex:    keptIndexBody,
+					deletedIndex: deletedIndexBody,
+				},
+				fail: map[string]bool{keptIndex: tc.fail},
+			}
+			srv := httptest.NewServer(registry)
+			t.Cleanup(srv.Close)
+
+			gcrrepo, err := gcrname.NewRepository(strings.TrimPrefix(srv.URL, "http://") + "/my-repo")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			cleaner := &Cleaner{
+				keychain:    gcrauthn.NewMultiKeychain(),
+				logger:      NewLogger("error", io.Discard, io.Discard),
+				concurrency: 1,
+			}
+			decisions, toDelete, err := cleaner.decideWithIndexes(context.Background(), gcrrepo, manifestsUploaded(tc.uploaded), &CleanOptions{
+				Since:            since,
+				RepoKeepFilter:   &ItemFilterNull{},
+				RepoPrefixFilter: &ItemFilterNull{},
+				TagFilter:        tagFilter,
+				TagKeepFilter:    tagKeepFilter,
+				PodFilter:        &PodFilterNull{},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The registry client may retry failed fetches, so only compare
+			// which indexes were requested.
+			fetched := make([]string, 0, len(registry.fetched))
+			seen := make(map[string]struct{})
+			for _, digest := range registry.fetched {
+				if _, ok := seen[digest]; !ok {
+					seen[digest] = struct{}{}
+					fetched = append(fetched, digest)
+				}
+			}
+			if got, want := fetched, tc.fetched; !reflect.DeepEqual(got, want) {
+				t.Errorf("expected fetched %q to be %q", got, want)
+			}
+
+			reasons := make(map[string]string, len(decisions))
+			for _, d := range decisions {
+				reasons[d.Digest] = d.Reason
+			}
+			for digest, want := range tc.reasons {
+				if got := reasons[digest]; got != want {
+					t.Errorf("expected %s reason %q to be %q", digest, got, want)
+				}
+			}
+
+			deleted := make([]string, 0, len(toDelete))
+			for _, m := range toDelete {
+				deleted = append(deleted, m.Digest)
+			}
+			sort.Strings(deleted)
+			sort.Strings(tc.toDelete)
+			if got, want := deleted, tc.toDelete; !reflect.DeepEqual(got, want) {
+				t.Errorf("expected deleted %q to be %q", got, want)
+			}
+		})
+	}
+}
+
+// testPlatformIndex returns an OCI image index that references the given
+// digests with the given platforms, and its digest. Each child is a pair of a
+// digest and a platform of the form "os/arch".
+func testPlatformIndex(tb testing.TB, children ...[2]string) (string, []byte) {
+	tb.Helper()
+
+	manifests := make([]map[string]any, 0, len(children))
+	for _, child := range children {
+		os, arch, _ := strings.Cut(child[1], "/")
+		manifests = append(manifests, map[string]any{
+			"mediaType": string(gcrtypes.OCIManifestSchema1),
+			"digest":    child[0],
+			"size":      1,
+			"platform": map[string]any{
+				"os":           os,
+				"architecture": arch,
+			},
+		})
+	}
+
+	b, err := json.Marshal(map[string]any{
+		"schemaVersion": 2,
+		"mediaType":     string(gcrtypes.OCIImageIndex),
+		"manifests":     manifests,
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(b)), b
+}
+
+func TestDecideWithIndexes_PlatformFilter(t *testing.T) {
+	t.Parallel()
+
+	amd64 := "sha256:" + strings.Repeat("2", 64)
+	arm64 := "sha256:" + strings.Repeat("3", 64)
+	shared := "sha256:" + strings.Repeat("4", 64)
+	index, indexBody := testPlatformIndex(t,
+		[2]string{amd64, "linux/amd64"},
+		[2]string{arm64, "linux/arm64"},
+		[2]string{shared, "linux/arm64"})
+	otherIndex, otherIndexBody := testPlatformIndex(t,
+		[2]string{shared, "linux/amd64"})
+
+	old := time.Date(2023, time.October, 1, 0, 0, 0, 0, time.UTC)
+	since := time.Date(2023, time.November, 1, 0, 0, 0, 0, time.UTC)
+
+	tagKeepFilter, err := BuildItemFilter("^v", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name      string
+		filter    string
+		reasons   map[string]string
+		platforms map[string]string
+		toDelete  []string
+	}{
+		{
+			name: "no_filter",
+			reasons: map[string]string{
+				amd64:  ReasonIndexChild,
+				arm64:  ReasonIndexChild,
+				shared: ReasonIndexChild,
+			},
+			toDelete: []string{},
+		},
+		{
+			name:   "arm64",
+			filter: "arm64$",
+			reasons: map[string]string{
+				amd64:  ReasonIndexChild,
+				arm64:  ReasonPlatform,
+				shared: ReasonIndexChild,
+			},
+			platforms: map[string]string{
+				arm64: "linux/arm64",
+			},
+			toDelete: []string{arm64},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			registry := &fakeIndexRegistry{
+				indexes: map[string][]byte{
+					index:      indexBody,
+					otherIndex: otherIndexBody,
+				},
+			}
+			srv := httptest.NewServer(registry)
+			t.Cleanup(srv.Close)
+
+			gcrrepo, err := gcrname.NewRepository(strings.TrimPrefix(srv.URL, "http://") + "/my-repo")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var platformFilter ItemFilter
+			if tc.filter != "" {
+				platformFilter, err = BuildItemFilter(tc.filter, "")
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			cleaner := &Cleaner{
+				keychain:    gcrauthn.NewMultiKeychain(),
+				logger:      NewLogger("error", io.Discard, io.Discard),
+				concurrency: 1,
+			}
+			manifests := []*manifest{
+				{Digest: index, Info: gcrgoogle.ManifestInfo{
+					Uploaded: old, Tags: []string{"v1"}, MediaType: string(gcrtypes.OCIImageIndex),
+				}},
+				{Digest: otherIndex, Info: gcrgoogle.ManifestInfo{
+					Uploaded: old, Tags: []string{"v2"}, MediaType: string(gcrtypes.OCIImageIndex),
+				}},
+				{Digest: amd64, Info: gcrgoogle.ManifestInfo{
+					Uploaded: old, MediaType: string(gcrtypes.OCIManifestSchema1),
+				}},
+				{Digest: arm64, Info: gcrgoogle.ManifestInfo{
+					Uploaded: old, MediaType: string(gcrtypes.OCIManifestSchema1),
+				}},
+				{Digest: shared, Info: gcrgoogle.ManifestInfo{
+					Uploaded: old, MediaType: string(gcrtypes.OCIManifestSchema1),
+				}},
+			}
+			decisions, toDelete, err := cleaner.decideWithIndexes(context.Background(), gcrrepo, manifests, &CleanOptions{
+				Since:            since,
+				RepoKeepFilter:   &ItemFilterNull{},
+				RepoPrefixFilter: &ItemFilterNull{},
+				TagFilter:        &ItemFilterNull{},
+				TagKeepFilter:    tagKeepFilter,
+				PodFilter:        &PodFilterNull{},
+				PlatformFilter:   platformFilter,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			reasons := make(map[string]string, len(decisions))
+			platforms := make(map[string]string, len(decisions))
+			for _, d := range decisions {
+				reasons[d.Digest] = d.Reason
+				if d.Platform != "" {
+					platforms[d.Digest] = d.Platform
+				}
+			}
+			for digest, want := range tc.reasons {
+				if got := reasons[digest]; got != want {
+					t.Errorf("expected %s reason %q to be %q", digest, got, want)
+				}
+			}
+			if tc.platforms == nil {
+				tc.platforms = map[string]string{}
+			}
+			if got, want := platforms, tc.platforms; !reflect.DeepEqual(got, want) {
+				t.Errorf("expected platforms %q to be %q", got, want)
+			}
+
+			deleted := make([]string, 0, len(toDelete))
+			for _, m := range toDelete {
+				deleted = append(deleted, m.Digest)
+			}
+			sort.Strings(deleted)
+			if got, want := deleted, tc.toDelete; !reflect.DeepEqual(got, want) {
+				t.Errorf("expected deleted %q to be %q", got, want)
+			}
+		})
+	}
+}
+
+func TestIsIndexMediaType(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		mediaType gcrtypes.MediaType
+		exp       bool
+	}{
+		{gcrtypes.OCIImageIndex, true},
+		{gcrtypes.DockerManifestList, true},
+		{gcrtypes.OCIManifestSchema1, false},
+		{gcrtypes.DockerManifestSchema2, false},
+		{"", false},
+	}
+
+	for _, tc := range cases {
+		if got, want := isIndexMediaType(string(tc.mediaType)), tc.exp; got != want {
+			t.Errorf("expected %q to be %t", tc.mediaType, want)
+		}
+	}
+}
+
+func TestCountDeletions(t *testing.T) {
+	t.Parallel()
+
+	results := []*RepoResult{
+		{
+			Repo: "gcr.io/my-project/a",
+			Decisions: []*Decision{
+				{Digest: "sha256:a1", Delete: true, Reason: ReasonUntagged},
+				{Digest: "sha256:a2", Delete: false, Reason: ReasonTooNew},
+				nil,
+			},
+		},
+		{
+			Repo: "gcr.io/my-project/b",
+			Decisions: []*Decision{
+				{Digest: "sha256:b1", Delete: true, Reason: ReasonTagFilter},
+			},
+		},
+		{
+			Repo: "gcr.io/my-project/c",
+		},
+	}
+
+	if got, want := CountDeletions(results), 2; got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+}
+
+func TestParseRepositoryPattern(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name    string
+		pattern string
+		parent  string
+		matches []string
+		misses  []string
+		err     string
+	}{
+		{
+			name:    "last_segment",
+			pattern: "gcr.io/my-project/team-*",
+			parent:  "gcr.io/my-project",
+			matches: []string{"gcr.io/my-project/team-a", "gcr.io/my-project/team-"},
+			misses:  []string{"gcr.io/my-project/team-a/nested", "gcr.io/my-project/other", "gcr.io/my-project"},
+		},
+		{
+			name:    "middle_segment",
+			pattern: "us-docker.pkg.dev/my-project/*/app",
+			parent:  "us-docker.pkg.dev/my-project",
+			matches: []string{"us-docker.pkg.dev/my-project/repo/app"},
+			misses:  []string{"us-docker.pkg.dev/my-project/repo/other/app", "us-docker.pkg.dev/my-project/repo"},
+		},
+		{
+			name:    "character_class",
+			pattern: "gcr.io/my-project/app-[ab]",
+			parent:  "gcr.io/my-project",
+			matches: []string{"gcr.io/my-project/app-a", "gcr.io/my-project/app-b"},
+			misses:  []string{"gcr.io/my-project/app-c"},
+		},
+		{
+			name:    "registry_wildcard",
+			pattern: "*.gcr.io/my-project",
+			err:     "registry cannot contain wildcards",
+		},
+		{
+			name:    "unterminated",
+			pattern: "gcr.io/my-project/app-[",
+			err:     "unterminated character class",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			parent, re, err := parseRepositoryPattern(tc.pattern)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected error containing %q, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got, want := parent, tc.parent; got != want {
+				t.Errorf("expected parent %q to be %q", got, want)
+			}
+			for _, v := range tc.matches {
+				if !re.MatchString(v) {
+					t.Errorf("expected %q to match %q", tc.pattern, v)
+				}
+			}
+			for _, v := range tc.misses {
+				if re.MatchString(v) {
+					t.Errorf("expected %q to not match %q", tc.pattern, v)
+				}
+			}
+		})
+	}
+}
+
+func TestExpandRepositories_NoPatterns(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	logger := NewLogger("error", io.Discard, io.Discard)
+	cleaner, err := NewCleaner(nil, logger, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without patterns, the registry is never contacted.
+	got, err := cleaner.ExpandRepositories(ctx, []string{"gcr.io/b", "gcr.io/a", "gcr.io/b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"gcr.io/a", "gcr.io/b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+}
+
+func TestUniqueRepositories(t *testing.T) {
+	t.Parallel()
+
+	got := UniqueRepositories([]string{
+		"gcr.io/p/a/b",
+		" gcr.io/p/a ",
+		"gcr.io/p/a/",
+		"",
+		"gcr.io/p/a/b",
+	})
+	exp := []string{"gcr.io/p/a", "gcr.io/p/a/b"}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected %q to be %q", got, exp)
+	}
+}
+
+func TestCollapseRepositories(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name  string
+		roots []string
+		exp   []string
+	}{
+		{
+			name:  "empty",
+			roots: nil,
+			exp:   []string{},
+		},
+		{
+			name:  "nested",
+			roots: []string{"gcr.io/p/a/b", "gcr.io/p/a", "gcr.io/p/a/b/c"},
+			exp:   []string{"gcr.io/p/a"},
+		},
+		{
+			name:  "duplicates",
+			roots: []string{"gcr.io/p/a/", "gcr.io/p/a", "gcr.io/p/a/b"},
+			exp:   []string{"gcr.io/p/a"},
+		},
+		{
+			name:  "siblings",
+			roots: []string{"gcr.io/p/a-b", "gcr.io/p/a", "gcr.io/p/ab"},
+			exp:   []string{"gcr.io/p/a", "gcr.io/p/a-b", "gcr.io/p/ab"},
+		},
+		{
+			name:  "registry",
+			roots: []string{"gcr.io/p/a", "gcr.io"},
+			exp:   []string{"gcr.io"},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got := CollapseRepositories(tc.roots); !reflect.DeepEqual(got, tc.exp) {
+				t.Errorf("expected %q to be %q", got, tc.exp)
+			}
+		})
+	}
+}
+
+func TestExcludeRepositories(t *testing.T) {
+	t.Parallel()
+
+	repos := []string{
+		"gcr.io/p/team",
+		"gcr.io/p/team/app",
+		"gcr.io/p/team/legacy",
+		"gcr.io/p/team/legacy-2",
+		"gcr.io/p/team/legacy/app",
+		"gcr.io/p/team/old-a/app",
+	}
+
+	cases := []struct {
+		name    string
+		exclude []string
+		exp     []string
+		err     string
+	}{
+		{
+			name: "none",
+			exp:  repos,
+		},
+		{
+			name:    "repository_and_children",
+			exclude: []string{"gcr.io/p/team/legacy"},
+			exp: []string{
+				"gcr.io/p/team",
+				"gcr.io/p/team/app",
+				"gcr.io/p/team/legacy-2",
+				"gcr.io/p/team/old-a/app",
+			},
+		},
+		{
+			name:    "trailing_slash",
+			exclude: []string{"gcr.io/p/team/legacy/"},
+			exp: []string{
+				"gcr.io/p/team",
+				"gcr.io/p/team/app",
+				"gcr.io/p/team/legacy-2",
+				"gcr.io/p/team/old-a/app",
+			},
+		},
+		{
+			name:    "pattern_and_children",
+			exclude: []string{"gcr.io/p/team/old-*"},
+			exp: []string{
+				"gcr.io/p/team",
+				"gcr.io/p/team/app",
+				"gcr.io/p/team/legacy",
+				"gcr.io/p/team/legacy-2",
+				"gcr.io/p/team/legacy/app",
+			},
+		},
+		{
+			name:    "root",
+			exclude: []string{"gcr.io/p/team"},
+			exp:     []string{},
+		},
+		{
+			name:    "invalid_pattern",
+			exclude: []string{"*.gcr.io/p"},
+			err:     "registry cannot contain wildcards",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := ExcludeRepositories(repos, tc.exclude)
+			if tc.err != "" {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				if got, want := err.Error(), tc.err; !strings.Contains(got, want) {
+					t.Errorf("expected %q to contain %q", got, want)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.exp) {
+				t.Errorf("expected %q to be %q", got, tc.exp)
+			}
+		})
+	}
+}
+
+func TestPruneChildRepositories(t *testing.T) {
+	t.Parallel()
+
+	roots := []string{"gcr.io/p"}
+	repos := []string{"gcr.io/p", "gcr.io/p/keep-me", "gcr.io/p/team-a", "gcr.io/p/team-b"}
+
+	cases := []struct {
+		name string
+		keep string
+		exp  []string
+	}{
+		{
+			name: "no_filters",
+			exp:  repos,
+		},
+		{
+			name: "keep_filter",
+			keep: "keep-me$",
+			exp:  []string{"gcr.io/p", "gcr.io/p/team-a", "gcr.io/p/team-b"},
+		},
+		{
+			name: "keeps_roots",
+			keep: "^gcr.io/p",
+			exp:  []string{"gcr.io/p"},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			keepFilter, err := BuildItemFilter(tc.keep, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := PruneChildRepositories(roots, repos, keepFilter)
+			if !reflect.DeepEqual(got, tc.exp) {
+				t.Errorf("expected %q to be %q", got, tc.exp)
+			}
+		})
+	}
+}
+
+func TestLimitChildRepositoryDepth(t *testing.T) {
+	t.Parallel()
+
+	roots := []string{"gcr.io/p", "gcr.io/q/r"}
+	repos := []string{
+		"gcr.io/p",
+		"gcr.io/p/a",
+		"gcr.io/p/a/b",
+		"gcr.io/p/a/b/c",
+		"gcr.io/q/r",
+		"gcr.io/q/r/s",
+	}
+
+	cases := []struct {
+		name     string
+		maxDepth int
+		exp      []string
+	}{
+		{
+			name:     "unlimited",
+			maxDepth: -1,
+			exp:      repos,
+		},
+		{
+			name:     "roots_only",
+			maxDepth: 0,
+			exp:      []string{"gcr.io/p", "gcr.io/q/r"},
+		},
+		{
+			name:     "direct_children",
+			maxDepth: 1,
+			exp:      []string{"gcr.io/p", "gcr.io/p/a", "gcr.io/q/r", "gcr.io/q/r/s"},
+		},
+		{
+			name:     "grandchildren",
+			maxDepth: 2,
+			exp:      []string{"gcr.io/p", "gcr.io/p/a", "gcr.io/p/a/b", "gcr.io/q/r", "gcr.io/q/r/s"},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			got := LimitChildRepositoryDepth(roots, repos, tc.maxDepth)
+			if !reflect.DeepEqual(got, tc.exp) {
+				t.Errorf("expected %q to be %q", got, tc.exp)
+			}
+		})
+	}
+}
+
+func TestCheckMaxDelete(t *testing.T) {
+	t.Parallel()
+
+	results := []*RepoResult{
+		{
+			Repo: "gcr.io/my-project/a",
+			Decisions: []*Decision{
+				{Digest: "sha256:a1", Delete: true},
+				{Digest: "sha256:a2", Delete: true},
+			},
+		},
+	}
+
+	if err := checkMaxDelete(results, 2); err != nil {
+		t.Errorf("expected no error at the cap: %s", err)
+	}
+
+	err := checkMaxDelete(results, 1)
+	if err == nil {
+		t.Fatal("expected error above the cap")
+	}
+	if got, want := err.Error(), "refusing to delete 2 manifests"; !strings.Contains(got, want) {
+		t.Errorf("expected %q to contain %q", got, want)
+	}
+}
+
+func TestCleaner_ListChildRepositoriesPartial(t *testing.T) {
+	t.Parallel()
+
+	okSrv := httptest.NewServer(&fakeListRegistry{
+		catalog: []string{"my-project/a", "my-project/b", "other-project/c"},
+	})
+	t.Cleanup(okSrv.Close)
+	okHost := strings.TrimPrefix(okSrv.URL, "http://")
+
+	failSrv := httptest.NewServer(&fakeListRegistry{failCatalog: true})
+	t.Cleanup(failSrv.Close)
+	failHost := strings.TrimPrefix(failSrv.URL, "http://")
+
+	roots := []string{okHost + "/my-project", failHost + "/my-project"}
+
+	cases := []struct {
+		name       string
+		bestEffort bool
+		err        bool
+		exp        []string
+		warnings   int
+	}{
+		{
+			name:       "fail_fast",
+			bestEffort: false,
+			err:        true,
+		},
+		{
+			name:       "best_effort",
+			bestEffort: true,
+			exp:        []string{okHost + "/my-project/a", okHost + "/my-project/b"},
+			warnings:   1,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			cleaner := &Cleaner{
+				keychain:    gcrauthn.NewMultiKeychain(),
+				logger:      NewLogger("error", io.Discard, io.Discard),
+				concurrency: 2,
+			}
+
+			repos, warnings, err := cleaner.ListChildRepositoriesPartial(context.Background(), roots, &CleanOptions{
+				ListBestEffort: tc.bestEffort,
+			})
+			if (err != nil) != tc.err {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(repos, tc.exp) {
+				t.Errorf("expected %q to be %q", repos, tc.exp)
+			}
+			if got, want := len(warnings), tc.warnings; got != want {
+				t.Fatalf("expected %d warnings to be %d: %v", got, want, warnings)
+			}
+			for _, warning := range warnings {
+				if got, want := warning.Error(), failHost; !strings.Contains(got, want) {
+					t.Errorf("expected %q to contain %q", got, want)
+				}
+			}
+		})
+	}
+}
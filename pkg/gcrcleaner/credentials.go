@@ -0,0 +1,193 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	gcrauthn "github.com/google/go-containerregistry/pkg/authn"
+	gcrgoogle "github.com/google/go-containerregistry/pkg/v1/google"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/impersonate"
+	"google.golang.org/api/option"
+)
+
+// cloudPlatformScope is the OAuth scope for Google Cloud APIs.
+const cloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+
+// CleanerOption is an option to NewCleaner.
+type CleanerOption func(c *cleanerConfig)
+
+// cleanerConfig is the configuration built from CleanerOptions.
+type cleanerConfig struct {
+	credentialsFile           string
+	credentialsJSON           []byte
+	impersonateServiceAccount string
+
+	// registries are the registries given to WithRegistry, and their
+	// authenticators.
+	registries map[string]gcrauthn.Authenticator
+
+	// httpClient is the client given to WithHTTPClient.
+	httpClient *http.Client
+
+	// pullTimes is the lister given to WithPullTimeLister.
+	pullTimes PullTimeLister
+}
+
+// WithCredentialsFile makes the cleaner use the credentials in the given file,
+// such as a service account key, instead of the default credentials. The
+// default is to use the default credentials.
+func WithCredentialsFile(path string) CleanerOption {
+	return func(c *cleanerConfig) {
+		c.credentialsFile = path
+	}
+}
+
+// WithCredentialsJSON makes the cleaner use the given credentials JSON, such as
+// a service account key, instead of the default credentials. The default is to
+// use the default credentials.
+func WithCredentialsJSON(b []byte) CleanerOption {
+	return func(c *cleanerConfig) {
+		c.credentialsJSON = b
+	}
+}
+
+// credentials returns the explicitly configured credentials, or nil if the
+// default credentials should be used.
+func (c *cleanerConfig) credentials(ctx context.Context) (*google.Credentials, error) {
+	if c.credentialsFile != "" && len(c.credentialsJSON) > 0 {
+		return nil, fmt.Errorf("only one of credentials file and credentials JSON may be given")
+	}
+
+	b := c.credentialsJSON
+	if c.credentialsFile != "" {
+		var err error
+		b, err = os.ReadFile(c.credentialsFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read credentials file: %w", err)
+		}
+	}
+	if len(b) == 0 {
+		return nil, nil
+	}
+
+	credentials, err := google.CredentialsFromJSON(ctx, b, cloudPlatformScope)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse credentials: %w", err)
+	}
+	return credentials, nil
+}
+
+// WithImpersonation makes the cleaner impersonate the given service account
+// when talking to Google registries and APIs, instead of using its own
+// credentials directly. The caller's credentials must have
+// roles/iam.serviceAccountTokenCreator on the service account. The default is
+// to not impersonate.
+func WithImpersonation(serviceAccount string) CleanerOption {
+	return func(c *cleanerConfig) {
+		c.impersonateServiceAccount = serviceAccount
+	}
+}
+
+// newImpersonatedTokenSource creates a token source for the given service
+// account using the given base credentials, or the default credentials if nil.
+// Tokens are fetched lazily, so permission errors are returned on first use.
+func newImpersonatedTokenSource(ctx context.Context, serviceAccount string, base *google.Credentials) (oauth2.TokenSource, error) {
+	var opts []option.ClientOption
+	if base != nil {
+		opts = append(opts, option.WithCredentials(base))
+	}
+
+	ts, err := impersonate.CredentialsTokenSource(ctx, impersonate.CredentialsConfig{
+		TargetPrincipal: serviceAccount,
+		Scopes:          []string{cloudPlatformScope},
+	}, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to impersonate %s: %w", serviceAccount, err)
+	}
+
+	return &impersonatedTokenSource{
+		serviceAccount: serviceAccount,
+		ts:             ts,
+	}, nil
+}
+
+// impersonatedTokenSource wraps an impersonated token source to explain
+// permission errors.
+type impersonatedTokenSource struct {
+	serviceAccount string
+	ts             oauth2.TokenSource
+}
+
+// Token implements oauth2.TokenSource.
+func (s *impersonatedTokenSource) Token() (*oauth2.Token, error) {
+	token, err := s.ts.Token()
+	if err != nil {
+		// The impersonate package does not return a structured error.
+		if strings.Contains(err.Error(), "status code 403") {
+			return nil, fmt.Errorf("permission denied impersonating %s, ensure the "+
+				"IAM Credentials API is enabled and the caller has "+
+				"roles/iam.serviceAccountTokenCreator on it: %w", s.serviceAccount, err)
+		}
+		return nil, fmt.Errorf("failed to impersonate %s: %w", s.serviceAccount, err)
+	}
+	return token, nil
+}
+
+// tokenSourceKeychain is a keychain that authenticates Google registries with
+// a token source. Other registries resolve to anonymous, so it can be used with
+// gcrauthn.NewMultiKeychain.
+type tokenSourceKeychain struct {
+	auth gcrauthn.Authenticator
+}
+
+// newTokenSourceKeychain creates a new keychain for the token source.
+func newTokenSourceKeychain(ts oauth2.TokenSource) *tokenSourceKeychain {
+	return &tokenSourceKeychain{
+		auth: gcrgoogle.NewTokenSourceAuthenticator(ts),
+	}
+}
+
+// Resolve implements gcrauthn.Keychain.
+func (k *tokenSourceKeychain) Resolve(target gcrauthn.Resource) (gcrauthn.Authenticator, error) {
+	if !isGoogleRegistry(target.RegistryStr()) {
+		return gcrauthn.Anonymous, nil
+	}
+	return k.auth, nil
+}
+
+// isGoogleRegistry returns true if the host is Container Registry or Artifact
+// Registry.
+func isGoogleRegistry(host string) bool {
+	return host == "gcr.io" ||
+		strings.HasSuffix(host, ".gcr.io") ||
+		strings.HasSuffix(host, ".pkg.dev") ||
+		strings.HasSuffix(host, ".google.com")
+}
+
+// clientOptions returns the options for Google API clients, such as BigQuery,
+// so they use the same credentials as the cleaner.
+func (c *Cleaner) clientOptions() []option.ClientOption {
+	if c.tokenSource == nil {
+		return nil
+	}
+	return []option.ClientOption{option.WithTokenSource(c.tokenSource)}
+}
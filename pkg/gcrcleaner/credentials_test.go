@@ -0,0 +1,251 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	gcrauthn "github.com/google/go-containerregistry/pkg/authn"
+	gcrname "github.com/google/go-containerregistry/pkg/name"
+	"golang.org/x/oauth2"
+)
+
+func TestTokenSourceKeychain(t *testing.T) {
+	t.Parallel()
+
+	keychain := newTokenSourceKeychain(oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "abc"}))
+
+	cases := []struct {
+		name      string
+		repo      string
+		anonymous bool
+	}{
+		{
+			name: "container_registry",
+			repo: "gcr.io/my-project/my-image",
+		},
+		{
+			name: "regional_container_registry",
+			repo: "eu.gcr.io/my-project/my-image",
+		},
+		{
+			name: "artifact_registry",
+			repo: "us-docker.pkg.dev/my-project/my-repo/my-image",
+		},
+		{
+			name:      "docker_hub",
+			repo:      "docker.io/library/busybox",
+			anonymous: true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			repo, err := gcrname.NewRepository(tc.repo)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			auth, err := keychain.Resolve(repo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := auth == gcrauthn.Anonymous, tc.anonymous; got != want {
+				t.Errorf("expected anonymous %t to be %t", got, want)
+			}
+		})
+	}
+}
+
+type errTokenSource struct {
+	err error
+}
+
+func (s *errTokenSource) Token() (*oauth2.Token, error) {
+	return nil, s.err
+}
+
+func TestImpersonatedTokenSource(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{
+			name: "permission_denied",
+			err:  fmt.Errorf("impersonate: status code 403: denied"),
+			want: "roles/iam.serviceAccountTokenCreator",
+		},
+		{
+			name: "other",
+			err:  fmt.Errorf("impersonate: unable to generate access token: timeout"),
+			want: "failed to impersonate cleaner@my-project.iam.gserviceaccount.com",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			ts := &impersonatedTokenSource{
+				serviceAccount: "cleaner@my-project.iam.gserviceaccount.com",
+				ts:             &errTokenSource{err: tc.err},
+			}
+
+			_, err := ts.Token()
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			if got := err.Error(); !strings.Contains(got, tc.want) {
+				t.Errorf("expected error %q to contain %q", got, tc.want)
+			}
+		})
+	}
+}
+
+// testCredentialsJSON is a service account key with a fake private key. Keys
+// are only parsed when a token is requested.
+const testCredentialsJSON = `{
+  "type": "service_account",
+  "project_id": "my-project",
+  "private_key_id": "abc",
+  "private_key": "not-a-key",
+  "client_email": "cleaner@my-project.iam.gserviceaccount.com",
+  "client_id": "123",
+  "token_uri": "https://oauth2.googleapis.com/token"
+}`
+
+func TestCleanerConfig_Credentials(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "key.json")
+	if err := os.WriteFile(path, []byte(testCredentialsJSON), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name    string
+		opts    []CleanerOption
+		project string
+		err     string
+	}{
+		{
+			name: "default",
+		},
+		{
+			name:    "file",
+			opts:    []CleanerOption{WithCredentialsFile(path)},
+			project: "my-project",
+		},
+		{
+			name:    "json",
+			opts:    []CleanerOption{WithCredentialsJSON([]byte(testCredentialsJSON))},
+			project: "my-project",
+		},
+		{
+			name: "both",
+			opts: []CleanerOption{
+				WithCredentialsFile(path),
+				WithCredentialsJSON([]byte(testCredentialsJSON)),
+			},
+			err: "only one of",
+		},
+		{
+			name: "missing_file",
+			opts: []CleanerOption{WithCredentialsFile(filepath.Join(dir, "missing.json"))},
+			err:  "failed to read credentials file",
+		},
+		{
+			name: "invalid_json",
+			opts: []CleanerOption{WithCredentialsJSON([]byte("{"))},
+			err:  "failed to parse credentials",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			var cfg cleanerConfig
+			for _, opt := range tc.opts {
+				opt(&cfg)
+			}
+
+			credentials, err := cfg.credentials(context.Background())
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected error %v to contain %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tc.project == "" {
+				if credentials != nil {
+					t.Errorf("expected no credentials")
+				}
+				return
+			}
+			if got, want := credentials.ProjectID, tc.project; got != want {
+				t.Errorf("expected project %q to be %q", got, want)
+			}
+		})
+	}
+}
+
+func TestNewServer_CleanerCredentials(t *testing.T) {
+	t.Parallel()
+
+	cleaner, err := NewCleaner(nil, NewLogger("error", io.Discard, io.Discard), 1,
+		WithCredentialsJSON([]byte(testCredentialsJSON)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cleaner.keychain == nil {
+		t.Fatal("expected a keychain for the credentials")
+	}
+
+	server, err := NewServer(cleaner)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	credentials, err := server.findCredentials(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := credentials.ProjectID, "my-project"; got != want {
+		t.Errorf("expected project %q to be %q", got, want)
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"errors"
+	"net/http"
+)
+
+// ErrorCode is a stable, machine-readable code for an error response. Unlike
+// the error message, codes never change, so callers can branch on them.
+type ErrorCode string
+
+const (
+	// ErrorCodeInvalidPayload means the payload could not be decoded or failed
+	// validation.
+	ErrorCodeInvalidPayload ErrorCode = "invalid_payload"
+
+	// ErrorCodeInvalidFilter means a filter, rule, or keep option in the payload
+	// could not be built.
+	ErrorCodeInvalidFilter ErrorCode = "invalid_filter"
+
+	// ErrorCodeRegistryPermissionDenied means the registry rejected the
+	// credentials with a 403.
+	ErrorCodeRegistryPermissionDenied ErrorCode = "registry_permission_denied"
+
+	// ErrorCodeAssetListFailed means in-use detection failed, and either
+	// in_use_strict was set or the asset inventory export was accessible.
+	ErrorCodeAssetListFailed ErrorCode = "asset_list_failed"
+
+	// ErrorCodeRepoListFailed means the repositories could not be expanded or
+	// listed recursively.
+	ErrorCodeRepoListFailed ErrorCode = "repo_list_failed"
+
+	// ErrorCodeRepoCleanFailed means cleaning the repositories failed.
+	ErrorCodeRepoCleanFailed ErrorCode = "repo_clean_failed"
+
+	// ErrorCodeUnauthenticated means the request was not authenticated.
+	ErrorCodeUnauthenticated ErrorCode = "unauthenticated"
+
+	// ErrorCodeNotFound means the requested resource, such as a job, does not
+	// exist.
+	ErrorCodeNotFound ErrorCode = "not_found"
+
+	// ErrorCodeMethodNotAllowed means the HTTP method is not supported.
+	ErrorCodeMethodNotAllowed ErrorCode = "method_not_allowed"
+
+	// ErrorCodeUnavailable means the server cannot accept the request, for
+	// example because it is shutting down.
+	ErrorCodeUnavailable ErrorCode = "unavailable"
+
+	// ErrorCodeInternal is any other error.
+	ErrorCodeInternal ErrorCode = "internal"
+)
+
+// codedError is an error with an explicit error code.
+type codedError struct {
+	code ErrorCode
+	err  error
+}
+
+func (e *codedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *codedError) Unwrap() error {
+	return e.err
+}
+
+// withErrorCode attaches the code to the error. It returns nil if err is nil.
+func withErrorCode(code ErrorCode, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &codedError{code: code, err: err}
+}
+
+// errorCodeFor returns the error code for the error. A 403 from the registry
+// always takes precedence, since it is the most actionable, followed by an
+// explicit code and then a code derived from the HTTP status.
+func errorCodeFor(err error, status int) ErrorCode {
+	if registryStatusCode(err) == http.StatusForbidden {
+		return ErrorCodeRegistryPermissionDenied
+	}
+
+	var cerr *codedError
+	if errors.As(err, &cerr) {
+		return cerr.code
+	}
+
+	var verr *ValidationError
+	if errors.As(err, &verr) {
+		return ErrorCodeInvalidPayload
+	}
+
+	switch status {
+	case http.StatusBadRequest:
+		return ErrorCodeInvalidPayload
+	case http.StatusUnauthorized:
+		return ErrorCodeUnauthenticated
+	case http.StatusNotFound:
+		return ErrorCodeNotFound
+	case http.StatusMethodNotAllowed:
+		return ErrorCodeMethodNotAllowed
+	case http.StatusServiceUnavailable:
+		return ErrorCodeUnavailable
+	default:
+		return ErrorCodeInternal
+	}
+}
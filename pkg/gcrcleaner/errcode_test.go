@@ -0,0 +1,191 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	gcrtransport "github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+func TestErrorCodeFor(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name   string
+		err    error
+		status int
+		exp    ErrorCode
+	}{
+		{
+			name:   "explicit",
+			err:    withErrorCode(ErrorCodeInvalidFilter, fmt.Errorf("oops")),
+			status: http.StatusBadRequest,
+			exp:    ErrorCodeInvalidFilter,
+		},
+		{
+			name:   "explicit_wrapped",
+			err:    fmt.Errorf("outer: %w", withErrorCode(ErrorCodeRepoCleanFailed, fmt.Errorf("oops"))),
+			status: http.StatusBadRequest,
+			exp:    ErrorCodeRepoCleanFailed,
+		},
+		{
+			name:   "registry_forbidden",
+			err:    withErrorCode(ErrorCodeRepoCleanFailed, fmt.Errorf("failed: %w", &gcrtransport.Error{StatusCode: 403})),
+			status: http.StatusBadRequest,
+			exp:    ErrorCodeRegistryPermissionDenied,
+		},
+		{
+			name:   "validation",
+			err:    &ValidationError{},
+			status: http.StatusBadRequest,
+			exp:    ErrorCodeInvalidPayload,
+		},
+		{
+			name:   "bad_request",
+			err:    fmt.Errorf("oops"),
+			status: http.StatusBadRequest,
+			exp:    ErrorCodeInvalidPayload,
+		},
+		{
+			name:   "not_found",
+			err:    fmt.Errorf("oops"),
+			status: http.StatusNotFound,
+			exp:    ErrorCodeNotFound,
+		},
+		{
+			name:   "shutting_down",
+			err:    errShuttingDown,
+			status: http.StatusServiceUnavailable,
+			exp:    ErrorCodeUnavailable,
+		},
+		{
+			name:   "internal",
+			err:    fmt.Errorf("oops"),
+			status: http.StatusInternalServerError,
+			exp:    ErrorCodeInternal,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got, want := errorCodeFor(tc.err, tc.status), tc.exp; got != want {
+				t.Errorf("expected %q to be %q", got, want)
+			}
+		})
+	}
+}
+
+func TestServer_HTTPHandler_ErrorCode(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name   string
+		body   string
+		status int
+		exp    ErrorCode
+	}{
+		{
+			name:   "invalid_json",
+			body:   `{`,
+			status: http.StatusInternalServerError,
+			exp:    ErrorCodeInvalidPayload,
+		},
+		{
+			name:   "invalid_payload",
+			body:   `{"keep": -1, "max_delete": -1, "skip_in_use_check": true}`,
+			status: http.StatusBadRequest,
+			exp:    ErrorCodeInvalidPayload,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			server := testServer(t)
+
+			w := httptest.NewRecorder()
+			server.HTTPHandler().ServeHTTP(w, httptest.NewRequest("POST", "/http", strings.NewReader(tc.body)))
+
+			if got, want := w.Code, tc.status; got != want {
+				t.Fatalf("expected status %d to be %d: %s", got, want, w.Body.String())
+			}
+
+			var resp errorResp
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+			if got, want := resp.ErrorCode, tc.exp; got != want {
+				t.Errorf("expected %q to be %q", got, want)
+			}
+		})
+	}
+}
+
+func TestServer_CleanPayload_ErrorCode(t *testing.T) {
+	t.Parallel()
+
+	// These payloads are rejected by Validate, so they are passed directly to
+	// cleanPayload to check the error codes of callers that skip validation.
+	cases := []struct {
+		name string
+		p    *Payload
+	}{
+		{
+			name: "in_use_images",
+			p: &Payload{
+				Repos:       sortedStringSlice{"gcr.io/p/a"},
+				InUseImages: sortedStringSlice{"gcr.io/p/bad:bad tag"},
+			},
+		},
+		{
+			name: "repos_exclude",
+			p: &Payload{
+				Repos:          sortedStringSlice{"gcr.io/p/a"},
+				ReposExclude:   []string{"*.gcr.io/p"},
+				SkipInUseCheck: true,
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			_, status, err := testServer(t).cleanPayload(context.Background(), tc.p, nil)
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			if got, want := errorCodeFor(err, status), ErrorCodeInvalidFilter; got != want {
+				t.Errorf("expected %q to be %q", got, want)
+			}
+		})
+	}
+}
@@ -17,6 +17,8 @@ package gcrcleaner
 import (
 	"fmt"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 
 	gcrname "github.com/google/go-containerregistry/pkg/name"
@@ -27,65 +29,252 @@ type PodFilter interface {
 	Matches(repo string, digest string, tags []string) bool
 }
 
+var _ PodFilter = (*PodFilterNull)(nil)
+
+// PodFilterNull is a PodFilter that never matches. It is used when in-use
+// detection is disabled.
+type PodFilterNull struct{}
+
+func (f *PodFilterNull) Add(image string) error {
+	return nil
+}
+
+func (f *PodFilterNull) Matches(repo string, digest string, tags []string) bool {
+	return false
+}
+
 var _ PodFilter = (*AssetPodFilter)(nil)
 
 type AssetPodFilter struct {
 	images map[string][]string
 	repos  []string
+
+	// resolve, if set, resolves tag references to digests. resolved caches the
+	// digest of each tag, or "" if it could not be resolved.
+	resolve  func(tag gcrname.Tag) (string, error)
+	resolved map[string]string
 }
 
-func NewAssetPodFilter(repos []string) PodFilter {
-	return &AssetPodFilter{
-		images: map[string][]string{},
-		repos:  repos,
+// AssetPodFilterOption is an option for NewAssetPodFilter.
+type AssetPodFilterOption func(a *AssetPodFilter)
+
+// WithTagResolver resolves in-use tag references to the digests they
+// reference as they are added, so the manifest is kept by its digest as well as
+// its tag. If a tag cannot be resolved, the manifest is still kept by its tag.
+// Each tag is only resolved once.
+func WithTagResolver(resolve func(tag gcrname.Tag) (string, error)) AssetPodFilterOption {
+	return func(a *AssetPodFilter) {
+		a.resolve = resolve
 	}
 }
 
-func (a *AssetPodFilter) Add(image string) error {
-	// Filter in-use image references to repositories that we are currently cleaning
-	repoMatches := false
-	for _, repo := range a.repos {
-		if strings.HasPrefix(image, repo) {
-			repoMatches = true
-			break
-		}
+func NewAssetPodFilter(repos []string, opts ...AssetPodFilterOption) PodFilter {
+	normalized := make([]string, 0, len(repos))
+	for _, repo := range repos {
+		normalized = append(normalized, normalizeRepository(repo))
 	}
-	if !repoMatches {
-		return nil
+
+	a := &AssetPodFilter{
+		images:   map[string][]string{},
+		repos:    normalized,
+		resolved: map[string]string{},
+	}
+	for _, opt := range opts {
+		opt(a)
 	}
+	return a
+}
+
+func (a *AssetPodFilter) Add(image string) error {
 	ref, err := gcrname.ParseReference(image)
 	if err != nil {
-		return err
+		// Only references to repositories that we are cleaning need to be
+		// valid, since others are ignored anyway.
+		if a.matchesRepo(normalizeRepository(imageRepository(image))) {
+			return err
+		}
+		return nil
+	}
+
+	// Filter in-use image references to repositories that we are currently
+	// cleaning. References are normalized so that "nginx" and
+	// "docker.io/library/nginx" are the same repository.
+	repo := ref.Context().Name()
+	if !a.matchesRepo(repo) {
+		return nil
 	}
+
 	// Add in-use image reference to map with repo as string and digest/tag as values
-	repo, exists := a.images[ref.Context().String()]
-	if !exists {
-		repo = []string{}
+	a.images[repo] = appendIdentifier(a.images[repo], ref.Identifier())
+
+	// The tag is kept either way, so failing to resolve it is safe.
+	if tag, ok := ref.(gcrname.Tag); ok && a.resolve != nil {
+		if digest := a.resolveTag(tag); digest != "" {
+			a.images[repo] = appendIdentifier(a.images[repo], digest)
+		}
 	}
-	repo = append(repo, ref.Identifier())
-	a.images[ref.Context().String()] = repo
 	return nil
 }
 
+// appendIdentifier appends the identifier unless it is already in the list. The
+// same image is often in use by many pods, but each repository only has a few
+// distinct identifiers, so a linear search is cheap.
+func appendIdentifier(identifiers []string, identifier string) []string {
+	for _, v := range identifiers {
+		if v == identifier {
+			return identifiers
+		}
+	}
+	return append(identifiers, identifier)
+}
+
+// resolveTag returns the digest the tag references, or "" if it could not be
+// resolved.
+func (a *AssetPodFilter) resolveTag(tag gcrname.Tag) string {
+	key := tag.Name()
+	if digest, ok := a.resolved[key]; ok {
+		return digest
+	}
+
+	digest, err := a.resolve(tag)
+	if err != nil {
+		digest = ""
+	}
+	a.resolved[key] = digest
+	return digest
+}
+
 func (a *AssetPodFilter) Matches(repo string, digest string, tags []string) bool {
-	if repoMatch, repoMatches := a.images[repo]; repoMatches {
-		for _, identifier := range repoMatch {
-			if identifier == "" {
-				continue
-			}
-			if strings.HasPrefix(digest, identifier) {
+	// Normalize the repository the same way references are normalized in Add.
+	repo = normalizeRepository(repo)
+	return matchesIdentifiers(a.images[repo], digest, tags)
+}
+
+// matchesIdentifiers returns true if any of the in-use identifiers is exactly
+// the digest or one of the tags. Identifiers with an algorithm, such as
+// "sha256:abcd...", are digests and are only compared to the digest. Others are
+// tags, which can never be a prefix of a digest.
+func matchesIdentifiers(identifiers []string, digest string, tags []string) bool {
+	for _, identifier := range identifiers {
+		if identifier == "" {
+			continue
+		}
+		if strings.Contains(identifier, ":") {
+			if identifier == digest {
 				return true
 			}
-			for _, tag := range tags {
-				if identifier == tag {
-					return true
-				}
+			continue
+		}
+		for _, tag := range tags {
+			if identifier == tag {
+				return true
 			}
 		}
 	}
 	return false
 }
 
+var _ PodFilter = (*StaticPodFilter)(nil)
+
+// StaticPodFilter is a PodFilter of a fixed list of in-use images, for
+// environments where Cloud Asset Inventory is not available. Images are matched
+// like AssetPodFilter, by exact digest or tag, but are not limited to the
+// repositories being cleaned.
+type StaticPodFilter struct {
+	images map[string][]string
+}
+
+// NewStaticPodFilter creates a StaticPodFilter of the given images. It returns
+// an error if any image is not a valid reference.
+func NewStaticPodFilter(images []string) (*StaticPodFilter, error) {
+	f := &StaticPodFilter{
+		images: make(map[string][]string, len(images)),
+	}
+	for _, image := range images {
+		if err := f.Add(image); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+func (f *StaticPodFilter) Add(image string) error {
+	ref, err := gcrname.ParseReference(strings.TrimSpace(image))
+	if err != nil {
+		return fmt.Errorf("failed to parse in-use image %q: %w", image, err)
+	}
+
+	repo := ref.Context().Name()
+	f.images[repo] = appendIdentifier(f.images[repo], ref.Identifier())
+	return nil
+}
+
+func (f *StaticPodFilter) Matches(repo string, digest string, tags []string) bool {
+	return matchesIdentifiers(f.images[normalizeRepository(repo)], digest, tags)
+}
+
+// matchesRepo returns true if the normalized repository is one of the
+// repositories being cleaned or is nested under one. Artifact Registry images
+// have an extra path segment (location-docker.pkg.dev/project/repo/image), so
+// whole path segments are compared rather than raw string prefixes.
+func (a *AssetPodFilter) matchesRepo(repo string) bool {
+	for _, root := range a.repos {
+		if isChildRepository(repo, root) {
+			return true
+		}
+	}
+	return false
+}
+
+// imageRepository returns the repository portion of an image reference by
+// removing any digest or tag. It does not validate the reference.
+func imageRepository(image string) string {
+	if i := strings.Index(image, "@"); i >= 0 {
+		image = image[:i]
+	}
+	// A colon after the last slash is a tag, whereas a colon before it is a
+	// registry port.
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		image = image[:i]
+	}
+	return image
+}
+
+// normalizeRepository returns the fully-qualified name of the repository, so
+// that "nginx", "docker.io/library/nginx" and "index.docker.io/library/nginx"
+// are all the same. A bare host such as "us-docker.pkg.dev" or
+// "localhost:5000" is treated as an entire registry. If the repository cannot
+// be parsed, it is returned unchanged.
+func normalizeRepository(repo string) string {
+	repo = strings.TrimSuffix(repo, "/")
+
+	if !strings.Contains(repo, "/") && (strings.ContainsAny(repo, ".:") || repo == "localhost") {
+		if r, err := gcrname.NewRegistry(repo); err == nil {
+			return r.Name()
+		}
+		return repo
+	}
+
+	if r, err := gcrname.NewRepository(repo); err == nil {
+		return r.Name()
+	}
+	return repo
+}
+
+// isChildRepository returns true if the repository is the root or is nested
+// under the root. Roots can be entire registries (us-docker.pkg.dev), projects
+// (us-docker.pkg.dev/my-project), Artifact Registry repositories
+// (us-docker.pkg.dev/my-project/my-repo), or images. Matching is done on whole
+// path segments, so "gcr.io/my-project/app" is not a child of
+// "gcr.io/my-project/ap".
+func isChildRepository(repo, root string) bool {
+	root = strings.TrimSuffix(root, "/")
+	if root == "" {
+		return false
+	}
+	return repo == root || strings.HasPrefix(repo, root+"/")
+}
+
 // ItemFilter is an interface which defines whether a a given string matches
 // the filter.
 type ItemFilter interface {
@@ -93,30 +282,116 @@ type ItemFilter interface {
 	Matches(s []string) bool
 }
 
+// PatternKind is the syntax used to interpret the patterns given to
+// BuildItemFilter.
+type PatternKind string
+
+const (
+	// PatternKindRegex interprets patterns as Go regular expressions. This is
+	// the default.
+	PatternKindRegex PatternKind = "regex"
+
+	// PatternKindGlob interprets patterns as shell-style globs. Globs are
+	// translated into anchored regular expressions before compilation.
+	PatternKindGlob PatternKind = "glob"
+)
+
+// ItemFilterOption is an option to BuildItemFilter.
+type ItemFilterOption func(o *itemFilterOptions)
+
+type itemFilterOptions struct {
+	kind            PatternKind
+	globMatchSlash  bool
+	caseInsensitive bool
+	allMatchEmpty   bool
+	none            string
+}
+
+// WithPatternKind sets the syntax used to interpret the patterns. The default
+// is PatternKindRegex.
+func WithPatternKind(kind PatternKind) ItemFilterOption {
+	return func(o *itemFilterOptions) {
+		o.kind = kind
+	}
+}
+
+// WithGlobMatchSlash controls whether the glob wildcards "*" and "?" match a
+// "/". It only applies to PatternKindGlob. The default is false, which is
+// usually desired when matching repository names.
+func WithGlobMatchSlash(v bool) ItemFilterOption {
+	return func(o *itemFilterOptions) {
+		o.globMatchSlash = v
+	}
+}
+
+// WithCaseInsensitive controls whether patterns match case-insensitively. It
+// is equivalent to prefixing each pattern with "(?i)". Inline flags in the
+// pattern itself still take precedence, so "(?-i)" can opt back in to
+// case-sensitive matching.
+func WithCaseInsensitive(v bool) ItemFilterOption {
+	return func(o *itemFilterOptions) {
+		o.caseInsensitive = v
+	}
+}
+
+// WithAllMatchEmpty controls whether an "all" filter matches an empty list.
+// The default is false, since treating an empty list as a vacuous match can
+// select images that have no tags at all.
+func WithAllMatchEmpty(v bool) ItemFilterOption {
+	return func(o *itemFilterOptions) {
+		o.allMatchEmpty = v
+	}
+}
+
+// WithNone builds a filter that matches if no item matches the pattern, such as
+// images without any release tag. It is mutually exclusive with the "any" and
+// "all" inputs to BuildItemFilter.
+func WithNone(pattern string) ItemFilterOption {
+	return func(o *itemFilterOptions) {
+		o.none = pattern
+	}
+}
+
 // BuildItemFilter builds and compiles a new filter for the given inputs. All
 // inputs are strings to be compiled to regular expressions and are mutually
-// exclusive.
-func BuildItemFilter(any, all string) (ItemFilter, error) {
+// exclusive, including the pattern given by WithNone.
+func BuildItemFilter(any, all string, opts ...ItemFilterOption) (ItemFilter, error) {
+	o := &itemFilterOptions{kind: PatternKindRegex}
+	for _, opt := range opts {
+		opt(o)
+	}
+	none := o.none
+
 	// Ensure only one tag filter type is given.
-	if any != "" && all != "" {
+	given := 0
+	for _, v := range []string{any, all, none} {
+		if v != "" {
+			given++
+		}
+	}
+	if given > 1 {
 		return nil, fmt.Errorf("only one tag filter type may be specified")
 	}
 
 	switch {
 	case any != "":
-		re, err := regexp.Compile(any)
-		fmt.Println(`regex expression any: `, re)
+		re, err := compilePattern(any, o)
 		if err != nil {
 			return nil, fmt.Errorf("failed to compile 'any' item filter regular expression %q: %w", any, err)
 		}
-		return &ItemFilterAny{re}, nil
+		return &ItemFilterAny{res: []*regexp.Regexp{re}}, nil
 	case all != "":
-		re, err := regexp.Compile(all)
-		fmt.Println(`regex expression all: `, re)
+		re, err := compilePattern(all, o)
 		if err != nil {
 			return nil, fmt.Errorf("failed to compile 'all' item filter regular expression %q: %w", all, err)
 		}
-		return &ItemFilterAll{re}, nil
+		return &ItemFilterAll{re: re, matchEmpty: o.allMatchEmpty}, nil
+	case none != "":
+		re, err := compilePattern(none, o)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compile 'none' item filter regular expression %q: %w", none, err)
+		}
+		return &ItemFilterNone{re}, nil
 	default:
 		// If no filters were provided, return the null filter which just returns
 		// false for all matches.
@@ -124,6 +399,125 @@ func BuildItemFilter(any, all string) (ItemFilter, error) {
 	}
 }
 
+// BuildItemFilterAny builds and compiles a filter that matches if any item
+// matches any of the given patterns. Empty patterns are ignored, and if there
+// are none, it returns the null filter.
+func BuildItemFilterAny(patterns []string, opts ...ItemFilterOption) (ItemFilter, error) {
+	o := &itemFilterOptions{kind: PatternKindRegex}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	res := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		if pattern == "" {
+			continue
+		}
+
+		re, err := compilePattern(pattern, o)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compile 'any' item filter regular expression %q: %w", pattern, err)
+		}
+		res = append(res, re)
+	}
+
+	if len(res) == 0 {
+		return &ItemFilterNull{}, nil
+	}
+	return &ItemFilterAny{res: res}, nil
+}
+
+// compilePattern compiles the given pattern into a regular expression,
+// translating it from the configured pattern kind.
+func compilePattern(pattern string, o *itemFilterOptions) (*regexp.Regexp, error) {
+	expr := pattern
+	switch o.kind {
+	case PatternKindRegex, "":
+	case PatternKindGlob:
+		var err error
+		expr, err = globToRegex(pattern, o.globMatchSlash)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown pattern kind %q", o.kind)
+	}
+
+	// Flags are scoped to the current group, so a leading "(?i)" applies to the
+	// entire expression but is overridden by any flags the pattern sets itself.
+	if o.caseInsensitive {
+		expr = "(?i)" + expr
+	}
+	return regexp.Compile(expr)
+}
+
+// globToRegex translates a shell-style glob into an anchored regular
+// expression. It supports "*", "?", character classes ("[abc]", "[!abc]",
+// "[a-z]"), and backslash escapes. If matchSlash is false, "*" and "?" do not
+// match a "/".
+func globToRegex(glob string, matchSlash bool) (string, error) {
+	wildcard := "."
+	if !matchSlash {
+		wildcard = "[^/]"
+	}
+
+	var b strings.Builder
+	b.WriteString("^")
+
+	runes := []rune(glob)
+	for i := 0; i < len(runes); i++ {
+		switch r := runes[i]; r {
+		case '*':
+			b.WriteString(wildcard + "*")
+		case '?':
+			b.WriteString(wildcard)
+		case '\\':
+			if i+1 >= len(runes) {
+				return "", fmt.Errorf("trailing escape in glob %q", glob)
+			}
+			i++
+			b.WriteString(regexp.QuoteMeta(string(runes[i])))
+		case '[':
+			end := i + 1
+			if end < len(runes) && (runes[end] == '!' || runes[end] == '^') {
+				end++
+			}
+			if end < len(runes) && runes[end] == ']' {
+				end++
+			}
+			for end < len(runes) && runes[end] != ']' {
+				end++
+			}
+			if end >= len(runes) {
+				return "", fmt.Errorf("unterminated character class in glob %q", glob)
+			}
+
+			class := runes[i+1 : end]
+			b.WriteString("[")
+			if len(class) > 0 && (class[0] == '!' || class[0] == '^') {
+				b.WriteString("^")
+				if !matchSlash {
+					b.WriteString("/")
+				}
+				class = class[1:]
+			}
+			for _, c := range class {
+				if c == '\\' || c == '[' || c == ']' {
+					b.WriteString("\\")
+				}
+				b.WriteRune(c)
+			}
+			b.WriteString("]")
+			i = end
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+
+	b.WriteString("$")
+	return b.String(), nil
+}
+
 var _ ItemFilter = (*ItemFilterNull)(nil)
 
 // ItemFilterNull always returns false.
@@ -138,33 +532,39 @@ func (f *ItemFilterNull) Name() string {
 }
 
 // ItemFilterAny filters based on the entire list. If any item in the list
-// matches, it returns true. If no items match, it returns false.
+// matches any of the regular expressions, it returns true. If no items match,
+// it returns false.
 type ItemFilterAny struct {
-	re *regexp.Regexp
+	res []*regexp.Regexp
 }
 
 func (f *ItemFilterAny) Matches(tags []string) bool {
-	if f.re == nil {
-		return false
-	}
 	for _, t := range tags {
-		if f.re.MatchString(t) {
-			return true
+		for _, re := range f.res {
+			if re.MatchString(t) {
+				return true
+			}
 		}
 	}
 	return false
 }
 
 func (f *ItemFilterAny) Name() string {
-	return fmt.Sprintf("any(%s)", f.re.String())
+	exprs := make([]string, 0, len(f.res))
+	for _, re := range f.res {
+		exprs = append(exprs, re.String())
+	}
+	return fmt.Sprintf("any(%s)", strings.Join(exprs, ", "))
 }
 
 var _ ItemFilter = (*ItemFilterAll)(nil)
 
 // ItemFilterAll filters based on the entire list. If all items in the last match,
-// it returns true. If one more more items do not match, it returns false.
+// it returns true. If one more more items do not match, it returns false. An
+// empty list only matches if matchEmpty is true.
 type ItemFilterAll struct {
-	re *regexp.Regexp
+	re         *regexp.Regexp
+	matchEmpty bool
 }
 
 func (f *ItemFilterAll) Name() string {
@@ -175,6 +575,9 @@ func (f *ItemFilterAll) Matches(tags []string) bool {
 	if f.re == nil {
 		return false
 	}
+	if len(tags) == 0 {
+		return f.matchEmpty
+	}
 	for _, t := range tags {
 		if !f.re.MatchString(t) {
 			return false
@@ -182,3 +585,527 @@ func (f *ItemFilterAll) Matches(tags []string) bool {
 	}
 	return true
 }
+
+var _ ItemFilter = (*ItemFilterNone)(nil)
+
+// ItemFilterNone filters based on the entire list. If no items in the list
+// match, it returns true. If one or more items match, it returns false. An
+// empty list never matches, since there is nothing to compare against.
+type ItemFilterNone struct {
+	re *regexp.Regexp
+}
+
+func (f *ItemFilterNone) Name() string {
+	if f.re == nil {
+		return "none(<nil>)"
+	}
+	return fmt.Sprintf("none(%s)", f.re.String())
+}
+
+func (f *ItemFilterNone) Matches(tags []string) bool {
+	if f.re == nil {
+		return false
+	}
+	if len(tags) == 0 {
+		return false
+	}
+	for _, t := range tags {
+		if f.re.MatchString(t) {
+			return false
+		}
+	}
+	return true
+}
+
+var _ ItemFilter = (*ItemFilterAnd)(nil)
+
+// ItemFilterAnd combines multiple filters. If all filters match the list, it
+// returns true. If any filter does not match, or there are no filters, it
+// returns false.
+type ItemFilterAnd struct {
+	filters []ItemFilter
+}
+
+// NewItemFilterAnd creates a new filter that matches only when all of the given
+// filters match.
+func NewItemFilterAnd(filters ...ItemFilter) *ItemFilterAnd {
+	return &ItemFilterAnd{filters: filters}
+}
+
+func (f *ItemFilterAnd) Name() string {
+	names := make([]string, 0, len(f.filters))
+	for _, filter := range f.filters {
+		names = append(names, filter.Name())
+	}
+	return fmt.Sprintf("and(%s)", strings.Join(names, ", "))
+}
+
+func (f *ItemFilterAnd) Matches(tags []string) bool {
+	if len(f.filters) == 0 {
+		return false
+	}
+	for _, filter := range f.filters {
+		if !filter.Matches(tags) {
+			return false
+		}
+	}
+	return true
+}
+
+var _ ItemFilter = (*ItemFilterOr)(nil)
+
+// ItemFilterOr combines multiple filters. If any filter matches the list, it
+// returns true. If no filters match, or there are no filters, it returns false.
+type ItemFilterOr struct {
+	filters []ItemFilter
+}
+
+// NewItemFilterOr creates a new filter that matches when any of the given
+// filters match.
+func NewItemFilterOr(filters ...ItemFilter) *ItemFilterOr {
+	return &ItemFilterOr{filters: filters}
+}
+
+func (f *ItemFilterOr) Name() string {
+	names := make([]string, 0, len(f.filters))
+	for _, filter := range f.filters {
+		names = append(names, filter.Name())
+	}
+	return fmt.Sprintf("or(%s)", strings.Join(names, ", "))
+}
+
+func (f *ItemFilterOr) Matches(tags []string) bool {
+	for _, filter := range f.filters {
+		if filter.Matches(tags) {
+			return true
+		}
+	}
+	return false
+}
+
+var _ ItemFilter = (*ItemFilterExact)(nil)
+
+// ItemFilterExact filters based on the entire list. If any item in the list is
+// exactly equal to one of the configured values, it returns true. Substrings
+// never match.
+type ItemFilterExact struct {
+	values map[string]struct{}
+}
+
+// NewItemFilterExact creates a new filter that matches any of the given values
+// exactly. Empty values are ignored.
+func NewItemFilterExact(values []string) *ItemFilterExact {
+	m := make(map[string]struct{}, len(values))
+	for _, v := range values {
+		if v != "" {
+			m[v] = struct{}{}
+		}
+	}
+	return &ItemFilterExact{values: m}
+}
+
+func (f *ItemFilterExact) Name() string {
+	values := make([]string, 0, len(f.values))
+	for v := range f.values {
+		values = append(values, v)
+	}
+	sort.Strings(values)
+	return fmt.Sprintf("exact(%s)", strings.Join(values, ", "))
+}
+
+func (f *ItemFilterExact) Matches(tags []string) bool {
+	for _, t := range tags {
+		if _, ok := f.values[t]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// BuildSemverFilter builds a filter from the given semantic version
+// constraint. A constraint is one or more comma-separated comparisons that must
+// all hold, for example ">= 2.0.0" or ">= 1.0.0, < 2.0.0". Supported operators
+// are "<", "<=", ">", ">=", "=", and "!=". If the constraint is empty, it
+// returns the null filter.
+func BuildSemverFilter(constraint string) (ItemFilter, error) {
+	if strings.TrimSpace(constraint) == "" {
+		return &ItemFilterNull{}, nil
+	}
+
+	var comparisons []*semverComparison
+	for _, part := range strings.Split(constraint, ",") {
+		part = strings.TrimSpace(part)
+
+		op := ""
+		for _, candidate := range []string{"<=", ">=", "!=", "==", "<", ">", "="} {
+			if strings.HasPrefix(part, candidate) {
+				op = candidate
+				break
+			}
+		}
+		if op == "" {
+			return nil, fmt.Errorf("failed to parse semver constraint %q: missing operator", part)
+		}
+
+		v, ok := parseSemver(strings.TrimSpace(strings.TrimPrefix(part, op)))
+		if !ok {
+			return nil, fmt.Errorf("failed to parse semver constraint %q: invalid version", part)
+		}
+
+		if op == "==" {
+			op = "="
+		}
+		comparisons = append(comparisons, &semverComparison{op: op, version: v})
+	}
+
+	return &ItemFilterSemver{
+		constraint:  constraint,
+		comparisons: comparisons,
+	}, nil
+}
+
+var _ ItemFilter = (*ItemFilterSemver)(nil)
+
+// ItemFilterSemver filters based on the entire list. If any item in the list
+// is a semantic version that satisfies all comparisons, it returns true. Items
+// that are not semantic versions never match.
+type ItemFilterSemver struct {
+	constraint  string
+	comparisons []*semverComparison
+}
+
+func (f *ItemFilterSemver) Name() string {
+	return fmt.Sprintf("semver(%s)", f.constraint)
+}
+
+func (f *ItemFilterSemver) Matches(tags []string) bool {
+	if len(f.comparisons) == 0 {
+		return false
+	}
+
+	for _, t := range tags {
+		v, ok := parseSemver(t)
+		if !ok {
+			continue
+		}
+
+		matches := true
+		for _, c := range f.comparisons {
+			if !c.matches(v) {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return true
+		}
+	}
+	return false
+}
+
+// semverComparison is a single comparison in a semver constraint.
+type semverComparison struct {
+	op      string
+	version *semver
+}
+
+func (c *semverComparison) matches(v *semver) bool {
+	cmp := v.compare(c.version)
+	switch c.op {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	case "=":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	default:
+		return false
+	}
+}
+
+// semver is a parsed semantic version. Build metadata is discarded because it
+// does not participate in precedence.
+type semver struct {
+	major, minor, patch uint64
+	prerelease          []string
+}
+
+// parseSemver parses the given string as a semantic version according to
+// https://semver.org. A leading "v" is permitted since it is a common tag
+// convention. It returns false if the string is not a valid version.
+func parseSemver(s string) (*semver, bool) {
+	s = strings.TrimPrefix(s, "v")
+
+	if i := strings.Index(s, "+"); i >= 0 {
+		build := s[i+1:]
+		s = s[:i]
+		if !validSemverIdentifiers(build, false) {
+			return nil, false
+		}
+	}
+
+	var prerelease []string
+	if i := strings.Index(s, "-"); i >= 0 {
+		pre := s[i+1:]
+		s = s[:i]
+		if !validSemverIdentifiers(pre, true) {
+			return nil, false
+		}
+		prerelease = strings.Split(pre, ".")
+	}
+
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 {
+		return nil, false
+	}
+
+	var nums [3]uint64
+	for i, part := range parts {
+		if !isSemverNumeric(part) {
+			return nil, false
+		}
+		n, err := strconv.ParseUint(part, 10, 64)
+		if err != nil {
+			return nil, false
+		}
+		nums[i] = n
+	}
+
+	return &semver{
+		major:      nums[0],
+		minor:      nums[1],
+		patch:      nums[2],
+		prerelease: prerelease,
+	}, true
+}
+
+// highestSemverDigests returns the digests of the manifests with the n highest
+// tags that are semantic versions, ordered by precedence. Tags that are not
+// semantic versions are ignored. Tags with equal precedence are ordered by
+// name, so the result is the same on every run.
+func highestSemverDigests(manifests []*manifest, n int) map[string]struct{} {
+	type versionedTag struct {
+		tag     string
+		version *semver
+		digest  string
+	}
+
+	var tags []*versionedTag
+	for _, m := range manifests {
+		for _, tag := range m.Info.Tags {
+			if v, ok := parseSemver(tag); ok {
+				tags = append(tags, &versionedTag{tag: tag, version: v, digest: m.Digest})
+			}
+		}
+	}
+
+	sort.Slice(tags, func(i, j int) bool {
+		if cmp := tags[i].version.compare(tags[j].version); cmp != 0 {
+			return cmp > 0
+		}
+		return tags[i].tag < tags[j].tag
+	})
+
+	if len(tags) > n {
+		tags = tags[:n]
+	}
+	digests := make(map[string]struct{}, len(tags))
+	for _, t := range tags {
+		digests[t.digest] = struct{}{}
+	}
+	return digests
+}
+
+// compare returns -1, 0, or 1 if v has lower, equal, or higher precedence than
+// other.
+func (v *semver) compare(other *semver) int {
+	for _, pair := range [][2]uint64{
+		{v.major, other.major},
+		{v.minor, other.minor},
+		{v.patch, other.patch},
+	} {
+		if pair[0] != pair[1] {
+			if pair[0] < pair[1] {
+				return -1
+			}
+			return 1
+		}
+	}
+
+	// A version without a prerelease has higher precedence than one with.
+	switch {
+	case len(v.prerelease) == 0 && len(other.prerelease) == 0:
+		return 0
+	case len(v.prerelease) == 0:
+		return 1
+	case len(other.prerelease) == 0:
+		return -1
+	}
+
+	for i := 0; i < len(v.prerelease) && i < len(other.prerelease); i++ {
+		if cmp := compareSemverIdentifier(v.prerelease[i], other.prerelease[i]); cmp != 0 {
+			return cmp
+		}
+	}
+
+	switch {
+	case len(v.prerelease) < len(other.prerelease):
+		return -1
+	case len(v.prerelease) > len(other.prerelease):
+		return 1
+	default:
+		return 0
+	}
+}
+
+// compareSemverIdentifier compares two prerelease identifiers. Numeric
+// identifiers are compared numerically and always have lower precedence than
+// alphanumeric identifiers, which are compared lexically.
+func compareSemverIdentifier(a, b string) int {
+	aNum, bNum := isSemverNumeric(a), isSemverNumeric(b)
+	switch {
+	case aNum && bNum:
+		if len(a) != len(b) {
+			if len(a) < len(b) {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(a, b)
+	case aNum:
+		return -1
+	case bNum:
+		return 1
+	default:
+		return strings.Compare(a, b)
+	}
+}
+
+// isSemverNumeric returns true if s is a numeric identifier without leading
+// zeros.
+func isSemverNumeric(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return s == "0" || s[0] != '0'
+}
+
+// validSemverIdentifiers returns true if s is a valid dot-separated list of
+// prerelease or build identifiers. Numeric prerelease identifiers must not have
+// leading zeros.
+func validSemverIdentifiers(s string, prerelease bool) bool {
+	if s == "" {
+		return false
+	}
+	for _, ident := range strings.Split(s, ".") {
+		if ident == "" {
+			return false
+		}
+
+		numeric := true
+		for _, r := range ident {
+			switch {
+			case r >= '0' && r <= '9':
+			case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '-':
+				numeric = false
+			default:
+				return false
+			}
+		}
+		if prerelease && numeric && !isSemverNumeric(ident) {
+			return false
+		}
+	}
+	return true
+}
+
+// BuildNumberRangeFilter builds a filter that extracts an integer from each item
+// using the first capture group of the regular expression pattern, such as
+// "^build-(\d+)$", and compares it against the inclusive range [min, max].
+// Either bound may be nil, but not both. If the pattern is empty, it returns the
+// null filter.
+func BuildNumberRangeFilter(pattern string, min, max *int64) (ItemFilter, error) {
+	if pattern == "" {
+		if min != nil || max != nil {
+			return nil, fmt.Errorf("a pattern is required with min or max")
+		}
+		return &ItemFilterNull{}, nil
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile number pattern: %w", err)
+	}
+	if re.NumSubexp() < 1 {
+		return nil, fmt.Errorf("number pattern %q must have a capture group", pattern)
+	}
+
+	if min == nil && max == nil {
+		return nil, fmt.Errorf("at least one of min or max is required")
+	}
+	if min != nil && max != nil && *min > *max {
+		return nil, fmt.Errorf("min %d is greater than max %d", *min, *max)
+	}
+
+	return &ItemFilterNumberRange{
+		re:  re,
+		min: min,
+		max: max,
+	}, nil
+}
+
+var _ ItemFilter = (*ItemFilterNumberRange)(nil)
+
+// ItemFilterNumberRange filters based on the entire list. If any item in the
+// list matches the pattern and its captured number is within the range, it
+// returns true. Items that do not match or do not capture an integer never
+// match.
+type ItemFilterNumberRange struct {
+	re       *regexp.Regexp
+	min, max *int64
+}
+
+func (f *ItemFilterNumberRange) Name() string {
+	bounds := make([]string, 0, 2)
+	if f.min != nil {
+		bounds = append(bounds, fmt.Sprintf(">= %d", *f.min))
+	}
+	if f.max != nil {
+		bounds = append(bounds, fmt.Sprintf("<= %d", *f.max))
+	}
+	return fmt.Sprintf("number(%s, %s)", f.re.String(), strings.Join(bounds, ", "))
+}
+
+func (f *ItemFilterNumberRange) Matches(tags []string) bool {
+	for _, t := range tags {
+		m := f.re.FindStringSubmatch(t)
+		if len(m) < 2 {
+			continue
+		}
+
+		n, err := strconv.ParseInt(m[1], 10, 64)
+		if err != nil {
+			continue
+		}
+
+		if f.min != nil && n < *f.min {
+			continue
+		}
+		if f.max != nil && n > *f.max {
+			continue
+		}
+		return true
+	}
+	return false
+}
@@ -15,12 +15,15 @@
 package gcrcleaner
 
 import (
+	"fmt"
 	"os"
 	"reflect"
 	"regexp"
+	"strings"
 	"testing"
 	"time"
 
+	gcrname "github.com/google/go-containerregistry/pkg/name"
 	gcrgoogle "github.com/google/go-containerregistry/pkg/v1/google"
 )
 
@@ -28,10 +31,10 @@ func TestBuildTagFilter(t *testing.T) {
 	t.Parallel()
 
 	cases := []struct {
-		name     string
-		any, all string
-		err      bool
-		exp      reflect.Type
+		name           string
+		any, all, none string
+		err            bool
+		exp            reflect.Type
 	}{
 		{
 			name: "empty",
@@ -57,6 +60,23 @@ func TestBuildTagFilter(t *testing.T) {
 			all:  "a",
 			exp:  reflect.TypeOf(&ItemFilterAll{}),
 		},
+		{
+			name: "none",
+			none: "a",
+			exp:  reflect.TypeOf(&ItemFilterNone{}),
+		},
+		{
+			name: "any_none",
+			any:  "b",
+			none: "c",
+			err:  true,
+		},
+		{
+			name: "all_none",
+			all:  "b",
+			none: "c",
+			err:  true,
+		},
 	}
 
 	for _, tc := range cases {
@@ -65,7 +85,7 @@ func TestBuildTagFilter(t *testing.T) {
 		t.Run(tc.name, func(t *testing.T) {
 			t.Parallel()
 
-			f, err := BuildItemFilter(tc.any, tc.all)
+			f, err := BuildItemFilter(tc.any, tc.all, WithNone(tc.none))
 			if (err != nil) != tc.err {
 				t.Fatal(err)
 			}
@@ -76,45 +96,287 @@ func TestBuildTagFilter(t *testing.T) {
 	}
 }
 
+func TestBuildItemFilterAny(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name     string
+		patterns []string
+		err      bool
+		exp      string
+	}{
+		{
+			name: "nil",
+			exp:  "(none)",
+		},
+		{
+			name:     "empty_patterns",
+			patterns: []string{"", ""},
+			exp:      "(none)",
+		},
+		{
+			name:     "single",
+			patterns: []string{"^pr-"},
+			exp:      "any(^pr-)",
+		},
+		{
+			name:     "multiple",
+			patterns: []string{"^pr-", "", "^tmp-"},
+			exp:      "any(^pr-, ^tmp-)",
+		},
+		{
+			name:     "invalid",
+			patterns: []string{"^pr-", "("},
+			err:      true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			f, err := BuildItemFilterAny(tc.patterns)
+			if (err != nil) != tc.err {
+				t.Fatal(err)
+			}
+			if err != nil {
+				return
+			}
+			if got, want := f.Name(), tc.exp; got != want {
+				t.Errorf("expected %q to be %q", got, want)
+			}
+		})
+	}
+}
+
+func TestBuildItemFilter_Glob(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name       string
+		pattern    string
+		matchSlash bool
+		input      string
+		exp        bool
+	}{
+		{
+			name:    "star",
+			pattern: "release-*",
+			input:   "release-1.2.3",
+			exp:     true,
+		},
+		{
+			name:    "star_anchored",
+			pattern: "release-*",
+			input:   "pre-release-1.2.3",
+			exp:     false,
+		},
+		{
+			name:    "question",
+			pattern: "v1.2.?",
+			input:   "v1.2.3",
+			exp:     true,
+		},
+		{
+			name:    "question_literal_dot",
+			pattern: "v1.2.?",
+			input:   "v1x2x3",
+			exp:     false,
+		},
+		{
+			name:    "class",
+			pattern: "v[0-9]",
+			input:   "v7",
+			exp:     true,
+		},
+		{
+			name:    "negated_class",
+			pattern: "v[!0-9]",
+			input:   "v7",
+			exp:     false,
+		},
+		{
+			name:    "escape",
+			pattern: `tag\*`,
+			input:   "tag*",
+			exp:     true,
+		},
+		{
+			name:    "star_no_slash",
+			pattern: "gcr.io/project/*",
+			input:   "gcr.io/project/team/app",
+			exp:     false,
+		},
+		{
+			name:       "star_slash",
+			pattern:    "gcr.io/project/*",
+			matchSlash: true,
+			input:      "gcr.io/project/team/app",
+			exp:        true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			f, err := BuildItemFilter(tc.pattern, "",
+				WithPatternKind(PatternKindGlob),
+				WithGlobMatchSlash(tc.matchSlash))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := f.Matches([]string{tc.input}), tc.exp; got != want {
+				t.Errorf("expected %q matches %q to be %t", f.Name(), tc.input, want)
+			}
+		})
+	}
+}
+
+func TestBuildItemFilter_GlobInvalid(t *testing.T) {
+	t.Parallel()
+
+	for _, pattern := range []string{`tag\`, "tag[abc"} {
+		if _, err := BuildItemFilter(pattern, "", WithPatternKind(PatternKindGlob)); err == nil {
+			t.Errorf("expected error for %q", pattern)
+		}
+	}
+
+	if _, err := BuildItemFilter("a", "", WithPatternKind("nope")); err == nil {
+		t.Errorf("expected error for unknown pattern kind")
+	}
+}
+
+func TestBuildItemFilter_CaseInsensitive(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name    string
+		any     string
+		all     string
+		kind    PatternKind
+		enabled bool
+		tags    []string
+		exp     bool
+	}{
+		{
+			name: "disabled",
+			any:  "^release$",
+			tags: []string{"RELEASE"},
+			exp:  false,
+		},
+		{
+			name:    "any",
+			any:     "^release$",
+			enabled: true,
+			tags:    []string{"Release"},
+			exp:     true,
+		},
+		{
+			name:    "all",
+			all:     "^release-",
+			enabled: true,
+			tags:    []string{"Release-1", "RELEASE-2"},
+			exp:     true,
+		},
+		{
+			name:    "glob",
+			any:     "release-*",
+			kind:    PatternKindGlob,
+			enabled: true,
+			tags:    []string{"RELEASE-1"},
+			exp:     true,
+		},
+		{
+			name:    "inline_flag",
+			any:     "(?s)^release.$",
+			enabled: true,
+			tags:    []string{"RELEASE\n"},
+			exp:     true,
+		},
+		{
+			name:    "inline_override",
+			any:     "(?-i)^release$",
+			enabled: true,
+			tags:    []string{"RELEASE"},
+			exp:     false,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			f, err := BuildItemFilter(tc.any, tc.all,
+				WithPatternKind(tc.kind),
+				WithCaseInsensitive(tc.enabled))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := f.Matches(tc.tags), tc.exp; got != want {
+				t.Errorf("expected %q matches %q to be %t", f.Name(), tc.tags, want)
+			}
+		})
+	}
+}
+
 func TestTagFilterAny_Matches(t *testing.T) {
 	t.Parallel()
 
 	cases := []struct {
 		name string
-		re   *regexp.Regexp
+		res  []*regexp.Regexp
 		tags []string
 		exp  bool
 	}{
 		{
 			name: "empty_re",
-			re:   nil,
+			res:  nil,
 			tags: nil,
 			exp:  false,
 		},
 		{
 			name: "empty_tags",
-			re:   regexp.MustCompile(`.*`),
+			res:  []*regexp.Regexp{regexp.MustCompile(`.*`)},
 			tags: nil,
 			exp:  false,
 		},
 		{
 			name: "matches_first",
-			re:   regexp.MustCompile(`^tag1$`),
+			res:  []*regexp.Regexp{regexp.MustCompile(`^tag1$`)},
 			tags: []string{"tag1", "tag2", "tag3"},
 			exp:  true,
 		},
 		{
 			name: "matches_middle",
-			re:   regexp.MustCompile(`^tag2$`),
+			res:  []*regexp.Regexp{regexp.MustCompile(`^tag2$`)},
 			tags: []string{"tag1", "tag2", "tag3"},
 			exp:  true,
 		},
 		{
 			name: "matches_end",
-			re:   regexp.MustCompile(`^tag3$`),
+			res:  []*regexp.Regexp{regexp.MustCompile(`^tag3$`)},
 			tags: []string{"tag1", "tag2", "tag3"},
 			exp:  true,
 		},
+		{
+			name: "matches_second_re",
+			res:  []*regexp.Regexp{regexp.MustCompile(`^pr-`), regexp.MustCompile(`^tmp-`)},
+			tags: []string{"latest", "tmp-1"},
+			exp:  true,
+		},
+		{
+			name: "matches_no_re",
+			res:  []*regexp.Regexp{regexp.MustCompile(`^pr-`), regexp.MustCompile(`^tmp-`)},
+			tags: []string{"latest", "v1"},
+			exp:  false,
+		},
 	}
 
 	for _, tc := range cases {
@@ -123,9 +385,9 @@ func TestTagFilterAny_Matches(t *testing.T) {
 		t.Run(tc.name, func(t *testing.T) {
 			t.Parallel()
 
-			f := &ItemFilterAny{re: tc.re}
+			f := &ItemFilterAny{res: tc.res}
 			if got, want := f.Matches(tc.tags), tc.exp; got != want {
-				t.Errorf("expected %q matches %q to be %t", tc.re, tc.tags, want)
+				t.Errorf("expected %q matches %q to be %t", tc.res, tc.tags, want)
 			}
 		})
 	}
@@ -135,10 +397,11 @@ func TestTagFilterAll_Matches(t *testing.T) {
 	t.Parallel()
 
 	cases := []struct {
-		name string
-		re   *regexp.Regexp
-		tags []string
-		exp  bool
+		name       string
+		re         *regexp.Regexp
+		matchEmpty bool
+		tags       []string
+		exp        bool
 	}{
 		{
 			name: "empty_re",
@@ -150,7 +413,21 @@ func TestTagFilterAll_Matches(t *testing.T) {
 			name: "empty_tags",
 			re:   regexp.MustCompile(`.*`),
 			tags: nil,
-			exp:  true,
+			exp:  false,
+		},
+		{
+			name:       "empty_tags_match_empty",
+			re:         regexp.MustCompile(`.*`),
+			matchEmpty: true,
+			tags:       nil,
+			exp:        true,
+		},
+		{
+			name:       "empty_re_match_empty",
+			re:         nil,
+			matchEmpty: true,
+			tags:       nil,
+			exp:        false,
 		},
 		{
 			name: "matches_one",
@@ -178,7 +455,7 @@ func TestTagFilterAll_Matches(t *testing.T) {
 		t.Run(tc.name, func(t *testing.T) {
 			t.Parallel()
 
-			f := &ItemFilterAll{re: tc.re}
+			f := &ItemFilterAll{re: tc.re, matchEmpty: tc.matchEmpty}
 			if got, want := f.Matches(tc.tags), tc.exp; got != want {
 				t.Errorf("expected %q matches %q to be %t", tc.re, tc.tags, want)
 			}
@@ -186,263 +463,1860 @@ func TestTagFilterAll_Matches(t *testing.T) {
 	}
 }
 
-func TestRepoSkipFilter_Matches(t *testing.T) {
+func TestBuildItemFilter_AllMatchEmpty(t *testing.T) {
 	t.Parallel()
-	repoPattern := "^sample-repo-name.*"
 
-	// Create the filter using the BuildItemFilter function
-	repoSkipFilter, err := BuildItemFilter(repoPattern, "")
-	if err != nil {
-		t.Fatalf("Error creating repoSkipFilter: %s", err)
+	for _, matchEmpty := range []bool{false, true} {
+		f, err := BuildItemFilter("", ".*", WithAllMatchEmpty(matchEmpty))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := f.Matches(nil), matchEmpty; got != want {
+			t.Errorf("expected %q matches empty list to be %t", f.Name(), want)
+		}
 	}
+}
 
-	// Verify that the filter is of the expected type (ItemFilter)
-	filter, ok := repoSkipFilter.(ItemFilter)
-	if !ok {
-		t.Fatalf("Expected repoSkipFilter to be an ItemFilter")
-	}
+func TestTagFilterNone_Matches(t *testing.T) {
+	t.Parallel()
 
 	cases := []struct {
-		name     string
-		input    []string
-		expected bool
+		name string
+		re   *regexp.Regexp
+		tags []string
+		exp  bool
 	}{
 		{
-			name:     "Matches with exact repo name",
-			input:    []string{"sample-repo-name"},
-			expected: true,
+			name: "empty_re",
+			re:   nil,
+			tags: []string{"tag1"},
+			exp:  false,
 		},
 		{
-			name:     "Matches with repo name and additional characters",
-			input:    []string{"sample-repo-name-extra"},
-			expected: true,
+			name: "empty_tags",
+			re:   regexp.MustCompile(`.*`),
+			tags: nil,
+			exp:  false,
 		},
 		{
-			name:     "Does not match with a different repo name",
-			input:    []string{"another-repo-name"},
-			expected: false,
+			name: "matches_none",
+			re:   regexp.MustCompile(`^keep-`),
+			tags: []string{"tag1", "tag2"},
+			exp:  true,
 		},
 		{
-			name:     "Does not match with empty input",
-			input:    []string{""},
-			expected: false,
+			name: "matches_one",
+			re:   regexp.MustCompile(`^keep-`),
+			tags: []string{"tag1", "keep-tag2"},
+			exp:  false,
 		},
 	}
 
-	for _, test := range cases {
-		t.Run(test.name, func(t *testing.T) {
-			actual := filter.Matches(test.input)
-			if actual != test.expected {
-				t.Errorf("Expected Matches(%v) to be %t, but got %t", test.input, test.expected, actual)
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			f := &ItemFilterNone{re: tc.re}
+			if got, want := f.Matches(tc.tags), tc.exp; got != want {
+				t.Errorf("expected %q matches %q to be %t", tc.re, tc.tags, want)
 			}
 		})
 	}
-}
 
-type mockManifest struct {
-	Repo   string
-	Digest string
-	Info   gcrgoogle.ManifestInfo
-}
+	t.Run("nil_re_name", func(t *testing.T) {
+		t.Parallel()
 
-type mockFilter struct {
-	str   string
-	Items []string
+		f := &ItemFilterNone{}
+		if got, want := f.Name(), "none(<nil>)"; got != want {
+			t.Errorf("expected name %q to be %q", got, want)
+		}
+	})
 }
 
-func (f mockFilter) Name() string {
-	return "mockFilter"
-}
+func TestItemFilterAnd_Matches(t *testing.T) {
+	t.Parallel()
 
-func (f mockFilter) Matches(items []string) bool {
-	return false
-}
+	cases := []struct {
+		name    string
+		filters []ItemFilter
+		tags    []string
+		exp     bool
+	}{
+		{
+			name:    "empty_filters",
+			filters: nil,
+			tags:    []string{"ci-1-temp"},
+			exp:     false,
+		},
+		{
+			name: "all_match",
+			filters: []ItemFilter{
+				&ItemFilterAll{re: regexp.MustCompile(`^ci-`)},
+				&ItemFilterAny{res: []*regexp.Regexp{regexp.MustCompile(`-temp$`)}},
+			},
+			tags: []string{"ci-1", "ci-1-temp"},
+			exp:  true,
+		},
+		{
+			name: "one_does_not_match",
+			filters: []ItemFilter{
+				&ItemFilterAll{re: regexp.MustCompile(`^ci-`)},
+				&ItemFilterAny{res: []*regexp.Regexp{regexp.MustCompile(`-temp$`)}},
+			},
+			tags: []string{"ci-1", "ci-2"},
+			exp:  false,
+		},
+	}
 
-type mockPodFilter struct{}
+	for _, tc := range cases {
+		tc := tc
 
-func (f mockPodFilter) Name() string {
-	return "mockPodFilter"
-}
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
 
-func (f mockPodFilter) Matches(repo string, digest string, items []string) bool {
-	return false
+			f := NewItemFilterAnd(tc.filters...)
+			if got, want := f.Matches(tc.tags), tc.exp; got != want {
+				t.Errorf("expected %q matches %q to be %t", f.Name(), tc.tags, want)
+			}
+		})
+	}
 }
 
-func (f mockPodFilter) Add(item string) error {
-	return nil
-}
+func TestItemFilterOr_Matches(t *testing.T) {
+	t.Parallel()
 
-func TestShouldDelete(t *testing.T) {
-	since := time.Date(2023, time.November, 1, 0, 0, 0, 0, time.UTC)
+	f := NewItemFilterOr(
+		&ItemFilterAny{res: []*regexp.Regexp{regexp.MustCompile(`^main$`)}},
+		NewItemFilterExact([]string{"release"}),
+	)
 
-	tests := []struct {
-		description      string
-		manifest         manifest
+	cases := []struct {
+		tags []string
+		exp  bool
+	}{
+		{tags: nil, exp: false},
+		{tags: []string{"main"}, exp: true},
+		{tags: []string{"release"}, exp: true},
+		{tags: []string{"other"}, exp: false},
+	}
+
+	for _, tc := range cases {
+		if got, want := f.Matches(tc.tags), tc.exp; got != want {
+			t.Errorf("expected %q matches %q to be %t", f.Name(), tc.tags, want)
+		}
+	}
+}
+
+func TestItemFilterExact_Matches(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name   string
+		values []string
+		tags   []string
+		exp    bool
+	}{
+		{
+			name:   "empty_values",
+			values: nil,
+			tags:   []string{"v1"},
+			exp:    false,
+		},
+		{
+			name:   "empty_tags",
+			values: []string{"v1"},
+			tags:   nil,
+			exp:    false,
+		},
+		{
+			name:   "exact",
+			values: []string{"v1", "latest"},
+			tags:   []string{"other", "latest"},
+			exp:    true,
+		},
+		{
+			name:   "substring",
+			values: []string{"v1"},
+			tags:   []string{"v10", "xv1"},
+			exp:    false,
+		},
+		{
+			name:   "case_sensitive",
+			values: []string{"latest"},
+			tags:   []string{"LATEST"},
+			exp:    false,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			f := NewItemFilterExact(tc.values)
+			if got, want := f.Matches(tc.tags), tc.exp; got != want {
+				t.Errorf("expected %q matches %q to be %t", f.Name(), tc.tags, want)
+			}
+		})
+	}
+}
+
+func TestBuildSemverFilter(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name       string
+		constraint string
+		err        bool
+		exp        reflect.Type
+	}{
+		{
+			name:       "empty",
+			constraint: "",
+			exp:        reflect.TypeOf(&ItemFilterNull{}),
+		},
+		{
+			name:       "single",
+			constraint: ">= 2.0.0",
+			exp:        reflect.TypeOf(&ItemFilterSemver{}),
+		},
+		{
+			name:       "range",
+			constraint: ">= 1.0.0, < 2.0.0",
+			exp:        reflect.TypeOf(&ItemFilterSemver{}),
+		},
+		{
+			name:       "missing_operator",
+			constraint: "1.0.0",
+			err:        true,
+		},
+		{
+			name:       "invalid_version",
+			constraint: "< 1.0",
+			err:        true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			f, err := BuildSemverFilter(tc.constraint)
+			if (err != nil) != tc.err {
+				t.Fatal(err)
+			}
+			if got, want := reflect.TypeOf(f), tc.exp; got != want {
+				t.Errorf("expected %v to be %v", got, want)
+			}
+		})
+	}
+}
+
+func TestItemFilterSemver_Matches(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name       string
+		constraint string
+		tags       []string
+		exp        bool
+	}{
+		{
+			name:       "empty_tags",
+			constraint: "< 1.0.0",
+			tags:       nil,
+			exp:        false,
+		},
+		{
+			name:       "not_semver",
+			constraint: "< 1.0.0",
+			tags:       []string{"latest", "1.0", "01.0.0"},
+			exp:        false,
+		},
+		{
+			name:       "less_than",
+			constraint: "< 1.0.0",
+			tags:       []string{"latest", "0.9.12"},
+			exp:        true,
+		},
+		{
+			name:       "v_prefix",
+			constraint: ">= 2.0.0",
+			tags:       []string{"v2.1.0"},
+			exp:        true,
+		},
+		{
+			name:       "range_outside",
+			constraint: ">= 1.0.0, < 2.0.0",
+			tags:       []string{"2.0.0", "0.1.0"},
+			exp:        false,
+		},
+		{
+			name:       "range_inside",
+			constraint: ">= 1.0.0, < 2.0.0",
+			tags:       []string{"2.0.0", "1.9.9"},
+			exp:        true,
+		},
+		{
+			name:       "prerelease_lower_than_release",
+			constraint: "< 1.0.0",
+			tags:       []string{"1.0.0-rc.1"},
+			exp:        true,
+		},
+		{
+			name:       "prerelease_numeric_ordering",
+			constraint: "> 1.0.0-alpha.2",
+			tags:       []string{"1.0.0-alpha.10"},
+			exp:        true,
+		},
+		{
+			name:       "prerelease_numeric_lower_than_alpha",
+			constraint: "< 1.0.0-alpha.beta",
+			tags:       []string{"1.0.0-alpha.1"},
+			exp:        true,
+		},
+		{
+			name:       "prerelease_shorter_lower",
+			constraint: "< 1.0.0-alpha.1",
+			tags:       []string{"1.0.0-alpha"},
+			exp:        true,
+		},
+		{
+			name:       "build_metadata_ignored",
+			constraint: "= 1.0.0",
+			tags:       []string{"1.0.0+build.5"},
+			exp:        true,
+		},
+		{
+			name:       "not_equal",
+			constraint: "!= 1.0.0",
+			tags:       []string{"1.0.0"},
+			exp:        false,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			f, err := BuildSemverFilter(tc.constraint)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := f.Matches(tc.tags), tc.exp; got != want {
+				t.Errorf("expected %q matches %q to be %t", f.Name(), tc.tags, want)
+			}
+		})
+	}
+}
+
+func TestBuildNumberRangeFilter(t *testing.T) {
+	t.Parallel()
+
+	min, max := int64(10), int64(5)
+
+	cases := []struct {
+		name    string
+		pattern string
+		min     *int64
+		max     *int64
+		err     bool
+		exp     reflect.Type
+	}{
+		{
+			name: "empty",
+			exp:  reflect.TypeOf(&ItemFilterNull{}),
+		},
+		{
+			name:    "min",
+			pattern: `^build-(\d+)$`,
+			min:     &min,
+			exp:     reflect.TypeOf(&ItemFilterNumberRange{}),
+		},
+		{
+			name: "bounds_without_pattern",
+			max:  &max,
+			err:  true,
+		},
+		{
+			name:    "no_bounds",
+			pattern: `^build-(\d+)$`,
+			err:     true,
+		},
+		{
+			name:    "no_capture_group",
+			pattern: `^build-\d+$`,
+			max:     &max,
+			err:     true,
+		},
+		{
+			name:    "invalid_pattern",
+			pattern: `(`,
+			max:     &max,
+			err:     true,
+		},
+		{
+			name:    "min_greater_than_max",
+			pattern: `^build-(\d+)$`,
+			min:     &min,
+			max:     &max,
+			err:     true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			f, err := BuildNumberRangeFilter(tc.pattern, tc.min, tc.max)
+			if (err != nil) != tc.err {
+				t.Fatal(err)
+			}
+			if got, want := reflect.TypeOf(f), tc.exp; got != want {
+				t.Errorf("expected %v to be %v", got, want)
+			}
+		})
+	}
+}
+
+func TestItemFilterNumberRange_Matches(t *testing.T) {
+	t.Parallel()
+
+	min, max := int64(100), int64(999)
+
+	cases := []struct {
+		name string
+		min  *int64
+		max  *int64
+		tags []string
+		exp  bool
+	}{
+		{
+			name: "empty_tags",
+			max:  &max,
+			tags: nil,
+			exp:  false,
+		},
+		{
+			name: "not_matching",
+			max:  &max,
+			tags: []string{"latest", "build-", "build-abc", "pr-12"},
+			exp:  false,
+		},
+		{
+			name: "below_max",
+			max:  &max,
+			tags: []string{"latest", "build-12"},
+			exp:  true,
+		},
+		{
+			name: "max_inclusive",
+			max:  &max,
+			tags: []string{"build-999"},
+			exp:  true,
+		},
+		{
+			name: "above_max",
+			max:  &max,
+			tags: []string{"build-1000"},
+			exp:  false,
+		},
+		{
+			name: "range_inside",
+			min:  &min,
+			max:  &max,
+			tags: []string{"build-1", "build-500"},
+			exp:  true,
+		},
+		{
+			name: "range_outside",
+			min:  &min,
+			max:  &max,
+			tags: []string{"build-1", "build-5000"},
+			exp:  false,
+		},
+		{
+			name: "overflow",
+			min:  &min,
+			tags: []string{"build-99999999999999999999"},
+			exp:  false,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			f, err := BuildNumberRangeFilter(`^build-(\d+)$`, tc.min, tc.max)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := f.Matches(tc.tags), tc.exp; got != want {
+				t.Errorf("expected %t to be %t", got, want)
+			}
+		})
+	}
+}
+
+func TestItemFilterNumberRange_Name(t *testing.T) {
+	t.Parallel()
+
+	min, max := int64(1), int64(999)
+	f, err := BuildNumberRangeFilter(`^build-(\d+)$`, &min, &max)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := f.Name(), `number(^build-(\d+)$, >= 1, <= 999)`; got != want {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+}
+
+func TestRepoSkipFilter_Matches(t *testing.T) {
+	t.Parallel()
+	repoPattern := "^sample-repo-name.*"
+
+	// Create the filter using the BuildItemFilter function
+	repoSkipFilter, err := BuildItemFilter(repoPattern, "")
+	if err != nil {
+		t.Fatalf("Error creating repoSkipFilter: %s", err)
+	}
+
+	// Verify that the filter is of the expected type (ItemFilter)
+	filter, ok := repoSkipFilter.(ItemFilter)
+	if !ok {
+		t.Fatalf("Expected repoSkipFilter to be an ItemFilter")
+	}
+
+	cases := []struct {
+		name     string
+		input    []string
+		expected bool
+	}{
+		{
+			name:     "Matches with exact repo name",
+			input:    []string{"sample-repo-name"},
+			expected: true,
+		},
+		{
+			name:     "Matches with repo name and additional characters",
+			input:    []string{"sample-repo-name-extra"},
+			expected: true,
+		},
+		{
+			name:     "Does not match with a different repo name",
+			input:    []string{"another-repo-name"},
+			expected: false,
+		},
+		{
+			name:     "Does not match with empty input",
+			input:    []string{""},
+			expected: false,
+		},
+	}
+
+	for _, test := range cases {
+		t.Run(test.name, func(t *testing.T) {
+			actual := filter.Matches(test.input)
+			if actual != test.expected {
+				t.Errorf("Expected Matches(%v) to be %t, but got %t", test.input, test.expected, actual)
+			}
+		})
+	}
+}
+
+type mockManifest struct {
+	Repo   string
+	Digest string
+	Info   gcrgoogle.ManifestInfo
+}
+
+type mockFilter struct {
+	str   string
+	Items []string
+}
+
+func (f mockFilter) Name() string {
+	return "mockFilter"
+}
+
+func (f mockFilter) Matches(items []string) bool {
+	return false
+}
+
+type mockPodFilter struct{}
+
+func (f mockPodFilter) Name() string {
+	return "mockPodFilter"
+}
+
+func (f mockPodFilter) Matches(repo string, digest string, items []string) bool {
+	return false
+}
+
+func (f mockPodFilter) Add(item string) error {
+	return nil
+}
+
+func TestShouldDelete(t *testing.T) {
+	since := time.Date(2023, time.November, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		description      string
+		manifest         manifest
 		expectedToDelete bool
+		expectedReason   string
+	}{
+		{
+			description: "Should delete when manifest is older with matching repo and tag filter",
+			manifest: manifest{
+				Repo:   "gcr.io/example/repo",
+				Digest: "digest1",
+				Info: gcrgoogle.ManifestInfo{
+					Created:  time.Date(2023, time.October, 1, 0, 0, 0, 0, time.UTC),
+					Uploaded: time.Date(2023, time.October, 10, 0, 0, 0, 0, time.UTC),
+					Tags:     []string{"delete-1"},
+				},
+			},
+			expectedToDelete: true,
+			expectedReason:   ReasonTagFilter + " any(delete.*)",
+		},
+		{
+			description: "Should not delete when manifest is too new",
+			manifest: manifest{
+				Repo:   "gcr.io/example/repo",
+				Digest: "digest2",
+				Info: gcrgoogle.ManifestInfo{
+					Created:  time.Date(2023, time.November, 5, 0, 0, 0, 0, time.UTC),
+					Uploaded: time.Date(2023, time.November, 16, 0, 0, 0, 0, time.UTC),
+					Tags:     []string{"main2"},
+				},
+			},
+			expectedToDelete: false,
+			expectedReason:   ReasonTooNew,
+		},
+		{
+
+			description: "Should not delete when manifest is too new with matching repo and tag filter",
+			manifest: manifest{
+				Repo:   "gcr.io/example/repo",
+				Digest: "digest3",
+				Info: gcrgoogle.ManifestInfo{
+					Created:  time.Date(2023, time.November, 5, 0, 0, 0, 0, time.UTC),
+					Uploaded: time.Date(2023, time.November, 16, 0, 0, 0, 0, time.UTC),
+					Tags:     []string{"main3"},
+				},
+			},
+			expectedToDelete: false,
+		},
+		{
+			description: "Should not delete when manifest is older but does not match repo filter",
+			manifest: manifest{
+				Repo:   "gcr.io/other-repo",
+				Digest: "digest4",
+				Info: gcrgoogle.ManifestInfo{
+					Created:  time.Date(2023, time.October, 1, 0, 0, 0, 0, time.UTC),
+					Uploaded: time.Date(2023, time.October, 10, 0, 0, 0, 0, time.UTC),
+					Tags:     []string{"main4"},
+				},
+			},
+			expectedToDelete: false,
+			expectedReason:   ReasonRepoKeep,
+		},
+		{
+			description: "Should delete when manifest is older and matches repo prefix filter",
+			manifest: manifest{
+				Repo:   "gcr.io/example/repo",
+				Digest: "digest5",
+				Info: gcrgoogle.ManifestInfo{
+					Created:  time.Date(2023, time.October, 1, 0, 0, 0, 0, time.UTC),
+					Uploaded: time.Date(2023, time.October, 10, 0, 0, 0, 0, time.UTC),
+					Tags:     []string{"other-tag"},
+				},
+			},
+			expectedToDelete: true,
+			expectedReason:   ReasonRepoMatch + " any(^gcr.io.example.*)",
+		},
+		{
+			description: "Should not delete when manifest is older but does not match repo or tag filter",
+			manifest: manifest{
+				Repo:   "gcr.io/other-repo",
+				Digest: "digest6",
+				Info: gcrgoogle.ManifestInfo{
+					Created:  time.Date(2023, time.October, 1, 0, 0, 0, 0, time.UTC),
+					Uploaded: time.Date(2023, time.October, 10, 0, 0, 0, 0, time.UTC),
+					Tags:     []string{"other-tag"},
+				},
+			},
+			expectedToDelete: false,
+		},
+		{
+			description: "Should delete when manifest is older with matching repo prefix and tag filter",
+			manifest: manifest{
+				Repo:   "gcr.io/example/repo",
+				Digest: "digest7",
+				Info: gcrgoogle.ManifestInfo{
+					Created:  time.Date(2023, time.October, 1, 0, 0, 0, 0, time.UTC),
+					Uploaded: time.Date(2023, time.October, 10, 0, 0, 0, 0, time.UTC),
+					Tags:     []string{"delete7"},
+				},
+			},
+			expectedToDelete: true,
+		},
+		{
+			description: "Should delete when manifest is older with matching repo and not tag keep filter",
+			manifest: manifest{
+				Repo:   "gcr.io/example/repo",
+				Digest: "digest8",
+				Info: gcrgoogle.ManifestInfo{
+					Created:  time.Date(2023, time.October, 1, 0, 0, 0, 0, time.UTC),
+					Uploaded: time.Date(2023, time.October, 10, 0, 0, 0, 0, time.UTC),
+					Tags:     []string{"delete8"},
+				},
+			},
+			expectedToDelete: true,
+		},
+		{
+			description: "Should not delete when manifest is older with matching repo and tag keep filter",
+			manifest: manifest{
+				Repo:   "gcr.io/example/repo",
+				Digest: "digest9",
+				Info: gcrgoogle.ManifestInfo{
+					Created:  time.Date(2023, time.October, 1, 0, 0, 0, 0, time.UTC),
+					Uploaded: time.Date(2023, time.October, 10, 0, 0, 0, 0, time.UTC),
+					Tags:     []string{"main9"},
+				},
+			},
+			expectedToDelete: false,
+			expectedReason:   ReasonTagKeep + " any(^main.*)",
+		},
+	}
+
+	repoPrefixFilter, err := BuildItemFilter(`^gcr.io.example.*`, "")
+	if err != nil {
+		t.Fatalf("Error creating repoPrefixFilter: %s", err)
+	}
+
+	tagFilter, err := BuildItemFilter("delete.*", "")
+	if err != nil {
+		t.Fatalf("Error creating tagFilter: %s", err)
+	}
+
+	repoSkipFilter, err := BuildItemFilter("other-repo", "")
+	if err != nil {
+		t.Fatalf("Error creating repoSkipFilter: %s", err)
+	}
+
+	tagKeepFilter, err := BuildItemFilter("^main.*", "")
+	if err != nil {
+		t.Fatalf("Error creating tagKeepFilter: %s", err)
+	}
+
+	mockPodFilter := mockPodFilter{}
+	var (
+		stdout = os.Stdout
+		stderr = os.Stderr
+	)
+
+	for _, test := range tests {
+		logger := NewLogger("debug", stderr, stdout)
+		cleaner := &Cleaner{
+			logger: logger,
+		} // Initialize your Cleaner instance here
+		actualToDelete, actualReason := cleaner.shouldDelete(&test.manifest, &CleanOptions{
+			Since:            since,
+			RepoKeepFilter:   repoSkipFilter,
+			RepoPrefixFilter: repoPrefixFilter,
+			TagFilter:        tagFilter,
+			TagKeepFilter:    tagKeepFilter,
+			PodFilter:        mockPodFilter,
+		})
+
+		if actualToDelete != test.expectedToDelete {
+			t.Errorf("%s: Expected deletion=%v, but got deletion=%v", test.description, test.expectedToDelete, actualToDelete)
+		}
+		if test.expectedReason != "" && actualReason != test.expectedReason {
+			t.Errorf("%s: Expected reason=%q, but got reason=%q", test.description, test.expectedReason, actualReason)
+		}
+	}
+}
+
+func TestShouldDelete_KeepDigests(t *testing.T) {
+	t.Parallel()
+
+	since := time.Date(2023, time.November, 1, 0, 0, 0, 0, time.UTC)
+	digest := "sha256:abcdef0123456789"
+
+	cases := []struct {
+		name        string
+		keepDigests []string
+		exp         bool
+	}{
+		{
+			name:        "empty",
+			keepDigests: nil,
+			exp:         true,
+		},
+		{
+			name:        "full",
+			keepDigests: []string{digest},
+			exp:         false,
+		},
+		{
+			name:        "prefix",
+			keepDigests: []string{"sha256:abcdef"},
+			exp:         false,
+		},
+		{
+			name:        "prefix_without_algorithm",
+			keepDigests: []string{"abcdef"},
+			exp:         false,
+		},
+		{
+			name:        "other",
+			keepDigests: []string{"sha256:fedcba"},
+			exp:         true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			cleaner := &Cleaner{
+				logger: NewLogger("error", os.Stderr, os.Stdout),
+			}
+
+			// An untagged manifest well outside the grace period would normally be
+			// deleted.
+			m := &manifest{
+				Repo:   "gcr.io/example/repo",
+				Digest: digest,
+				Info: gcrgoogle.ManifestInfo{
+					Uploaded: time.Date(2023, time.October, 10, 0, 0, 0, 0, time.UTC),
+				},
+			}
+
+			got, reason := cleaner.shouldDelete(m, &CleanOptions{
+				Since:            since,
+				RepoKeepFilter:   &ItemFilterNull{},
+				RepoPrefixFilter: &ItemFilterNull{},
+				TagFilter:        &ItemFilterNull{},
+				TagKeepFilter:    &ItemFilterNull{},
+				PodFilter:        mockPodFilter{},
+				KeepDigests:      tc.keepDigests,
+			})
+			if got != tc.exp {
+				t.Errorf("expected deletion=%t, got %t (%s)", tc.exp, got, reason)
+			}
+			if !tc.exp && reason != ReasonKeepDigest {
+				t.Errorf("expected reason %q, got %q", ReasonKeepDigest, reason)
+			}
+		})
+	}
+}
+
+func TestIsChildRepository(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name string
+		repo string
+		root string
+		exp  bool
+	}{
+		{
+			name: "registry_root",
+			repo: "us-docker.pkg.dev/my-project/my-repo/my-image",
+			root: "us-docker.pkg.dev",
+			exp:  true,
+		},
+		{
+			name: "project_root",
+			repo: "us-docker.pkg.dev/my-project/my-repo/my-image",
+			root: "us-docker.pkg.dev/my-project",
+			exp:  true,
+		},
+		{
+			name: "ar_repo_root",
+			repo: "europe-west1-docker.pkg.dev/my-project/my-repo/team/my-image",
+			root: "europe-west1-docker.pkg.dev/my-project/my-repo",
+			exp:  true,
+		},
+		{
+			name: "trailing_slash",
+			repo: "us-docker.pkg.dev/my-project/my-repo/my-image",
+			root: "us-docker.pkg.dev/my-project/my-repo/",
+			exp:  true,
+		},
+		{
+			name: "exact",
+			repo: "us-docker.pkg.dev/my-project/my-repo/my-image",
+			root: "us-docker.pkg.dev/my-project/my-repo/my-image",
+			exp:  true,
+		},
+		{
+			name: "partial_segment",
+			repo: "us-docker.pkg.dev/my-project/my-repo-2/my-image",
+			root: "us-docker.pkg.dev/my-project/my-repo",
+			exp:  false,
+		},
+		{
+			name: "different_location",
+			repo: "europe-docker.pkg.dev/my-project/my-repo/my-image",
+			root: "us-docker.pkg.dev/my-project/my-repo",
+			exp:  false,
+		},
+		{
+			name: "gcr",
+			repo: "gcr.io/my-project/my-image",
+			root: "gcr.io/my-project",
+			exp:  true,
+		},
+		{
+			name: "empty_root",
+			repo: "gcr.io/my-project/my-image",
+			root: "",
+			exp:  false,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got, want := isChildRepository(tc.repo, tc.root), tc.exp; got != want {
+				t.Errorf("expected %q child of %q to be %t", tc.repo, tc.root, want)
+			}
+		})
+	}
+}
+
+func TestAssetPodFilter(t *testing.T) {
+	t.Parallel()
+
+	digest := "sha256:2d07f9a7d6ac41b0fd3c10c1a23ab1fd4daf1d0c1b4ba3a8ff2ea43bb6e0f4a3"
+
+	cases := []struct {
+		name   string
+		repos  []string
+		images []string
+		repo   string
+		digest string
+		tags   []string
+		exp    bool
+	}{
+		{
+			name:   "ar_digest",
+			repos:  []string{"us-docker.pkg.dev/my-project/my-repo"},
+			images: []string{"us-docker.pkg.dev/my-project/my-repo/my-image@" + digest},
+			repo:   "us-docker.pkg.dev/my-project/my-repo/my-image",
+			digest: digest,
+			exp:    true,
+		},
+		{
+			name:   "ar_tag",
+			repos:  []string{"us-docker.pkg.dev/my-project/my-repo"},
+			images: []string{"us-docker.pkg.dev/my-project/my-repo/my-image:v1.2.3"},
+			repo:   "us-docker.pkg.dev/my-project/my-repo/my-image",
+			digest: digest,
+			tags:   []string{"v1.2.3", "latest"},
+			exp:    true,
+		},
+		{
+			name:   "ar_tag_and_digest",
+			repos:  []string{"europe-west1-docker.pkg.dev/my-project/my-repo"},
+			images: []string{"europe-west1-docker.pkg.dev/my-project/my-repo/team/my-image:v1@" + digest},
+			repo:   "europe-west1-docker.pkg.dev/my-project/my-repo/team/my-image",
+			digest: digest,
+			exp:    true,
+		},
+		{
+			name:   "ar_sibling_repo",
+			repos:  []string{"us-docker.pkg.dev/my-project/my-repo"},
+			images: []string{"us-docker.pkg.dev/my-project/my-repo-2/my-image@" + digest},
+			repo:   "us-docker.pkg.dev/my-project/my-repo-2/my-image",
+			digest: digest,
+			exp:    false,
+		},
+		{
+			name:   "ar_different_image",
+			repos:  []string{"us-docker.pkg.dev/my-project/my-repo"},
+			images: []string{"us-docker.pkg.dev/my-project/my-repo/other-image@" + digest},
+			repo:   "us-docker.pkg.dev/my-project/my-repo/my-image",
+			digest: digest,
+			exp:    false,
+		},
+		{
+			name:   "gcr_tag",
+			repos:  []string{"gcr.io/my-project"},
+			images: []string{"gcr.io/my-project/my-image:latest"},
+			repo:   "gcr.io/my-project/my-image",
+			digest: digest,
+			tags:   []string{"latest"},
+			exp:    true,
+		},
+		{
+			name:   "tag_mismatch",
+			repos:  []string{"gcr.io/my-project"},
+			images: []string{"gcr.io/my-project/my-image:latest"},
+			repo:   "gcr.io/my-project/my-image",
+			digest: digest,
+			tags:   []string{"v1"},
+			exp:    false,
+		},
+		{
+			name:   "ecr_tag",
+			repos:  []string{"123456789012.dkr.ecr.us-east-1.amazonaws.com/team"},
+			images: []string{"123456789012.dkr.ecr.us-east-1.amazonaws.com/team/app:v1"},
+			repo:   "123456789012.dkr.ecr.us-east-1.amazonaws.com/team/app",
+			digest: digest,
+			tags:   []string{"v1"},
+			exp:    true,
+		},
+		{
+			name:   "ecr_other_account",
+			repos:  []string{"123456789012.dkr.ecr.us-east-1.amazonaws.com"},
+			images: []string{"210987654321.dkr.ecr.us-east-1.amazonaws.com/app@" + digest},
+			repo:   "210987654321.dkr.ecr.us-east-1.amazonaws.com/app",
+			digest: digest,
+			exp:    false,
+		},
+		{
+			name:   "docker_hub_short_image",
+			repos:  []string{"docker.io/library/nginx"},
+			images: []string{"nginx:1.25"},
+			repo:   "docker.io/library/nginx",
+			digest: digest,
+			tags:   []string{"1.25"},
+			exp:    true,
+		},
+		{
+			name:   "docker_hub_short_repo",
+			repos:  []string{"nginx"},
+			images: []string{"index.docker.io/library/nginx@" + digest},
+			repo:   "nginx",
+			digest: digest,
+			exp:    true,
+		},
+		{
+			name:   "docker_hub_user_repo",
+			repos:  []string{"docker.io/my-org/app"},
+			images: []string{"my-org/app:latest"},
+			repo:   "my-org/app",
+			digest: digest,
+			tags:   []string{"latest"},
+			exp:    true,
+		},
+		{
+			name:   "port_registry",
+			repos:  []string{"localhost:5000"},
+			images: []string{"localhost:5000/team/app:v1"},
+			repo:   "localhost:5000/team/app",
+			digest: digest,
+			tags:   []string{"v1"},
+			exp:    true,
+		},
+		{
+			name:   "port_registry_digest",
+			repos:  []string{"registry.internal:5000/team"},
+			images: []string{"registry.internal:5000/team/app:v1@" + digest},
+			repo:   "registry.internal:5000/team/app",
+			digest: digest,
+			exp:    true,
+		},
+		{
+			name:   "port_registry_different_port",
+			repos:  []string{"registry.internal:5000"},
+			images: []string{"registry.internal:5001/team/app@" + digest},
+			repo:   "registry.internal:5001/team/app",
+			digest: digest,
+			exp:    false,
+		},
+		{
+			name:   "invalid_image_other_repo",
+			repos:  []string{"gcr.io/my-project"},
+			images: []string{"gcr.io/other-project/my-image:bad tag"},
+			repo:   "gcr.io/my-project/my-image",
+			digest: digest,
+			exp:    false,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			f := NewAssetPodFilter(tc.repos)
+			for _, image := range tc.images {
+				if err := f.Add(image); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if got, want := f.Matches(tc.repo, tc.digest, tc.tags), tc.exp; got != want {
+				t.Errorf("expected %q %q %q to be %t", tc.repo, tc.digest, tc.tags, want)
+			}
+		})
+	}
+}
+
+func TestAssetPodFilter_InvalidImage(t *testing.T) {
+	t.Parallel()
+
+	f := NewAssetPodFilter([]string{"gcr.io/my-project"})
+	if err := f.Add("gcr.io/my-project/my-image:bad tag"); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+func TestMatchesIdentifiers(t *testing.T) {
+	t.Parallel()
+
+	digest := "sha256:ab" + strings.Repeat("1", 62)
+	colliding := "sha256:ab" + strings.Repeat("2", 62)
+
+	cases := []struct {
+		name        string
+		identifiers []string
+		tags        []string
+		exp         bool
+	}{
+		{
+			name:        "full_digest",
+			identifiers: []string{digest},
+			exp:         true,
+		},
+		{
+			name:        "colliding_digest",
+			identifiers: []string{colliding},
+			exp:         false,
+		},
+		{
+			name:        "short_digest_prefix",
+			identifiers: []string{"sha256:ab"},
+			exp:         false,
+		},
+		{
+			name:        "algorithm_only",
+			identifiers: []string{"sha256:"},
+			exp:         false,
+		},
+		{
+			name:        "tag_prefix_of_digest",
+			identifiers: []string{"sha256"},
+			exp:         false,
+		},
+		{
+			name:        "tag",
+			identifiers: []string{"sha256"},
+			tags:        []string{"sha256"},
+			exp:         true,
+		},
+		{
+			name:        "empty",
+			identifiers: []string{""},
+			tags:        []string{""},
+			exp:         false,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got, want := matchesIdentifiers(tc.identifiers, digest, tc.tags), tc.exp; got != want {
+				t.Errorf("expected %t to be %t", got, want)
+			}
+		})
+	}
+}
+
+func TestAssetPodFilter_CollidingDigests(t *testing.T) {
+	t.Parallel()
+
+	inUse := "sha256:ab" + strings.Repeat("1", 62)
+	colliding := "sha256:ab" + strings.Repeat("2", 62)
+
+	f := NewAssetPodFilter([]string{"gcr.io/my-project"})
+	if err := f.Add("gcr.io/my-project/app@" + inUse); err != nil {
+		t.Fatal(err)
+	}
+
+	if !f.Matches("gcr.io/my-project/app", inUse, nil) {
+		t.Errorf("expected %s to match", inUse)
+	}
+	if f.Matches("gcr.io/my-project/app", colliding, nil) {
+		t.Errorf("expected %s to not match", colliding)
+	}
+}
+
+func TestAssetPodFilter_Deduplicates(t *testing.T) {
+	t.Parallel()
+
+	digest := "sha256:" + strings.Repeat("1", 64)
+
+	f := NewAssetPodFilter([]string{"gcr.io/my-project"})
+	for i := 0; i < 100; i++ {
+		for _, image := range []string{
+			"gcr.io/my-project/app:prod",
+			"gcr.io/my-project/app@" + digest,
+			"gcr.io/my-project/app:v1",
+		} {
+			if err := f.Add(image); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	exp := map[string][]string{
+		"gcr.io/my-project/app": {"prod", digest, "v1"},
+	}
+	if got, want := f.(*AssetPodFilter).images, exp; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+}
+
+func TestAssetPodFilter_TagResolver(t *testing.T) {
+	t.Parallel()
+
+	resolved := "sha256:" + strings.Repeat("1", 64)
+
+	var calls int
+	resolve := func(tag gcrname.Tag) (string, error) {
+		calls++
+		if tag.TagStr() == "broken" {
+			return "", fmt.Errorf("registry unavailable")
+		}
+		return resolved, nil
+	}
+
+	f := NewAssetPodFilter([]string{"gcr.io/my-project"}, WithTagResolver(resolve))
+	for _, image := range []string{
+		"gcr.io/my-project/app:prod",
+		"gcr.io/my-project/app:prod",
+		"gcr.io/my-project/web:broken",
+		"gcr.io/other-project/app:prod",
+	} {
+		if err := f.Add(image); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Each tag in the cleaned repositories is resolved once.
+	if got, want := calls, 2; got != want {
+		t.Errorf("expected %d calls to be %d", got, want)
+	}
+
+	// The resolved digest is kept even if the registry lists it without the tag.
+	if !f.Matches("gcr.io/my-project/app", resolved, nil) {
+		t.Errorf("expected resolved digest to match")
+	}
+	if !f.Matches("gcr.io/my-project/app", "sha256:"+strings.Repeat("2", 64), []string{"prod"}) {
+		t.Errorf("expected tag to still match")
+	}
+
+	// A tag that fails to resolve is still kept by its tag.
+	if !f.Matches("gcr.io/my-project/web", "sha256:"+strings.Repeat("3", 64), []string{"broken"}) {
+		t.Errorf("expected unresolved tag to match")
+	}
+	if f.Matches("gcr.io/my-project/web", resolved, nil) {
+		t.Errorf("expected unrelated digest to not match")
+	}
+}
+
+func TestStaticPodFilter(t *testing.T) {
+	t.Parallel()
+
+	digest := "sha256:" + strings.Repeat("a", 64)
+
+	f, err := NewStaticPodFilter([]string{
+		"gcr.io/my-project/app@" + digest,
+		"gcr.io/my-project/web:prod",
+		"nginx:stable",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name   string
+		repo   string
+		digest string
+		tags   []string
+		exp    bool
+	}{
+		{
+			name:   "digest",
+			repo:   "gcr.io/my-project/app",
+			digest: digest,
+			exp:    true,
+		},
+		{
+			name:   "other_digest",
+			repo:   "gcr.io/my-project/app",
+			digest: "sha256:" + strings.Repeat("b", 64),
+			exp:    false,
+		},
+		{
+			name:   "tag",
+			repo:   "gcr.io/my-project/web",
+			digest: digest,
+			tags:   []string{"prod", "v1"},
+			exp:    true,
+		},
+		{
+			name:   "tag_prefix",
+			repo:   "gcr.io/my-project/web",
+			digest: digest,
+			tags:   []string{"production"},
+			exp:    false,
+		},
+		{
+			name:   "other_repo",
+			repo:   "gcr.io/my-project/other",
+			digest: digest,
+			tags:   []string{"prod"},
+			exp:    false,
+		},
+		{
+			name:   "docker_hub",
+			repo:   "docker.io/library/nginx",
+			digest: digest,
+			tags:   []string{"stable"},
+			exp:    true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got, want := f.Matches(tc.repo, tc.digest, tc.tags), tc.exp; got != want {
+				t.Errorf("expected %t to be %t", got, want)
+			}
+		})
+	}
+}
+
+func TestNewStaticPodFilter_InvalidImage(t *testing.T) {
+	t.Parallel()
+
+	if _, err := NewStaticPodFilter([]string{"gcr.io/my-project/my-image:bad tag"}); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+func TestNormalizeRepository(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name string
+		repo string
+		exp  string
+	}{
+		{
+			name: "gcr",
+			repo: "gcr.io/my-project/my-image",
+			exp:  "gcr.io/my-project/my-image",
+		},
+		{
+			name: "ecr",
+			repo: "123456789012.dkr.ecr.us-east-1.amazonaws.com/app",
+			exp:  "123456789012.dkr.ecr.us-east-1.amazonaws.com/app",
+		},
+		{
+			name: "docker_hub_official",
+			repo: "nginx",
+			exp:  "index.docker.io/library/nginx",
+		},
+		{
+			name: "docker_hub_qualified",
+			repo: "docker.io/library/nginx",
+			exp:  "index.docker.io/library/nginx",
+		},
+		{
+			name: "docker_hub_user",
+			repo: "my-org/app",
+			exp:  "index.docker.io/my-org/app",
+		},
+		{
+			name: "docker_hub_registry",
+			repo: "docker.io",
+			exp:  "index.docker.io",
+		},
+		{
+			name: "registry",
+			repo: "us-docker.pkg.dev/",
+			exp:  "us-docker.pkg.dev",
+		},
+		{
+			name: "port",
+			repo: "localhost:5000/app",
+			exp:  "localhost:5000/app",
+		},
+		{
+			name: "port_registry",
+			repo: "registry.internal:5000",
+			exp:  "registry.internal:5000",
+		},
+		{
+			name: "invalid",
+			repo: "gcr.io/My Project",
+			exp:  "gcr.io/My Project",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got, want := normalizeRepository(tc.repo), tc.exp; got != want {
+				t.Errorf("expected %q to be %q", got, want)
+			}
+		})
+	}
+}
+
+func TestShouldDelete_MinAge(t *testing.T) {
+	t.Parallel()
+
+	since := time.Date(2023, time.November, 10, 0, 0, 0, 0, time.UTC)
+	cutoff := time.Date(2023, time.November, 1, 0, 0, 0, 0, time.UTC)
+	old := time.Date(2023, time.October, 1, 0, 0, 0, 0, time.UTC)
+	recent := time.Date(2023, time.November, 5, 0, 0, 0, 0, time.UTC)
+
+	tagFilter, err := BuildItemFilter("^pr-", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name        string
+		cutoff      time.Time
+		uploaded    time.Time
+		tags        []string
+		keepDigests []string
+		exp         bool
+		reason      string
 	}{
 		{
-			description: "Should delete when manifest is older with matching repo and tag filter",
-			manifest: manifest{
-				Repo:   "gcr.io/example/repo",
-				Digest: "digest1",
-				Info: gcrgoogle.ManifestInfo{
-					Created:  time.Date(2023, time.October, 1, 0, 0, 0, 0, time.UTC),
-					Uploaded: time.Date(2023, time.October, 10, 0, 0, 0, 0, time.UTC),
-					Tags:     []string{"delete-1"},
-				},
-			},
-			expectedToDelete: true,
+			name:     "no_min_age",
+			uploaded: recent,
+			tags:     []string{"pr-1"},
+			exp:      true,
+			reason:   ReasonTagFilter + " " + tagFilter.Name(),
 		},
 		{
-			description: "Should not delete when manifest is too new",
-			manifest: manifest{
-				Repo:   "gcr.io/example/repo",
-				Digest: "digest2",
-				Info: gcrgoogle.ManifestInfo{
-					Created:  time.Date(2023, time.November, 5, 0, 0, 0, 0, time.UTC),
-					Uploaded: time.Date(2023, time.November, 16, 0, 0, 0, 0, time.UTC),
-					Tags:     []string{"main2"},
-				},
-			},
-			expectedToDelete: false,
+			name:     "older_than_min_age",
+			cutoff:   cutoff,
+			uploaded: old,
+			tags:     []string{"pr-1"},
+			exp:      true,
+			reason:   ReasonTagFilter + " " + tagFilter.Name(),
+		},
+		{
+			name:     "overrides_tag_filter",
+			cutoff:   cutoff,
+			uploaded: recent,
+			tags:     []string{"pr-1"},
+			exp:      false,
+			reason:   ReasonMinAge,
+		},
+		{
+			name:     "overrides_untagged",
+			cutoff:   cutoff,
+			uploaded: recent,
+			exp:      false,
+			reason:   ReasonMinAge,
 		},
 		{
+			name:        "precedes_keep_digests",
+			cutoff:      cutoff,
+			uploaded:    recent,
+			keepDigests: []string{"sha256:abcdef"},
+			exp:         false,
+			reason:      ReasonMinAge,
+		},
+	}
 
-			description: "Should not delete when manifest is too new with matching repo and tag filter",
-			manifest: manifest{
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			cleaner := &Cleaner{
+				logger: NewLogger("error", os.Stderr, os.Stdout),
+			}
+
+			m := &manifest{
 				Repo:   "gcr.io/example/repo",
-				Digest: "digest3",
+				Digest: "sha256:abcdef0123456789",
 				Info: gcrgoogle.ManifestInfo{
-					Created:  time.Date(2023, time.November, 5, 0, 0, 0, 0, time.UTC),
-					Uploaded: time.Date(2023, time.November, 16, 0, 0, 0, 0, time.UTC),
-					Tags:     []string{"main3"},
+					Uploaded: tc.uploaded,
+					Tags:     tc.tags,
 				},
-			},
-			expectedToDelete: false,
+			}
+
+			got, reason := cleaner.shouldDelete(m, &CleanOptions{
+				Since:            since,
+				MinAgeCutoff:     tc.cutoff,
+				KeepDigests:      tc.keepDigests,
+				RepoKeepFilter:   &ItemFilterNull{},
+				RepoPrefixFilter: &ItemFilterNull{},
+				TagFilter:        tagFilter,
+				TagKeepFilter:    &ItemFilterNull{},
+				PodFilter:        &PodFilterNull{},
+			})
+			if want := tc.exp; got != want {
+				t.Errorf("expected %t to be %t", got, want)
+			}
+			if want := tc.reason; reason != want {
+				t.Errorf("expected reason %q to be %q", reason, want)
+			}
+		})
+	}
+}
+
+func TestShouldDelete_RepoMatch(t *testing.T) {
+	t.Parallel()
+
+	since := time.Date(2023, time.November, 1, 0, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		name   string
+		filter ItemFilter
+		repo   string
+		exp    bool
+		reason string
+	}{
+		{
+			name:   "no_filter",
+			repo:   "gcr.io/example/repo",
+			exp:    true,
+			reason: ReasonUntagged,
 		},
 		{
-			description: "Should not delete when manifest is older but does not match repo filter",
-			manifest: manifest{
-				Repo:   "gcr.io/other-repo",
-				Digest: "digest4",
-				Info: gcrgoogle.ManifestInfo{
-					Created:  time.Date(2023, time.October, 1, 0, 0, 0, 0, time.UTC),
-					Uploaded: time.Date(2023, time.October, 10, 0, 0, 0, 0, time.UTC),
-					Tags:     []string{"main4"},
-				},
-			},
-			expectedToDelete: false,
+			name:   "matches",
+			filter: NewItemFilterExact([]string{"gcr.io/example/repo"}),
+			repo:   "gcr.io/example/repo",
+			exp:    true,
+			reason: ReasonUntagged,
 		},
 		{
-			description: "Should delete when manifest is older and matches repo prefix filter",
-			manifest: manifest{
-				Repo:   "gcr.io/example/repo",
-				Digest: "digest5",
-				Info: gcrgoogle.ManifestInfo{
-					Created:  time.Date(2023, time.October, 1, 0, 0, 0, 0, time.UTC),
-					Uploaded: time.Date(2023, time.October, 10, 0, 0, 0, 0, time.UTC),
-					Tags:     []string{"other-tag"},
-				},
-			},
-			expectedToDelete: true,
+			name:   "child_repo",
+			filter: NewItemFilterExact([]string{"gcr.io/example/repo"}),
+			repo:   "gcr.io/example/repo/child",
+			exp:    false,
+			reason: ReasonRepoNotMatch,
 		},
 		{
-			description: "Should not delete when manifest is older but does not match repo or tag filter",
-			manifest: manifest{
-				Repo:   "gcr.io/other-repo",
-				Digest: "digest6",
+			name:   "other_repo",
+			filter: NewItemFilterExact([]string{"gcr.io/example/repo"}),
+			repo:   "gcr.io/example/other",
+			exp:    false,
+			reason: ReasonRepoNotMatch,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			cleaner := &Cleaner{
+				logger: NewLogger("error", os.Stderr, os.Stdout),
+			}
+
+			m := &manifest{
+				Repo:   tc.repo,
+				Digest: "sha256:abcdef0123456789",
 				Info: gcrgoogle.ManifestInfo{
-					Created:  time.Date(2023, time.October, 1, 0, 0, 0, 0, time.UTC),
-					Uploaded: time.Date(2023, time.October, 10, 0, 0, 0, 0, time.UTC),
-					Tags:     []string{"other-tag"},
+					Uploaded: time.Date(2023, time.October, 1, 0, 0, 0, 0, time.UTC),
 				},
-			},
-			expectedToDelete: false,
+			}
+
+			got, reason := cleaner.shouldDelete(m, &CleanOptions{
+				Since:            since,
+				RepoKeepFilter:   &ItemFilterNull{},
+				RepoPrefixFilter: &ItemFilterNull{},
+				RepoMatchFilter:  tc.filter,
+				TagFilter:        &ItemFilterNull{},
+				TagKeepFilter:    &ItemFilterNull{},
+				PodFilter:        &PodFilterNull{},
+			})
+			if want := tc.exp; got != want {
+				t.Errorf("expected %t to be %t", got, want)
+			}
+			if want := tc.reason; reason != want {
+				t.Errorf("expected reason %q to be %q", reason, want)
+			}
+		})
+	}
+}
+
+func TestShouldDelete_PodFilterNull(t *testing.T) {
+	t.Parallel()
+
+	tagFilter, err := BuildItemFilter("^delete", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	podFilter := &PodFilterNull{}
+	if err := podFilter.Add("gcr.io/my-project/my-image:delete-me"); err != nil {
+		t.Fatal(err)
+	}
+
+	cleaner := &Cleaner{logger: NewLogger("error", os.Stderr, os.Stdout)}
+	m := &manifest{
+		Repo:   "gcr.io/my-project/my-image",
+		Digest: "sha256:abcd",
+		Info: gcrgoogle.ManifestInfo{
+			Uploaded: time.Date(2023, time.October, 10, 0, 0, 0, 0, time.UTC),
+			Tags:     []string{"delete-me"},
+		},
+	}
+
+	shouldDelete, reason := cleaner.shouldDelete(m, &CleanOptions{
+		Since:            time.Date(2023, time.November, 1, 0, 0, 0, 0, time.UTC),
+		RepoKeepFilter:   &ItemFilterNull{},
+		RepoPrefixFilter: &ItemFilterNull{},
+		TagFilter:        tagFilter,
+		TagKeepFilter:    &ItemFilterNull{},
+		PodFilter:        podFilter,
+	})
+	if !shouldDelete {
+		t.Errorf("expected manifest to be deleted, got %q", reason)
+	}
+}
+
+func TestShouldDelete_UntaggedOnly(t *testing.T) {
+	t.Parallel()
+
+	since := time.Date(2023, time.November, 1, 0, 0, 0, 0, time.UTC)
+
+	tagFilter, err := BuildItemFilter(".*", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name      string
+		tags      []string
+		uploaded  time.Time
+		exp       bool
+		expReason string
+	}{
+		{
+			name:      "untagged",
+			tags:      nil,
+			uploaded:  time.Date(2023, time.October, 10, 0, 0, 0, 0, time.UTC),
+			exp:       true,
+			expReason: ReasonUntagged,
 		},
 		{
-			description: "Should delete when manifest is older with matching repo prefix and tag filter",
-			manifest: manifest{
-				Repo:   "gcr.io/example/repo",
-				Digest: "digest7",
-				Info: gcrgoogle.ManifestInfo{
-					Created:  time.Date(2023, time.October, 1, 0, 0, 0, 0, time.UTC),
-					Uploaded: time.Date(2023, time.October, 10, 0, 0, 0, 0, time.UTC),
-					Tags:     []string{"delete7"},
-				},
-			},
-			expectedToDelete: true,
+			name:      "tagged",
+			tags:      []string{"latest"},
+			uploaded:  time.Date(2023, time.October, 10, 0, 0, 0, 0, time.UTC),
+			exp:       false,
+			expReason: ReasonTagged,
 		},
 		{
-			description: "Should delete when manifest is older with matching repo and not tag keep filter",
-			manifest: manifest{
+			name:      "untagged_too_new",
+			tags:      nil,
+			uploaded:  time.Date(2023, time.November, 10, 0, 0, 0, 0, time.UTC),
+			exp:       false,
+			expReason: ReasonTooNew,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			cleaner := &Cleaner{
+				logger: NewLogger("error", os.Stderr, os.Stdout),
+			}
+
+			m := &manifest{
 				Repo:   "gcr.io/example/repo",
-				Digest: "digest8",
+				Digest: "sha256:abcd",
 				Info: gcrgoogle.ManifestInfo{
-					Created:  time.Date(2023, time.October, 1, 0, 0, 0, 0, time.UTC),
-					Uploaded: time.Date(2023, time.October, 10, 0, 0, 0, 0, time.UTC),
-					Tags:     []string{"delete8"},
+					Uploaded: tc.uploaded,
+					Tags:     tc.tags,
 				},
-			},
-			expectedToDelete: true,
+			}
+
+			got, reason := cleaner.shouldDelete(m, &CleanOptions{
+				Since:            since,
+				RepoKeepFilter:   &ItemFilterNull{},
+				RepoPrefixFilter: &ItemFilterNull{},
+				TagFilter:        tagFilter,
+				TagKeepFilter:    &ItemFilterNull{},
+				PodFilter:        &PodFilterNull{},
+				UntaggedOnly:     true,
+			})
+			if got != tc.exp {
+				t.Errorf("expected deletion=%t, got %t (%s)", tc.exp, got, reason)
+			}
+			if reason != tc.expReason {
+				t.Errorf("expected reason %q, got %q", tc.expReason, reason)
+			}
+		})
+	}
+}
+
+func TestShouldDelete_TimeSource(t *testing.T) {
+	t.Parallel()
+
+	since := time.Date(2023, time.November, 1, 0, 0, 0, 0, time.UTC)
+	old := time.Date(2023, time.January, 1, 0, 0, 0, 0, time.UTC)
+	recent := time.Date(2023, time.November, 10, 0, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		name       string
+		timeSource TimeSource
+		created    time.Time
+		uploaded   time.Time
+		exp        bool
+	}{
+		{
+			name:       "default_uses_uploaded",
+			timeSource: "",
+			created:    old,
+			uploaded:   recent,
+			exp:        false,
 		},
 		{
-			description: "Should not delete when manifest is older with matching repo and tag keep filter",
-			manifest: manifest{
-				Repo:   "gcr.io/example/repo",
-				Digest: "digest9",
-				Info: gcrgoogle.ManifestInfo{
-					Created:  time.Date(2023, time.October, 1, 0, 0, 0, 0, time.UTC),
-					Uploaded: time.Date(2023, time.October, 10, 0, 0, 0, 0, time.UTC),
-					Tags:     []string{"main9"},
-				},
-			},
-			expectedToDelete: false,
+			name:       "uploaded_recent",
+			timeSource: TimeSourceUploaded,
+			created:    old,
+			uploaded:   recent,
+			exp:        false,
+		},
+		{
+			name:       "created_old",
+			timeSource: TimeSourceCreated,
+			created:    old,
+			uploaded:   recent,
+			exp:        true,
+		},
+		{
+			name:       "created_recent",
+			timeSource: TimeSourceCreated,
+			created:    recent,
+			uploaded:   old,
+			exp:        false,
+		},
+		{
+			name:       "created_zero_uses_uploaded",
+			timeSource: TimeSourceCreated,
+			created:    time.Time{},
+			uploaded:   recent,
+			exp:        false,
+		},
+		{
+			name:       "created_reproducible_uses_uploaded",
+			timeSource: TimeSourceCreated,
+			created:    time.Date(1980, time.January, 1, 0, 0, 1, 0, time.UTC),
+			uploaded:   recent,
+			exp:        false,
+		},
+		{
+			name:       "created_zero_uploaded_old",
+			timeSource: TimeSourceCreated,
+			created:    time.Time{},
+			uploaded:   old,
+			exp:        true,
 		},
 	}
 
-	repoPrefixFilter, err := BuildItemFilter(`^gcr.io.example.*`, "")
-	if err != nil {
-		t.Fatalf("Error creating repoPrefixFilter: %s", err)
-	}
+	for _, tc := range cases {
+		tc := tc
 
-	tagFilter, err := BuildItemFilter("delete.*", "")
-	if err != nil {
-		t.Fatalf("Error creating tagFilter: %s", err)
-	}
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
 
-	repoSkipFilter, err := BuildItemFilter("other-repo", "")
-	if err != nil {
-		t.Fatalf("Error creating repoSkipFilter: %s", err)
+			cleaner := &Cleaner{
+				logger: NewLogger("error", os.Stderr, os.Stdout),
+			}
+
+			m := &manifest{
+				Repo:   "gcr.io/example/repo",
+				Digest: "sha256:abcd",
+				Info: gcrgoogle.ManifestInfo{
+					Created:  tc.created,
+					Uploaded: tc.uploaded,
+				},
+			}
+
+			got, reason := cleaner.shouldDelete(m, &CleanOptions{
+				Since:            since,
+				TimeSource:       tc.timeSource,
+				RepoKeepFilter:   &ItemFilterNull{},
+				RepoPrefixFilter: &ItemFilterNull{},
+				TagFilter:        &ItemFilterNull{},
+				TagKeepFilter:    &ItemFilterNull{},
+				PodFilter:        &PodFilterNull{},
+			})
+			if got != tc.exp {
+				t.Errorf("expected deletion=%t, got %t (%s)", tc.exp, got, reason)
+			}
+		})
 	}
+}
 
-	tagKeepFilter, err := BuildItemFilter("^main.*", "")
-	if err != nil {
-		t.Fatalf("Error creating tagKeepFilter: %s", err)
+func TestTimeSource_Validate(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name   string
+		source TimeSource
+		err    bool
+	}{
+		{name: "empty", source: ""},
+		{name: "uploaded", source: TimeSourceUploaded},
+		{name: "created", source: TimeSourceCreated},
+		{name: "pulled", source: TimeSourcePulled},
+		{name: "unknown", source: "modified", err: true},
 	}
 
-	mockPodFilter := mockPodFilter{}
-	var (
-		stdout = os.Stdout
-		stderr = os.Stderr
-	)
+	for _, tc := range cases {
+		tc := tc
 
-	for _, test := range tests {
-		logger := NewLogger("debug", stderr, stdout)
-		cleaner := &Cleaner{
-			logger: logger,
-		} // Initialize your Cleaner instance here
-		actualToDelete := cleaner.shouldDelete(
-			&test.manifest,
-			since,
-			repoSkipFilter,   // repoSkipFilter
-			repoPrefixFilter, // repoPrefixFilter
-			tagFilter,        // tagFilter
-			tagKeepFilter,    // tagKeepFilter
-			mockPodFilter,    // podFilter
-		)
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
 
-		if actualToDelete != test.expectedToDelete {
-			t.Errorf("%s: Expected deletion=%v, but got deletion=%v", test.description, test.expectedToDelete, actualToDelete)
-		}
+			if err := tc.source.Validate(); (err != nil) != tc.err {
+				t.Errorf("expected error=%t, got %v", tc.err, err)
+			}
+		})
 	}
 }
@@ -0,0 +1,314 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	contentTypeNDJSON = "application/x-ndjson"
+	contentTypeCSV    = "text/csv"
+
+	// ndjsonFlushEvery is the number of lines written between flushes.
+	ndjsonFlushEvery = 1000
+)
+
+// NDJSON line types.
+const (
+	ndjsonTypeRef      = "ref"
+	ndjsonTypeDecision = "decision"
+	ndjsonTypeRepo     = "repo"
+	ndjsonTypeSummary  = "summary"
+	ndjsonTypeError    = "error"
+)
+
+// ndjsonRef is a deleted ref.
+type ndjsonRef struct {
+	Type string `json:"type"`
+	Repo string `json:"repo"`
+	Ref  string `json:"ref"`
+}
+
+// ndjsonDecision is the decision for a single manifest. It is only written for
+// dry runs.
+type ndjsonDecision struct {
+	Type string `json:"type"`
+	Repo string `json:"repo"`
+	*Decision
+}
+
+// ndjsonRepo is the summary of a single repository. It is written after the
+// repository's refs and decisions, as soon as the repository is cleaned.
+type ndjsonRepo struct {
+	Type         string      `json:"type"`
+	Repo         string      `json:"repo"`
+	Deleted      int         `json:"deleted"`
+	SkippedInUse int         `json:"skipped_in_use"`
+	BytesFreed   *FreedBytes `json:"bytes_freed"`
+	Error        string      `json:"error,omitempty"`
+}
+
+// ndjsonSummary is the summary of the entire request. It is the last line
+// unless an error occurred.
+type ndjsonSummary struct {
+	Type       string      `json:"type"`
+	Repos      int         `json:"repos"`
+	Deleted    int         `json:"deleted"`
+	BytesFreed *FreedBytes `json:"bytes_freed"`
+	Errors     int         `json:"errors,omitempty"`
+}
+
+// ndjsonError is an error that occurred after the first line was written. It
+// is always the last line.
+type ndjsonError struct {
+	Type      string    `json:"type"`
+	Error     string    `json:"error"`
+	ErrorCode ErrorCode `json:"error_code"`
+}
+
+// acceptsMediaType returns true if the request's Accept header explicitly
+// includes the media type. Wildcards are not considered a match, so the default
+// format is used unless another is requested.
+func acceptsMediaType(r *http.Request, mediaType string) bool {
+	for _, v := range r.Header.Values("Accept") {
+		for _, part := range strings.Split(v, ",") {
+			mt, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+			if err != nil {
+				continue
+			}
+			if strings.EqualFold(mt, mediaType) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hasMediaType returns true if the request body has the media type, ignoring
+// parameters such as the charset.
+func hasMediaType(r *http.Request, mediaType string) bool {
+	mt, _, err := mime.ParseMediaType(r.Header.Get(contentTypeHeader))
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(mt, mediaType)
+}
+
+// ndjsonStream writes the response as newline-delimited JSON, one repository
+// at a time as each finishes. Each repository is written as its deleted refs,
+// then its decisions for dry runs, then a summary line, and is flushed so
+// clients can process it immediately. The final line summarizes the entire
+// request, or is an error. The headers are written with the first line. It is
+// safe for concurrent use.
+type ndjsonStream struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+
+	lock    sync.Mutex
+	bw      *bufio.Writer
+	enc     *json.Encoder
+	started bool
+	lines   int
+}
+
+// newNDJSONStream creates a new stream that writes to w.
+func newNDJSONStream(w http.ResponseWriter) *ndjsonStream {
+	flusher, _ := w.(http.Flusher)
+	bw := bufio.NewWriter(w)
+	return &ndjsonStream{
+		w:       w,
+		flusher: flusher,
+		bw:      bw,
+		enc:     json.NewEncoder(bw),
+	}
+}
+
+// writeRepo writes the lines for a single repository and flushes them.
+// Decisions are only written for dry runs. If countsOnly is set, only the
+// repository line is written.
+func (n *ndjsonStream) writeRepo(result *RepoResult, dryRun, countsOnly bool) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if !countsOnly {
+		for _, ref := range result.Deleted {
+			if err := n.write(&ndjsonRef{Type: ndjsonTypeRef, Repo: result.Repo, Ref: ref}); err != nil {
+				return err
+			}
+		}
+	}
+
+	if dryRun && !countsOnly {
+		for _, d := range result.Decisions {
+			if d == nil {
+				continue
+			}
+			if err := n.write(&ndjsonDecision{Type: ndjsonTypeDecision, Repo: result.Repo, Decision: d}); err != nil {
+				return err
+			}
+		}
+	}
+
+	line := &ndjsonRepo{
+		Type:         ndjsonTypeRepo,
+		Repo:         result.Repo,
+		Deleted:      len(result.Deleted),
+		SkippedInUse: len(filterDecisions(result.Decisions, ReasonInUse)),
+		BytesFreed:   EstimateFreedBytes(result.Decisions),
+	}
+	if result.Err != nil {
+		line.Error = result.Err.Error()
+	}
+	if err := n.write(line); err != nil {
+		return err
+	}
+	return n.flush()
+}
+
+// writeSummary writes the summary of the entire request and flushes it.
+func (n *ndjsonStream) writeSummary(resp *CleanResponse) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if err := n.write(&ndjsonSummary{
+		Type:       ndjsonTypeSummary,
+		Repos:      len(resp.BytesFreedByRepo),
+		Deleted:    resp.deletedCount(),
+		BytesFreed: resp.BytesFreed,
+		Errors:     len(resp.Errors),
+	}); err != nil {
+		return err
+	}
+	return n.flush()
+}
+
+// writeError writes an error as the final line and flushes it. It is used for
+// errors that occur after the first line was written, when the status code
+// can no longer be changed.
+func (n *ndjsonStream) writeError(err error, code ErrorCode) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if err := n.write(&ndjsonError{Type: ndjsonTypeError, Error: err.Error(), ErrorCode: code}); err != nil {
+		return err
+	}
+	return n.flush()
+}
+
+// isStarted returns true if any line has been written.
+func (n *ndjsonStream) isStarted() bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.started
+}
+
+// write writes a single line, and the headers if this is the first line. Large
+// repositories are flushed periodically. The caller must hold the lock.
+func (n *ndjsonStream) write(v any) error {
+	if !n.started {
+		n.w.Header().Set(contentTypeHeader, contentTypeNDJSON)
+		n.w.WriteHeader(http.StatusOK)
+		n.started = true
+	}
+
+	if err := n.enc.Encode(v); err != nil {
+		return fmt.Errorf("failed to write NDJSON line: %w", err)
+	}
+
+	n.lines++
+	if n.lines%ndjsonFlushEvery == 0 {
+		return n.flush()
+	}
+	return nil
+}
+
+// flush flushes the buffered lines to the client. The caller must hold the
+// lock.
+func (n *ndjsonStream) flush() error {
+	if err := n.bw.Flush(); err != nil {
+		return fmt.Errorf("failed to flush NDJSON: %w", err)
+	}
+	if n.flusher != nil {
+		n.flusher.Flush()
+	}
+	return nil
+}
+
+// csvHeader is the header row of the CSV format.
+var csvHeader = []string{"repo", "digest", "tags", "created", "uploaded", "size"}
+
+// writeCSV writes the deleted manifests as CSV, with a header row. For dry runs,
+// these are the manifests that would be deleted. Tags are joined with commas in
+// a single column, and the size is empty if the registry did not report one.
+func writeCSV(w http.ResponseWriter, resp *CleanResponse) error {
+	w.Header().Set(contentTypeHeader, contentTypeCSV+"; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvHeader); err != nil {
+		return fmt.Errorf("failed to write CSV header: %w", err)
+	}
+
+	repos := make([]string, 0, len(resp.deletedManifests))
+	for repo := range resp.deletedManifests {
+		repos = append(repos, repo)
+	}
+	sort.Strings(repos)
+
+	for _, repo := range repos {
+		for _, d := range resp.deletedManifests[repo] {
+			var size string
+			if d.Size > 0 {
+				size = strconv.FormatUint(d.Size, 10)
+			}
+
+			if err := cw.Write([]string{
+				repo,
+				d.Digest,
+				strings.Join(d.Tags, ","),
+				csvTime(d.Created),
+				csvTime(d.Uploaded),
+				size,
+			}); err != nil {
+				return fmt.Errorf("failed to write CSV row: %w", err)
+			}
+		}
+	}
+
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return fmt.Errorf("failed to flush CSV: %w", err)
+	}
+	return nil
+}
+
+// csvTime formats the time as RFC3339, or empty if it is zero.
+func csvTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
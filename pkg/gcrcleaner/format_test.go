@@ -0,0 +1,281 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAcceptsMediaType(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name   string
+		accept []string
+		exp    bool
+	}{
+		{
+			name: "missing",
+		},
+		{
+			name:   "exact",
+			accept: []string{"application/x-ndjson"},
+			exp:    true,
+		},
+		{
+			name:   "list_with_params",
+			accept: []string{"application/json;q=0.5, application/x-ndjson;q=1"},
+			exp:    true,
+		},
+		{
+			name:   "multiple_headers",
+			accept: []string{"application/json", "application/x-ndjson"},
+			exp:    true,
+		},
+		{
+			name:   "wildcard",
+			accept: []string{"*/*"},
+		},
+		{
+			name:   "other",
+			accept: []string{"application/json"},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			r := httptest.NewRequest("POST", "/http", nil)
+			for _, v := range tc.accept {
+				r.Header.Add("Accept", v)
+			}
+
+			if got, want := acceptsMediaType(r, contentTypeNDJSON), tc.exp; got != want {
+				t.Errorf("expected %t to be %t", got, want)
+			}
+		})
+	}
+}
+
+// ndjsonLines returns the type and repo of each NDJSON line.
+func ndjsonLines(tb testing.TB, body string) ([]string, []string) {
+	tb.Helper()
+
+	var types, repos []string
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	for scanner.Scan() {
+		var line struct {
+			Type string `json:"type"`
+			Repo string `json:"repo"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			tb.Fatalf("invalid line %q: %s", scanner.Text(), err)
+		}
+		types = append(types, line.Type)
+		repos = append(repos, line.Repo)
+	}
+	if err := scanner.Err(); err != nil {
+		tb.Fatal(err)
+	}
+	return types, repos
+}
+
+func TestNDJSONStream(t *testing.T) {
+	t.Parallel()
+
+	w := httptest.NewRecorder()
+	stream := newNDJSONStream(w)
+
+	if stream.isStarted() {
+		t.Errorf("expected stream to not be started")
+	}
+
+	if err := stream.writeRepo(&RepoResult{
+		Repo:    "gcr.io/p/a",
+		Deleted: []string{"gcr.io/p/a@sha256:1", "gcr.io/p/a@sha256:2"},
+		Decisions: []*Decision{
+			{Digest: "sha256:1", Delete: true, Size: 10},
+			{Digest: "sha256:2", Delete: true, Size: 20},
+		},
+	}, false, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := w.Header().Get(contentTypeHeader), contentTypeNDJSON; got != want {
+		t.Errorf("expected content type %q to be %q", got, want)
+	}
+	if !w.Flushed {
+		t.Errorf("expected repo to be flushed")
+	}
+
+	// The first repository is written before the next one finishes.
+	types, _ := ndjsonLines(t, w.Body.String())
+	if got, want := types, []string{"ref", "ref", "repo"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected types %q to be %q", got, want)
+	}
+
+	if err := stream.writeRepo(&RepoResult{
+		Repo: "gcr.io/p/b",
+		Decisions: []*Decision{
+			{Digest: "sha256:3", Reason: "kept by keep"},
+		},
+	}, true, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := stream.writeSummary(&CleanResponse{
+		Refs:       []string{"gcr.io/p/a@sha256:1", "gcr.io/p/a@sha256:2"},
+		BytesFreed: &FreedBytes{Bytes: 30},
+		BytesFreedByRepo: map[string]*FreedBytes{
+			"gcr.io/p/a": {Bytes: 30},
+			"gcr.io/p/b": {},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	types, repos := ndjsonLines(t, w.Body.String())
+	expTypes := []string{"ref", "ref", "repo", "decision", "repo", "summary"}
+	if !reflect.DeepEqual(types, expTypes) {
+		t.Errorf("expected types %q to be %q", types, expTypes)
+	}
+	expRepos := []string{"gcr.io/p/a", "gcr.io/p/a", "gcr.io/p/a", "gcr.io/p/b", "gcr.io/p/b", ""}
+	if !reflect.DeepEqual(repos, expRepos) {
+		t.Errorf("expected repos %q to be %q", repos, expRepos)
+	}
+}
+
+func TestNDJSONStream_CountsOnly(t *testing.T) {
+	t.Parallel()
+
+	w := httptest.NewRecorder()
+	stream := newNDJSONStream(w)
+
+	if err := stream.writeRepo(&RepoResult{
+		Repo:    "gcr.io/p/a",
+		Deleted: []string{"gcr.io/p/a@sha256:1"},
+		Decisions: []*Decision{
+			{Digest: "sha256:1", Delete: true, Size: 10},
+		},
+	}, true, true); err != nil {
+		t.Fatal(err)
+	}
+
+	types, _ := ndjsonLines(t, w.Body.String())
+	if got, want := types, []string{"repo"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected types %q to be %q", got, want)
+	}
+}
+
+func TestNDJSONStream_Error(t *testing.T) {
+	t.Parallel()
+
+	w := httptest.NewRecorder()
+	stream := newNDJSONStream(w)
+
+	if err := stream.writeRepo(&RepoResult{Repo: "gcr.io/p/a"}, false, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.writeError(fmt.Errorf("oops"), ErrorCodeInternal); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	if got, want := lines[len(lines)-1], `{"type":"error","error":"oops","error_code":"internal"}`; got != want {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+}
+
+func TestServer_HTTPHandler_NDJSONError(t *testing.T) {
+	t.Parallel()
+
+	server := testServer(t)
+
+	body := strings.NewReader(`{"tag_filter_any": "(", "skip_in_use_check": true}`)
+	r := httptest.NewRequest("POST", "/http", body)
+	r.Header.Set("Accept", contentTypeNDJSON)
+	w := httptest.NewRecorder()
+	server.HTTPHandler().ServeHTTP(w, r)
+
+	// Errors before the first line keep their status code and JSON body.
+	if got, want := w.Code, http.StatusBadRequest; got != want {
+		t.Fatalf("expected status %d to be %d", got, want)
+	}
+
+	var resp errorResp
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(resp.Fields), 1; got != want {
+		t.Errorf("expected %d fields to be %d: %#v", got, want, resp.Fields)
+	}
+}
+
+func TestWriteCSV(t *testing.T) {
+	t.Parallel()
+
+	uploaded := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	resp := &CleanResponse{
+		deletedManifests: map[string][]*Decision{
+			"gcr.io/p/b": {
+				{Digest: "sha256:2", Delete: true},
+			},
+			"gcr.io/p/a": {
+				{Digest: "sha256:1", Tags: []string{"a", "b"}, Delete: true, Size: 42, Uploaded: uploaded, Created: uploaded},
+			},
+		},
+	}
+
+	w := httptest.NewRecorder()
+	if err := writeCSV(w, resp); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := w.Header().Get(contentTypeHeader), contentTypeCSV; !strings.HasPrefix(got, want) {
+		t.Errorf("expected content type %q to start with %q", got, want)
+	}
+
+	// The tag list contains a comma, so it must be quoted.
+	if got, want := w.Body.String(), `"a,b"`; !strings.Contains(got, want) {
+		t.Errorf("expected body %q to contain %q", got, want)
+	}
+
+	records, err := csv.NewReader(w.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := [][]string{
+		{"repo", "digest", "tags", "created", "uploaded", "size"},
+		{"gcr.io/p/a", "sha256:1", "a,b", "2024-01-02T03:04:05Z", "2024-01-02T03:04:05Z", "42"},
+		{"gcr.io/p/b", "sha256:2", "", "", "", ""},
+	}
+	if !reflect.DeepEqual(records, exp) {
+		t.Errorf("expected %q to be %q", records, exp)
+	}
+}
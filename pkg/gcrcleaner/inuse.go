@@ -0,0 +1,249 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"google.golang.org/api/googleapi"
+)
+
+// inUseUnavailableError is an in-use detection error caused by the asset
+// inventory export not being accessible, such as when the table is not found
+// or permission to it is denied. Unless in_use_strict is set, only these errors
+// continue the clean without in-use detection.
+type inUseUnavailableError struct {
+	err error
+}
+
+func (e *inUseUnavailableError) Error() string {
+	return e.err.Error()
+}
+
+func (e *inUseUnavailableError) Unwrap() error {
+	return e.err
+}
+
+// classifyInUseError returns err as an inUseUnavailableError if BigQuery
+// reported the asset inventory export as forbidden or not found. Other errors,
+// such as transient or context errors, are returned unchanged.
+func classifyInUseError(err error) error {
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) && (gerr.Code == http.StatusForbidden || gerr.Code == http.StatusNotFound) {
+		return &inUseUnavailableError{err: err}
+	}
+	return err
+}
+
+// inUseAssetContainerPathsLock guards inUseAssetContainerPaths, which can be
+// extended with RegisterInUseAssetType.
+var inUseAssetContainerPathsLock sync.RWMutex
+
+// inUseAssetContainerPaths maps Cloud Asset Inventory asset types to the JSON
+// paths in the asset's resource data that contain a list of containers. Each
+// container is expected to have an "image" field.
+var inUseAssetContainerPaths = map[string][]string{
+	"k8s.io/Pod": {
+		"$.spec.containers",
+		"$.spec.initContainers",
+	},
+	"apps.k8s.io/Deployment": {
+		"$.spec.template.spec.containers",
+		"$.spec.template.spec.initContainers",
+	},
+	"apps.k8s.io/StatefulSet": {
+		"$.spec.template.spec.containers",
+		"$.spec.template.spec.initContainers",
+	},
+	"apps.k8s.io/DaemonSet": {
+		"$.spec.template.spec.containers",
+		"$.spec.template.spec.initContainers",
+	},
+	"batch.k8s.io/Job": {
+		"$.spec.template.spec.containers",
+		"$.spec.template.spec.initContainers",
+	},
+	"batch.k8s.io/CronJob": {
+		"$.spec.jobTemplate.spec.template.spec.containers",
+		"$.spec.jobTemplate.spec.template.spec.initContainers",
+	},
+	"run.googleapis.com/Service": {
+		"$.spec.template.spec.containers",
+	},
+	"run.googleapis.com/Job": {
+		"$.spec.template.spec.template.spec.containers",
+	},
+}
+
+// defaultInUseAssetTypes are the asset types scanned for in-use images if none
+// are given.
+var defaultInUseAssetTypes = []string{
+	"batch.k8s.io/CronJob",
+	"k8s.io/Pod",
+	"run.googleapis.com/Job",
+	"run.googleapis.com/Service",
+}
+
+var (
+	// assetTypeRe and assetPathRe restrict asset types and JSON paths to safe
+	// characters, since they are interpolated into the query.
+	assetTypeRe = regexp.MustCompile(`^[A-Za-z0-9._-]+/[A-Za-z0-9._-]+$`)
+	assetPathRe = regexp.MustCompile(`^\$(\.[A-Za-z0-9_]+|\[[0-9]+\])+$`)
+
+	// tableNameRe restricts BigQuery table names to safe characters.
+	tableNameRe = regexp.MustCompile("^`?[A-Za-z0-9_.:-]+`?$")
+
+	// inUseScopeRe matches a Cloud Asset Inventory ancestor, such as
+	// "projects/123456789012" or "folders/123456789012". Ancestors are always
+	// numeric, so project IDs like "projects/my-project" never match any asset.
+	inUseScopeRe = regexp.MustCompile(`^(organizations|folders|projects)/[0-9]+$`)
+)
+
+// RegisterInUseAssetType registers the JSON paths of container lists in the
+// resource data of the given Cloud Asset Inventory asset type, so that it can
+// be listed in the in-use asset types without giving its paths in each
+// request. Each container in the lists must have an "image" field.
+// Registering an asset type that is already known replaces its paths. It is
+// typically called from an init function.
+func RegisterInUseAssetType(assetType string, paths ...string) error {
+	if !assetTypeRe.MatchString(assetType) {
+		return fmt.Errorf("invalid asset type %q", assetType)
+	}
+	if len(paths) == 0 {
+		return fmt.Errorf("no container paths given for asset type %q", assetType)
+	}
+	for _, path := range paths {
+		if !assetPathRe.MatchString(path) {
+			return fmt.Errorf("invalid container path %q for asset type %q", path, assetType)
+		}
+	}
+
+	copied := make([]string, len(paths))
+	copy(copied, paths)
+
+	inUseAssetContainerPathsLock.Lock()
+	defer inUseAssetContainerPathsLock.Unlock()
+	inUseAssetContainerPaths[assetType] = copied
+	return nil
+}
+
+// validateInUseScope returns an error if the scope is not empty and is not a
+// valid resource ancestor.
+func validateInUseScope(scope string) error {
+	if scope == "" || inUseScopeRe.MatchString(scope) {
+		return nil
+	}
+	return fmt.Errorf("invalid scope %q: must be organizations/<number>, folders/<number>, or projects/<number>", scope)
+}
+
+// resolveInUseAssetTypes returns the container paths for each of the given
+// asset types, sorted by asset type. Asset types are looked up in
+// inUseAssetContainerPaths, including registered asset types, and customPaths
+// adds or overrides entries. If assetTypes is empty, defaultInUseAssetTypes is
+// used.
+func resolveInUseAssetTypes(assetTypes []string, customPaths map[string][]string) ([]string, map[string][]string, error) {
+	if len(assetTypes) == 0 {
+		assetTypes = defaultInUseAssetTypes
+	}
+
+	// Sort for a deterministic query.
+	sorted := make([]string, len(assetTypes))
+	copy(sorted, assetTypes)
+	sort.Strings(sorted)
+
+	resolved := make(map[string][]string, len(sorted))
+	for _, assetType := range sorted {
+		if !assetTypeRe.MatchString(assetType) {
+			return nil, nil, fmt.Errorf("invalid asset type %q", assetType)
+		}
+
+		paths, ok := customPaths[assetType]
+		if !ok {
+			inUseAssetContainerPathsLock.RLock()
+			paths, ok = inUseAssetContainerPaths[assetType]
+			inUseAssetContainerPathsLock.RUnlock()
+		}
+		if !ok || len(paths) == 0 {
+			return nil, nil, fmt.Errorf("unsupported asset type %q: no container paths are known", assetType)
+		}
+
+		for _, path := range paths {
+			if !assetPathRe.MatchString(path) {
+				return nil, nil, fmt.Errorf("invalid container path %q for asset type %q", path, assetType)
+			}
+		}
+		resolved[assetType] = paths
+	}
+
+	return sorted, resolved, nil
+}
+
+// buildInUseQuery builds the BigQuery query that lists container images seen
+// in the past week for the given asset types. See resolveInUseAssetTypes for
+// how asset types are resolved. If scope is given, only assets under that
+// organization, folder, or project are included.
+func buildInUseQuery(table string, assetTypes []string, customPaths map[string][]string, scope string) (string, error) {
+	if !tableNameRe.MatchString(table) {
+		return "", fmt.Errorf("invalid table name %q", table)
+	}
+
+	if err := validateInUseScope(scope); err != nil {
+		return "", err
+	}
+
+	var scopeClause string
+	if scope != "" {
+		scopeClause = fmt.Sprintf("\n    AND %q IN UNNEST(ancestors)", scope)
+	}
+
+	sorted, resolved, err := resolveInUseAssetTypes(assetTypes, customPaths)
+	if err != nil {
+		return "", err
+	}
+
+	cases := make([]string, 0, len(sorted))
+	types := make([]string, 0, len(sorted))
+	for _, assetType := range sorted {
+		paths := resolved[assetType]
+
+		arrays := make([]string, 0, len(paths))
+		for _, path := range paths {
+			arrays = append(arrays, fmt.Sprintf("COALESCE(JSON_QUERY_ARRAY(resource.data, '%s'), [])", path))
+		}
+
+		cases = append(cases, fmt.Sprintf("      WHEN %q THEN ARRAY_CONCAT(\n        %s\n      )",
+			assetType, strings.Join(arrays, ",\n        ")))
+		types = append(types, fmt.Sprintf("%q", assetType))
+	}
+
+	return fmt.Sprintf(`
+SELECT DISTINCT JSON_VALUE(container, '$.image') as image
+FROM (
+  SELECT
+    CASE asset_type
+%s
+    END
+    AS containers
+  FROM %s
+  WHERE readTime >= TIMESTAMP_SUB(CURRENT_TIMESTAMP(), INTERVAL 7 day)
+    AND asset_type IN (%s)%s
+), UNNEST(containers) AS container;`, strings.Join(cases, "\n"), table, strings.Join(types, ", "), scopeClause), nil
+}
@@ -0,0 +1,216 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBuildInUseQuery(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name        string
+		table       string
+		assetTypes  []string
+		customPaths map[string][]string
+		scope       string
+		contains    []string
+		notContains []string
+		err         string
+	}{
+		{
+			name:  "defaults",
+			table: "my-project.my_dataset.assets",
+			contains: []string{
+				"FROM my-project.my_dataset.assets",
+				`WHEN "k8s.io/Pod" THEN`,
+				`WHEN "batch.k8s.io/CronJob" THEN`,
+				`WHEN "run.googleapis.com/Service" THEN`,
+				`WHEN "run.googleapis.com/Job" THEN`,
+				"'$.spec.jobTemplate.spec.template.spec.initContainers'",
+				`asset_type IN ("batch.k8s.io/CronJob", "k8s.io/Pod", "run.googleapis.com/Job", "run.googleapis.com/Service")`,
+			},
+		},
+		{
+			name:       "selected",
+			table:      "`my-project.my_dataset.assets`",
+			assetTypes: []string{"apps.k8s.io/Deployment"},
+			contains: []string{
+				`WHEN "apps.k8s.io/Deployment" THEN`,
+				"'$.spec.template.spec.containers'",
+			},
+			notContains: []string{
+				`"k8s.io/Pod"`,
+				"ancestors",
+			},
+		},
+		{
+			name:  "folder_scope",
+			table: "assets",
+			scope: "folders/123456789012",
+			contains: []string{
+				`AND "folders/123456789012" IN UNNEST(ancestors)`,
+			},
+		},
+		{
+			name:  "project_scope",
+			table: "assets",
+			scope: "projects/123456789012",
+			contains: []string{
+				`AND "projects/123456789012" IN UNNEST(ancestors)`,
+			},
+		},
+		{
+			name:  "invalid_scope",
+			table: "assets",
+			scope: `folders/1" OR TRUE`,
+			err:   "invalid scope",
+		},
+		{
+			name:  "project_id_scope",
+			table: "assets",
+			scope: "projects/my-project",
+			err:   "invalid scope",
+		},
+		{
+			name:       "custom_paths",
+			table:      "assets",
+			assetTypes: []string{"cloudfunctions.googleapis.com/Function", "k8s.io/Pod"},
+			customPaths: map[string][]string{
+				"cloudfunctions.googleapis.com/Function": {"$.serviceConfig.containers"},
+				"k8s.io/Pod":                             {"$.spec.containers"},
+			},
+			contains: []string{
+				`WHEN "cloudfunctions.googleapis.com/Function" THEN`,
+				"'$.serviceConfig.containers'",
+			},
+			notContains: []string{
+				"initContainers",
+			},
+		},
+		{
+			name:       "unsupported",
+			table:      "assets",
+			assetTypes: []string{"example.com/Thing"},
+			err:        "unsupported asset type",
+		},
+		{
+			name:       "invalid_type",
+			table:      "assets",
+			assetTypes: []string{`k8s.io/Pod" OR 1=1`},
+			err:        "invalid asset type",
+		},
+		{
+			name:       "invalid_path",
+			table:      "assets",
+			assetTypes: []string{"k8s.io/Pod"},
+			customPaths: map[string][]string{
+				"k8s.io/Pod": {"$.spec'); DROP TABLE x; --"},
+			},
+			err: "invalid container path",
+		},
+		{
+			name:  "invalid_table",
+			table: "assets; DROP TABLE x",
+			err:   "invalid table name",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			query, err := buildInUseQuery(tc.table, tc.assetTypes, tc.customPaths, tc.scope)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected error %v to contain %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, want := range tc.contains {
+				if !strings.Contains(query, want) {
+					t.Errorf("expected query to contain %q:\n%s", want, query)
+				}
+			}
+			for _, want := range tc.notContains {
+				if strings.Contains(query, want) {
+					t.Errorf("expected query to not contain %q:\n%s", want, query)
+				}
+			}
+		})
+	}
+}
+
+func TestRegisterInUseAssetType(t *testing.T) {
+	t.Parallel()
+
+	if err := RegisterInUseAssetType("example.com/Widget", "$.spec.containers"); err != nil {
+		t.Fatal(err)
+	}
+
+	query, err := buildInUseQuery("assets", []string{"example.com/Widget"}, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `WHEN "example.com/Widget" THEN`; !strings.Contains(query, want) {
+		t.Errorf("expected query to contain %q:\n%s", want, query)
+	}
+
+	cases := []struct {
+		name      string
+		assetType string
+		paths     []string
+		err       string
+	}{
+		{
+			name:      "invalid_type",
+			assetType: "Widget",
+			paths:     []string{"$.spec.containers"},
+			err:       "invalid asset type",
+		},
+		{
+			name:      "no_paths",
+			assetType: "example.com/Gadget",
+			err:       "no container paths",
+		},
+		{
+			name:      "invalid_path",
+			assetType: "example.com/Gadget",
+			paths:     []string{"$.spec'"},
+			err:       "invalid container path",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			err := RegisterInUseAssetType(tc.assetType, tc.paths...)
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Fatalf("expected error %v to contain %q", err, tc.err)
+			}
+		})
+	}
+}
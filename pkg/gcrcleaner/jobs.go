@@ -0,0 +1,259 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+)
+
+// defaultJobTTL is the default time a completed job is kept.
+const defaultJobTTL = time.Hour
+
+// jobStatus is the status of an asynchronous clean job.
+type jobStatus string
+
+const (
+	jobStatusRunning jobStatus = "running"
+	jobStatusDone    jobStatus = "done"
+	jobStatusFailed  jobStatus = "failed"
+)
+
+// job is an asynchronous clean job.
+type job struct {
+	ID       string        `json:"id"`
+	Status   jobStatus     `json:"status"`
+	Progress cleanProgress `json:"progress"`
+
+	// Result is the clean response. It is only set when the job is done.
+	Result *CleanResponse `json:"result,omitempty"`
+
+	// Error is the error message. It is only set when the job failed.
+	Error string `json:"error,omitempty"`
+
+	// ErrorCode is the stable, machine-readable code for Error.
+	ErrorCode ErrorCode `json:"error_code,omitempty"`
+
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// jobStore is an in-memory store of jobs. Completed jobs are removed once they
+// are older than the TTL. It is safe for concurrent use.
+type jobStore struct {
+	lock sync.Mutex
+	jobs map[string]*job
+
+	// ttl is how long completed jobs are kept. If zero, they are kept forever.
+	ttl time.Duration
+}
+
+// newJobStore creates a new job store.
+func newJobStore(ttl time.Duration) *jobStore {
+	return &jobStore{
+		jobs: make(map[string]*job),
+		ttl:  ttl,
+	}
+}
+
+// Create creates a new running job and returns a copy of it.
+func (s *jobStore) Create() (*job, error) {
+	id, err := randomID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate job id: %w", err)
+	}
+
+	j := &job{
+		ID:        id,
+		Status:    jobStatusRunning,
+		StartedAt: time.Now().UTC(),
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.expireLocked(time.Now())
+	s.jobs[j.ID] = j
+
+	cp := *j
+	return &cp, nil
+}
+
+// Get returns a copy of the job with the given ID.
+func (s *jobStore) Get(id string) (*job, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.expireLocked(time.Now())
+
+	j, ok := s.jobs[id]
+	if !ok {
+		return nil, false
+	}
+
+	cp := *j
+	return &cp, true
+}
+
+// Update calls fn with the job with the given ID while holding the lock. It
+// does nothing if the job does not exist.
+func (s *jobStore) Update(id string, fn func(j *job)) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if j, ok := s.jobs[id]; ok {
+		fn(j)
+	}
+}
+
+// expireLocked removes completed jobs that are older than the TTL. The caller
+// must hold the lock.
+func (s *jobStore) expireLocked(now time.Time) {
+	if s.ttl <= 0 {
+		return
+	}
+
+	for id, j := range s.jobs {
+		if j.FinishedAt != nil && now.Sub(*j.FinishedAt) > s.ttl {
+			delete(s.jobs, id)
+		}
+	}
+}
+
+// StartJobHandler is an http handler that starts the cleaner in the background
+// with the given parameters. It immediately responds with the job, whose
+// status can be polled with JobStatusHandler.
+func (s *Server) StartJobHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			err := fmt.Errorf("method %s is not allowed", r.Method)
+			s.handleError(w, err, http.StatusMethodNotAllowed)
+			return
+		}
+
+		// Read the body now, since it is closed when the handler returns.
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			err = fmt.Errorf("failed to read payload: %w", err)
+			s.handleError(w, err, 500)
+			return
+		}
+		if !json.Valid(body) {
+			err := fmt.Errorf("failed to decode payload as JSON")
+			s.handleError(w, err, 400)
+			return
+		}
+
+		if err := s.background.start(false); err != nil {
+			s.handleError(w, err, http.StatusServiceUnavailable)
+			return
+		}
+
+		j, err := s.jobs.Create()
+		if err != nil {
+			s.background.done()
+			s.handleError(w, err, 500)
+			return
+		}
+
+		// Use the job ID as the request ID, unless one was given, so logs can be
+		// correlated with the job.
+		requestID := r.Header.Get(requestIDHeader)
+		if !isValidRequestID(requestID) {
+			requestID = j.ID
+		}
+		w.Header().Set(requestIDHeader, requestID)
+		rs := s.forRequest(requestID)
+
+		go func() {
+			defer s.background.done()
+
+			// Intentionally don't use the request context, since it terminates but
+			// the background job should still be processing. Instead, it is
+			// cancelled after the server's job timeout.
+			ctx, cancel := context.WithTimeout(context.Background(), s.jobTimeout)
+			defer cancel()
+
+			resp, status, err := rs.clean(ctx, io.NopCloser(bytes.NewReader(body)), func(p cleanProgress) {
+				// Don't hold on to the repository's result for the life of the job.
+				p.result = nil
+				s.jobs.Update(j.ID, func(j *job) {
+					j.Progress = p
+				})
+			})
+			if err != nil {
+				if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+					err = fmt.Errorf("timed out after %s: %w", s.jobTimeout, err)
+				}
+				rs.logger.Error("failed to clean", "job", j.ID, "error", err)
+			}
+
+			s.jobs.Update(j.ID, func(j *job) {
+				now := time.Now().UTC()
+				j.FinishedAt = &now
+
+				if err != nil {
+					j.Status = jobStatusFailed
+					j.Error = err.Error()
+					j.ErrorCode = errorCodeFor(err, status)
+					return
+				}
+				j.Status = jobStatusDone
+				j.Result = resp
+			})
+		}()
+
+		s.writeJob(w, http.StatusAccepted, j)
+	}
+}
+
+// JobStatusHandler is an http handler that returns the status of the job whose
+// ID is the last element of the path, such as "/jobs/{id}".
+func (s *Server) JobStatusHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := path.Base(r.URL.Path)
+
+		j, ok := s.jobs.Get(id)
+		if !ok {
+			err := fmt.Errorf("job %q not found", id)
+			s.handleError(w, err, http.StatusNotFound)
+			return
+		}
+
+		s.writeJob(w, http.StatusOK, j)
+	}
+}
+
+// writeJob writes the job as JSON.
+func (s *Server) writeJob(w http.ResponseWriter, status int, j *job) {
+	b, err := json.Marshal(j)
+	if err != nil {
+		err = fmt.Errorf("failed to marshal JSON job: %w", err)
+		s.handleError(w, err, 500)
+		return
+	}
+
+	w.Header().Set(contentTypeHeader, contentTypeJSON)
+	w.WriteHeader(status)
+	fmt.Fprint(w, string(b))
+}
@@ -0,0 +1,213 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJobStore(t *testing.T) {
+	t.Parallel()
+
+	s := newJobStore(time.Minute)
+
+	j, err := s.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := j.Status, jobStatusRunning; got != want {
+		t.Errorf("expected status %q to be %q", got, want)
+	}
+
+	s.Update(j.ID, func(j *job) {
+		j.Progress.ReposDone = 1
+	})
+
+	got, ok := s.Get(j.ID)
+	if !ok {
+		t.Fatalf("expected job %q to exist", j.ID)
+	}
+	if got, want := got.Progress.ReposDone, 1; got != want {
+		t.Errorf("expected repos done %d to be %d", got, want)
+	}
+
+	// Running jobs never expire.
+	s.lock.Lock()
+	s.jobs[j.ID].StartedAt = time.Now().Add(-time.Hour)
+	s.lock.Unlock()
+	if _, ok := s.Get(j.ID); !ok {
+		t.Errorf("expected running job to exist")
+	}
+
+	// Completed jobs expire after the TTL.
+	s.Update(j.ID, func(j *job) {
+		finished := time.Now().Add(-2 * time.Minute)
+		j.FinishedAt = &finished
+		j.Status = jobStatusDone
+	})
+	if _, ok := s.Get(j.ID); ok {
+		t.Errorf("expected completed job to expire")
+	}
+
+	if _, ok := s.Get("missing"); ok {
+		t.Errorf("expected missing job to not exist")
+	}
+}
+
+func TestServer_Jobs(t *testing.T) {
+	t.Parallel()
+
+	server := testServer(t)
+
+	t.Run("method_not_allowed", func(t *testing.T) {
+		t.Parallel()
+
+		w := httptest.NewRecorder()
+		server.StartJobHandler().ServeHTTP(w, httptest.NewRequest("GET", "/jobs", nil))
+
+		if got, want := w.Code, 405; got != want {
+			t.Errorf("expected status %d to be %d", got, want)
+		}
+	})
+
+	t.Run("invalid_json", func(t *testing.T) {
+		t.Parallel()
+
+		w := httptest.NewRecorder()
+		server.StartJobHandler().ServeHTTP(w, httptest.NewRequest("POST", "/jobs", strings.NewReader("not json")))
+
+		if got, want := w.Code, 400; got != want {
+			t.Errorf("expected status %d to be %d", got, want)
+		}
+	})
+
+	t.Run("not_found", func(t *testing.T) {
+		t.Parallel()
+
+		w := httptest.NewRecorder()
+		server.JobStatusHandler().ServeHTTP(w, httptest.NewRequest("GET", "/jobs/missing", nil))
+
+		if got, want := w.Code, 404; got != want {
+			t.Errorf("expected status %d to be %d", got, want)
+		}
+	})
+
+	t.Run("done", func(t *testing.T) {
+		t.Parallel()
+
+		w := httptest.NewRecorder()
+		body := strings.NewReader(`{"repos": [], "skip_in_use_check": true}`)
+		server.StartJobHandler().ServeHTTP(w, httptest.NewRequest("POST", "/jobs", body))
+
+		if got, want := w.Code, 202; got != want {
+			t.Fatalf("expected status %d to be %d: %s", got, want, w.Body.String())
+		}
+
+		var started job
+		if err := json.NewDecoder(w.Body).Decode(&started); err != nil {
+			t.Fatal(err)
+		}
+		if started.ID == "" {
+			t.Fatalf("expected job id")
+		}
+
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			w := httptest.NewRecorder()
+			server.JobStatusHandler().ServeHTTP(w, httptest.NewRequest("GET", "/jobs/"+started.ID, nil))
+
+			if got, want := w.Code, 200; got != want {
+				t.Fatalf("expected status %d to be %d: %s", got, want, w.Body.String())
+			}
+
+			var j job
+			if err := json.NewDecoder(w.Body).Decode(&j); err != nil {
+				t.Fatal(err)
+			}
+
+			if j.Status == jobStatusDone {
+				if j.Result == nil {
+					t.Errorf("expected result")
+				}
+				if j.FinishedAt == nil {
+					t.Errorf("expected finished at")
+				}
+				return
+			}
+			if j.Status == jobStatusFailed {
+				t.Fatalf("expected job to succeed: %s", j.Error)
+			}
+
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for job, status %q", j.Status)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+}
+
+func TestServer_Jobs_Timeout(t *testing.T) {
+	t.Parallel()
+
+	// The registry never responds, so the job can only finish by timing out.
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	t.Cleanup(registry.Close)
+
+	server := testServer(t, WithJobTimeout(50*time.Millisecond))
+
+	repo := strings.TrimPrefix(registry.URL, "http://") + "/my-repo"
+	body := strings.NewReader(`{"repos": ["` + repo + `"], "skip_in_use_check": true}`)
+
+	w := httptest.NewRecorder()
+	server.StartJobHandler().ServeHTTP(w, httptest.NewRequest("POST", "/jobs", body))
+	if got, want := w.Code, 202; got != want {
+		t.Fatalf("expected status %d to be %d: %s", got, want, w.Body.String())
+	}
+
+	var started job
+	if err := json.NewDecoder(w.Body).Decode(&started); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		j, ok := server.jobs.Get(started.ID)
+		if !ok {
+			t.Fatalf("expected job %q to exist", started.ID)
+		}
+
+		if j.Status == jobStatusFailed {
+			if !strings.Contains(j.Error, "timed out after 50ms") {
+				t.Errorf("expected %q to contain %q", j.Error, "timed out after 50ms")
+			}
+			return
+		}
+		if j.Status == jobStatusDone {
+			t.Fatalf("expected job to time out")
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for job, status %q", j.Status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,207 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/GoogleCloudPlatform/gcr-cleaner/internal/worker"
+	gcrname "github.com/google/go-containerregistry/pkg/name"
+	gcrv1 "github.com/google/go-containerregistry/pkg/v1"
+	gcrremote "github.com/google/go-containerregistry/pkg/v1/remote"
+	gcrtypes "github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// labelCacheMaxEntries is the maximum number of manifests in the label cache.
+// When it is full, it is cleared.
+const labelCacheMaxEntries = 10000
+
+// labelCache caches the labels of manifests by digest. Manifests are immutable,
+// so entries never expire. A nil cache caches nothing.
+type labelCache struct {
+	lock   sync.Mutex
+	labels map[string]map[string]string
+}
+
+// newLabelCache creates an empty label cache.
+func newLabelCache() *labelCache {
+	return &labelCache{
+		labels: make(map[string]map[string]string),
+	}
+}
+
+// get returns the cached labels of the digest, if any.
+func (lc *labelCache) get(digest string) (map[string]string, bool) {
+	if lc == nil {
+		return nil, false
+	}
+
+	lc.lock.Lock()
+	defer lc.lock.Unlock()
+	labels, ok := lc.labels[digest]
+	return labels, ok
+}
+
+// set caches the labels of the digest.
+func (lc *labelCache) set(digest string, labels map[string]string) {
+	if lc == nil {
+		return
+	}
+
+	lc.lock.Lock()
+	defer lc.lock.Unlock()
+	if len(lc.labels) >= labelCacheMaxEntries {
+		lc.labels = make(map[string]map[string]string)
+	}
+	lc.labels[digest] = labels
+}
+
+// ParseKeepLabels parses a list of "key=value" pairs into a map. Values may be
+// empty, but keys may not.
+func ParseKeepLabels(pairs []string) (map[string]string, error) {
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+
+	labels := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid label %q: must be key=value", pair)
+		}
+		labels[key] = value
+	}
+	return labels, nil
+}
+
+// matchKeepLabel returns the first of the keep labels, as "key=value", that the
+// labels have, or the empty string if there are none.
+func matchKeepLabel(labels, keepLabels map[string]string) string {
+	keys := make([]string, 0, len(keepLabels))
+	for key := range keepLabels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if value, ok := labels[key]; ok && value == keepLabels[key] {
+			return key + "=" + value
+		}
+	}
+	return ""
+}
+
+// labelResult is the result of fetching the labels of a single manifest.
+type labelResult struct {
+	digest string
+	labels map[string]string
+	err    error
+}
+
+// manifestLabels fetches the labels of each of the given manifests. Errors
+// fetching a manifest are returned in its result. Only context errors are
+// returned directly.
+func (c *Cleaner) manifestLabels(ctx context.Context, gcrrepo gcrname.Repository, digests []string, opts *CleanOptions) ([]*labelResult, error) {
+	w := worker.New[*labelResult](c.concurrency)
+	for _, digest := range digests {
+		digest := digest
+
+		if err := w.Do(ctx, func() (*labelResult, error) {
+			if labels, ok := c.labels.get(digest); ok {
+				return &labelResult{digest: digest, labels: labels}, nil
+			}
+
+			if err := opts.limiter.Wait(ctx); err != nil {
+				return nil, err
+			}
+
+			labels, err := c.fetchLabels(ctx, gcrrepo.Digest(digest))
+			if err != nil {
+				return &labelResult{digest: digest, err: err}, nil
+			}
+			c.labels.set(digest, labels)
+			return &labelResult{digest: digest, labels: labels}, nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	results, err := w.Done(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]*labelResult, 0, len(results))
+	for _, result := range results {
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		out = append(out, result.Value)
+	}
+	return out, nil
+}
+
+// fetchLabels returns the annotations of the manifest, merged with the labels
+// of its image config. Image indexes and manifests whose config is not an
+// image config, such as signatures, only have annotations. Annotations take
+// precedence over labels with the same key.
+func (c *Cleaner) fetchLabels(ctx context.Context, ref gcrname.Digest) (map[string]string, error) {
+	desc, err := gcrremote.Get(ref, c.remoteOptions(ctx)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get manifest %s: %w", ref, err)
+	}
+
+	labels := make(map[string]string)
+	if desc.MediaType.IsIndex() {
+		idx, err := gcrv1.ParseIndexManifest(bytes.NewReader(desc.Manifest))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse index %s: %w", ref, err)
+		}
+		for k, v := range idx.Annotations {
+			labels[k] = v
+		}
+		return labels, nil
+	}
+
+	m, err := gcrv1.ParseManifest(bytes.NewReader(desc.Manifest))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse manifest %s: %w", ref, err)
+	}
+
+	switch m.Config.MediaType {
+	case gcrtypes.DockerConfigJSON, gcrtypes.OCIConfigJSON:
+		img, err := desc.Image()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get image %s: %w", ref, err)
+		}
+		cfg, err := img.ConfigFile()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get config of %s: %w", ref, err)
+		}
+		for k, v := range cfg.Config.Labels {
+			labels[k] = v
+		}
+	}
+
+	for k, v := range m.Annotations {
+		labels[k] = v
+	}
+	return labels, nil
+}
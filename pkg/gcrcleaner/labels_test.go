@@ -0,0 +1,173 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	gcrauthn "github.com/google/go-containerregistry/pkg/authn"
+	gcrgoogle "github.com/google/go-containerregistry/pkg/v1/google"
+)
+
+func TestParseKeepLabels(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name  string
+		pairs []string
+		exp   map[string]string
+		err   string
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name:  "pairs",
+			pairs: []string{"keep=true", "team=", "a=b=c"},
+			exp:   map[string]string{"keep": "true", "team": "", "a": "b=c"},
+		},
+		{
+			name:  "missing_value",
+			pairs: []string{"keep"},
+			err:   "must be key=value",
+		},
+		{
+			name:  "missing_key",
+			pairs: []string{"=true"},
+			err:   "must be key=value",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := ParseKeepLabels(tc.pairs)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected error %v to contain %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := tc.exp; !reflect.DeepEqual(got, want) {
+				t.Errorf("expected %v to be %v", got, want)
+			}
+		})
+	}
+}
+
+func TestMatchKeepLabel(t *testing.T) {
+	t.Parallel()
+
+	keep := map[string]string{"keep": "true", "pinned": "yes"}
+
+	cases := []struct {
+		labels map[string]string
+		exp    string
+	}{
+		{nil, ""},
+		{map[string]string{"keep": "false"}, ""},
+		{map[string]string{"keep": "true"}, "keep=true"},
+		{map[string]string{"pinned": "yes", "keep": "true"}, "keep=true"},
+		{map[string]string{"other": "true"}, ""},
+	}
+
+	for _, tc := range cases {
+		if got, want := matchKeepLabel(tc.labels, keep), tc.exp; got != want {
+			t.Errorf("expected %q to be %q", got, want)
+		}
+	}
+}
+
+func TestDecideWithIndexes_KeepLabels(t *testing.T) {
+	t.Parallel()
+
+	registry := newTestRegistry(t)
+	gcrrepo := registry.repo(t, "my-repo")
+
+	old := time.Date(2023, time.October, 1, 0, 0, 0, 0, time.UTC)
+	labeled := registry.push(t, gcrrepo, testImage(t, old, map[string]string{"keep": "true"}, nil))
+	annotated := registry.push(t, gcrrepo, testImage(t, old, nil, map[string]string{"keep": "true"}))
+	other := registry.push(t, gcrrepo, testImage(t, old, map[string]string{"keep": "false"}, nil))
+	failing := "sha256:" + strings.Repeat("f", 64)
+	registry.failRef(failing)
+
+	manifests := []*manifest{
+		{Digest: labeled, Info: gcrgoogle.ManifestInfo{Uploaded: old}},
+		{Digest: annotated, Info: gcrgoogle.ManifestInfo{Uploaded: old}},
+		{Digest: other, Info: gcrgoogle.ManifestInfo{Uploaded: old}},
+		{Digest: failing, Info: gcrgoogle.ManifestInfo{Uploaded: old}},
+	}
+
+	cleaner := &Cleaner{
+		keychain:    gcrauthn.NewMultiKeychain(),
+		logger:      NewLogger("error", io.Discard, io.Discard),
+		concurrency: 1,
+		labels:      newLabelCache(),
+	}
+	opts := &CleanOptions{
+		Since:            time.Date(2023, time.November, 1, 0, 0, 0, 0, time.UTC),
+		RepoKeepFilter:   &ItemFilterNull{},
+		RepoPrefixFilter: &ItemFilterNull{},
+		TagFilter:        &ItemFilterNull{},
+		TagKeepFilter:    &ItemFilterNull{},
+		PodFilter:        &PodFilterNull{},
+		KeepLabels:       map[string]string{"keep": "true"},
+	}
+
+	for i := 0; i < 2; i++ {
+		decisions, toDelete, err := cleaner.decideWithIndexes(context.Background(), gcrrepo, manifests, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		reasons := make(map[string]string, len(decisions))
+		for _, d := range decisions {
+			reasons[d.Digest] = d.Reason
+		}
+		exp := map[string]string{
+			labeled:   ReasonKeepLabel,
+			annotated: ReasonKeepLabel,
+			other:     ReasonUntagged,
+			failing:   ReasonLabelFailed,
+		}
+		if got, want := reasons, exp; !reflect.DeepEqual(got, want) {
+			t.Errorf("expected reasons %v to be %v", got, want)
+		}
+
+		if got, want := len(toDelete), 1; got != want {
+			t.Fatalf("expected %d to delete to be %d", got, want)
+		}
+		if got, want := toDelete[0].Digest, other; got != want {
+			t.Errorf("expected %q to be %q", got, want)
+		}
+	}
+
+	// The second decision uses the cached labels, and only fetches the manifest
+	// that failed again.
+	if got, want := registry.fetchCount(), 5; got != want {
+		t.Errorf("expected %d fetches to be %d", got, want)
+	}
+}
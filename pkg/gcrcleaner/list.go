@@ -0,0 +1,146 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	gcrname "github.com/google/go-containerregistry/pkg/name"
+	gcrgoogle "github.com/google/go-containerregistry/pkg/v1/google"
+	gcrtransport "github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+// listPageSize is the number of tags requested per page. ECR rejects more than
+// 1000, and the other registries accept it.
+const listPageSize = 1000
+
+// listGoogle lists the manifests in a Container Registry or Artifact Registry
+// repository, keyed by digest. Unlike google.List, which returns the first
+// page as soon as it includes manifests, it follows the Link header until the
+// last page, so large repositories are listed completely.
+func (c *Cleaner) listGoogle(ctx context.Context, gcrrepo gcrname.Repository, opts *CleanOptions) (map[string]gcrgoogle.ManifestInfo, error) {
+	auth, err := c.keychain.Resolve(gcrrepo)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve credentials: %w", err)
+	}
+
+	inner := gcrtransport.NewUserAgent(gcrtransport.NewRetry(c.httpTransport()), userAgent)
+	scopes := []string{gcrrepo.Scope(gcrtransport.PullScope)}
+	tr, err := gcrtransport.NewWithContext(ctx, gcrrepo.Registry, auth, inner, scopes)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Transport: tr}
+
+	uri := &url.URL{
+		Scheme:   gcrrepo.Registry.Scheme(),
+		Host:     gcrrepo.Registry.RegistryStr(),
+		Path:     fmt.Sprintf("/v2/%s/tags/list", gcrrepo.RepositoryStr()),
+		RawQuery: fmt.Sprintf("n=%d", listPageSize),
+	}
+
+	manifests := make(map[string]gcrgoogle.ManifestInfo, 32)
+	for page := 0; uri != nil; page++ {
+		// The first page was already rate limited by the caller.
+		if page > 0 {
+			if err := opts.limiter.Wait(ctx); err != nil {
+				return nil, err
+			}
+		}
+
+		var tags gcrgoogle.Tags
+		uri, err = listPage(ctx, client, uri, &tags)
+		if err != nil {
+			return nil, err
+		}
+
+		// A manifest is listed once, but guard against a registry repeating it
+		// on the next page with more tags.
+		for digest, info := range tags.Manifests {
+			if existing, ok := manifests[digest]; ok {
+				info.Tags = appendMissing(existing.Tags, info.Tags)
+			}
+			manifests[digest] = info
+		}
+	}
+	return manifests, nil
+}
+
+// listPage fetches a single page of the tag listing into tags and returns the
+// URL of the next page, or nil if it is the last page.
+func listPage(ctx context.Context, client *http.Client, uri *url.URL, tags *gcrgoogle.Tags) (*url.URL, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if err := gcrtransport.CheckError(resp, http.StatusOK); err != nil {
+		return nil, err
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(tags); err != nil {
+		return nil, fmt.Errorf("failed to decode tags: %w", err)
+	}
+	return nextPageURL(resp)
+}
+
+// nextPageURL returns the URL of the next page from the response's Link header,
+// resolved against the request URL, or nil if there is no next page.
+func nextPageURL(resp *http.Response) (*url.URL, error) {
+	link := resp.Header.Get("Link")
+	if link == "" {
+		return nil, nil
+	}
+
+	start, end := strings.Index(link, "<"), strings.Index(link, ">")
+	if start != 0 || end == -1 {
+		return nil, fmt.Errorf("failed to parse link header %q", link)
+	}
+
+	next, err := url.Parse(link[1:end])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse link header %q: %w", link, err)
+	}
+	if resp.Request == nil || resp.Request.URL == nil {
+		return next, nil
+	}
+	return resp.Request.URL.ResolveReference(next), nil
+}
+
+// appendMissing appends the values in add that are not already in list.
+func appendMissing(list, add []string) []string {
+	seen := make(map[string]struct{}, len(list))
+	for _, v := range list {
+		seen[v] = struct{}{}
+	}
+	for _, v := range add {
+		if _, ok := seen[v]; !ok {
+			seen[v] = struct{}{}
+			list = append(list, v)
+		}
+	}
+	return list
+}
@@ -0,0 +1,206 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	gcrauthn "github.com/google/go-containerregistry/pkg/authn"
+	gcrtypes "github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// fakePagedRegistry serves each page of manifests in turn, linking to the next
+// page like Artifact Registry does for large repositories. Each page maps a
+// digest to its tags.
+type fakePagedRegistry struct {
+	pages []map[string][]string
+
+	deletes int32
+}
+
+func (f *fakePagedRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/v2/":
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodDelete:
+		atomic.AddInt32(&f.deletes, 1)
+		w.WriteHeader(http.StatusAccepted)
+	case strings.HasSuffix(r.URL.Path, "/tags/list"):
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		if page >= len(f.pages) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if page+1 < len(f.pages) {
+			next := url.URL{Path: r.URL.Path, RawQuery: fmt.Sprintf("n=1000&page=%d", page+1)}
+			w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"next\"", next.String()))
+		}
+
+		manifests := make(map[string]any, len(f.pages[page]))
+		for digest, tags := range f.pages[page] {
+			if tags == nil {
+				tags = []string{}
+			}
+			manifests[digest] = map[string]any{
+				"mediaType":      string(gcrtypes.DockerManifestSchema2),
+				"tag":            tags,
+				"timeCreatedMs":  "1600000000000",
+				"timeUploadedMs": "1600000000000",
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]any{
+			"manifest": manifests,
+		})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestCleaner_ListGoogle_Pages(t *testing.T) {
+	t.Parallel()
+
+	digests := make([]string, 0, 5)
+	for i := 1; i <= 5; i++ {
+		digests = append(digests, "sha256:"+strings.Repeat(strconv.Itoa(i), 64))
+	}
+
+	registry := &fakePagedRegistry{
+		pages: []map[string][]string{
+			{digests[0]: nil, digests[1]: {"a"}},
+			{digests[2]: nil, digests[1]: {"b"}},
+			{digests[3]: nil, digests[4]: nil},
+		},
+	}
+	srv := httptest.NewServer(registry)
+	t.Cleanup(srv.Close)
+
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	cleaner, err := NewCleaner(gcrauthn.NewMultiKeychain(), NewLogger("error", io.Discard, io.Discard), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deleted, decisions, err := cleaner.CleanWithOptions(context.Background(), host+"/proj/a", &CleanOptions{
+		Since:            time.Now().UTC(),
+		RepoKeepFilter:   &ItemFilterNull{},
+		RepoPrefixFilter: &ItemFilterNull{},
+		TagFilter:        &ItemFilterNull{},
+		TagKeepFilter:    &ItemFilterNull{},
+		PodFilter:        &PodFilterNull{},
+		DryRun:           true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every manifest on every page is considered.
+	got := make([]string, 0, len(decisions))
+	for _, d := range decisions {
+		got = append(got, d.Digest)
+		if d.Digest == digests[1] {
+			if want := []string{"a", "b"}; !reflect.DeepEqual(d.Tags, want) {
+				t.Errorf("expected tags %q to be %q", d.Tags, want)
+			}
+		}
+	}
+	sort.Strings(got)
+	if want := digests; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected decisions for %q to be for %q", got, want)
+	}
+
+	// The tagged manifest is kept by the default tag filter.
+	if got, want := len(deleted), 4; got != want {
+		t.Errorf("expected %d deleted refs to be %d: %q", got, want, deleted)
+	}
+}
+
+func TestNextPageURL(t *testing.T) {
+	t.Parallel()
+
+	base, err := url.Parse("https://gcr.io/v2/p/r/tags/list?n=1000")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name string
+		link string
+		exp  string
+		err  bool
+	}{
+		{
+			name: "none",
+		},
+		{
+			name: "relative",
+			link: `</v2/p/r/tags/list?n=1000&last=abc>; rel="next"`,
+			exp:  "https://gcr.io/v2/p/r/tags/list?n=1000&last=abc",
+		},
+		{
+			name: "absolute",
+			link: `<https://us-docker.pkg.dev/v2/p/r/tags/list?page=2>; rel="next"`,
+			exp:  "https://us-docker.pkg.dev/v2/p/r/tags/list?page=2",
+		},
+		{
+			name: "missing_brackets",
+			link: `/v2/p/r/tags/list; rel="next"`,
+			err:  true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			resp := &http.Response{
+				Header:  http.Header{},
+				Request: &http.Request{URL: base},
+			}
+			if tc.link != "" {
+				resp.Header.Set("Link", tc.link)
+			}
+
+			next, err := nextPageURL(resp)
+			if (err != nil) != tc.err {
+				t.Fatalf("expected error %t, got %v", tc.err, err)
+			}
+
+			var got string
+			if next != nil {
+				got = next.String()
+			}
+			if want := tc.exp; got != want {
+				t.Errorf("expected %q to be %q", got, want)
+			}
+		})
+	}
+}
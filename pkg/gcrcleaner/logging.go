@@ -19,9 +19,12 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
+	"unicode"
 )
 
 type Severity uint8
@@ -54,16 +57,75 @@ var (
 	}
 )
 
+// LogFormat is the output format of a Logger.
+type LogFormat string
+
+const (
+	// LogFormatJSON writes each entry as a single line of JSON. This is the
+	// default, and is what Cloud Logging expects.
+	LogFormatJSON LogFormat = "json"
+
+	// LogFormatText writes each entry as a single line of text, with the time,
+	// severity, and message followed by key=value pairs.
+	LogFormatText LogFormat = "text"
+)
+
 type Logger struct {
-	level Severity
+	level  Severity
+	format LogFormat
 
 	stdout io.Writer
 	stderr io.Writer
 
-	lock sync.Mutex
+	// fields are added to every entry, before the fields given to each call.
+	fields []any
+
+	// lock is shared with derived loggers, since they write to the same
+	// writers.
+	lock *sync.Mutex
+}
+
+// LoggerOption is an option to NewLogger.
+type LoggerOption func(l *Logger)
+
+// WithLogFormat sets the output format. The empty string means LogFormatJSON.
+func WithLogFormat(format LogFormat) LoggerOption {
+	return func(l *Logger) {
+		l.format = format
+	}
 }
 
-func NewLogger(level string, outw, errw io.Writer) *Logger {
+func NewLogger(level string, outw, errw io.Writer, opts ...LoggerOption) *Logger {
+	v, err := parseSeverity(level)
+	if err != nil {
+		panic(err.Error())
+	}
+
+	l := &Logger{
+		level:  v,
+		format: LogFormatJSON,
+		stdout: outw,
+		stderr: errw,
+		lock:   &sync.Mutex{},
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+
+	switch l.format {
+	case LogFormatJSON, LogFormatText:
+	case "":
+		l.format = LogFormatJSON
+	default:
+		panic(fmt.Sprintf("failed to parse log format %q: must be %q or %q",
+			l.format, LogFormatJSON, LogFormatText))
+	}
+
+	return l
+}
+
+// parseSeverity parses the given level name. The empty string is "INFO".
+func parseSeverity(level string) (Severity, error) {
 	normalized := strings.ToUpper(strings.TrimSpace(level))
 	if normalized == "" {
 		normalized = "INFO"
@@ -71,10 +133,36 @@ func NewLogger(level string, outw, errw io.Writer) *Logger {
 
 	v, ok := nameSeverityMap[normalized]
 	if !ok {
-		panic(fmt.Sprintf("failed to parse level %q: not found", normalized))
+		return 0, fmt.Errorf("failed to parse level %q: not found", normalized)
+	}
+	return v, nil
+}
+
+// WithLevel returns a copy of the logger that writes to the same outputs at
+// the given level. The original logger is not modified.
+func (l *Logger) WithLevel(level string) (*Logger, error) {
+	v, err := parseSeverity(level)
+	if err != nil {
+		return nil, err
 	}
 
-	return &Logger{level: v, stdout: outw, stderr: errw}
+	cp := *l
+	cp.level = v
+	return &cp, nil
+}
+
+// With returns a copy of the logger that adds the given key/value pairs to
+// every entry. The original logger is not modified.
+func (l *Logger) With(fields ...any) *Logger {
+	if len(fields)%2 != 0 {
+		panic("number of fields must be even")
+	}
+
+	cp := *l
+	cp.fields = make([]any, 0, len(l.fields)+len(fields))
+	cp.fields = append(cp.fields, l.fields...)
+	cp.fields = append(cp.fields, fields...)
+	return &cp
 }
 
 func (l *Logger) Debug(msg string, fields ...any) {
@@ -107,6 +195,10 @@ func (l *Logger) log(w io.Writer, msg string, sev Severity, fields ...any) {
 		return
 	}
 
+	if len(l.fields) > 0 {
+		fields = append(append(make([]any, 0, len(l.fields)+len(fields)), l.fields...), fields...)
+	}
+
 	data := make(map[string]any, len(fields)/2)
 	for i := 0; i < len(fields); i += 2 {
 		key, ok := fields[i].(string)
@@ -114,29 +206,50 @@ func (l *Logger) log(w io.Writer, msg string, sev Severity, fields ...any) {
 			panic(fmt.Errorf("field %d is not a string (%T, %q)", i, fields[i], fields[i]))
 		}
 
-		switch typ := fields[i+1].(type) {
-		case error:
-			data[key] = typ.Error()
-		default:
-			data[key] = typ
-		}
+		data[key] = logValue(fields[i+1])
 	}
 
-	jsonPayload, err := json.Marshal(&LogEntry{
+	entry := &LogEntry{
 		Time:     timePtr(time.Now().UTC()),
 		Severity: sev,
 		Message:  msg,
 		Data:     data,
-	})
-	if err != nil {
-		panic(fmt.Errorf("failed to marshal log entry: %w", err))
+	}
+
+	var line string
+	switch l.format {
+	case LogFormatText:
+		line = entry.text()
+	default:
+		b, err := json.Marshal(entry)
+		if err != nil {
+			panic(fmt.Errorf("failed to marshal log entry: %w", err))
+		}
+		line = string(b)
 	}
 
 	l.lock.Lock()
-	fmt.Fprintln(w, string(jsonPayload))
+	fmt.Fprintln(w, line)
 	l.lock.Unlock()
 }
 
+// logValue converts errors to strings, since they usually have no exported
+// fields and would otherwise be logged as empty objects.
+func logValue(v any) any {
+	switch typ := v.(type) {
+	case error:
+		return typ.Error()
+	case []error:
+		msgs := make([]string, 0, len(typ))
+		for _, err := range typ {
+			msgs = append(msgs, err.Error())
+		}
+		return msgs
+	default:
+		return typ
+	}
+}
+
 type LogEntry struct {
 	Time     *time.Time
 	Severity Severity
@@ -161,6 +274,68 @@ func (l *LogEntry) MarshalJSON() ([]byte, error) {
 	return json.Marshal(d)
 }
 
+// text formats the entry as a single line of text. Fields are sorted by key.
+// Strings are quoted if they contain spaces or special characters, and other
+// values are formatted as JSON. The message is quoted only if it contains
+// newlines or other control characters, so every entry stays on one line.
+func (l *LogEntry) text() string {
+	var b strings.Builder
+
+	if l.Time != nil {
+		b.WriteString(l.Time.Format(time.RFC3339))
+		b.WriteString(" ")
+	}
+	b.WriteString(severityNameMap[l.Severity])
+	b.WriteString(" ")
+	if hasNonPrintable(l.Message) {
+		b.WriteString(strconv.Quote(l.Message))
+	} else {
+		b.WriteString(l.Message)
+	}
+
+	keys := make([]string, 0, len(l.Data))
+	for k := range l.Data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		b.WriteString(" ")
+		b.WriteString(k)
+		b.WriteString("=")
+		b.WriteString(textValue(l.Data[k]))
+	}
+
+	return b.String()
+}
+
+// textValue formats a single value for the text format.
+func textValue(v any) string {
+	switch typ := v.(type) {
+	case string:
+		if typ == "" || strings.ContainsAny(typ, " =\"\\") || hasNonPrintable(typ) {
+			return strconv.Quote(typ)
+		}
+		return typ
+	case fmt.Stringer:
+		return textValue(typ.String())
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return textValue(fmt.Sprintf("%v", v))
+	}
+	return string(b)
+}
+
+// hasNonPrintable returns true if s contains a rune that is not printable,
+// such as a newline or another control character.
+func hasNonPrintable(s string) bool {
+	return strings.IndexFunc(s, func(r rune) bool {
+		return !unicode.IsPrint(r)
+	}) >= 0
+}
+
 func timePtr(t time.Time) *time.Time {
 	if t.IsZero() {
 		return nil
@@ -0,0 +1,221 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLogger(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name   string
+		format LogFormat
+		check  func(tb testing.TB, line string)
+	}{
+		{
+			name:   "json",
+			format: LogFormatJSON,
+			check: func(tb testing.TB, line string) {
+				var got map[string]any
+				if err := json.Unmarshal([]byte(line), &got); err != nil {
+					tb.Fatalf("expected %q to be JSON: %s", line, err)
+				}
+				delete(got, "time")
+
+				want := map[string]any{
+					"severity": "ERROR",
+					"message":  "failed",
+					"error":    "oops",
+					"errors":   []any{"a", "b"},
+					"repo":     "gcr.io/my-project/my-image",
+					"count":    float64(3),
+				}
+				if !reflect.DeepEqual(got, want) {
+					tb.Errorf("expected %v to be %v", got, want)
+				}
+			},
+		},
+		{
+			name:   "text",
+			format: LogFormatText,
+			check: func(tb testing.TB, line string) {
+				want := ` ERROR failed count=3 error=oops errors=["a","b"] repo=gcr.io/my-project/my-image`
+				if !strings.HasSuffix(line, want) {
+					tb.Errorf("expected %q to end with %q", line, want)
+				}
+			},
+		},
+		{
+			name:   "default",
+			format: "",
+			check: func(tb testing.TB, line string) {
+				if !json.Valid([]byte(line)) {
+					tb.Errorf("expected %q to be JSON", line)
+				}
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			var stdout, stderr bytes.Buffer
+			logger := NewLogger("info", &stdout, &stderr, WithLogFormat(tc.format))
+
+			logger.Debug("hidden")
+			logger.Error("failed",
+				"error", fmt.Errorf("oops"),
+				"errors", []error{fmt.Errorf("a"), fmt.Errorf("b")},
+				"repo", "gcr.io/my-project/my-image",
+				"count", 3)
+
+			if got := stdout.String(); got != "" {
+				t.Errorf("expected stdout to be empty, got %q", got)
+			}
+			tc.check(t, strings.TrimSuffix(stderr.String(), "\n"))
+		})
+	}
+}
+
+func TestTextValue(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name string
+		in   any
+		exp  string
+	}{
+		{name: "plain", in: "abc", exp: "abc"},
+		{name: "empty", in: "", exp: `""`},
+		{name: "spaces", in: "a b", exp: `"a b"`},
+		{name: "quotes", in: `a"b`, exp: `"a\"b"`},
+		{name: "newline", in: "a\nb", exp: `"a\nb"`},
+		{name: "carriage_return", in: "a\rb", exp: `"a\rb"`},
+		{name: "control", in: "a\x1bb", exp: `"a\x1bb"`},
+		{name: "unicode", in: "ünïcode", exp: "ünïcode"},
+		{name: "stringer_newline", in: testStringer("a\nb"), exp: `"a\nb"`},
+		{name: "number", in: 1.5, exp: "1.5"},
+		{name: "bool", in: true, exp: "true"},
+		{name: "slice", in: []string{"a", "b"}, exp: `["a","b"]`},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got, want := textValue(tc.in), tc.exp; got != want {
+				t.Errorf("expected %q to be %q", got, want)
+			}
+		})
+	}
+}
+
+type testStringer string
+
+func (s testStringer) String() string {
+	return string(s)
+}
+
+func TestLogger_TextEscapesNewlines(t *testing.T) {
+	t.Parallel()
+
+	var stdout bytes.Buffer
+	logger := NewLogger("info", &stdout, &stdout, WithLogFormat(LogFormatText))
+
+	logger.Info("failed to clean\nrepo", "error", "line 1\nline 2\r\nline 3")
+
+	out := stdout.String()
+	if got, want := strings.Count(out, "\n"), 1; got != want {
+		t.Errorf("expected %d lines to be %d: %q", got, want, out)
+	}
+
+	want := ` INFO "failed to clean\nrepo" error="line 1\nline 2\r\nline 3"` + "\n"
+	if !strings.HasSuffix(out, want) {
+		t.Errorf("expected %q to end with %q", out, want)
+	}
+}
+
+func TestLogger_WithLevel(t *testing.T) {
+	t.Parallel()
+
+	var stdout bytes.Buffer
+	logger := NewLogger("info", &stdout, &stdout)
+
+	debug, err := logger.WithLevel("debug")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger.Debug("from original")
+	debug.Debug("from derived")
+
+	got := stdout.String()
+	if strings.Contains(got, "from original") {
+		t.Errorf("expected original logger to stay at info: %q", got)
+	}
+	if !strings.Contains(got, "from derived") {
+		t.Errorf("expected derived logger to log at debug: %q", got)
+	}
+
+	if _, err := logger.WithLevel("chatty"); err == nil {
+		t.Errorf("expected error for unknown level")
+	}
+}
+
+func TestLogger_With(t *testing.T) {
+	t.Parallel()
+
+	var stdout bytes.Buffer
+	logger := NewLogger("info", &stdout, &stdout)
+	child := logger.With("request_id", "abc")
+
+	logger.Info("from original")
+	child.Info("from child", "repo", "gcr.io/my-project/my-image")
+
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	if got, want := len(lines), 2; got != want {
+		t.Fatalf("expected %d lines to be %d: %q", got, want, lines)
+	}
+
+	var original, derived map[string]any
+	if err := json.Unmarshal([]byte(lines[0]), &original); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &derived); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := original["request_id"]; ok {
+		t.Errorf("expected original logger to not have request_id: %v", original)
+	}
+	if got, want := derived["request_id"], "abc"; got != want {
+		t.Errorf("expected request_id %v to be %v", got, want)
+	}
+	if got, want := derived["repo"], "gcr.io/my-project/my-image"; got != want {
+		t.Errorf("expected repo %v to be %v", got, want)
+	}
+}
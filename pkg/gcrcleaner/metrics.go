@@ -0,0 +1,97 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/GoogleCloudPlatform/gcr-cleaner/internal/metrics"
+)
+
+// Metrics are the Prometheus metrics for clean operations. A nil *Metrics is
+// valid and records nothing.
+type Metrics struct {
+	registry *metrics.Registry
+
+	deletedRefs     *metrics.CounterVec
+	skippedInUse    *metrics.CounterVec
+	bytesFreed      *metrics.CounterVec
+	cleanErrors     *metrics.CounterVec
+	requests        *metrics.CounterVec
+	requestDuration *metrics.Histogram
+}
+
+// NewMetrics creates a new set of metrics in a new registry.
+func NewMetrics() *Metrics {
+	r := metrics.NewRegistry()
+
+	return &Metrics{
+		registry: r,
+
+		deletedRefs: r.NewCounterVec("gcrcleaner_deleted_refs_total",
+			"Number of refs (tags and digests) deleted.", "repo"),
+		skippedInUse: r.NewCounterVec("gcrcleaner_skipped_in_use_total",
+			"Number of manifests kept because they are in use.", "repo"),
+		bytesFreed: r.NewCounterVec("gcrcleaner_bytes_freed_total",
+			"Estimated number of bytes freed by deleting manifests with a known size.", "repo"),
+		cleanErrors: r.NewCounterVec("gcrcleaner_clean_errors_total",
+			"Number of repositories that failed to clean.", "repo"),
+		requests: r.NewCounterVec("gcrcleaner_clean_requests_total",
+			"Number of clean requests, by response status code.", "code"),
+		requestDuration: r.NewHistogram("gcrcleaner_clean_request_duration_seconds",
+			"Duration of clean requests.", nil),
+	}
+}
+
+// Handler returns an http handler that serves the metrics.
+func (m *Metrics) Handler() http.Handler {
+	if m == nil {
+		return http.NotFoundHandler()
+	}
+	return m.registry.Handler()
+}
+
+// recordClean records the result of cleaning a single repository. Deleted refs
+// and freed bytes are only recorded when the deletion actually happened.
+func (m *Metrics) recordClean(repo string, deleted []string, decisions []*Decision, dryRun bool, err error) {
+	if m == nil {
+		return
+	}
+
+	if err != nil {
+		m.cleanErrors.Inc(repo)
+		return
+	}
+
+	m.skippedInUse.Add(float64(len(filterDecisions(decisions, ReasonInUse))), repo)
+
+	if !dryRun {
+		m.deletedRefs.Add(float64(len(deleted)), repo)
+		m.bytesFreed.Add(float64(EstimateFreedBytes(decisions).Bytes), repo)
+	}
+}
+
+// recordRequest records a clean request with the given status code and start
+// time.
+func (m *Metrics) recordRequest(status int, start time.Time) {
+	if m == nil {
+		return
+	}
+
+	m.requests.Inc(strconv.Itoa(status))
+	m.requestDuration.Observe(time.Since(start).Seconds())
+}
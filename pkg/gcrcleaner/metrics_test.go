@@ -0,0 +1,89 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetrics_RecordClean(t *testing.T) {
+	t.Parallel()
+
+	m := NewMetrics()
+
+	decisions := []*Decision{
+		{Delete: true, Size: 100},
+		{Delete: false, Reason: ReasonInUse},
+		{Delete: false, Reason: ReasonTooNew},
+	}
+	m.recordClean("gcr.io/my/repo", []string{"a", "b"}, decisions, false, nil)
+	m.recordClean("gcr.io/my/repo", []string{"c"}, decisions, true, nil)
+	m.recordClean("gcr.io/my/other", nil, nil, false, fmt.Errorf("oops"))
+
+	if got, want := m.deletedRefs.Value("gcr.io/my/repo"), 2.0; got != want {
+		t.Errorf("expected deleted refs %v to be %v", got, want)
+	}
+	if got, want := m.skippedInUse.Value("gcr.io/my/repo"), 2.0; got != want {
+		t.Errorf("expected skipped in use %v to be %v", got, want)
+	}
+	if got, want := m.bytesFreed.Value("gcr.io/my/repo"), 100.0; got != want {
+		t.Errorf("expected bytes freed %v to be %v", got, want)
+	}
+	if got, want := m.cleanErrors.Value("gcr.io/my/other"), 1.0; got != want {
+		t.Errorf("expected clean errors %v to be %v", got, want)
+	}
+
+	// A nil metrics is valid and records nothing.
+	var nilMetrics *Metrics
+	nilMetrics.recordClean("gcr.io/my/repo", nil, nil, false, nil)
+}
+
+func TestServer_Metrics(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	m := NewMetrics()
+	server := testServer(t)
+	WithMetrics(m)(server)
+
+	if _, _, err := server.clean(ctx, io.NopCloser(strings.NewReader("not json")), nil); err == nil {
+		t.Fatal("expected error")
+	}
+
+	if got, want := m.requests.Value("500"), 1.0; got != want {
+		t.Errorf("expected requests %v to be %v", got, want)
+	}
+	if got, want := m.requestDuration.Count(), uint64(1); got != want {
+		t.Errorf("expected request duration count %v to be %v", got, want)
+	}
+
+	w := httptest.NewRecorder()
+	server.MetricsHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+	for _, want := range []string{
+		`gcrcleaner_clean_requests_total{code="500"} 1`,
+		`gcrcleaner_clean_request_duration_seconds_count 1`,
+		`# TYPE gcrcleaner_deleted_refs_total counter`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected %q to contain %q", body, want)
+		}
+	}
+}
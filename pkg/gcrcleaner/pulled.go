@@ -0,0 +1,84 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"context"
+	"time"
+)
+
+// PullTimeLister lists the time each manifest in a repository was last pulled,
+// for TimeSourcePulled.
+type PullTimeLister interface {
+	// ListPullTimes returns the last pull time of each manifest in the
+	// repository, keyed by digest. Manifests that were never pulled, or whose
+	// pull time is unknown, may be omitted.
+	ListPullTimes(ctx context.Context, repo string) (map[string]time.Time, error)
+}
+
+var _ PullTimeLister = (PullTimeListerFunc)(nil)
+
+// PullTimeListerFunc is a function that implements PullTimeLister.
+type PullTimeListerFunc func(ctx context.Context, repo string) (map[string]time.Time, error)
+
+// ListPullTimes implements PullTimeLister.
+func (f PullTimeListerFunc) ListPullTimes(ctx context.Context, repo string) (map[string]time.Time, error) {
+	return f(ctx, repo)
+}
+
+// WithPullTimeLister makes the cleaner use the given lister for the last pull
+// times of manifests when the time source is TimeSourcePulled. Registries do
+// not expose pull times through the registry API, so without a lister, every
+// manifest falls back to its upload time.
+func WithPullTimeLister(lister PullTimeLister) CleanerOption {
+	return func(c *cleanerConfig) {
+		c.pullTimes = lister
+	}
+}
+
+// applyPullTimes sets the last pull time of each manifest. Manifests without a
+// pull time fall back to their upload time, which is logged, since it makes
+// them look less recently used than they may be.
+func (c *Cleaner) applyPullTimes(ctx context.Context, repo string, manifests []*manifest) {
+	if c.pullTimes == nil {
+		c.logger.Warn("pull times are not available, falling back to upload time",
+			"repo", repo)
+		return
+	}
+
+	pulled, err := c.pullTimes.ListPullTimes(ctx, repo)
+	if err != nil {
+		c.logger.Warn("failed to list pull times, falling back to upload time",
+			"repo", repo,
+			"error", err)
+		return
+	}
+
+	var missing int
+	for _, m := range manifests {
+		t, ok := pulled[m.Digest]
+		if !ok || t.IsZero() {
+			missing++
+			continue
+		}
+		m.Pulled = t.UTC()
+	}
+
+	if missing > 0 {
+		c.logger.Info("some manifests have no pull time, falling back to upload time",
+			"repo", repo,
+			"manifests", missing)
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	gcrgoogle "github.com/google/go-containerregistry/pkg/v1/google"
+)
+
+func TestCleaner_ApplyPullTimes(t *testing.T) {
+	t.Parallel()
+
+	uploaded := time.Date(2023, time.October, 1, 0, 0, 0, 0, time.UTC)
+	pulled := time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC)
+
+	a := "sha256:" + strings.Repeat("a", 64)
+	b := "sha256:" + strings.Repeat("b", 64)
+
+	cases := []struct {
+		name   string
+		lister PullTimeLister
+		exp    map[string]time.Time
+	}{
+		{
+			name:   "no_lister",
+			lister: nil,
+			exp:    map[string]time.Time{a: uploaded, b: uploaded},
+		},
+		{
+			name: "lister_error",
+			lister: PullTimeListerFunc(func(ctx context.Context, repo string) (map[string]time.Time, error) {
+				return nil, fmt.Errorf("oops")
+			}),
+			exp: map[string]time.Time{a: uploaded, b: uploaded},
+		},
+		{
+			name: "partial",
+			lister: PullTimeListerFunc(func(ctx context.Context, repo string) (map[string]time.Time, error) {
+				if got, want := repo, "gcr.io/p/r"; got != want {
+					return nil, fmt.Errorf("expected %q to be %q", got, want)
+				}
+				return map[string]time.Time{a: pulled}, nil
+			}),
+			exp: map[string]time.Time{a: pulled, b: uploaded},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			cleaner := &Cleaner{
+				logger:    NewLogger("error", io.Discard, io.Discard),
+				pullTimes: tc.lister,
+			}
+
+			manifests := []*manifest{
+				{Repo: "gcr.io/p/r", Digest: a, Info: gcrgoogle.ManifestInfo{Uploaded: uploaded}},
+				{Repo: "gcr.io/p/r", Digest: b, Info: gcrgoogle.ManifestInfo{Uploaded: uploaded}},
+			}
+			cleaner.applyPullTimes(context.Background(), "gcr.io/p/r", manifests)
+
+			got := make(map[string]time.Time, len(manifests))
+			for _, m := range manifests {
+				got[m.Digest] = TimeSourcePulled.time(m)
+			}
+			if !reflect.DeepEqual(got, tc.exp) {
+				t.Errorf("expected %v to be %v", got, tc.exp)
+			}
+		})
+	}
+}
+
+func TestSortManifests_Pulled(t *testing.T) {
+	t.Parallel()
+
+	old := time.Date(2022, time.October, 1, 0, 0, 0, 0, time.UTC)
+	recent := time.Date(2024, time.October, 1, 0, 0, 0, 0, time.UTC)
+
+	a := "sha256:" + strings.Repeat("a", 64)
+	b := "sha256:" + strings.Repeat("b", 64)
+	c := "sha256:" + strings.Repeat("c", 64)
+
+	// a is the oldest upload but the most recently pulled, and c was never
+	// pulled, so it falls back to its upload time.
+	manifests := []*manifest{
+		{Digest: c, Info: gcrgoogle.ManifestInfo{Uploaded: old.Add(2 * time.Hour)}},
+		{Digest: b, Info: gcrgoogle.ManifestInfo{Uploaded: old.Add(time.Hour)}, Pulled: recent},
+		{Digest: a, Info: gcrgoogle.ManifestInfo{Uploaded: old}, Pulled: recent.Add(time.Hour)},
+	}
+	sortManifests(manifests, TimeSourcePulled)
+
+	got := make([]string, 0, len(manifests))
+	for _, m := range manifests {
+		got = append(got, m.Digest)
+	}
+	if exp := []string{a, b, c}; !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected %q to be %q", got, exp)
+	}
+}
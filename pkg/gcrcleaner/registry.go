@@ -0,0 +1,224 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/gcr-cleaner/internal/worker"
+	gcrauthn "github.com/google/go-containerregistry/pkg/authn"
+	gcrname "github.com/google/go-containerregistry/pkg/name"
+	gcrgoogle "github.com/google/go-containerregistry/pkg/v1/google"
+	gcrremote "github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// WithRegistry registers a registry that is not Container Registry or Artifact
+// Registry, such as Harbor, Quay, or a self-hosted registry. The registry is
+// given as a host, optionally with a port, such as "harbor.example.com".
+//
+// These registries do not report when each manifest was uploaded, so the tags
+// are listed with the standard registry API and each tagged manifest is fetched
+// to find when it was created, which is used as both timestamps. Images that do
+// not record a real created time, such as reproducible builds that set it to
+// the Unix epoch, are never deleted. Untagged manifests cannot be listed, so
+// they are never deleted. Manifests are deleted by digest, which also removes
+// their tags. In-use detection is not performed for the registry.
+//
+// If auth is nil, the cleaner's keychain is used to authenticate to the
+// registry.
+func WithRegistry(registry string, auth gcrauthn.Authenticator) CleanerOption {
+	return func(c *cleanerConfig) {
+		if c.registries == nil {
+			c.registries = make(map[string]gcrauthn.Authenticator, 4)
+		}
+		c.registries[registry] = auth
+	}
+}
+
+// minKnownCreated is the earliest created time that is trusted for images in a
+// registry given to WithRegistry. Reproducible builds commonly set the created
+// time to the Unix epoch or leave it empty, which would otherwise make a new
+// image appear decades old.
+var minKnownCreated = time.Date(2013, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// knownCreated returns true if the created time of an image can be trusted.
+func knownCreated(created time.Time) bool {
+	return !created.Before(minKnownCreated)
+}
+
+// registryKeychain is a keychain that authenticates registries with the
+// authenticators given to WithRegistry. Other registries resolve to anonymous,
+// so it can be used with gcrauthn.NewMultiKeychain.
+type registryKeychain struct {
+	auths map[string]gcrauthn.Authenticator
+}
+
+// Resolve implements gcrauthn.Keychain.
+func (k *registryKeychain) Resolve(target gcrauthn.Resource) (gcrauthn.Authenticator, error) {
+	if auth := k.auths[target.RegistryStr()]; auth != nil {
+		return auth, nil
+	}
+	return gcrauthn.Anonymous, nil
+}
+
+// isThirdPartyRegistry returns true if the repository is in a registry given to
+// WithRegistry.
+func (c *Cleaner) isThirdPartyRegistry(repo string) bool {
+	if len(c.registries) == 0 {
+		return false
+	}
+
+	gcrrepo, err := gcrname.NewRepository(repo)
+	if err != nil {
+		return false
+	}
+	_, ok := c.registries[gcrrepo.RegistryStr()]
+	return ok
+}
+
+// listThirdParty lists the tagged manifests in a repository in a registry
+// given to WithRegistry, keyed by digest. Each tag is fetched to find its
+// digest, and each manifest is fetched to find when it was created.
+func (c *Cleaner) listThirdParty(ctx context.Context, gcrrepo gcrname.Repository, opts *CleanOptions) (map[string]gcrgoogle.ManifestInfo, error) {
+	remoteOpts := c.remoteOptions(ctx)
+
+	tags, err := gcrremote.List(gcrrepo, remoteOpts...)
+	if err != nil {
+		return nil, err
+	}
+
+	manifests := make(map[string]gcrgoogle.ManifestInfo, len(tags))
+	var lock sync.Mutex
+
+	w := worker.New[struct{}](c.concurrency)
+	for _, tag := range tags {
+		tag := tag
+
+		if err := w.Do(ctx, func() (struct{}, error) {
+			if err := opts.limiter.Wait(ctx); err != nil {
+				return struct{}{}, err
+			}
+
+			desc, err := gcrremote.Get(gcrrepo.Tag(tag), remoteOpts...)
+			if err != nil {
+				return struct{}{}, fmt.Errorf("failed to get tag %s: %w", tag, err)
+			}
+			digest := desc.Digest.String()
+
+			// Tags that share a manifest only need to fetch it once.
+			lock.Lock()
+			info, ok := manifests[digest]
+			if ok {
+				info.Tags = append(info.Tags, tag)
+				manifests[digest] = info
+			}
+			lock.Unlock()
+			if ok {
+				return struct{}{}, nil
+			}
+
+			created, size, err := describeManifest(desc)
+			if err != nil {
+				return struct{}{}, fmt.Errorf("failed to describe tag %s: %w", tag, err)
+			}
+
+			lock.Lock()
+			defer lock.Unlock()
+
+			info, ok = manifests[digest]
+			if !ok {
+				info = gcrgoogle.ManifestInfo{
+					Size:      size,
+					MediaType: string(desc.MediaType),
+					Created:   created,
+					Uploaded:  created,
+				}
+			}
+			info.Tags = append(info.Tags, tag)
+			manifests[digest] = info
+			return struct{}{}, nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	results, err := w.Done(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, result := range results {
+		if result.Error != nil {
+			return nil, result.Error
+		}
+	}
+
+	// Tags are added in the order they were fetched.
+	for _, info := range manifests {
+		sort.Strings(info.Tags)
+	}
+	return manifests, nil
+}
+
+// describeManifest returns when the image was created and its size, which is
+// the total size of its config and layers. For image indexes, the creation time
+// is that of the first image, and the size is zero.
+func describeManifest(desc *gcrremote.Descriptor) (time.Time, uint64, error) {
+	if isIndexMediaType(string(desc.MediaType)) {
+		idx, err := desc.ImageIndex()
+		if err != nil {
+			return time.Time{}, 0, err
+		}
+		manifest, err := idx.IndexManifest()
+		if err != nil {
+			return time.Time{}, 0, err
+		}
+		if len(manifest.Manifests) == 0 {
+			return time.Time{}, 0, nil
+		}
+
+		img, err := idx.Image(manifest.Manifests[0].Digest)
+		if err != nil {
+			return time.Time{}, 0, err
+		}
+		config, err := img.ConfigFile()
+		if err != nil {
+			return time.Time{}, 0, err
+		}
+		return config.Created.Time, 0, nil
+	}
+
+	img, err := desc.Image()
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	config, err := img.ConfigFile()
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	manifest, err := img.Manifest()
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+
+	size := manifest.Config.Size
+	for _, layer := range manifest.Layers {
+		size += layer.Size
+	}
+	return config.Created.Time, uint64(size), nil
+}
@@ -0,0 +1,334 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	gcrauthn "github.com/google/go-containerregistry/pkg/authn"
+	gcrname "github.com/google/go-containerregistry/pkg/name"
+	gcrregistry "github.com/google/go-containerregistry/pkg/registry"
+	gcrv1 "github.com/google/go-containerregistry/pkg/v1"
+	gcrempty "github.com/google/go-containerregistry/pkg/v1/empty"
+	gcrmutate "github.com/google/go-containerregistry/pkg/v1/mutate"
+	gcrremote "github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// testRegistry is an in-memory registry that implements the standard registry
+// API. It records manifest requests, and manifest requests for the refs in
+// fail return a 500.
+type testRegistry struct {
+	host string
+
+	lock    sync.Mutex
+	fail    map[string]bool
+	fetches int
+	deletes []string
+}
+
+// newTestRegistry starts a new, empty testRegistry.
+func newTestRegistry(tb testing.TB) *testRegistry {
+	tb.Helper()
+
+	r := &testRegistry{fail: make(map[string]bool)}
+	handler := gcrregistry.New(gcrregistry.Logger(log.New(io.Discard, "", 0)))
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if _, ref, ok := strings.Cut(req.URL.Path, "/manifests/"); ok {
+			r.lock.Lock()
+			switch req.Method {
+			case http.MethodGet:
+				r.fetches++
+			case http.MethodDelete:
+				r.deletes = append(r.deletes, ref)
+			}
+			fail := r.fail[ref]
+			r.lock.Unlock()
+
+			if fail {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
+		handler.ServeHTTP(w, req)
+	}))
+	tb.Cleanup(srv.Close)
+
+	r.host = strings.TrimPrefix(srv.URL, "http://")
+	return r
+}
+
+// repo returns the repository with the given name in the registry.
+func (r *testRegistry) repo(tb testing.TB, name string) gcrname.Repository {
+	tb.Helper()
+
+	repo, err := gcrname.NewRepository(r.host + "/" + name)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return repo
+}
+
+// push pushes the image to the repository with each of the tags, or by digest
+// if there are none, and returns its digest. The push is not recorded.
+func (r *testRegistry) push(tb testing.TB, repo gcrname.Repository, img gcrv1.Image, tags ...string) string {
+	tb.Helper()
+
+	digest, err := img.Digest()
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	refs := []gcrname.Reference{repo.Digest(digest.String())}
+	if len(tags) > 0 {
+		refs = refs[:0]
+		for _, tag := range tags {
+			refs = append(refs, repo.Tag(tag))
+		}
+	}
+	for _, ref := range refs {
+		if err := gcrremote.Write(ref, img); err != nil {
+			tb.Fatal(err)
+		}
+	}
+
+	r.lock.Lock()
+	r.fetches, r.deletes = 0, nil
+	r.lock.Unlock()
+	return digest.String()
+}
+
+// failRef makes manifest requests for ref return a 500.
+func (r *testRegistry) failRef(ref string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.fail[ref] = true
+}
+
+// fetchCount returns the number of manifest fetches since the last push.
+func (r *testRegistry) fetchCount() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.fetches
+}
+
+// deleted returns the refs deleted since the last push, in order.
+func (r *testRegistry) deleted() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]string(nil), r.deletes...)
+}
+
+// testImage returns an empty image created at the given time, with the given
+// config labels and manifest annotations.
+func testImage(tb testing.TB, created time.Time, labels, annotations map[string]string) gcrv1.Image {
+	tb.Helper()
+
+	cfg, err := gcrempty.Image.ConfigFile()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	cfg = cfg.DeepCopy()
+	cfg.Created = gcrv1.Time{Time: created}
+	cfg.Architecture, cfg.OS = "amd64", "linux"
+	cfg.Config.Labels = labels
+
+	img, err := gcrmutate.ConfigFile(gcrempty.Image, cfg)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if len(annotations) > 0 {
+		img = gcrmutate.Annotations(img, annotations).(gcrv1.Image)
+	}
+	return img
+}
+
+func TestCleanRepos_ThirdPartyRegistry(t *testing.T) {
+	t.Parallel()
+
+	registry := newTestRegistry(t)
+	repo := registry.repo(t, "proj/app")
+	registry.push(t, repo, testImage(t, time.Now().UTC(), nil, nil), "new")
+	oldDigest := registry.push(t, repo, testImage(t, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), nil, nil), "old", "old-alias")
+
+	host := registry.host
+	logger := NewLogger("error", io.Discard, io.Discard)
+	cleaner, err := NewCleaner(gcrauthn.NewMultiKeychain(), logger, 2, WithRegistry(host, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := cleaner.CleanRepos(context.Background(), []string{host + "/proj/app"}, 1, &CleanOptions{
+		Since:            time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC),
+		RepoKeepFilter:   &ItemFilterNull{},
+		RepoPrefixFilter: &ItemFilterNull{},
+		TagFilter:        &ItemFilterAny{res: nil},
+		TagKeepFilter:    &ItemFilterNull{},
+		PodFilter:        &PodFilterNull{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing matches the tag filter, so nothing is deleted.
+	if got, want := CountDeletions(results), 0; got != want {
+		t.Errorf("expected %d deletions to be %d", got, want)
+	}
+
+	tagFilter, err := BuildItemFilter(".*", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err = cleaner.CleanRepos(context.Background(), []string{host + "/proj/app"}, 1, &CleanOptions{
+		Since:            time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC),
+		RepoKeepFilter:   &ItemFilterNull{},
+		RepoPrefixFilter: &ItemFilterNull{},
+		TagFilter:        tagFilter,
+		TagKeepFilter:    &ItemFilterNull{},
+		PodFilter:        &PodFilterNull{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := results[0].Deleted, []string{oldDigest}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+	for _, d := range results[0].Decisions {
+		if d.Digest == oldDigest {
+			if got, want := d.Tags, []string{"old", "old-alias"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("expected %q to be %q", got, want)
+			}
+		}
+	}
+
+	// The manifest is deleted by digest, without deleting its tags.
+	if got, want := registry.deleted(), []string{oldDigest}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected deletes %q to be %q", got, want)
+	}
+}
+
+func TestCleanRepos_ThirdPartyRegistryUnknownCreated(t *testing.T) {
+	t.Parallel()
+
+	registry := newTestRegistry(t)
+	repo := registry.repo(t, "proj/app")
+	oldDigest := registry.push(t, repo, testImage(t, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), nil, nil), "old")
+	epochDigest := registry.push(t, repo, testImage(t, time.Unix(0, 0).UTC(), nil, nil), "epoch")
+
+	host := registry.host
+	logger := NewLogger("error", io.Discard, io.Discard)
+	cleaner, err := NewCleaner(gcrauthn.NewMultiKeychain(), logger, 2, WithRegistry(host, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tagFilter, err := BuildItemFilter(".*", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := cleaner.CleanRepos(context.Background(), []string{host + "/proj/app"}, 1, &CleanOptions{
+		Since:            time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC),
+		MinAgeCutoff:     time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC),
+		RepoKeepFilter:   &ItemFilterNull{},
+		RepoPrefixFilter: &ItemFilterNull{},
+		TagFilter:        tagFilter,
+		TagKeepFilter:    &ItemFilterNull{},
+		PodFilter:        &PodFilterNull{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The epoch-created image could have been pushed at any time, so only the
+	// image with a real created time is deleted.
+	if got, want := results[0].Deleted, []string{oldDigest}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+
+	var found bool
+	for _, d := range results[0].Decisions {
+		if d.Digest == epochDigest {
+			found = true
+			if got, want := d.Reason, ReasonUnknownCreated; got != want {
+				t.Errorf("expected reason %q to be %q", got, want)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("expected a decision for %s", epochDigest)
+	}
+}
+
+func TestRegistryKeychain_Resolve(t *testing.T) {
+	t.Parallel()
+
+	auth := &gcrauthn.Basic{Username: "robot", Password: "secret"}
+	keychain := &registryKeychain{auths: map[string]gcrauthn.Authenticator{
+		"harbor.example.com": auth,
+		"quay.io":            nil,
+	}}
+
+	cases := []struct {
+		name string
+		repo string
+		exp  gcrauthn.Authenticator
+	}{
+		{
+			name: "configured",
+			repo: "harbor.example.com/proj/app",
+			exp:  auth,
+		},
+		{
+			name: "nil_auth",
+			repo: "quay.io/proj/app",
+			exp:  gcrauthn.Anonymous,
+		},
+		{
+			name: "other",
+			repo: "gcr.io/proj/app",
+			exp:  gcrauthn.Anonymous,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			repo, err := gcrname.NewRepository(tc.repo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := keychain.Resolve(repo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.exp {
+				t.Errorf("expected %v to be %v", got, tc.exp)
+			}
+		})
+	}
+}
@@ -15,15 +15,24 @@
 package gcrcleaner
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
+	"reflect"
+	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"cloud.google.com/go/bigquery"
@@ -32,30 +41,186 @@ import (
 
 	"golang.org/x/oauth2/google"
 	"google.golang.org/api/cloudresourcemanager/v1"
+	"google.golang.org/api/idtoken"
 	"google.golang.org/api/iterator"
 )
 
 const (
 	contentTypeHeader = "Content-Type"
 	contentTypeJSON   = "application/json"
+
+	// contentTypeText is a request body with one repository per line.
+	contentTypeText = "text/plain"
 )
 
+// defaultRepoConcurrency is the default number of repositories to clean in
+// parallel. Each repository also performs deletions in parallel, so this is
+// intentionally small.
+const defaultRepoConcurrency = 4
+
+// defaultPubSubTimeout is the default maximum duration of a clean started by a
+// pubsub request.
+const defaultPubSubTimeout = time.Hour
+
+// defaultJobTimeout is the default maximum duration of an asynchronous job.
+const defaultJobTimeout = time.Hour
+
 // Server is a cleaning server.
 type Server struct {
 	cleaner *Cleaner
 	logger  *Logger
+	metrics *Metrics
+
+	// inUseCache caches in-use images across requests.
+	inUseCache *imageCache
+
+	// requestID is the ID of the request, if the server is scoped to a single
+	// request by forRequest.
+	requestID string
+
+	// resultSink receives the result of each clean started by a pubsub request.
+	resultSink ResultSink
+
+	// background tracks cleans running in the background, so Shutdown can wait
+	// for them.
+	background *backgroundTracker
+
+	// notifiers receive the result of every clean.
+	notifiers []ResultSink
+
+	// requireConfirm forces a dry run unless the payload sets confirm.
+	requireConfirm bool
+
+	// allowedSubscriptions is the set of subscriptions pubsub requests are
+	// accepted from. If empty, requests from any subscription are accepted.
+	allowedSubscriptions map[string]struct{}
+
+	// pubSubTimeout is the maximum duration of a clean started by a pubsub
+	// request.
+	pubSubTimeout time.Duration
+
+	// jobs stores asynchronous clean jobs.
+	jobs   *jobStore
+	jobTTL time.Duration
+
+	// jobTimeout is the maximum duration of an asynchronous job.
+	jobTimeout time.Duration
+
+	// oidc is the configuration for verifying OIDC tokens. If nil, tokens are
+	// not verified.
+	oidc *oidcConfig
+
+	// validateToken validates an OIDC token. It is a field so tests can replace
+	// it.
+	validateToken func(ctx context.Context, token, audience string) (*idtoken.Payload, error)
+
+	// findCredentials finds the default credentials. It is a field so tests can
+	// replace it.
+	findCredentials func(ctx context.Context, scopes ...string) (*google.Credentials, error)
+
+	// queryImages runs an in-use query and returns the images. It is a field so
+	// tests can replace it.
+	queryImages func(ctx context.Context, query string, pageSize int) ([]string, error)
+}
+
+// ServerOption is an option to NewServer.
+type ServerOption func(s *Server)
+
+// WithMetrics sets the metrics the server records to. The default is a new set
+// of metrics from NewMetrics.
+func WithMetrics(m *Metrics) ServerOption {
+	return func(s *Server) {
+		s.metrics = m
+	}
+}
+
+// WithJobTTL sets how long completed asynchronous jobs are kept. If zero,
+// completed jobs are kept forever. The default is one hour.
+func WithJobTTL(ttl time.Duration) ServerOption {
+	return func(s *Server) {
+		s.jobTTL = ttl
+	}
+}
+
+// WithJobTimeout sets the maximum duration of an asynchronous job. When it is
+// exceeded, in-flight registry calls are cancelled and the job fails. The
+// default is one hour.
+func WithJobTimeout(timeout time.Duration) ServerOption {
+	return func(s *Server) {
+		s.jobTimeout = timeout
+	}
+}
+
+// WithPubSubTimeout sets the maximum duration of a clean started by a pubsub
+// request. When it is exceeded, in-flight registry calls are cancelled. The
+// default is one hour.
+func WithPubSubTimeout(timeout time.Duration) ServerOption {
+	return func(s *Server) {
+		s.pubSubTimeout = timeout
+	}
+}
+
+// WithRequireConfirm makes every clean a dry run unless the payload sets
+// "confirm" to true. This protects shared deployments from accidental
+// deletions. The default is false, which deletes unless the payload sets
+// "dry_run".
+func WithRequireConfirm(require bool) ServerOption {
+	return func(s *Server) {
+		s.requireConfirm = require
+	}
+}
+
+// WithAllowedSubscriptions restricts pubsub requests to the given
+// subscriptions, in the form "projects/<project>/subscriptions/<name>". This is
+// not a substitute for authenticating the push endpoint, but rejects messages
+// from unexpected subscriptions. The default is to accept any subscription.
+func WithAllowedSubscriptions(subscriptions ...string) ServerOption {
+	return func(s *Server) {
+		if len(subscriptions) == 0 {
+			s.allowedSubscriptions = nil
+			return
+		}
+
+		s.allowedSubscriptions = make(map[string]struct{}, len(subscriptions))
+		for _, sub := range subscriptions {
+			s.allowedSubscriptions[sub] = struct{}{}
+		}
+	}
 }
 
 // NewServer creates a new server for handler functions.
-func NewServer(cleaner *Cleaner) (*Server, error) {
+func NewServer(cleaner *Cleaner, opts ...ServerOption) (*Server, error) {
 	if cleaner == nil {
 		return nil, fmt.Errorf("missing cleaner")
 	}
 
-	return &Server{
+	s := &Server{
 		cleaner: cleaner,
 		logger:  cleaner.logger,
-	}, nil
+		metrics: NewMetrics(),
+
+		inUseCache:      newImageCache(),
+		background:      newBackgroundTracker(),
+		pubSubTimeout:   defaultPubSubTimeout,
+		jobTTL:          defaultJobTTL,
+		jobTimeout:      defaultJobTimeout,
+		validateToken:   validateIDToken,
+		findCredentials: google.FindDefaultCredentials,
+	}
+	// Use the cleaner's credentials, if configured, for the project ID.
+	if credentials := cleaner.credentials; credentials != nil {
+		s.findCredentials = func(_ context.Context, _ ...string) (*google.Credentials, error) {
+			return credentials, nil
+		}
+	}
+
+	s.queryImages = s.queryInUseImages
+
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.jobs = newJobStore(s.jobTTL)
+	return s, nil
 }
 
 // PubSubHandler is an http handler that invokes the cleaner from a pubsub
@@ -70,274 +235,1120 @@ func (s *Server) PubSubHandler(cache Cache) http.HandlerFunc {
 			return
 		}
 
+		if !s.isAllowedSubscription(m.Subscription) {
+			err := fmt.Errorf("subscription %q is not allowed", m.Subscription)
+			s.handleError(w, err, 400)
+			return
+		}
+
+		// Reject messages while shutting down, before they are marked as
+		// processed, so pubsub redelivers them.
+		if err := s.background.start(false); err != nil {
+			s.handleError(w, err, http.StatusServiceUnavailable)
+			return
+		}
+
 		// PubSub is "at least once" delivery. The cleaner is idempotent, but
 		// let's try to prevent unnecessary work by not processing messages we've
 		// already received.
 		msgID := m.Subscription + "/" + m.Message.ID
 		if exists := cache.Insert(msgID); exists {
+			s.background.done()
 			s.logger.Info("already processed message", "id", msgID)
 			w.WriteHeader(204)
 			return
 		}
 
 		if len(m.Message.Data) == 0 {
+			s.background.done()
 			err := fmt.Errorf("missing data in pubsub payload")
 			s.handleError(w, err, 400)
 			return
 		}
 
-		// Start a goroutine to delete the images
+		// Start a goroutine to delete the images. Logs are correlated by the
+		// message ID.
 		body := io.NopCloser(bytes.NewReader(m.Message.Data))
+		rs := s.forRequest(m.Message.ID)
 		go func() {
-			// Intentionally don't use the request context, since it terminates but
-			// the background job should still be processing.
-			ctx := context.Background()
-			if _, _, err := s.clean(ctx, body); err != nil {
-				s.logger.Error("failed to clean", "error", err)
-			}
+			defer s.background.done()
+			rs.cleanPubSub(body)
 		}()
 
 		w.WriteHeader(204)
 	}
 }
 
+// isAllowedSubscription returns true if pubsub requests from the subscription
+// are accepted.
+func (s *Server) isAllowedSubscription(subscription string) bool {
+	if len(s.allowedSubscriptions) == 0 {
+		return true
+	}
+	_, ok := s.allowedSubscriptions[subscription]
+	return ok
+}
+
+// cleanPubSub cleans in the background for a pubsub request. It intentionally
+// doesn't use the request context, since it terminates but the background job
+// should still be processing. Instead, it is cancelled after the server's
+// pubsub timeout, and the progress made so far is logged.
+func (s *Server) cleanPubSub(body io.ReadCloser) {
+	startedAt := time.Now().UTC()
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.pubSubTimeout)
+	defer cancel()
+
+	// All progress is reported before clean returns.
+	var progress cleanProgress
+	resp, _, err := s.clean(ctx, body, func(p cleanProgress) {
+		progress = p
+	})
+
+	s.reportResult(newCleanSummary(s.requestID, startedAt, resp, progress, err))
+
+	if err == nil {
+		return
+	}
+
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		s.logger.Error("timed out cleaning",
+			"timeout", s.pubSubTimeout.String(),
+			"repos_total", progress.ReposTotal,
+			"repos_done", progress.ReposDone,
+			"deleted", progress.Deleted,
+			"error", err)
+		return
+	}
+	s.logger.Error("failed to clean", "error", err)
+}
+
 // HTTPHandler is an http handler that invokes the cleaner with the given
-// parameters.
+// parameters. The response is a single JSON object, newline-delimited JSON if
+// the request accepts "application/x-ndjson", or a CSV of the deleted manifests
+// if the request accepts "text/csv".
 func (s *Server) HTTPHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
 
-		deleted, status, err := s.clean(ctx, r.Body)
+		requestID, err := requestIDFromHeader(r)
 		if err != nil {
-			s.handleError(w, err, status)
+			s.handleError(w, err, 500)
 			return
 		}
+		w.Header().Set(requestIDHeader, requestID)
+		rs := s.forRequest(requestID)
+
+		// Long repository lists can be sent as text, one per line, instead of a
+		// JSON payload.
+		if hasMediaType(r, contentTypeText) {
+			body, err := textPayloadBody(r.Body, r.URL.Query())
+			if err != nil {
+				rs.handleError(w, err, http.StatusBadRequest)
+				return
+			}
+			r.Body = body
+		}
 
-		refs := make([]string, 0, 16)
-		for _, v := range deleted {
-			refs = append(refs, v...)
+		// Large responses can be requested as NDJSON, which is written one
+		// repository at a time as each is cleaned.
+		if acceptsMediaType(r, contentTypeNDJSON) {
+			rs.cleanNDJSON(w, r)
+			return
 		}
-		sort.Strings(refs)
 
-		b, err := json.Marshal(&cleanResp{
-			Count:      len(deleted),
-			Refs:       refs,
-			RefsByRepo: deleted,
-		})
+		resp, status, err := rs.clean(ctx, r.Body, nil)
+		if err != nil {
+			rs.handleError(w, err, status)
+			return
+		}
+
+		// Deleted manifests can be exported as CSV for auditing.
+		if acceptsMediaType(r, contentTypeCSV) {
+			if err := writeCSV(w, resp); err != nil {
+				rs.logger.Error("failed to write response", "error", err)
+			}
+			return
+		}
+
+		b, err := json.Marshal(resp)
 		if err != nil {
 			err = fmt.Errorf("failed to marshal JSON errors: %w", err)
-			s.handleError(w, err, 500)
+			rs.handleError(w, err, 500)
 			return
 		}
 
-		w.WriteHeader(200)
 		w.Header().Set(contentTypeHeader, contentTypeJSON)
+		w.WriteHeader(status)
 		fmt.Fprint(w, string(b))
 	}
 }
 
-// clean reads the given body as JSON and starts a cleaner instance.
-func (s *Server) clean(ctx context.Context, r io.ReadCloser) (map[string][]string, int, error) {
+// cleanNDJSON cleans and writes the response as NDJSON. Errors that occur
+// before the first repository is cleaned are returned as regular JSON errors
+// with the appropriate status code. Later errors are written as the last line.
+func (s *Server) cleanNDJSON(w http.ResponseWriter, r *http.Request) {
+	// The request context is cancelled when the client disconnects. It is also
+	// cancelled if a line cannot be written.
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	stream := newNDJSONStream(w)
+
+	resp, status, err := s.clean(ctx, r.Body, func(p cleanProgress) {
+		if p.result == nil {
+			return
+		}
+		if err := stream.writeRepo(p.result, p.dryRun, p.countsOnly); err != nil {
+			s.logger.Debug("failed to write repo, cancelling", "error", err)
+			cancel()
+		}
+	})
+	if err != nil {
+		if !stream.isStarted() {
+			s.handleError(w, err, status)
+			return
+		}
+
+		s.logger.Error(err.Error(), "error", err)
+		if err := stream.writeError(err, errorCodeFor(err, status)); err != nil {
+			s.logger.Debug("failed to write error", "error", err)
+		}
+		return
+	}
+
+	if err := stream.writeSummary(resp); err != nil {
+		s.logger.Error("failed to write response", "error", err)
+	}
+}
+
+// HealthHandler is an http handler for liveness probes. It always succeeds if
+// the server is able to respond.
+func (s *Server) HealthHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.writeHealth(w, http.StatusOK, &healthResp{Status: healthStatusOK})
+	}
+}
+
+// ReadyHandler is an http handler for readiness probes. It verifies that
+// default credentials can be obtained and, if in-use detection is configured,
+// that a BigQuery client can be created. It does not make any calls to the
+// registry.
+func (s *Server) ReadyHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		credentials, err := s.findCredentials(ctx, cloudresourcemanager.CloudPlatformScope)
+		if err != nil {
+			s.writeHealth(w, http.StatusServiceUnavailable, &healthResp{
+				Status:  healthStatusUnavailable,
+				Message: fmt.Sprintf("failed to get default credentials: %s", err),
+			})
+			return
+		}
+
+		if os.Getenv("CLOUD_ASSET_INVENTORY_TABLE_NAME") != "" {
+			client, err := bigquery.NewClient(ctx, credentials.ProjectID, s.cleaner.clientOptions()...)
+			if err != nil {
+				s.writeHealth(w, http.StatusServiceUnavailable, &healthResp{
+					Status:  healthStatusUnavailable,
+					Message: fmt.Sprintf("failed to create BigQuery client: %s", err),
+				})
+				return
+			}
+			client.Close()
+		}
+
+		s.writeHealth(w, http.StatusOK, &healthResp{Status: healthStatusOK})
+	}
+}
+
+// writeHealth writes the health response as JSON.
+func (s *Server) writeHealth(w http.ResponseWriter, status int, resp *healthResp) {
+	b, err := json.Marshal(resp)
+	if err != nil {
+		err = fmt.Errorf("failed to marshal JSON health: %w", err)
+		s.handleError(w, err, 500)
+		return
+	}
+
+	w.Header().Set(contentTypeHeader, contentTypeJSON)
+	w.WriteHeader(status)
+	fmt.Fprint(w, string(b))
+}
+
+// MetricsHandler is an http handler that serves Prometheus metrics for clean
+// operations.
+func (s *Server) MetricsHandler() http.Handler {
+	return s.metrics.Handler()
+}
+
+// clean reads the given body as JSON and runs the payload. If onProgress is not
+// nil, it is called once the repositories are known and again as each
+// repository is cleaned.
+func (s *Server) clean(ctx context.Context, r io.ReadCloser, onProgress func(cleanProgress)) (*CleanResponse, int, error) {
 	var p Payload
 	if err := json.NewDecoder(r).Decode(&p); err != nil {
-		return nil, 500, fmt.Errorf("failed to decode payload as JSON: %w", err)
+		err = withErrorCode(ErrorCodeInvalidPayload, fmt.Errorf("failed to decode payload as JSON: %w", err))
+		s.metrics.recordRequest(500, time.Now())
+		s.notifyResult(time.Now(), nil, cleanProgress{}, err)
+		return nil, 500, err
+	}
+	return s.run(ctx, &p, onProgress)
+}
+
+// Run validates and cleans the payload, exactly as if it had been sent to the
+// HTTP endpoint, including filter building, in-use detection, and recursion.
+// The clean is recorded in the server's metrics and reported to its notifiers.
+// The payload is not modified. If some repositories failed to clean, the
+// response has their errors and the error is nil.
+func (s *Server) Run(ctx context.Context, p Payload) (*CleanResponse, error) {
+	resp, _, err := s.run(ctx, &p, nil)
+	return resp, err
+}
+
+// run implements Run and clean. It records the clean in the server's metrics
+// and notifies the server's notifiers.
+func (s *Server) run(ctx context.Context, p *Payload, onProgress func(cleanProgress)) (*CleanResponse, int, error) {
+	start := time.Now()
+
+	// Notifiers need the partial counts if the clean fails.
+	var progress cleanProgress
+	if len(s.notifiers) > 0 {
+		next := onProgress
+		onProgress = func(p cleanProgress) {
+			progress = p
+			if next != nil {
+				next(p)
+			}
+		}
+	}
+
+	resp, status, err := s.doRun(ctx, p, onProgress)
+	s.metrics.recordRequest(status, start)
+	s.notifyResult(start, resp, progress, err)
+	return resp, status, err
+}
+
+// doRun validates and cleans the payload.
+func (s *Server) doRun(ctx context.Context, p *Payload, onProgress func(cleanProgress)) (*CleanResponse, int, error) {
+	if err := p.Validate(); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	rs, err := s.withLogLevel(p.LogLevel)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	return rs.cleanPayload(ctx, p, onProgress)
+}
+
+// cleanPayload cleans the repositories in the decoded and validated payload.
+func (s *Server) cleanPayload(ctx context.Context, p *Payload, onProgress func(cleanProgress)) (*CleanResponse, int, error) {
+	start := time.Now()
+
+	// Unconfirmed requests are never allowed to delete when the server requires
+	// confirmation.
+	dryRunForced := s.requireConfirm && !p.Confirm && !p.DryRun
+	if dryRunForced {
+		p.DryRun = true
+	}
+
+	// The inventory and counts are only for planning, so they never delete
+	// anything.
+	if p.VerboseDryRun || p.CountsOnly {
+		p.DryRun = true
 	}
 
 	s.logger.Info("starting clean request",
 		"version", version.HumanVersion,
 		"payload", p)
 
+	now := time.Now().UTC()
+	since := p.since(now)
+
+	var minAgeCutoff time.Time
+	if p.MinAge > 0 {
+		minAgeCutoff = now.Add(-time.Duration(p.MinAge))
+	}
+
+	filterOpts := p.filterOptions()
+
+	repoKeepFilter, err := BuildItemFilter(p.RepoKeepFilterAny, "", filterOpts...)
+	if err != nil {
+		return nil, http.StatusBadRequest, withErrorCode(ErrorCodeInvalidFilter, fmt.Errorf("failed to build repo keep filter: %w", err))
+	}
+	s.logger.Debug("server: created repo keep filter", "filter", p.RepoKeepFilterAny)
+
+	repoPrefixFilter, err := BuildItemFilter(p.RepoMatchPrefixFilter, "", filterOpts...)
+	if err != nil {
+		return nil, http.StatusBadRequest, withErrorCode(ErrorCodeInvalidFilter, fmt.Errorf("failed to build repo prefix filter: %w", err))
+	}
+	s.logger.Debug("server: created repo prefix filter", "filter", p.RepoMatchPrefixFilter)
+
+	var repoMatchFilter ItemFilter
+	if len(p.ReposMatch) > 0 {
+		repoMatchFilter = NewItemFilterExact(p.ReposMatch)
+		s.logger.Debug("server: created repo match filter", "filter", repoMatchFilter.Name())
+	}
+
+	tagFilter, err := BuildItemFilter("", p.TagFilterAll,
+		append([]ItemFilterOption{WithNone(p.TagFilterNone)}, filterOpts...)...)
+	if err != nil {
+		return nil, http.StatusBadRequest, withErrorCode(ErrorCodeInvalidFilter, fmt.Errorf("failed to build tag filter: %w", err))
+	}
+
+	if patterns := p.tagFilterAnyPatterns(); len(patterns) > 0 {
+		if _, ok := tagFilter.(*ItemFilterNull); !ok {
+			return nil, http.StatusBadRequest, withErrorCode(ErrorCodeInvalidFilter, fmt.Errorf("failed to build tag filter: only one tag filter type may be specified"))
+		}
+
+		tagFilter, err = BuildItemFilterAny(patterns, filterOpts...)
+		if err != nil {
+			return nil, http.StatusBadRequest, withErrorCode(ErrorCodeInvalidFilter, fmt.Errorf("failed to build tag filter: %w", err))
+		}
+	}
+	s.logger.Debug("server: created tag filter any", "filter", p.tagFilterAnyPatterns())
+	s.logger.Debug("server: created tag filter all", "filter", p.TagFilterAll)
+	s.logger.Debug("server: created tag filter none", "filter", p.TagFilterNone)
+
+	if p.TagFilterSemver != "" {
+		if _, ok := tagFilter.(*ItemFilterNull); !ok {
+			return nil, http.StatusBadRequest, withErrorCode(ErrorCodeInvalidFilter, fmt.Errorf("failed to build tag filter: only one tag filter type may be specified"))
+		}
+
+		tagFilter, err = BuildSemverFilter(p.TagFilterSemver)
+		if err != nil {
+			return nil, http.StatusBadRequest, withErrorCode(ErrorCodeInvalidFilter, fmt.Errorf("failed to build tag filter: %w", err))
+		}
+		s.logger.Debug("server: created tag filter semver", "filter", p.TagFilterSemver)
+	}
+
+	if p.TagFilterNumber != nil {
+		if _, ok := tagFilter.(*ItemFilterNull); !ok {
+			return nil, http.StatusBadRequest, withErrorCode(ErrorCodeInvalidFilter, fmt.Errorf("failed to build tag filter: only one tag filter type may be specified"))
+		}
+
+		tagFilter, err = p.TagFilterNumber.build()
+		if err != nil {
+			return nil, http.StatusBadRequest, withErrorCode(ErrorCodeInvalidFilter, fmt.Errorf("failed to build tag filter: %w", err))
+		}
+		s.logger.Debug("server: created tag filter number", "filter", tagFilter.Name())
+	}
+
+	if len(p.TagFilterClauses) > 0 {
+		filters := make([]ItemFilter, 0, len(p.TagFilterClauses)+1)
+		if _, ok := tagFilter.(*ItemFilterNull); !ok {
+			filters = append(filters, tagFilter)
+		}
+
+		for i, clause := range p.TagFilterClauses {
+			filter, err := clause.build(filterOpts...)
+			if err != nil {
+				return nil, http.StatusBadRequest, withErrorCode(ErrorCodeInvalidFilter, fmt.Errorf("failed to build tag filter clause %d: %w", i, err))
+			}
+			filters = append(filters, filter)
+		}
+
+		tagFilter = NewItemFilterAnd(filters...)
+		s.logger.Debug("server: created tag filter clauses", "filter", tagFilter.Name())
+	}
+
+	tagKeepFilter, err := BuildItemFilter(p.TagKeepAny, "", filterOpts...)
+	if err != nil {
+		return nil, http.StatusBadRequest, withErrorCode(ErrorCodeInvalidFilter, fmt.Errorf("failed to build tag keep filter: %w", err))
+	}
+	s.logger.Debug("server: created tag keep filter", "filter", p.TagKeepAny)
+
+	if p.TagKeepSemver != "" {
+		if _, ok := tagKeepFilter.(*ItemFilterNull); !ok {
+			return nil, http.StatusBadRequest, withErrorCode(ErrorCodeInvalidFilter, fmt.Errorf("failed to build tag keep filter: only one tag keep filter type may be specified"))
+		}
+
+		tagKeepFilter, err = BuildSemverFilter(p.TagKeepSemver)
+		if err != nil {
+			return nil, http.StatusBadRequest, withErrorCode(ErrorCodeInvalidFilter, fmt.Errorf("failed to build tag keep filter: %w", err))
+		}
+		s.logger.Debug("server: created tag keep filter semver", "filter", p.TagKeepSemver)
+	}
+
+	if len(p.TagKeepExact) > 0 {
+		exact := NewItemFilterExact(p.TagKeepExact)
+		if _, ok := tagKeepFilter.(*ItemFilterNull); ok {
+			tagKeepFilter = exact
+		} else {
+			tagKeepFilter = NewItemFilterOr(tagKeepFilter, exact)
+		}
+		s.logger.Debug("server: created tag keep filter exact", "filter", tagKeepFilter.Name())
+	}
+
+	rules := make([]*repoRule, 0, len(p.RepoRules))
+	for i, r := range p.RepoRules {
+		rule, err := r.build(now, filterOpts...)
+		if err != nil {
+			return nil, http.StatusBadRequest, withErrorCode(ErrorCodeInvalidFilter, fmt.Errorf("failed to build repo rule %d: %w", i, err))
+		}
+		rules = append(rules, rule)
+	}
+
+	var keepGroupBy *regexp.Regexp
+	if p.KeepGroupBy != "" {
+		keepGroupBy, err = regexp.Compile(p.KeepGroupBy)
+		if err != nil {
+			return nil, http.StatusBadRequest, withErrorCode(ErrorCodeInvalidFilter, fmt.Errorf("failed to compile keep group regular expression %q: %w", p.KeepGroupBy, err))
+		}
+	}
+
+	// Gather all the repositories.
+	repos := UniqueRepositories(p.Repos)
+
+	// Expand any repository patterns, such as "gcr.io/my-project/team-*".
+	// Patterns can match repositories that were also given explicitly, so
+	// ensure each repository is only cleaned once.
+	repos, err = s.cleaner.ExpandRepositories(ctx, repos)
+	if err != nil {
+		return nil, http.StatusBadRequest, withErrorCode(ErrorCodeRepoListFailed, err)
+	}
+	repos = UniqueRepositories(repos)
+
+	// In-use detection only applies to Google registries.
+	inUseRepos := make([]string, 0, len(repos))
+	for _, repo := range repos {
+		if !s.cleaner.isThirdPartyRegistry(repo) {
+			inUseRepos = append(inUseRepos, repo)
+		}
+	}
+
+	var podFilter PodFilter = &PodFilterNull{}
+	var inUseErr error
+	if len(p.InUseImages) > 0 {
+		s.logger.Info("using the given in-use images instead of in-use image detection",
+			"images", len(p.InUseImages))
+		podFilter, err = NewStaticPodFilter(p.InUseImages)
+		if err != nil {
+			return nil, http.StatusBadRequest, withErrorCode(ErrorCodeInvalidFilter, err)
+		}
+	} else if p.SkipInUseCheck {
+		s.logger.Info("skipping in-use image detection")
+	} else if len(inUseRepos) == 0 {
+		s.logger.Info("skipping in-use image detection for third-party registries")
+	} else {
+		podFilter, err = s.inUseFilter(ctx, inUseRepos, &inUseOptions{
+			assetTypes: p.InUseAssetTypes,
+			assetPaths: p.InUseAssetPaths,
+			scope:      p.InUseScope,
+			cacheTTL:   time.Duration(p.InUseCacheTTL),
+			refresh:    p.InUseCacheRefresh,
+			pageSize:   p.InUsePageSize,
+		})
+		if err != nil {
+			// Most cleanups are tag-based and do not need in-use detection, so do not
+			// fail them because it is unavailable, for example in projects without
+			// access to the organization's assets. Any other failure, such as a
+			// transient BigQuery error or an image that cannot be parsed, fails the
+			// request, since continuing could delete images that are in use.
+			var uerr *inUseUnavailableError
+			if p.InUseStrict || !errors.As(err, &uerr) {
+				return nil, http.StatusInternalServerError, withErrorCode(ErrorCodeAssetListFailed, err)
+			}
+
+			s.logger.Warn("in-use image detection failed, continuing without it",
+				"error", err)
+			podFilter = &PodFilterNull{}
+			inUseErr = err
+		}
+	}
+
+	keepLabels, err := ParseKeepLabels(p.KeepLabels)
+	if err != nil {
+		return nil, http.StatusBadRequest, withErrorCode(ErrorCodeInvalidFilter, fmt.Errorf("failed to parse keep labels: %w", err))
+	}
+
+	var platformFilter ItemFilter
+	if p.PlatformFilter != "" {
+		platformFilter, err = BuildItemFilter(p.PlatformFilter, "", filterOpts...)
+		if err != nil {
+			return nil, http.StatusBadRequest, withErrorCode(ErrorCodeInvalidFilter, fmt.Errorf("failed to build platform filter: %w", err))
+		}
+		s.logger.Debug("server: created platform filter", "filter", p.PlatformFilter)
+	}
+
+	concurrency := p.Concurrency
+	if concurrency < 1 {
+		concurrency = defaultRepoConcurrency
+	}
+
+	cleanOpts := &CleanOptions{
+		Since:                  since,
+		TimeSource:             p.TimeSource,
+		MinAgeCutoff:           minAgeCutoff,
+		UploadedAfter:          time.Time(p.UploadedAfter),
+		UploadedBefore:         time.Time(p.UploadedBefore),
+		MinManifests:           p.MinManifests,
+		Keep:                   p.Keep,
+		KeepScope:              p.KeepScope,
+		KeepTagged:             p.KeepTagged,
+		KeepUntagged:           p.KeepUntagged,
+		KeepGroupBy:            keepGroupBy,
+		RepoKeepFilter:         repoKeepFilter,
+		RepoPrefixFilter:       repoPrefixFilter,
+		RepoMatchFilter:        repoMatchFilter,
+		TagFilter:              tagFilter,
+		TagKeepFilter:          tagKeepFilter,
+		PodFilter:              podFilter,
+		KeepDigests:            p.KeepDigests,
+		KeepLabels:             keepLabels,
+		TagKeepSemverHighest:   p.TagKeepSemverHighest,
+		KeepSignatures:         p.KeepSignatures,
+		PlatformFilter:         platformFilter,
+		UntaggedOnly:           p.UntaggedOnly,
+		OrphanedSignaturesOnly: p.OrphanedSignaturesOnly,
+		DryRun:                 p.DryRun,
+		MaxDelete:              p.MaxDelete,
+		RepoTimeout:            time.Duration(p.RepoTimeout),
+		ContinueOnError:        true,
+		RepoOptions:            repoRuleOptions(rules),
+
+		DeleteMaxAttempts:    p.DeleteMaxAttempts,
+		DeleteRetryBaseDelay: time.Duration(p.DeleteRetryBaseDelay),
+		DeleteJitter:         time.Duration(p.DeleteJitter),
+		MaxRequestsPerSecond: p.MaxDeletesPerSecond,
+		ListBestEffort:       p.RecursiveBestEffort,
+		Metrics:              s.metrics,
+	}
+
+	// Share one rate limiter between listing child repositories and cleaning.
+	cleanOpts = cleanOpts.WithSharedLimiter()
+
+	var listWarnings []string
+	if p.Recursive {
+		s.logger.Debug("gathering child repositories recursively")
+
+		// Nested roots are folded into their ancestor, since its children include
+		// them. Every root is still used to limit the depth.
+		allRepos, warnings, err := s.cleaner.ListChildRepositoriesPartial(ctx, CollapseRepositories(repos), cleanOpts)
+		if err != nil {
+			return nil, http.StatusBadRequest, withErrorCode(ErrorCodeRepoListFailed,
+				fmt.Errorf("failed to list child repositories: %w", err))
+		}
+		for _, warning := range warnings {
+			s.logger.Warn("skipping registry that could not be listed", "error", warning)
+			listWarnings = append(listWarnings, warning.Error())
+		}
+		s.logger.Debug("recursively listed child repositories",
+			"in", repos,
+			"out", allRepos)
+
+		// This is safe because ListChildRepositories is guaranteed to include at
+		// least the list repos given to it. Skip children that the repo filters
+		// exclude, so their manifests are never listed.
+		if p.MaxDepth != nil {
+			allRepos = LimitChildRepositoryDepth(repos, allRepos, *p.MaxDepth)
+		}
+
+		pruned := PruneChildRepositories(repos, allRepos, repoKeepFilter)
+		s.logger.Debug("pruned child repositories",
+			"in", len(allRepos),
+			"out", len(pruned))
+
+		// Each child counts towards the outermost root it is under.
+		if p.KeepAcrossRepos {
+			cleanOpts.KeepRoots = CollapseRepositories(repos)
+		}
+		repos = pruned
+	}
+
+	if len(p.ReposExclude) > 0 {
+		excluded, err := ExcludeRepositories(repos, p.ReposExclude)
+		if err != nil {
+			return nil, http.StatusBadRequest, withErrorCode(ErrorCodeInvalidFilter, err)
+		}
+		s.logger.Debug("excluded repositories",
+			"in", len(repos),
+			"out", len(excluded))
+		repos = excluded
+	}
+
+	s.logger.Info("deleting refs",
+		"since", since,
+		"repos", repos)
+
+	countsOnly := p.CountsOnly
+	if onProgress != nil {
+		var progressLock sync.Mutex
+		progress := cleanProgress{ReposTotal: len(repos)}
+		onProgress(progress)
+
+		cleanOpts.OnRepoDone = func(result *RepoResult) {
+			progressLock.Lock()
+			defer progressLock.Unlock()
+
+			progress.ReposDone++
+			progress.Deleted += len(result.Deleted)
+			progress.LastRepo = result.Repo
+
+			p := progress
+			p.result = result
+			p.dryRun = cleanOpts.DryRun
+			p.countsOnly = countsOnly
+			onProgress(p)
+		}
+	}
+
+	// Do the deletion.
+	results, err := s.cleaner.CleanRepos(ctx, repos, concurrency, cleanOpts)
+	if err != nil {
+		return nil, http.StatusBadRequest, withErrorCode(ErrorCodeRepoCleanFailed, err)
+	}
+
+	deleted := make(map[string][]string, len(results))
+	decisions := make(map[string][]*Decision, len(results))
+	deletedManifests := make(map[string][]*Decision, len(results))
+	freed := &FreedBytes{}
+	freedByRepo := make(map[string]*FreedBytes, len(results))
+	skippedInUse := make(map[string][]*Decision, len(results))
+	repoErrors := make(map[string]string)
+	var skippedMinManifests map[string]int
+	durations := make(map[string]int64, len(results))
+	phaseDurations := make(map[string]*phaseDurationsResp, len(results))
+	var deletedCount, keptCount, inUseCount int
+	for _, result := range results {
+		repo := result.Repo
+
+		if t := result.Timing; t != nil {
+			durations[repo] = t.Total().Milliseconds()
+			phaseDurations[repo] = &phaseDurationsResp{
+				Plan:   t.Plan.Milliseconds(),
+				Delete: t.Delete.Milliseconds(),
+			}
+		}
+
+		if result.Err != nil {
+			repoErrors[repo] = result.Err.Error()
+
+			// Refs deleted before the failure, such as a timeout, were still
+			// deleted.
+			if len(result.Deleted) > 0 {
+				deleted[repo] = append(deleted[repo], result.Deleted...)
+			}
+			continue
+		}
+
+		if cleanOpts.belowMinManifests(len(result.Decisions)) {
+			if skippedMinManifests == nil {
+				skippedMinManifests = make(map[string]int)
+			}
+			skippedMinManifests[repo] = len(result.Decisions)
+		}
+
+		for _, d := range result.Decisions {
+			if d == nil {
+				continue
+			}
+			if d.Delete {
+				deletedCount++
+			} else {
+				keptCount++
+			}
+		}
+
+		if len(result.Deleted) > 0 {
+			s.logger.Debug("deleted refs", "repo", repo, "refs", result.Deleted)
+			deleted[repo] = append(deleted[repo], result.Deleted...)
+		}
+
+		if len(result.Decisions) > 0 {
+			decisions[repo] = append(decisions[repo], result.Decisions...)
+		}
+
+		for _, d := range result.Decisions {
+			if d != nil && d.Delete {
+				deletedManifests[repo] = append(deletedManifests[repo], d)
+			}
+		}
+
+		if inUse := filterDecisions(result.Decisions, ReasonInUse); len(inUse) > 0 {
+			skippedInUse[repo] = inUse
+			inUseCount += len(inUse)
+		}
+
+		repoFreed := EstimateFreedBytes(result.Decisions)
+		freedByRepo[repo] = repoFreed
+		freed.Add(repoFreed)
+	}
+
+	s.logger.Debug("deleted refs", "refs", deleted, "dryRun", p.DryRun)
+
+	// Log a single summary line, which is easier to aggregate and alert on than
+	// the full list of refs.
+	s.logger.Info("clean summary",
+		"repos", len(results),
+		"deleted", deletedCount,
+		"kept", keptCount,
+		"skipped_in_use", inUseCount,
+		"failed", len(repoErrors),
+		"bytes_freed", freed.Bytes,
+		"bytes_freed_unknown_count", freed.UnknownCount,
+		"duration", time.Since(start).String(),
+		"dry_run", p.DryRun)
+
+	// The same digest can be deleted from more than one repository, but it is
+	// only listed once. RefsByRepo still has the refs of every repository.
+	seen := make(map[string]struct{}, 16)
+	refs := make([]string, 0, 16)
+	for _, v := range deleted {
+		for _, ref := range v {
+			if _, ok := seen[ref]; ok {
+				continue
+			}
+			seen[ref] = struct{}{}
+			refs = append(refs, ref)
+		}
+	}
+	sort.Strings(refs)
+
+	countByRepo := make(map[string]int, len(deleted))
+	for repo, v := range deleted {
+		countByRepo[repo] = len(v)
+	}
+
+	resp := &CleanResponse{
+		Count:       len(deleted),
+		Refs:        refs,
+		RefsByRepo:  deleted,
+		RepoCount:   len(deleted),
+		CountByRepo: countByRepo,
+
+		BytesFreed:       freed,
+		BytesFreedByRepo: freedByRepo,
+
+		SkippedInUse: skippedInUse,
+
+		SkippedMinManifests: skippedMinManifests,
+
+		Durations:      durations,
+		PhaseDurations: phaseDurations,
+
+		Filters: newFiltersResp(cleanOpts),
+
+		deletedManifests: deletedManifests,
+		dryRun:           cleanOpts.DryRun,
+
+		DryRunForced: dryRunForced,
+	}
+
+	if p.ResponseVersion >= responseVersionRefCount {
+		resp.Count = resp.deletedCount()
+	}
+
+	if inUseErr != nil {
+		resp.InUseCheckError = inUseErr.Error()
+	}
+
+	// The other repositories were still cleaned, so report partial success.
+	status := http.StatusOK
+	if len(repoErrors) > 0 {
+		resp.Errors = repoErrors
+		status = http.StatusMultiStatus
+	}
+	if len(listWarnings) > 0 {
+		resp.ListWarnings = listWarnings
+		status = http.StatusMultiStatus
+	}
+
+	// Only explain decisions on dry runs that ask for them, since the list
+	// includes every manifest in every repository and is intended for debugging
+	// filter configurations.
+	if p.DryRun && p.IncludeReasons {
+		resp.RefsWithReasons = decisions
+	}
+
+	if p.VerboseDryRun {
+		resp.Inventory = newInventory(decisions)
+	}
+
+	// The filters were still evaluated for every manifest, so the counts are
+	// accurate, but the refs and decisions are omitted to keep the response
+	// small.
+	if p.CountsOnly {
+		resp.Refs = []string{}
+		resp.RefsByRepo = map[string][]string{}
+		resp.SkippedInUse = map[string][]*Decision{}
+		resp.RefsWithReasons = nil
+	}
+
+	return resp, status, nil
+}
+
+// tagFilterAnyPatterns returns TagFilterAny and TagFilterAnyOf as a single
+// list, omitting empty patterns.
+func (p *Payload) tagFilterAnyPatterns() []string {
+	patterns := make([]string, 0, len(p.TagFilterAnyOf)+1)
+	for _, pattern := range append([]string{p.TagFilterAny}, p.TagFilterAnyOf...) {
+		if pattern != "" {
+			patterns = append(patterns, pattern)
+		}
+	}
+	return patterns
+}
+
+// since returns the cutoff time. Images newer than it are never deleted. It is
+// Before if given, and otherwise Grace before now.
+func (p *Payload) since(now time.Time) time.Time {
+	if before := time.Time(p.Before); !before.IsZero() {
+		return before.UTC()
+	}
+
+	return graceSince(now, p.Grace)
+}
+
+// graceSince returns the cutoff time for the grace period.
+func graceSince(now time.Time, grace duration) time.Time {
 	// Convert duration to a negative value, since we're about to "add" it to the
 	// since time.
-	sub := time.Duration(p.Grace)
-	if p.Grace > 0 {
+	sub := time.Duration(grace)
+	if grace > 0 {
 		sub = sub * -1
 	}
+	return now.Add(sub)
+}
+
+// requestIDHeader is the header that carries the request ID.
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength is the maximum length of a request ID given in the
+// request header.
+const maxRequestIDLength = 128
+
+// randomID returns a new random hex ID.
+func randomID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// isValidRequestID returns true if the given request ID is not empty and is
+// not too long.
+func isValidRequestID(id string) bool {
+	return id != "" && len(id) <= maxRequestIDLength
+}
+
+// requestIDFromHeader returns the request ID from the request header, or
+// generates a new one if none was given or it is invalid.
+func requestIDFromHeader(r *http.Request) (string, error) {
+	if id := r.Header.Get(requestIDHeader); isValidRequestID(id) {
+		return id, nil
+	}
 
-	since := time.Now().UTC().Add(sub)
-	repoKeepFilter, err := BuildItemFilter(p.RepoKeepFilterAny, "")
+	id, err := randomID()
 	if err != nil {
-		return nil, http.StatusBadRequest, fmt.Errorf("failed to build repo keep filter: %w", err)
+		return "", fmt.Errorf("failed to generate request id: %w", err)
 	}
-	s.logger.Debug("server: created repo keep filter", "filter", p.RepoKeepFilterAny)
+	return id, nil
+}
 
-	repoPrefixFilter, err := BuildItemFilter(p.RepoMatchPrefixFilter, "")
+// forRequest returns a copy of the server for a single request, whose logger
+// (and whose cleaner's logger) adds the request ID to every entry.
+func (s *Server) forRequest(requestID string) *Server {
+	logger := s.logger.With("request_id", requestID)
+
+	cp := *s
+	cp.requestID = requestID
+	cp.logger = logger
+	cp.cleaner = s.cleaner.withLogger(logger)
+	return &cp
+}
+
+// withLogLevel returns a copy of the server for a single request, whose logger
+// (and whose cleaner's logger) uses the given level if it is more verbose than
+// the server's level. The original server is not modified, so concurrent
+// requests are not affected. If level is empty, it returns the server.
+func (s *Server) withLogLevel(level string) (*Server, error) {
+	if level == "" {
+		return s, nil
+	}
+
+	v, err := parseSeverity(level)
 	if err != nil {
-		return nil, http.StatusBadRequest, fmt.Errorf("failed to build repo prefix filter: %w", err)
+		return nil, err
+	}
+	if v >= s.logger.level {
+		return s, nil
+	}
+
+	logger, err := s.logger.WithLevel(level)
+	if err != nil {
+		return nil, err
+	}
+
+	cp := *s
+	cp.logger = logger
+	cp.cleaner = s.cleaner.withLogger(logger)
+	return &cp, nil
+}
+
+// inUseOptions are the options for building the in-use filter.
+type inUseOptions struct {
+	assetTypes []string
+	assetPaths map[string][]string
+
+	// scope limits assets to those under the given organization, folder, or
+	// project. If empty, all assets in the export are included.
+	scope string
+
+	// cacheTTL is the maximum age of cached results. If zero, results are
+	// neither read from nor written to the cache.
+	cacheTTL time.Duration
+
+	// refresh forces the results to be fetched, even if they are cached.
+	refresh bool
+
+	// pageSize is the maximum number of rows read from BigQuery per request. If
+	// zero, BigQuery chooses the page size.
+	pageSize int
+}
+
+// inUseFilter builds a PodFilter of container images that were recently seen
+// in the given asset types (by default GKE pods and Cloud Run services),
+// limited to the given repositories.
+func (s *Server) inUseFilter(ctx context.Context, repos []string, opts *inUseOptions) (PodFilter, error) {
+	cloudAssetInventoryTableName := os.Getenv("CLOUD_ASSET_INVENTORY_TABLE_NAME")
+
+	recentlySeenImagesQuery, err := buildInUseQuery(cloudAssetInventoryTableName, opts.assetTypes, opts.assetPaths, opts.scope)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build in-use query: %w", err)
+	}
+
+	// The cache is keyed by the query, since it includes the table and asset
+	// types. Results are cached before filtering by repository, so they can be
+	// shared across requests for different repositories.
+	source := "cache"
+	images, ok := []string(nil), false
+	if opts.cacheTTL > 0 && !opts.refresh {
+		images, ok = s.inUseCache.Get(recentlySeenImagesQuery, opts.cacheTTL)
+	}
+	if !ok {
+		source = "bigquery"
+		images, err = s.queryImages(ctx, recentlySeenImagesQuery, opts.pageSize)
+		if err != nil {
+			return nil, classifyInUseError(err)
+		}
+
+		if opts.cacheTTL > 0 {
+			s.inUseCache.Set(recentlySeenImagesQuery, images)
+		}
 	}
-	s.logger.Debug("server: created repo prefix filter", "filter", p.RepoMatchPrefixFilter)
 
-	tagFilter, err := BuildItemFilter(p.TagFilterAny, p.TagFilterAll)
-	if err != nil {
-		return nil, http.StatusBadRequest, fmt.Errorf("failed to build tag filter: %w", err)
+	// Pods often reference images by tag, so tags are also resolved to the
+	// digests they reference.
+	podFilter := NewAssetPodFilter(repos, WithTagResolver(s.cleaner.tagResolver(ctx)))
+	for _, image := range images {
+		if err := podFilter.Add(image); err != nil {
+			return nil, fmt.Errorf("failed to parse container image: %w", err)
+		}
 	}
-	s.logger.Debug("server: created tag filter any", "filter", p.TagFilterAny)
-	s.logger.Debug("server: created tag filter all", "filter", p.TagFilterAll)
 
-	tagKeepFilter, err := BuildItemFilter(p.TagKeepAny, "")
-	if err != nil {
-		return nil, http.StatusBadRequest, fmt.Errorf("failed to build tag keep filter: %w", err)
+	reposAdded := 0
+	refsAdded := 0
+	for _, refs := range podFilter.(*AssetPodFilter).images {
+		reposAdded++
+		refsAdded += len(refs)
 	}
-	s.logger.Debug("server: created tag keep filter", "filter", p.TagKeepAny)
+	s.logger.Info("added recently seen container images to filter",
+		"source", source,
+		"repoCount", reposAdded,
+		"imageRefCount", refsAdded)
+
+	return podFilter, nil
+}
 
+// queryInUseImages runs the given query in BigQuery and returns the images,
+// reading up to pageSize rows per request if it is positive.
+func (s *Server) queryInUseImages(ctx context.Context, recentlySeenImagesQuery string, pageSize int) ([]string, error) {
 	// Get Project ID from Application Default Credentials
 	// https://stackoverflow.com/a/50365313
-	credentials, err := google.FindDefaultCredentials(ctx, cloudresourcemanager.CloudPlatformScope)
+	credentials, err := s.findCredentials(ctx, cloudresourcemanager.CloudPlatformScope)
 	if err != nil {
-		return nil, http.StatusInternalServerError, fmt.Errorf("failed to get default credentials: %w", err)
-	}
-
-	// Gather all the repositories.
-	repos := make([]string, 0, len(p.Repos))
-	for _, v := range p.Repos {
-		if t := strings.TrimSpace(v); t != "" {
-			repos = append(repos, t)
-		}
+		return nil, fmt.Errorf("failed to get default credentials: %w", err)
 	}
 
-	// List and collect container images from GKE pods and Cloud Run services that were seen in the past week.
+	// List and collect container images from GKE workloads and Cloud Run services that were seen in the past week.
 	// We pull this from Cloud Asset Inventory data exported to BigQuery, because calling the CAI API directly is too slow.
 	s.logger.Info("fetching recently seen container images from BigQuery...")
 
-	podFilter := NewAssetPodFilter(repos)
-
-	cloudAssetInventoryTableName := os.Getenv("CLOUD_ASSET_INVENTORY_TABLE_NAME")
 	cloudAssetInventoryTableLocation := os.Getenv("CLOUD_ASSET_INVENTORY_TABLE_LOCATION")
 
-	recentlySeenImagesQuery := fmt.Sprintf(`
-SELECT DISTINCT JSON_VALUE(container, '$.image') as image
-FROM (
-  SELECT
-    CASE asset_type
-      WHEN "k8s.io/Pod" THEN ARRAY_CONCAT(
-        JSON_QUERY_ARRAY(
-          resource.data,'$.spec.containers'
-        ),
-        COALESCE(
-          JSON_QUERY_ARRAY(
-            resource.data,'$.spec.initContainers'
-          ),
-          []
-        )
-      )
-      WHEN "batch.k8s.io/CronJob" THEN ARRAY_CONCAT(
-        JSON_QUERY_ARRAY(
-          resource.data,'$.spec.jobTemplate.spec.template.spec.containers'
-        ),
-        COALESCE(
-          JSON_QUERY_ARRAY(
-            resource.data,'$.spec.jobTemplate.spec.template.spec.initContainers'
-          ),
-          []
-        )
-      )
-      WHEN "run.googleapis.com/Service" THEN JSON_QUERY_ARRAY(
-        resource.data,'$.spec.template.spec.containers'
-      )
-      WHEN "run.googleapis.com/Job" THEN JSON_QUERY_ARRAY(
-        resource.data,'$.spec.template.spec.template.spec.containers'
-      )
-    END
-    AS containers
-  FROM %s
-  WHERE readTime >= TIMESTAMP_SUB(CURRENT_TIMESTAMP(), INTERVAL 7 day)
-), UNNEST(containers) AS container;`, cloudAssetInventoryTableName)
-
-	bigQueryClient, err := bigquery.NewClient(ctx, credentials.ProjectID)
+	bigQueryClient, err := bigquery.NewClient(ctx, credentials.ProjectID, s.cleaner.clientOptions()...)
 	if err != nil {
-		return nil, http.StatusInternalServerError, fmt.Errorf("failed to create new BigQuery client: %w", err)
+		return nil, fmt.Errorf("failed to create new BigQuery client: %w", err)
 	}
+	defer bigQueryClient.Close()
 
 	query := bigQueryClient.Query(recentlySeenImagesQuery)
 	query.Location = cloudAssetInventoryTableLocation
 	queryIterator, err := query.Read(ctx)
 	if err != nil {
-		return nil, http.StatusInternalServerError, fmt.Errorf("failed to get query results from BigQuery: %w", err)
+		return nil, fmt.Errorf("failed to get query results from BigQuery: %w", err)
+	}
+	if pageSize > 0 {
+		queryIterator.PageInfo().MaxSize = pageSize
 	}
 
+	var images []string
 	for {
+		// The iterator only checks the context when it fetches the next page, so
+		// stop reading rows as soon as the request is cancelled.
+		if err := ctx.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read rows from BigQuery: %w", err)
+		}
+
 		var values []bigquery.Value
 		err := queryIterator.Next(&values)
 		if err == iterator.Done {
 			break
 		}
 		if err != nil {
-			return nil, http.StatusInternalServerError, fmt.Errorf("failed to read row from BigQuery: %w", err)
+			return nil, fmt.Errorf("failed to read row from BigQuery: %w", err)
 		}
 		image, ok := values[0].(string)
 		if !ok {
-			return nil, http.StatusInternalServerError, fmt.Errorf("failed to parse row from BigQuery: %v", values[0])
-		}
-		err = podFilter.Add(image)
-		if err != nil {
-			return nil, http.StatusInternalServerError, fmt.Errorf("failed to parse container image: %w", err)
+			return nil, fmt.Errorf("failed to parse row from BigQuery: %v", values[0])
 		}
+		images = append(images, image)
 	}
+	return images, nil
+}
 
-	bigQueryClient.Close()
-
-	reposAdded := 0
-	refsAdded := 0
-	for _, refs := range podFilter.(*AssetPodFilter).images {
-		reposAdded++
-		refsAdded += len(refs)
-	}
-	s.logger.Info("added recently seen container images to filter", "repoCount", reposAdded, "imageRefCount", refsAdded)
-
-	if p.Recursive {
-		s.logger.Debug("gathering child repositories recursively")
-
-		allRepos, err := s.cleaner.ListChildRepositories(ctx, repos)
-		if err != nil {
-			return nil, http.StatusBadRequest, fmt.Errorf("failed to list child repositories: %w", err)
-		}
-		s.logger.Debug("recursively listed child repositories",
-			"in", repos,
-			"out", allRepos)
+// handleError returns a JSON-formatted error message
+func (s *Server) handleError(w http.ResponseWriter, err error, status int) {
+	s.logger.Error(err.Error(), "error", err)
 
-		// This is safe because ListChildRepositories is guaranteed to include at
-		// least the list repos given to it.
-		repos = allRepos
+	resp := &errorResp{
+		Error:     err.Error(),
+		ErrorCode: errorCodeFor(err, status),
 	}
 
-	s.logger.Info("deleting refs",
-		"since", since,
-		"repos", repos)
-
-	// Do the deletion.
-	deleted := make(map[string][]string, len(repos))
-	for _, repo := range repos {
-		s.logger.Info("deleting refs for repo", "repo", repo)
-
-		childrenDeleted, err := s.cleaner.Clean(ctx, repo, since, p.Keep, repoKeepFilter, repoPrefixFilter, tagFilter, tagKeepFilter, podFilter, p.DryRun)
-		if err != nil {
-			return nil, http.StatusBadRequest, fmt.Errorf("failed to clean repo %q: %w", repo, err)
-		}
-
-		if len(childrenDeleted) > 0 {
-			s.logger.Info("deleted refs", "repo", repo, "refs", childrenDeleted)
-			deleted[repo] = append(deleted[repo], childrenDeleted...)
+	var verr *ValidationError
+	if errors.As(err, &verr) {
+		for _, fe := range verr.Errors {
+			resp.Fields = append(resp.Fields, &fieldErrorResp{
+				Field: fe.Field,
+				Error: fe.Err.Error(),
+			})
 		}
 	}
 
-	s.logger.Info("deleted refs", "refs", deleted, "dryRun", p.DryRun)
-
-	return deleted, http.StatusOK, nil
-}
-
-// handleError returns a JSON-formatted error message
-func (s *Server) handleError(w http.ResponseWriter, err error, status int) {
-	s.logger.Error(err.Error(), "error", err)
-
-	b, err := json.Marshal(&errorResp{Error: err.Error()})
+	b, err := json.Marshal(resp)
 	if err != nil {
 		err = fmt.Errorf("failed to marshal JSON errors: %w", err)
 		http.Error(w, err.Error(), 500)
 		return
 	}
 
-	w.WriteHeader(status)
 	w.Header().Set(contentTypeHeader, contentTypeJSON)
+	w.WriteHeader(status)
 	fmt.Fprint(w, string(b))
 }
 
@@ -346,13 +1357,88 @@ type Payload struct {
 	// Repos is the list of repositories to clean.
 	Repos sortedStringSlice `json:"repos"`
 
-	// Grace is a time.Duration value indicating how much grade period should be
-	// given to new, untagged layers. The default is no grace.
+	// ReposExclude is the list of repositories that are never cleaned, with the
+	// same syntax as Repos. Each excludes the matching repositories and all of
+	// their children. It is applied after Repos are expanded, including by
+	// Recursive.
+	ReposExclude sortedStringSlice `json:"repos_exclude"`
+
+	// Grace is a time.Duration value indicating how much grace period should be
+	// given to new images. It applies to tagged and untagged images alike, and is
+	// checked before the tag filters. The default is no grace.
 	Grace duration `json:"grace"`
 
+	// MinAge is an absolute floor on deletion. Images uploaded less than MinAge
+	// ago are never deleted, even if they match the tag filters or are outside
+	// the keep count. Unlike Grace, it cannot be overridden by Before or by
+	// repository rules. The default is no minimum age.
+	MinAge duration `json:"min_age"`
+
+	// Before is an RFC3339 timestamp. If given, only images older than it are
+	// deleted. It takes precedence over Grace.
+	Before timestamp `json:"before"`
+
+	// TimeSource is the image timestamp compared against the grace period.
+	// Valid values are "uploaded" (the default) and "created". Use "uploaded"
+	// when old images are re-pushed or re-tagged, since their created time may
+	// be much older than when they were last pushed. TimeSourcePulled is only
+	// supported by the Go library, since it requires a PullTimeLister.
+	TimeSource TimeSource `json:"time_source"`
+
+	// UploadedAfter and UploadedBefore are RFC3339 timestamps that restrict
+	// deletion to images uploaded within the window. Either side may be omitted.
+	// The window is applied in addition to Grace.
+	UploadedAfter  timestamp `json:"uploaded_after"`
+	UploadedBefore timestamp `json:"uploaded_before"`
+
+	// MinManifests, if given, leaves repositories with fewer manifests than it
+	// untouched, so cleanup focuses on repositories that have accumulated many
+	// images. The skipped repositories are reported in the response.
+	MinManifests int `json:"min_manifests"`
+
 	// Keep is the minimum number of images to keep.
 	Keep int64 `json:"keep"`
 
+	// KeepScope is the set of images that keep counts, either "candidates" (the
+	// default), the images the filters selected for deletion, or "all", every
+	// image in the repository.
+	KeepScope KeepScope `json:"keep_scope"`
+
+	// KeepTagged and KeepUntagged, if either is given, keep the newest tagged
+	// and untagged images independently instead of counting them together
+	// towards Keep. If only one is given, the other uses Keep.
+	KeepTagged   *int64 `json:"keep_tagged"`
+	KeepUntagged *int64 `json:"keep_untagged"`
+
+	// KeepGroupBy is a regular expression used to group images by tag. If given,
+	// Keep applies to each group independently. The group key is the first
+	// capture group of the first matching tag, for example "^(.+)-[0-9a-f]+$"
+	// groups "service-a-abc123" and "service-a-def456" together.
+	KeepGroupBy string `json:"keep_group_by"`
+
+	// KeepDigests is a list of digests that are never deleted, even if they are
+	// untagged and older than the grace period. Entries may be full digests
+	// ("sha256:abcd...") or digest prefixes.
+	KeepDigests sortedStringSlice `json:"keep_digests"`
+
+	// KeepLabels is a list of "key=value" pairs. Images whose config labels or
+	// manifest annotations include any of them are never deleted. Since this
+	// fetches each image that would be deleted, it costs extra registry calls.
+	KeepLabels sortedStringSlice `json:"keep_labels"`
+
+	// UntaggedOnly restricts deletion to images without any tags. Tagged images
+	// are always kept, regardless of the tag filters.
+	UntaggedOnly bool `json:"untagged_only"`
+
+	// KeepSignatures keeps cosign signatures and attestations whenever the
+	// image they reference is kept.
+	KeepSignatures bool `json:"keep_signatures"`
+
+	// OrphanedSignaturesOnly restricts deletion to cosign signatures and
+	// attestations whose referenced image no longer exists in the repository.
+	// Every other image is kept, regardless of the tag filters and keep.
+	OrphanedSignaturesOnly bool `json:"orphaned_signatures_only"`
+
 	// RepoKeepFilterAny is a repository pattern to keep images for. If given, any
 	// image that matches this given regular expression will be kept. The image
 	// will be kept even if it has other tags that do not match the given regular
@@ -365,30 +1451,387 @@ type Payload struct {
 	// or groups of repositories for deletion.
 	RepoMatchPrefixFilter string `json:"repository_match_prefix"`
 
+	// ReposMatch is a list of exact repository names. If given, only images in
+	// these repositories are deleted, in addition to the other filters.
+	ReposMatch sortedStringSlice `json:"repos_match"`
+
 	// TagFilterAny is the tags pattern to be allowed removing. If given, any
 	// image with at least one tag that matches this given regular expression will
 	// be deleted. The image will be deleted even if it has other tags that do not
 	// match the given regular expression.
 	TagFilterAny string `json:"tag_filter_any"`
 
+	// TagFilterAnyOf is a list of tag patterns that is matched like
+	// TagFilterAny, deleting any image with at least one tag that matches any of
+	// the patterns. It may be combined with TagFilterAny.
+	TagFilterAnyOf sortedStringSlice `json:"tag_filter_any_of"`
+
 	// TagFilterAll is the tags pattern to be allowed removing. If given, any
 	// image where all tags match this given regular expression will be deleted.
 	// The image will not be delete if it has other tags that do not match the
 	// given regular expression.
 	TagFilterAll string `json:"tag_filter_all"`
 
+	// TagFilterAllMatchEmpty controls whether TagFilterAll matches an image
+	// with no tags. The default is false.
+	TagFilterAllMatchEmpty bool `json:"tag_filter_all_match_empty"`
+
+	// TagFilterNone is the tags pattern to be allowed removing. If given, any
+	// image where none of the tags match this given regular expression will be
+	// deleted. Images with at least one matching tag are kept.
+	TagFilterNone string `json:"tag_filter_none"`
+
 	//TagKeepAny is the tags pattern to be allowed keeping. If given, any
 	// image with at least one tag that matches this given regular expression will
 	// be kept. The image will be kept even if it has other tags that do not
 	// match the given regular expression.
 	TagKeepAny string `json:"tag_keep_any"`
 
+	// PlatformFilter is the pattern for platforms, such as "linux/arm64", to
+	// delete from image indexes. A child manifest whose platform matches is
+	// deleted even if its index is kept, as long as it would otherwise be
+	// deleted. The platform is reported in refs_with_reasons.
+	PlatformFilter string `json:"platform_filter"`
+
+	// TagFilterClauses is a list of tag filters that must all match for an image
+	// to be deleted. Each clause accepts the same options as the top-level tag
+	// filters, and the top-level tag filter (if any) is included as an
+	// additional clause.
+	TagFilterClauses []*TagFilterClause `json:"tag_filter_clauses"`
+
+	// TagFilterSemver is a semantic version constraint for tags to be allowed
+	// removing, such as "< 1.0.0". If given, any image with at least one tag
+	// that is a semantic version satisfying the constraint will be deleted. Tags
+	// that are not semantic versions never match. It cannot be combined with the
+	// other tag filters.
+	TagFilterSemver string `json:"tag_filter_semver"`
+
+	// TagFilterNumber selects tags to be allowed removing by an integer captured
+	// from them, such as build numbers. If given, any image with at least one tag
+	// whose number is within the range will be deleted. Tags that do not match
+	// the pattern never match. It cannot be combined with the other tag filters.
+	TagFilterNumber *NumberRange `json:"tag_filter_number"`
+
+	// TagKeepSemver is a semantic version constraint for tags to be allowed
+	// keeping, such as ">= 2.0.0". If given, any image with at least one tag
+	// that is a semantic version satisfying the constraint will be kept. It
+	// cannot be combined with TagKeepAny.
+	TagKeepSemver string `json:"tag_keep_semver"`
+
+	// TagKeepSemverHighest, if given, keeps the images with this many of the
+	// highest tags in each repository that are semantic versions, regardless of
+	// when they were uploaded. Tags that are not semantic versions are ignored.
+	TagKeepSemverHighest int `json:"tag_keep_semver_highest"`
+
+	// PatternKind is the syntax used to interpret all filter patterns. Valid
+	// values are "regex" (the default) and "glob".
+	PatternKind PatternKind `json:"pattern_kind"`
+
+	// GlobMatchSlash controls whether the glob wildcards "*" and "?" match a
+	// "/". It only applies when PatternKind is "glob".
+	GlobMatchSlash bool `json:"glob_match_slash"`
+
+	// CaseInsensitive makes all repository and tag filters match without regard
+	// to case.
+	CaseInsensitive bool `json:"case_insensitive"`
+
+	// TagKeepExact is a list of tags to be kept. If given, any image with at
+	// least one tag exactly equal to an entry in the list will be kept. If
+	// TagKeepAny is also given, images matching either are kept.
+	TagKeepExact sortedStringSlice `json:"tag_keep_exact"`
+
+	// LogLevel raises the log level for this request only, such as "debug". It
+	// has no effect if the server already logs at a more verbose level.
+	LogLevel string `json:"log_level"`
+
 	// DryRun instructs the server to not perform actual cleaning. The response
 	// will include repositories that would have been deleted.
 	DryRun bool `json:"dry_run"`
 
+	// Confirm allows the request to delete when the server requires
+	// confirmation. Without it, such servers always perform a dry run. It has
+	// no effect otherwise.
+	Confirm bool `json:"confirm"`
+
+	// VerboseDryRun implies DryRun and includes an inventory of every manifest
+	// in the response, annotated with whether it would be deleted, why, and its
+	// timestamps.
+	VerboseDryRun bool `json:"verbose_dry_run"`
+
+	// IncludeReasons includes the decision for every manifest, and why it was
+	// made, in the response. It only applies to dry runs.
+	IncludeReasons bool `json:"include_reasons"`
+
+	// CountsOnly implies DryRun and omits the refs and decisions from the
+	// response, leaving only the counts and bytes freed. Every filter is still
+	// evaluated, so the counts are the same as for a full dry run.
+	CountsOnly bool `json:"counts_only"`
+
+	// MaxDelete is the maximum number of manifests a single request may delete
+	// across all repositories. If given, every repository is evaluated first
+	// and nothing is deleted if the cap would be exceeded. The default is no
+	// limit.
+	MaxDelete int `json:"max_delete"`
+
 	// Recursive enables cleaning all child repositories.
 	Recursive bool `json:"recursive"`
+
+	// MaxDepth limits how many path segments below each repository Recursive
+	// descends. A depth of 0 cleans only the given repositories and 1 also
+	// cleans their direct children. The default is no limit.
+	MaxDepth *int `json:"max_depth"`
+
+	// RecursiveBestEffort cleans the child repositories of the registries that
+	// could be listed if others fail, such as because of a permissions error,
+	// and reports the failures in the response's list_warnings. The default is to
+	// fail the request. Requires Recursive.
+	RecursiveBestEffort bool `json:"recursive_best_effort"`
+
+	// RepoRules override the retention settings for specific repositories. For
+	// each repository, the first matching rule is used, and repositories that
+	// do not match any rule use the top-level settings.
+	RepoRules []*RepoRule `json:"repo_rules"`
+
+	// KeepAcrossRepos applies Keep (and KeepTagged and KeepUntagged) across all
+	// of the child repositories of each repository given in Repos, instead of
+	// to each child repository independently. Requires Recursive.
+	KeepAcrossRepos bool `json:"keep_across_repos"`
+
+	// InUseAssetTypes is the list of Cloud Asset Inventory asset types scanned
+	// for in-use images. The default is GKE pods and cron jobs and Cloud Run
+	// services and jobs.
+	InUseAssetTypes sortedStringSlice `json:"in_use_asset_types"`
+
+	// InUseAssetPaths maps asset types to the JSON paths of their container
+	// lists, such as "$.spec.template.spec.containers". It adds support for
+	// asset types that are not built in, or overrides the built-in paths.
+	InUseAssetPaths map[string][]string `json:"in_use_asset_paths"`
+
+	// InUseScope limits in-use detection to assets under the given resource,
+	// such as "folders/123456789012" or "projects/123456789012". The default is
+	// every asset in the Cloud Asset Inventory export, which is usually the
+	// entire organization.
+	InUseScope string `json:"in_use_scope"`
+
+	// InUseCacheTTL is the maximum age of cached in-use images. If set, in-use
+	// images are cached across requests and reused while they are newer than
+	// the TTL. The default is no caching.
+	InUseCacheTTL duration `json:"in_use_cache_ttl"`
+
+	// InUsePageSize is the maximum number of in-use images read from the Cloud
+	// Asset Inventory export in BigQuery per request. Smaller pages use less
+	// memory per request, larger pages make fewer requests. The default lets
+	// BigQuery choose.
+	InUsePageSize int `json:"in_use_page_size"`
+
+	// InUseCacheRefresh forces in-use images to be fetched, even if they are
+	// cached. The fetched images are still cached if InUseCacheTTL is set.
+	InUseCacheRefresh bool `json:"in_use_cache_refresh"`
+
+	// InUseImages is a list of image references that are in use. If given, they
+	// are kept instead of the images found by in-use detection, which is not
+	// run. References with a digest keep the manifest with that digest, and
+	// references with a tag keep manifests with that tag.
+	InUseImages sortedStringSlice `json:"in_use_images"`
+
+	// SkipInUseCheck disables detection of images that are in use by GKE pods
+	// and Cloud Run services. This avoids the need for access to the Cloud
+	// Asset Inventory export.
+	SkipInUseCheck bool `json:"skip_in_use_check"`
+
+	// InUseStrict fails the request if the asset inventory export cannot be
+	// accessed. By default, if the export is not found or permission to it is
+	// denied, a warning is logged and the request continues without keeping
+	// in-use images. Other in-use detection failures always fail the request.
+	InUseStrict bool `json:"in_use_strict"`
+
+	// DeleteMaxAttempts is the maximum number of attempts for each deletion
+	// that fails with a transient error (429 or 5xx). The default is 3.
+	DeleteMaxAttempts int `json:"delete_max_attempts"`
+
+	// DeleteRetryBaseDelay is the delay before the first retry of a failed
+	// deletion. It doubles for each subsequent retry. The default is 500ms.
+	DeleteRetryBaseDelay duration `json:"delete_retry_base_delay"`
+
+	// DeleteJitter delays each deletion by a random duration of up to
+	// DeleteJitter, to stagger concurrent deletions of images that share
+	// layers. The default is no jitter.
+	DeleteJitter duration `json:"delete_jitter"`
+
+	// MaxDeletesPerSecond caps the rate of delete and list calls to the
+	// registry across all repositories in the request. Calls block until they
+	// are allowed. The default is no limit.
+	MaxDeletesPerSecond float64 `json:"max_deletes_per_second"`
+
+	// Concurrency is the number of repositories to clean in parallel. The
+	// default is 4.
+	Concurrency int64 `json:"concurrency"`
+
+	// RepoTimeout is the maximum time to clean each repository. Repositories
+	// that take longer fail with a timeout error, and the remaining
+	// repositories are still cleaned. The default is no limit.
+	RepoTimeout duration `json:"repo_timeout"`
+
+	// ResponseVersion selects the version of the response. In version 1, count
+	// is the number of repositories with deleted refs. In version 2, it is the
+	// number of deleted refs. The default is 1.
+	ResponseVersion int `json:"response_version"`
+}
+
+// NumberRange is an inclusive range of integers captured from tags by the first
+// capture group of Pattern, such as "^build-(\d+)$". Either bound may be
+// omitted, but not both.
+type NumberRange struct {
+	Pattern string `json:"pattern"`
+	Min     *int64 `json:"min"`
+	Max     *int64 `json:"max"`
+}
+
+// build compiles the range into an ItemFilter. A nil range is the null filter.
+func (r *NumberRange) build() (ItemFilter, error) {
+	if r == nil {
+		return &ItemFilterNull{}, nil
+	}
+	return BuildNumberRangeFilter(r.Pattern, r.Min, r.Max)
+}
+
+// TagFilterClause is a single clause in a compound tag filter. Exactly one
+// field must be given.
+type TagFilterClause struct {
+	Any    string `json:"any"`
+	All    string `json:"all"`
+	None   string `json:"none"`
+	Semver string `json:"semver"`
+}
+
+// build compiles the clause into an ItemFilter.
+func (c *TagFilterClause) build(opts ...ItemFilterOption) (ItemFilter, error) {
+	if c.Semver != "" {
+		if c.Any != "" || c.All != "" || c.None != "" {
+			return nil, fmt.Errorf("only one tag filter type may be specified")
+		}
+		return BuildSemverFilter(c.Semver)
+	}
+
+	filter, err := BuildItemFilter(c.Any, c.All, append([]ItemFilterOption{WithNone(c.None)}, opts...)...)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := filter.(*ItemFilterNull); ok {
+		return nil, fmt.Errorf("clause must specify a filter")
+	}
+	return filter, nil
+}
+
+// RepoRule overrides the retention settings for the repositories it matches.
+// Fields that are not given use the top-level settings.
+type RepoRule struct {
+	// Repo is the repository the rule applies to, including its child
+	// repositories. It may be a pattern, such as "gcr.io/my-project/team-*".
+	Repo string `json:"repo"`
+
+	// Grace overrides the top-level Grace and Before.
+	Grace *duration `json:"grace"`
+
+	// Keep overrides the top-level Keep.
+	Keep *int64 `json:"keep"`
+
+	// TagFilterAny and TagFilterAll, if either is given, replace every top-level
+	// tag filter.
+	TagFilterAny string `json:"tag_filter_any"`
+	TagFilterAll string `json:"tag_filter_all"`
+
+	// TagKeepAny, if given, replaces every top-level tag keep filter.
+	TagKeepAny string `json:"tag_keep_any"`
+}
+
+// repoRule is a compiled RepoRule.
+type repoRule struct {
+	prefixes []string
+	patterns []*regexp.Regexp
+
+	since         *time.Time
+	keep          *int64
+	tagFilter     ItemFilter
+	tagKeepFilter ItemFilter
+}
+
+// build compiles the rule. Grace is relative to now.
+func (r *RepoRule) build(now time.Time, opts ...ItemFilterOption) (*repoRule, error) {
+	if strings.TrimSpace(r.Repo) == "" {
+		return nil, fmt.Errorf("repo is required")
+	}
+	prefixes, patterns, err := parseRepositoryMatchers([]string{r.Repo})
+	if err != nil {
+		return nil, err
+	}
+	rule := &repoRule{
+		prefixes: prefixes,
+		patterns: patterns,
+		keep:     r.Keep,
+	}
+
+	if r.Grace != nil {
+		since := graceSince(now, *r.Grace)
+		rule.since = &since
+	}
+
+	if r.Keep != nil && *r.Keep < 0 {
+		return nil, fmt.Errorf("keep must not be negative")
+	}
+
+	if r.TagFilterAny != "" || r.TagFilterAll != "" {
+		rule.tagFilter, err = BuildItemFilter(r.TagFilterAny, r.TagFilterAll, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to build tag filter: %w", err)
+		}
+	}
+
+	if r.TagKeepAny != "" {
+		rule.tagKeepFilter, err = BuildItemFilter(r.TagKeepAny, "", opts...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to build tag keep filter: %w", err)
+		}
+	}
+	return rule, nil
+}
+
+// matches returns true if the rule applies to the repository.
+func (r *repoRule) matches(repo string) bool {
+	return isExcludedRepository(repo, r.prefixes, r.patterns)
+}
+
+// apply overrides the options with the settings given in the rule.
+func (r *repoRule) apply(opts *CleanOptions) {
+	if r.since != nil {
+		opts.Since = *r.since
+	}
+	if r.keep != nil {
+		opts.Keep = *r.keep
+	}
+	if r.tagFilter != nil {
+		opts.TagFilter = r.tagFilter
+	}
+	if r.tagKeepFilter != nil {
+		opts.TagKeepFilter = r.tagKeepFilter
+	}
+}
+
+// repoRuleOptions returns a CleanOptions.RepoOptions that applies the first
+// rule that matches each repository. If there are no rules, it returns nil.
+func repoRuleOptions(rules []*repoRule) func(repo string, opts *CleanOptions) {
+	if len(rules) == 0 {
+		return nil
+	}
+
+	return func(repo string, opts *CleanOptions) {
+		for _, rule := range rules {
+			if rule.matches(repo) {
+				rule.apply(opts)
+				return
+			}
+		}
+	}
 }
 
 type pubsubMessage struct {
@@ -399,18 +1842,260 @@ type pubsubMessage struct {
 	Subscription string `json:"subscription"`
 }
 
-type cleanResp struct {
+// Response versions, selected with the response_version field of the payload.
+const (
+	// responseVersionRepoCount reports the number of repositories with deleted
+	// refs as the count. It is the default, for compatibility.
+	responseVersionRepoCount = 1
+
+	// responseVersionRefCount reports the number of deleted refs as the count.
+	responseVersionRefCount = 2
+)
+
+// CleanResponse is the result of a clean. It is the JSON response of the HTTP
+// endpoint and is returned by Run.
+type CleanResponse struct {
+	// Count is the number of deleted refs with response_version 2, or the
+	// number of repositories with deleted refs with response_version 1.
 	Count      int                 `json:"count"`
 	Refs       []string            `json:"refs"`
 	RefsByRepo map[string][]string `json:"refs_by_repo"`
+
+	// RepoCount is the number of repositories with deleted refs.
+	RepoCount int `json:"repo_count"`
+
+	// CountByRepo is the number of deleted refs, keyed by repository. Unlike
+	// RefsByRepo, it is also populated for counts_only requests.
+	CountByRepo map[string]int `json:"count_by_repo"`
+
+	// BytesFreed is the estimated storage reclaimed by the deletion, in total
+	// and by repository. For dry runs, it is the storage that would have been
+	// reclaimed.
+	BytesFreed       *FreedBytes            `json:"bytes_freed"`
+	BytesFreedByRepo map[string]*FreedBytes `json:"bytes_freed_by_repo"`
+
+	// SkippedInUse is the list of manifests that were kept because they are in
+	// use, keyed by repository.
+	SkippedInUse map[string][]*Decision `json:"skipped_in_use"`
+
+	// Filters is the name of each filter in effect, as compiled from the
+	// payload.
+	Filters *filtersResp `json:"filters"`
+
+	// InUseCheckError is the reason in-use detection failed, if it did. In that
+	// case no manifests were kept because they are in use.
+	InUseCheckError string `json:"in_use_check_error,omitempty"`
+
+	// ListWarnings is the error for each registry whose child repositories could
+	// not be listed with recursive_best_effort. Its repositories were not
+	// cleaned, and the status is 207 Multi-Status.
+	ListWarnings []string `json:"list_warnings,omitempty"`
+
+	// SkippedMinManifests is the number of manifests in each repository that
+	// was left untouched because it has fewer than min_manifests, keyed by
+	// repository.
+	SkippedMinManifests map[string]int `json:"skipped_min_manifests,omitempty"`
+
+	// Durations is the time spent on each repository in milliseconds, keyed by
+	// repository, including for dry runs and repositories that failed.
+	// PhaseDurations splits it into listing and deciding ("plan") and deleting
+	// ("delete").
+	Durations      map[string]int64               `json:"durations"`
+	PhaseDurations map[string]*phaseDurationsResp `json:"phase_durations"`
+
+	// Errors is the error message for each repository that failed to clean,
+	// keyed by repository. The remaining repositories were still cleaned, and
+	// the status is 207 Multi-Status.
+	Errors map[string]string `json:"errors,omitempty"`
+
+	// RefsWithReasons is the decision made for each manifest, keyed by
+	// repository. It is only populated for dry runs with IncludeReasons.
+	RefsWithReasons map[string][]*Decision `json:"refs_with_reasons,omitempty"`
+
+	// Inventory is every manifest annotated with the action that would be
+	// taken, keyed by repository. It is only populated for verbose dry runs.
+	Inventory map[string][]*inventoryEntry `json:"inventory,omitempty"`
+
+	// deletedManifests is the decision for each deleted manifest, keyed by
+	// repository. It is used for formats other than JSON.
+	deletedManifests map[string][]*Decision
+
+	// DryRunForced is true if the request was made a dry run because the server
+	// requires confirmation and the payload did not set confirm.
+	DryRunForced bool `json:"dry_run_forced,omitempty"`
+
+	// dryRun is true if nothing was deleted. It is used for notifications.
+	dryRun bool
+}
+
+// phaseDurationsResp is the time spent in each phase of cleaning a repository,
+// in milliseconds.
+type phaseDurationsResp struct {
+	Plan   int64 `json:"plan"`
+	Delete int64 `json:"delete"`
+}
+
+// filtersResp is the name of each top-level filter, such as "any(^pr-.*)" or
+// "(none)". Filters that were not given are "(none)", except for the optional
+// filters, which are omitted. Repository rules are not included.
+type filtersResp struct {
+	RepoKeep   string `json:"repo_keep"`
+	RepoPrefix string `json:"repo_prefix"`
+	RepoMatch  string `json:"repo_match,omitempty"`
+	Tag        string `json:"tag"`
+	TagKeep    string `json:"tag_keep"`
+	Platform   string `json:"platform,omitempty"`
+}
+
+// newFiltersResp returns the names of the filters in opts.
+func newFiltersResp(opts *CleanOptions) *filtersResp {
+	name := func(f ItemFilter) string {
+		if f == nil {
+			return ""
+		}
+		return f.Name()
+	}
+
+	return &filtersResp{
+		RepoKeep:   name(opts.RepoKeepFilter),
+		RepoPrefix: name(opts.RepoPrefixFilter),
+		RepoMatch:  name(opts.RepoMatchFilter),
+		Tag:        name(opts.TagFilter),
+		TagKeep:    name(opts.TagKeepFilter),
+		Platform:   name(opts.PlatformFilter),
+	}
+}
+
+// deletedCount returns the number of refs deleted across every repository. A
+// digest deleted from multiple repositories is counted for each of them, unlike
+// in Refs.
+func (r *CleanResponse) deletedCount() int {
+	var count int
+	for _, n := range r.CountByRepo {
+		count += n
+	}
+	return count
+}
+
+// Inventory actions.
+const (
+	inventoryActionDelete = "would-delete"
+	inventoryActionKeep   = "would-keep"
+)
+
+// inventoryEntry is a single manifest in a verbose dry run inventory.
+type inventoryEntry struct {
+	Digest   string    `json:"digest"`
+	Tags     []string  `json:"tags,omitempty"`
+	Action   string    `json:"action"`
+	Reason   string    `json:"reason"`
+	Group    string    `json:"group,omitempty"`
+	Size     uint64    `json:"size,omitempty"`
+	Uploaded time.Time `json:"uploaded"`
+	Created  time.Time `json:"created"`
+}
+
+// newInventory builds the inventory from the decisions, keyed by repository.
+// Entries are sorted from newest to oldest upload.
+func newInventory(decisions map[string][]*Decision) map[string][]*inventoryEntry {
+	inventory := make(map[string][]*inventoryEntry, len(decisions))
+	for repo, ds := range decisions {
+		entries := make([]*inventoryEntry, 0, len(ds))
+		for _, d := range ds {
+			if d == nil {
+				continue
+			}
+
+			action := inventoryActionKeep
+			if d.Delete {
+				action = inventoryActionDelete
+			}
+
+			entries = append(entries, &inventoryEntry{
+				Digest:   d.Digest,
+				Tags:     d.Tags,
+				Action:   action,
+				Reason:   d.Reason,
+				Group:    d.Group,
+				Size:     d.Size,
+				Uploaded: d.Uploaded,
+				Created:  d.Created,
+			})
+		}
+
+		sort.SliceStable(entries, func(i, j int) bool {
+			return entries[i].Uploaded.After(entries[j].Uploaded)
+		})
+		inventory[repo] = entries
+	}
+	return inventory
+}
+
+// cleanProgress is the progress of a clean request.
+type cleanProgress struct {
+	ReposTotal int `json:"repos_total"`
+	ReposDone  int `json:"repos_done"`
+
+	// Deleted is the number of refs deleted so far. For dry runs, it is the
+	// number of refs that would have been deleted.
+	Deleted int `json:"deleted"`
+
+	// LastRepo is the most recently cleaned repository.
+	LastRepo string `json:"last_repo,omitempty"`
+
+	// result is the result of LastRepo. It is only set for the call made as
+	// LastRepo finishes. dryRun and countsOnly report whether it was a dry run
+	// and a counts only request.
+	result     *RepoResult
+	dryRun     bool
+	countsOnly bool
 }
 
 type errorResp struct {
 	Error string `json:"error"`
+
+	// ErrorCode is the stable, machine-readable code for the error.
+	ErrorCode ErrorCode `json:"error_code"`
+
+	// Fields lists each invalid field if the payload failed validation.
+	Fields []*fieldErrorResp `json:"fields,omitempty"`
+}
+
+type fieldErrorResp struct {
+	Field string `json:"field"`
+	Error string `json:"error"`
+}
+
+const (
+	healthStatusOK          = "ok"
+	healthStatusUnavailable = "unavailable"
+)
+
+type healthResp struct {
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
 }
 
 type sortedStringSlice []string
 
+// newSortedStringSlice returns the values, trimmed, without empty values or
+// duplicates, and sorted.
+func newSortedStringSlice(values []string) sortedStringSlice {
+	m := make(map[string]struct{}, len(values))
+	for _, v := range values {
+		if t := strings.TrimSpace(v); t != "" {
+			m[t] = struct{}{}
+		}
+	}
+
+	list := make([]string, 0, len(m))
+	for v := range m {
+		list = append(list, v)
+	}
+	sort.Strings(list)
+	return list
+}
+
 func (s sortedStringSlice) MarshalJSON() ([]byte, error) {
 	return json.Marshal([]string(s))
 }
@@ -421,41 +2106,123 @@ func (s *sortedStringSlice) UnmarshalJSON(b []byte) error {
 		return err
 	}
 
-	m := make(map[string]struct{}, 4)
+	var values []string
 
 	switch val := v.(type) {
 	case string:
-		if t := strings.TrimSpace(val); t != "" {
-			m[t] = struct{}{}
-		}
+		values = []string{val}
 	case []any:
+		values = make([]string, 0, len(val))
 		for i, v := range val {
 			s, ok := v.(string)
 			if !ok {
 				return fmt.Errorf("list must contain only strings (got %T at index %d)", v, i)
 			}
-			if t := strings.TrimSpace(s); t != "" {
-				m[t] = struct{}{}
-			}
+			values = append(values, s)
 		}
 	case []string:
-		for _, v := range val {
-			if t := strings.TrimSpace(v); t != "" {
-				m[t] = struct{}{}
-			}
-		}
+		values = val
 	default:
 		return fmt.Errorf("invalid list type %T", val)
 	}
 
-	list := make([]string, 0, len(m))
-	for v := range m {
-		list = append(list, v)
+	*s = newSortedStringSlice(values)
+	return nil
+}
+
+// textPayloadBody reads a text body with one repository per line and returns
+// the equivalent JSON payload body. Blank lines and lines starting with "#" are
+// ignored. Other payload fields are given as query parameters, such as
+// "?dry_run=true&grace=48h". Parameters for boolean or numeric fields are
+// decoded as such, other parameters are strings, and repeated parameters are
+// lists. Repositories given as a "repos" parameter are merged with the body.
+func textPayloadBody(r io.Reader, query url.Values) (io.ReadCloser, error) {
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read repositories: %w", err)
 	}
-	sort.Strings(list)
-	*s = list
 
-	return nil
+	fields := make(map[string]any, len(query)+1)
+	for key, values := range query {
+		if len(values) == 1 {
+			fields[key] = queryValue(key, values[0])
+			continue
+		}
+
+		list := make([]any, 0, len(values))
+		for _, v := range values {
+			list = append(list, queryValue(key, v))
+		}
+		fields[key] = list
+	}
+	fields["repos"] = newSortedStringSlice(append(lines, query["repos"]...))
+
+	b, err := json.Marshal(fields)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal payload: %w", err)
+	}
+	return io.NopCloser(bytes.NewReader(b)), nil
+}
+
+// payloadScalarFields is the set of JSON names of the Payload fields that are
+// booleans or numbers, without custom decoding such as durations.
+var payloadScalarFields = func() map[string]struct{} {
+	unmarshaler := reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+
+	fields := make(map[string]struct{})
+	t := reflect.TypeOf(Payload{})
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+
+		typ := field.Type
+		if typ.Kind() == reflect.Pointer {
+			typ = typ.Elem()
+		}
+		if reflect.PointerTo(typ).Implements(unmarshaler) {
+			continue
+		}
+
+		switch typ.Kind() {
+		case reflect.Bool,
+			reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+			reflect.Float32, reflect.Float64:
+			fields[name] = struct{}{}
+		}
+	}
+	return fields
+}()
+
+// queryValue returns the value of the query parameter for the named payload
+// field. It is a boolean or number if the field is one and the value parses as
+// one, and otherwise a string.
+func queryValue(field, v string) any {
+	if _, ok := payloadScalarFields[field]; !ok {
+		return v
+	}
+
+	switch v {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+	if n, err := strconv.ParseFloat(v, 64); err == nil {
+		return n
+	}
+	return v
 }
 
 type duration time.Duration
@@ -485,3 +2252,39 @@ func (d *duration) UnmarshalJSON(b []byte) error {
 		return fmt.Errorf("invalid duration type %T", val)
 	}
 }
+
+type timestamp time.Time
+
+func (t timestamp) MarshalJSON() ([]byte, error) {
+	if time.Time(t).IsZero() {
+		return json.Marshal("")
+	}
+	return json.Marshal(time.Time(t).Format(time.RFC3339))
+}
+
+func (t *timestamp) UnmarshalJSON(b []byte) error {
+	var v any
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+
+	switch val := v.(type) {
+	case nil:
+		*t = timestamp{}
+		return nil
+	case string:
+		if val == "" {
+			*t = timestamp{}
+			return nil
+		}
+
+		parsed, err := time.Parse(time.RFC3339, val)
+		if err != nil {
+			return fmt.Errorf("invalid timestamp %q: must be RFC3339 (e.g. 2006-01-02T15:04:05Z): %w", val, err)
+		}
+		*t = timestamp(parsed.UTC())
+		return nil
+	default:
+		return fmt.Errorf("invalid timestamp type %T", val)
+	}
+}
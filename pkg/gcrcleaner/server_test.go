@@ -0,0 +1,1931 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	gcrauthn "github.com/google/go-containerregistry/pkg/authn"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/googleapi"
+)
+
+func testServer(tb testing.TB, opts ...ServerOption) *Server {
+	tb.Helper()
+
+	logger := NewLogger("error", io.Discard, io.Discard)
+	cleaner, err := NewCleaner(gcrauthn.NewMultiKeychain(), logger, 1)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	server, err := NewServer(cleaner, opts...)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return server
+}
+
+func TestServer_HealthHandler(t *testing.T) {
+	t.Parallel()
+
+	server := testServer(t)
+
+	w := httptest.NewRecorder()
+	server.HealthHandler().ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+
+	if got, want := w.Code, 200; got != want {
+		t.Errorf("expected status %d to be %d", got, want)
+	}
+	if got, want := w.Header().Get(contentTypeHeader), contentTypeJSON; got != want {
+		t.Errorf("expected content type %q to be %q", got, want)
+	}
+
+	var resp healthResp
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := resp.Status, healthStatusOK; got != want {
+		t.Errorf("expected status %q to be %q", got, want)
+	}
+}
+
+func TestServer_ReadyHandler(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name       string
+		findCreds  func(ctx context.Context, scopes ...string) (*google.Credentials, error)
+		expCode    int
+		expStatus  string
+		expMessage string
+	}{
+		{
+			name: "ready",
+			findCreds: func(ctx context.Context, scopes ...string) (*google.Credentials, error) {
+				return &google.Credentials{ProjectID: "my-project"}, nil
+			},
+			expCode:   200,
+			expStatus: healthStatusOK,
+		},
+		{
+			name: "no_credentials",
+			findCreds: func(ctx context.Context, scopes ...string) (*google.Credentials, error) {
+				return nil, fmt.Errorf("could not find default credentials")
+			},
+			expCode:    503,
+			expStatus:  healthStatusUnavailable,
+			expMessage: "failed to get default credentials",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			server := testServer(t)
+			server.findCredentials = tc.findCreds
+
+			w := httptest.NewRecorder()
+			server.ReadyHandler().ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+
+			if got, want := w.Code, tc.expCode; got != want {
+				t.Errorf("expected status %d to be %d", got, want)
+			}
+
+			var resp healthResp
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+			if got, want := resp.Status, tc.expStatus; got != want {
+				t.Errorf("expected status %q to be %q", got, want)
+			}
+			if got, want := resp.Message, tc.expMessage; !strings.Contains(got, want) {
+				t.Errorf("expected message %q to contain %q", got, want)
+			}
+		})
+	}
+}
+
+func TestServer_InUseFilter_Cache(t *testing.T) {
+	t.Setenv("CLOUD_ASSET_INVENTORY_TABLE_NAME", "my-project.my_dataset.assets")
+
+	ctx := context.Background()
+	server := testServer(t)
+
+	// Fetching from BigQuery always fails, so a successful result must come
+	// from the cache.
+	server.findCredentials = func(ctx context.Context, scopes ...string) (*google.Credentials, error) {
+		return nil, fmt.Errorf("no credentials")
+	}
+
+	query, err := buildInUseQuery("my-project.my_dataset.assets", nil, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.inUseCache.Set(query, []string{"gcr.io/my-project/my-image:latest"})
+
+	repos := []string{"gcr.io/my-project"}
+
+	podFilter, err := server.inUseFilter(ctx, repos, &inUseOptions{cacheTTL: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !podFilter.Matches("gcr.io/my-project/my-image", "sha256:abcd", []string{"latest"}) {
+		t.Errorf("expected cached image to match")
+	}
+
+	if _, err := server.inUseFilter(ctx, repos, &inUseOptions{cacheTTL: time.Hour, refresh: true}); err == nil {
+		t.Errorf("expected refresh to bypass the cache")
+	}
+
+	if _, err := server.inUseFilter(ctx, repos, &inUseOptions{}); err == nil {
+		t.Errorf("expected zero ttl to bypass the cache")
+	}
+}
+
+func TestNewInventory(t *testing.T) {
+	t.Parallel()
+
+	older := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	newer := time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)
+
+	inventory := newInventory(map[string][]*Decision{
+		"gcr.io/my-project/my-image": {
+			{Digest: "sha256:old", Delete: true, Reason: "matched tag filter", Uploaded: older},
+			nil,
+			{Digest: "sha256:new", Tags: []string{"latest"}, Reason: "kept by keep", Uploaded: newer},
+		},
+	})
+
+	entries := inventory["gcr.io/my-project/my-image"]
+	if got, want := len(entries), 2; got != want {
+		t.Fatalf("expected %d entries to be %d", got, want)
+	}
+
+	if got, want := entries[0].Digest, "sha256:new"; got != want {
+		t.Errorf("expected first digest %q to be %q", got, want)
+	}
+	if got, want := entries[0].Action, inventoryActionKeep; got != want {
+		t.Errorf("expected action %q to be %q", got, want)
+	}
+	if got, want := entries[1].Action, inventoryActionDelete; got != want {
+		t.Errorf("expected action %q to be %q", got, want)
+	}
+	if got, want := entries[1].Uploaded, older; !got.Equal(want) {
+		t.Errorf("expected uploaded %s to be %s", got, want)
+	}
+}
+
+func TestServer_WithLogLevel(t *testing.T) {
+	t.Parallel()
+
+	server := testServer(t)
+
+	cases := []struct {
+		name  string
+		level string
+		exp   Severity
+		same  bool
+		err   bool
+	}{
+		{name: "empty", level: "", exp: SeverityError, same: true},
+		{name: "less_verbose", level: "fatal", exp: SeverityError, same: true},
+		{name: "more_verbose", level: "debug", exp: SeverityDebug},
+		{name: "invalid", level: "chatty", err: true},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := server.withLogLevel(tc.level)
+			if (err != nil) != tc.err {
+				t.Fatalf("expected error=%t, got %v", tc.err, err)
+			}
+			if err != nil {
+				return
+			}
+
+			if got, want := got.logger.level, tc.exp; got != want {
+				t.Errorf("expected level %d to be %d", got, want)
+			}
+			if got, want := got.cleaner.logger.level, tc.exp; got != want {
+				t.Errorf("expected cleaner level %d to be %d", got, want)
+			}
+			if (got == server) != tc.same {
+				t.Errorf("expected same server=%t", tc.same)
+			}
+
+			// The shared server is never modified.
+			if got, want := server.logger.level, SeverityError; got != want {
+				t.Errorf("expected server level %d to be %d", got, want)
+			}
+		})
+	}
+}
+
+func TestServer_HTTPHandler_ContentType(t *testing.T) {
+	t.Parallel()
+
+	registry := &fakeListRegistry{
+		manifests: []string{"sha256:" + strings.Repeat("1", 64)},
+		failRepos: []string{"proj/fail"},
+	}
+	srv := httptest.NewServer(registry)
+	t.Cleanup(srv.Close)
+
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	cases := []struct {
+		name string
+		body string
+		code int
+	}{
+		{
+			name: "ok",
+			body: fmt.Sprintf(`{"repos": [%q], "skip_in_use_check": true, "dry_run": true}`, host+"/proj/ok"),
+			code: 200,
+		},
+		{
+			name: "partial_failure",
+			body: fmt.Sprintf(`{"repos": [%q, %q], "skip_in_use_check": true, "dry_run": true}`, host+"/proj/ok", host+"/proj/fail"),
+			code: 207,
+		},
+		{
+			name: "invalid_payload",
+			body: `{"max_delete": -1, "skip_in_use_check": true}`,
+			code: 400,
+		},
+		{
+			name: "invalid_json",
+			body: `{`,
+			code: 500,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			server := testServer(t)
+
+			w := httptest.NewRecorder()
+			server.HTTPHandler().ServeHTTP(w, httptest.NewRequest("POST", "/http", strings.NewReader(tc.body)))
+
+			if got, want := w.Code, tc.code; got != want {
+				t.Errorf("expected status %d to be %d: %s", got, want, w.Body.String())
+			}
+			if got, want := w.Header().Get(contentTypeHeader), contentTypeJSON; got != want {
+				t.Errorf("expected content type %q to be %q", got, want)
+			}
+			if !json.Valid(w.Body.Bytes()) {
+				t.Errorf("expected valid JSON: %s", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestServer_RequestID(t *testing.T) {
+	t.Parallel()
+
+	var logs bytes.Buffer
+	logger := NewLogger("info", &logs, &logs)
+	cleaner, err := NewCleaner(nil, logger, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewServer(cleaner)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name   string
+		header string
+		exp    string
+	}{
+		{name: "given", header: "my-request", exp: "my-request"},
+		{name: "generated", header: ""},
+		{name: "too_long", header: strings.Repeat("a", maxRequestIDLength+1)},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		// Not parallel, since the subtests share the log buffer.
+		t.Run(tc.name, func(t *testing.T) {
+			logs.Reset()
+
+			r := httptest.NewRequest("POST", "/http", strings.NewReader(`{"skip_in_use_check": true}`))
+			if tc.header != "" {
+				r.Header.Set(requestIDHeader, tc.header)
+			}
+
+			w := httptest.NewRecorder()
+			server.HTTPHandler().ServeHTTP(w, r)
+
+			got := w.Header().Get(requestIDHeader)
+			if got == "" || len(got) > maxRequestIDLength {
+				t.Fatalf("expected a valid request id, got %q", got)
+			}
+			if tc.exp != "" && got != tc.exp {
+				t.Errorf("expected request id %q to be %q", got, tc.exp)
+			}
+
+			if want := fmt.Sprintf(`"request_id":%q`, got); !strings.Contains(logs.String(), want) {
+				t.Errorf("expected logs to contain %q: %s", want, logs.String())
+			}
+		})
+	}
+}
+
+func TestServer_CleanPayload_RecursiveTagAndPrefixFilter(t *testing.T) {
+	t.Parallel()
+
+	registry := &fakeListRegistry{
+		catalog:   []string{"proj", "proj/team-a", "proj/team-b", "other"},
+		manifests: []string{"sha256:" + strings.Repeat("1", 64)},
+		tags:      []string{"pr-1"},
+	}
+	srv := httptest.NewServer(registry)
+	t.Cleanup(srv.Close)
+
+	host := strings.TrimPrefix(srv.URL, "http://")
+	server := testServer(t)
+
+	// The tag filter matches in every repository, so repositories that do not
+	// match the prefix filter must still be cleaned.
+	resp, _, err := server.cleanPayload(context.Background(), &Payload{
+		Repos:                 []string{host + "/proj"},
+		Recursive:             true,
+		TagFilterAny:          "^pr-",
+		RepoMatchPrefixFilter: "team-a$",
+		SkipInUseCheck:        true,
+		DryRun:                true,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repos := make([]string, 0, len(resp.RefsByRepo))
+	for repo := range resp.RefsByRepo {
+		repos = append(repos, repo)
+	}
+	sort.Strings(repos)
+
+	exp := []string{host + "/proj", host + "/proj/team-a", host + "/proj/team-b"}
+	if !reflect.DeepEqual(repos, exp) {
+		t.Errorf("expected %q to be %q", repos, exp)
+	}
+}
+
+func TestServer_CleanPayload_OverlappingRepos(t *testing.T) {
+	t.Parallel()
+
+	digest := "sha256:" + strings.Repeat("1", 64)
+	registry := &fakeListRegistry{
+		catalog:   []string{"proj/a", "proj/a/b", "proj/a/b/c", "proj/ab"},
+		manifests: []string{digest},
+	}
+	srv := httptest.NewServer(registry)
+	t.Cleanup(srv.Close)
+
+	host := strings.TrimPrefix(srv.URL, "http://")
+	server := testServer(t)
+
+	// Both roots are given, one with a trailing slash and one twice, and each
+	// would list the nested children.
+	var progress cleanProgress
+	resp, _, err := server.cleanPayload(context.Background(), &Payload{
+		Repos: sortedStringSlice{
+			host + "/proj/a",
+			host + "/proj/a/",
+			host + "/proj/a/b",
+			host + "/proj/a/b",
+		},
+		Recursive:      true,
+		SkipInUseCheck: true,
+		DryRun:         true,
+	}, func(p cleanProgress) {
+		progress = p
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expRepos := []string{host + "/proj/a", host + "/proj/a/b", host + "/proj/a/b/c"}
+
+	if got, want := progress.ReposTotal, len(expRepos); got != want {
+		t.Errorf("expected %d repos to be %d", got, want)
+	}
+	if got, want := progress.ReposDone, len(expRepos); got != want {
+		t.Errorf("expected %d repos done to be %d", got, want)
+	}
+
+	// Each repository is listed exactly once.
+	if got, want := atomic.LoadInt32(&registry.lists), int32(len(expRepos)); got != want {
+		t.Errorf("expected %d lists to be %d", got, want)
+	}
+
+	repos := make([]string, 0, len(resp.BytesFreedByRepo))
+	for repo := range resp.BytesFreedByRepo {
+		repos = append(repos, repo)
+	}
+	sort.Strings(repos)
+	if !reflect.DeepEqual(repos, expRepos) {
+		t.Errorf("expected repos %q to be %q", repos, expRepos)
+	}
+
+	// The response has exactly one entry for each repository's manifest.
+	if got, want := len(resp.RefsByRepo), len(expRepos); got != want {
+		t.Errorf("expected %d repos with refs to be %d", got, want)
+	}
+	for _, repo := range expRepos {
+		if got, want := resp.RefsByRepo[repo], []string{digest}; !reflect.DeepEqual(got, want) {
+			t.Errorf("expected refs for %s %q to be %q", repo, got, want)
+		}
+	}
+	// The digest is shared, so it is only listed once.
+	if got, want := resp.Refs, []string{digest}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+	if got, want := resp.deletedCount(), len(expRepos); got != want {
+		t.Errorf("expected %d deleted to be %d", got, want)
+	}
+}
+
+func TestServer_CleanPayload_InUseImages(t *testing.T) {
+	t.Parallel()
+
+	inUse := "sha256:" + strings.Repeat("1", 64)
+	other := "sha256:" + strings.Repeat("2", 64)
+	registry := &fakeListRegistry{
+		manifests: []string{inUse, other},
+	}
+	srv := httptest.NewServer(registry)
+	t.Cleanup(srv.Close)
+
+	host := strings.TrimPrefix(srv.URL, "http://")
+	server := testServer(t)
+
+	// The asset inventory is never queried, so failing to reach it does not
+	// fail the request even when strict.
+	server.findCredentials = func(ctx context.Context, scopes ...string) (*google.Credentials, error) {
+		return nil, fmt.Errorf("no credentials")
+	}
+
+	resp, _, err := server.cleanPayload(context.Background(), &Payload{
+		Repos:       sortedStringSlice{host + "/proj/a"},
+		InUseImages: sortedStringSlice{host + "/proj/a@" + inUse},
+		InUseStrict: true,
+		DryRun:      true,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := resp.RefsByRepo[host+"/proj/a"], []string{other}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+	if got, want := len(resp.SkippedInUse[host+"/proj/a"]), 1; got != want {
+		t.Errorf("expected %d in use to be %d", got, want)
+	}
+}
+
+func TestServer_CleanPayload_InUseFailure(t *testing.T) {
+	t.Setenv("CLOUD_ASSET_INVENTORY_TABLE_NAME", "my-project.my_dataset.assets")
+
+	cases := []struct {
+		name   string
+		strict bool
+		images []string
+		err    error
+		expErr bool
+	}{
+		{
+			name: "forbidden",
+			err:  &googleapi.Error{Code: http.StatusForbidden, Message: "access denied"},
+		},
+		{
+			name: "not_found",
+			err:  fmt.Errorf("failed to get query results from BigQuery: %w", &googleapi.Error{Code: http.StatusNotFound}),
+		},
+		{
+			name:   "forbidden_strict",
+			strict: true,
+			err:    &googleapi.Error{Code: http.StatusForbidden, Message: "access denied"},
+			expErr: true,
+		},
+		{
+			name:   "transient",
+			err:    &googleapi.Error{Code: http.StatusServiceUnavailable, Message: "backend error"},
+			expErr: true,
+		},
+		{
+			name:   "rate_limited",
+			err:    &googleapi.Error{Code: http.StatusTooManyRequests, Message: "rate limit exceeded"},
+			expErr: true,
+		},
+		{
+			name:   "context",
+			err:    fmt.Errorf("failed to read rows from BigQuery: %w", context.DeadlineExceeded),
+			expErr: true,
+		},
+		{
+			name:   "credentials",
+			err:    fmt.Errorf("failed to get default credentials: no credentials"),
+			expErr: true,
+		},
+		{
+			name:   "parse",
+			images: []string{"%s/proj/a@sha256:not-a-digest"},
+			expErr: true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			registry := &fakeListRegistry{
+				manifests: []string{"sha256:" + strings.Repeat("1", 64)},
+			}
+			srv := httptest.NewServer(registry)
+			t.Cleanup(srv.Close)
+
+			host := strings.TrimPrefix(srv.URL, "http://")
+			server := testServer(t)
+			server.queryImages = func(ctx context.Context, query string, pageSize int) ([]string, error) {
+				if tc.err != nil {
+					return nil, tc.err
+				}
+				images := make([]string, 0, len(tc.images))
+				for _, image := range tc.images {
+					images = append(images, fmt.Sprintf(image, host))
+				}
+				return images, nil
+			}
+
+			resp, status, err := server.cleanPayload(context.Background(), &Payload{
+				Repos:       sortedStringSlice{host + "/proj/a"},
+				InUseStrict: tc.strict,
+				DryRun:      true,
+			}, nil)
+			if tc.expErr {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				if got, want := status, 500; got != want {
+					t.Errorf("expected %d to be %d", got, want)
+				}
+				if got, want := errorCodeFor(err, status), ErrorCodeAssetListFailed; got != want {
+					t.Errorf("expected %q to be %q", got, want)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.InUseCheckError == "" {
+				t.Errorf("expected in-use check error")
+			}
+			if got, want := len(resp.Refs), 1; got != want {
+				t.Errorf("expected %d refs to be %d", got, want)
+			}
+		})
+	}
+}
+
+func TestServer_CleanPayload_InUseMissingTable(t *testing.T) {
+	t.Setenv("CLOUD_ASSET_INVENTORY_TABLE_NAME", "")
+
+	registry := &fakeListRegistry{
+		manifests: []string{"sha256:" + strings.Repeat("1", 64)},
+	}
+	srv := httptest.NewServer(registry)
+	t.Cleanup(srv.Close)
+
+	host := strings.TrimPrefix(srv.URL, "http://")
+	server := testServer(t)
+
+	_, status, err := server.cleanPayload(context.Background(), &Payload{
+		Repos:  sortedStringSlice{host + "/proj/a"},
+		DryRun: true,
+	}, nil)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if got, want := status, 500; got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+}
+
+func TestServer_CleanPayload_RepoRules(t *testing.T) {
+	t.Parallel()
+
+	digest1 := "sha256:" + strings.Repeat("1", 64)
+	digest2 := "sha256:" + strings.Repeat("2", 64)
+
+	registry := &fakeListRegistry{
+		manifests: []string{digest1, digest2},
+	}
+	srv := httptest.NewServer(registry)
+	t.Cleanup(srv.Close)
+
+	host := strings.TrimPrefix(srv.URL, "http://")
+	server := testServer(t)
+
+	keep := func(v int64) *int64 { return &v }
+	grace := duration(10 * 365 * 24 * time.Hour)
+
+	resp, _, err := server.cleanPayload(context.Background(), &Payload{
+		Repos: sortedStringSlice{
+			host + "/proj/a",
+			host + "/proj/b",
+			host + "/proj/c/child",
+			host + "/other/d",
+		},
+		RepoRules: []*RepoRule{
+			// The first matching rule is used, even if a later rule also matches.
+			{Repo: host + "/proj/a", Keep: keep(2)},
+			{Repo: host + "/proj/c", Grace: &grace},
+			{Repo: host + "/proj/*", Keep: keep(1)},
+		},
+		SkipInUseCheck: true,
+		DryRun:         true,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := map[string][]string{
+		// proj/a keeps both images and has no entry. proj/c/child matches the
+		// rule for its parent, and both images are newer than its grace.
+		host + "/proj/b":  {digest2},
+		host + "/other/d": {digest1, digest2},
+	}
+	if got, want := resp.RefsByRepo, exp; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+}
+
+func TestServer_CleanPayload_DuplicateRefs(t *testing.T) {
+	t.Parallel()
+
+	// The registry serves the same digest in every repository.
+	digest := "sha256:" + strings.Repeat("1", 64)
+	registry := &fakeListRegistry{
+		manifests: []string{digest},
+	}
+	srv := httptest.NewServer(registry)
+	t.Cleanup(srv.Close)
+
+	host := strings.TrimPrefix(srv.URL, "http://")
+	server := testServer(t)
+
+	resp, _, err := server.cleanPayload(context.Background(), &Payload{
+		Repos:          sortedStringSlice{host + "/proj/a", host + "/proj/b"},
+		SkipInUseCheck: true,
+		DryRun:         true,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := resp.Refs, []string{digest}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+	exp := map[string][]string{
+		host + "/proj/a": {digest},
+		host + "/proj/b": {digest},
+	}
+	if got, want := resp.RefsByRepo, exp; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+	if got, want := resp.deletedCount(), 2; got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+}
+
+func TestServer_CleanPayload_ReposMatch(t *testing.T) {
+	t.Parallel()
+
+	digest := "sha256:" + strings.Repeat("1", 64)
+	registry := &fakeListRegistry{
+		manifests: []string{digest},
+	}
+	srv := httptest.NewServer(registry)
+	t.Cleanup(srv.Close)
+
+	host := strings.TrimPrefix(srv.URL, "http://")
+	server := testServer(t)
+
+	resp, _, err := server.cleanPayload(context.Background(), &Payload{
+		Repos:          sortedStringSlice{host + "/proj/a", host + "/proj/b"},
+		ReposMatch:     sortedStringSlice{host + "/proj/b"},
+		SkipInUseCheck: true,
+		DryRun:         true,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := map[string][]string{
+		host + "/proj/b": {digest},
+	}
+	if got, want := resp.RefsByRepo, exp; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+}
+
+func TestServer_HTTPHandler_TextBody(t *testing.T) {
+	t.Parallel()
+
+	registry := &fakeListRegistry{
+		manifests: []string{"sha256:" + strings.Repeat("1", 64)},
+	}
+	srv := httptest.NewServer(registry)
+	t.Cleanup(srv.Close)
+
+	host := strings.TrimPrefix(srv.URL, "http://")
+	server := testServer(t)
+
+	body := fmt.Sprintf("# comment\n%s/proj/a\n\n  %s/proj/b  \n%s/proj/a\n", host, host, host)
+	r := httptest.NewRequest("POST", "/http?skip_in_use_check=true&dry_run=true&response_version=2&repos="+host+"/proj/c", strings.NewReader(body))
+	r.Header.Set(contentTypeHeader, "text/plain; charset=utf-8")
+	w := httptest.NewRecorder()
+	server.HTTPHandler().ServeHTTP(w, r)
+
+	if got, want := w.Code, 200; got != want {
+		t.Fatalf("expected %d to be %d: %s", got, want, w.Body.String())
+	}
+
+	var resp CleanResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	exp := map[string]int{
+		host + "/proj/a": 1,
+		host + "/proj/b": 1,
+		host + "/proj/c": 1,
+	}
+	if got, want := resp.CountByRepo, exp; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v to be %v", got, want)
+	}
+	if got := atomic.LoadInt32(&registry.deletes); got != 0 {
+		t.Errorf("expected %d deletes to be 0", got)
+	}
+}
+
+func TestQueryValue(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		field string
+		in    string
+		exp   any
+	}{
+		{"dry_run", "true", true},
+		{"dry_run", "false", false},
+		{"dry_run", "True", "True"},
+		{"keep", "3", float64(3)},
+		{"max_depth", "2", float64(2)},
+		{"max_deletes_per_second", "1.5", 1.5},
+		{"grace", "48h", "48h"},
+		{"grace", "3600", "3600"},
+		{"tag_filter_any", "^pr-", "^pr-"},
+		{"tag_filter_any", "2024", "2024"},
+		{"keep_group_by", "1", "1"},
+		{"tag_keep_exact", "1", "1"},
+		{"unknown", "1", "1"},
+	}
+
+	for _, tc := range cases {
+		if got, want := queryValue(tc.field, tc.in), tc.exp; got != want {
+			t.Errorf("expected %s=%v (%T) to be %v (%T)", tc.field, got, got, want, want)
+		}
+	}
+}
+
+func TestTextPayloadBody(t *testing.T) {
+	t.Parallel()
+
+	query, err := url.ParseQuery("tag_filter_any=2024&keep_group_by=1&tag_keep_exact=1&tag_keep_exact=2&keep=3&dry_run=true&grace=48h")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := textPayloadBody(strings.NewReader("gcr.io/my-project/my-image\n"), query)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var p Payload
+	if err := json.NewDecoder(body).Decode(&p); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := p.TagFilterAny, "2024"; got != want {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+	if got, want := p.KeepGroupBy, "1"; got != want {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+	if got, want := p.TagKeepExact, (sortedStringSlice{"1", "2"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+	if got, want := p.Keep, int64(3); got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+	if !p.DryRun {
+		t.Errorf("expected dry run")
+	}
+	if got, want := time.Duration(p.Grace), 48*time.Hour; got != want {
+		t.Errorf("expected %s to be %s", got, want)
+	}
+	if got, want := p.Repos, (sortedStringSlice{"gcr.io/my-project/my-image"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+
+	// A bare number is not a duration, rather than being read as nanoseconds.
+	query.Set("grace", "3600")
+	body, err = textPayloadBody(strings.NewReader(""), query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.NewDecoder(body).Decode(&Payload{}); err == nil {
+		t.Errorf("expected error decoding a bare number grace")
+	}
+}
+
+func TestServer_CleanPayload_CountsOnly(t *testing.T) {
+	t.Parallel()
+
+	digest := "sha256:" + strings.Repeat("1", 64)
+	registry := &fakeListRegistry{
+		manifests: []string{digest},
+	}
+	srv := httptest.NewServer(registry)
+	t.Cleanup(srv.Close)
+
+	host := strings.TrimPrefix(srv.URL, "http://")
+	server := testServer(t)
+
+	resp, _, err := server.cleanPayload(context.Background(), &Payload{
+		Repos:           sortedStringSlice{host + "/proj/a", host + "/proj/b"},
+		CountsOnly:      true,
+		ResponseVersion: responseVersionRefCount,
+		SkipInUseCheck:  true,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Counts only implies a dry run.
+	if got := atomic.LoadInt32(&registry.deletes); got != 0 {
+		t.Errorf("expected %d deletes to be 0", got)
+	}
+
+	if got, want := resp.Count, 2; got != want {
+		t.Errorf("expected count %d to be %d", got, want)
+	}
+	exp := map[string]int{
+		host + "/proj/a": 1,
+		host + "/proj/b": 1,
+	}
+	if got, want := resp.CountByRepo, exp; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v to be %v", got, want)
+	}
+	if len(resp.Refs) != 0 || len(resp.RefsByRepo) != 0 || resp.RefsWithReasons != nil {
+		t.Errorf("expected refs and decisions to be omitted, got %q, %q, %v",
+			resp.Refs, resp.RefsByRepo, resp.RefsWithReasons)
+	}
+}
+
+func TestServer_CleanPayload_MinManifests(t *testing.T) {
+	t.Parallel()
+
+	digests := []string{
+		"sha256:" + strings.Repeat("1", 64),
+		"sha256:" + strings.Repeat("2", 64),
+	}
+
+	cases := []struct {
+		name         string
+		minManifests int
+		skipped      bool
+	}{
+		{
+			name:         "below",
+			minManifests: 3,
+			skipped:      true,
+		},
+		{
+			name:         "at_least",
+			minManifests: 2,
+			skipped:      false,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			registry := &fakeListRegistry{
+				manifests: digests,
+			}
+			srv := httptest.NewServer(registry)
+			t.Cleanup(srv.Close)
+
+			host := strings.TrimPrefix(srv.URL, "http://")
+			repo := host + "/proj/a"
+			server := testServer(t)
+
+			resp, _, err := server.cleanPayload(context.Background(), &Payload{
+				Repos:          sortedStringSlice{repo},
+				MinManifests:   tc.minManifests,
+				SkipInUseCheck: true,
+				DryRun:         true,
+				IncludeReasons: true,
+			}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tc.skipped {
+				if got, want := resp.SkippedMinManifests, map[string]int{repo: 2}; !reflect.DeepEqual(got, want) {
+					t.Errorf("expected %v to be %v", got, want)
+				}
+				if got := len(resp.RefsByRepo[repo]); got != 0 {
+					t.Errorf("expected %d refs to be 0", got)
+				}
+				for _, d := range resp.RefsWithReasons[repo] {
+					if got, want := d.Reason, ReasonMinManifests; got != want {
+						t.Errorf("expected %q to be %q", got, want)
+					}
+				}
+				return
+			}
+
+			if resp.SkippedMinManifests != nil {
+				t.Errorf("expected no skipped repos, got %v", resp.SkippedMinManifests)
+			}
+			if got, want := len(resp.RefsByRepo[repo]), len(digests); got != want {
+				t.Errorf("expected %d refs to be %d", got, want)
+			}
+		})
+	}
+}
+
+func TestServer_CleanPayload_Durations(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name      string
+		dryRun    bool
+		maxDelete int
+	}{
+		{
+			name:   "dry_run",
+			dryRun: true,
+		},
+		{
+			name:   "real",
+			dryRun: false,
+		},
+		{
+			name:      "planned",
+			dryRun:    false,
+			maxDelete: 10,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			registry := &fakeListRegistry{
+				manifests: []string{"sha256:" + strings.Repeat("1", 64)},
+				failRepos: []string{"proj/b"},
+			}
+			srv := httptest.NewServer(registry)
+			t.Cleanup(srv.Close)
+
+			host := strings.TrimPrefix(srv.URL, "http://")
+			server := testServer(t)
+
+			repos := []string{host + "/proj/a", host + "/proj/b"}
+			resp, _, err := server.cleanPayload(context.Background(), &Payload{
+				Repos:          sortedStringSlice(repos),
+				SkipInUseCheck: true,
+				DryRun:         tc.dryRun,
+				MaxDelete:      tc.maxDelete,
+			}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Failed repositories are timed too.
+			for _, repo := range repos {
+				total, ok := resp.Durations[repo]
+				if !ok {
+					t.Errorf("expected durations %v to include %s", resp.Durations, repo)
+					continue
+				}
+				phases := resp.PhaseDurations[repo]
+				if phases == nil {
+					t.Errorf("expected phase durations %v to include %s", resp.PhaseDurations, repo)
+					continue
+				}
+				if got, want := phases.Plan+phases.Delete, total; got > want {
+					t.Errorf("expected phases %d to be at most %d", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestServer_CleanPayload_RequireConfirm(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name    string
+		require bool
+		confirm bool
+		dryRun  bool
+		forced  bool
+		deletes int32
+	}{
+		{
+			name:    "not_required",
+			deletes: 1,
+		},
+		{
+			name:    "unconfirmed",
+			require: true,
+			forced:  true,
+		},
+		{
+			name:    "confirmed",
+			require: true,
+			confirm: true,
+			deletes: 1,
+		},
+		{
+			name:    "explicit_dry_run",
+			require: true,
+			dryRun:  true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			registry := &fakeListRegistry{
+				manifests: []string{"sha256:" + strings.Repeat("1", 64)},
+			}
+			srv := httptest.NewServer(registry)
+			t.Cleanup(srv.Close)
+
+			host := strings.TrimPrefix(srv.URL, "http://")
+			server := testServer(t)
+			server.requireConfirm = tc.require
+
+			resp, _, err := server.cleanPayload(context.Background(), &Payload{
+				Repos:          sortedStringSlice{host + "/proj/a"},
+				Confirm:        tc.confirm,
+				DryRun:         tc.dryRun,
+				SkipInUseCheck: true,
+			}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got, want := resp.DryRunForced, tc.forced; got != want {
+				t.Errorf("expected dry run forced %t to be %t", got, want)
+			}
+			if got, want := atomic.LoadInt32(&registry.deletes), tc.deletes; got != want {
+				t.Errorf("expected %d deletes to be %d", got, want)
+			}
+		})
+	}
+}
+
+func TestServer_Run(t *testing.T) {
+	t.Parallel()
+
+	registry := &fakeListRegistry{
+		manifests: []string{"sha256:" + strings.Repeat("1", 64)},
+	}
+	srv := httptest.NewServer(registry)
+	t.Cleanup(srv.Close)
+
+	host := strings.TrimPrefix(srv.URL, "http://")
+	server := testServer(t)
+
+	p := Payload{
+		Repos:          sortedStringSlice{host + "/proj/a"},
+		CountsOnly:     true,
+		SkipInUseCheck: true,
+	}
+	resp, err := server.Run(context.Background(), p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := resp.CountByRepo[host+"/proj/a"], 1; got != want {
+		t.Errorf("expected count %d to be %d", got, want)
+	}
+	if got := atomic.LoadInt32(&registry.deletes); got != 0 {
+		t.Errorf("expected %d deletes to be 0", got)
+	}
+	if p.DryRun {
+		t.Errorf("expected payload to not be modified")
+	}
+
+	// Invalid payloads are rejected.
+	if _, err := server.Run(context.Background(), Payload{MaxDelete: -1}); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+func TestServer_CleanPayload_IncludeReasons(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name           string
+		includeReasons bool
+		exp            int
+	}{
+		{name: "default", includeReasons: false, exp: 0},
+		{name: "include_reasons", includeReasons: true, exp: 1},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			registry := &fakeListRegistry{
+				manifests: []string{"sha256:" + strings.Repeat("1", 64)},
+			}
+			srv := httptest.NewServer(registry)
+			t.Cleanup(srv.Close)
+
+			repo := strings.TrimPrefix(srv.URL, "http://") + "/proj/a"
+			resp, _, err := testServer(t).cleanPayload(context.Background(), &Payload{
+				Repos:          sortedStringSlice{repo},
+				SkipInUseCheck: true,
+				DryRun:         true,
+				IncludeReasons: tc.includeReasons,
+			}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got, want := len(resp.RefsWithReasons[repo]), tc.exp; got != want {
+				t.Errorf("expected %d decisions to be %d", got, want)
+			}
+		})
+	}
+}
+
+func TestServer_CleanPayload_ResponseVersion(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name    string
+		version int
+		count   int
+	}{
+		{
+			name:    "default",
+			version: 0,
+			count:   1,
+		},
+		{
+			name:    "repo_count",
+			version: 1,
+			count:   1,
+		},
+		{
+			name:    "ref_count",
+			version: 2,
+			count:   2,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			registry := &fakeListRegistry{
+				manifests: []string{
+					"sha256:" + strings.Repeat("1", 64),
+					"sha256:" + strings.Repeat("2", 64),
+				},
+			}
+			srv := httptest.NewServer(registry)
+			t.Cleanup(srv.Close)
+
+			host := strings.TrimPrefix(srv.URL, "http://")
+			server := testServer(t)
+
+			resp, _, err := server.cleanPayload(context.Background(), &Payload{
+				Repos:           sortedStringSlice{host + "/proj/a"},
+				SkipInUseCheck:  true,
+				DryRun:          true,
+				ResponseVersion: tc.version,
+			}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got, want := resp.Count, tc.count; got != want {
+				t.Errorf("expected count %d to be %d", got, want)
+			}
+			if got, want := resp.RepoCount, 1; got != want {
+				t.Errorf("expected repo count %d to be %d", got, want)
+			}
+		})
+	}
+}
+
+func TestServer_CleanPayload_Filters(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name    string
+		payload *Payload
+		exp     *filtersResp
+	}{
+		{
+			name:    "default",
+			payload: &Payload{},
+			exp: &filtersResp{
+				RepoKeep:   "(none)",
+				RepoPrefix: "(none)",
+				Tag:        "(none)",
+				TagKeep:    "(none)",
+			},
+		},
+		{
+			name: "regex",
+			payload: &Payload{
+				RepoKeepFilterAny: "^keep",
+				TagFilterAny:      "^pr-",
+				TagKeepAny:        "^v",
+				ReposMatch:        sortedStringSlice{"gcr.io/p/b", "gcr.io/p/a"},
+				PlatformFilter:    "arm64$",
+			},
+			exp: &filtersResp{
+				RepoKeep:   "any(^keep)",
+				RepoPrefix: "(none)",
+				RepoMatch:  "exact(gcr.io/p/a, gcr.io/p/b)",
+				Tag:        "any(^pr-)",
+				TagKeep:    "any(^v)",
+				Platform:   "any(arm64$)",
+			},
+		},
+		{
+			name: "case_insensitive_glob",
+			payload: &Payload{
+				PatternKind:     PatternKindGlob,
+				CaseInsensitive: true,
+				TagFilterAll:    "pr-*",
+			},
+			exp: &filtersResp{
+				RepoKeep:   "(none)",
+				RepoPrefix: "(none)",
+				Tag:        "all((?i)^pr-[^/]*$)",
+				TagKeep:    "(none)",
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			registry := &fakeListRegistry{}
+			srv := httptest.NewServer(registry)
+			t.Cleanup(srv.Close)
+
+			host := strings.TrimPrefix(srv.URL, "http://")
+			server := testServer(t)
+
+			tc.payload.Repos = sortedStringSlice{host + "/proj/a"}
+			tc.payload.SkipInUseCheck = true
+			tc.payload.DryRun = true
+
+			resp, _, err := server.cleanPayload(context.Background(), tc.payload, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got, want := resp.Filters, tc.exp; !reflect.DeepEqual(got, want) {
+				t.Errorf("expected %+v to be %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestServer_CleanPayload_PartialFailure(t *testing.T) {
+	t.Parallel()
+
+	digest := "sha256:" + strings.Repeat("1", 64)
+	registry := &fakeListRegistry{
+		manifests: []string{digest},
+		failRepos: []string{"proj/a"},
+	}
+	srv := httptest.NewServer(registry)
+	t.Cleanup(srv.Close)
+
+	host := strings.TrimPrefix(srv.URL, "http://")
+	server := testServer(t)
+
+	resp, status, err := server.cleanPayload(context.Background(), &Payload{
+		Repos:          sortedStringSlice{host + "/proj/a", host + "/proj/b"},
+		SkipInUseCheck: true,
+		DryRun:         true,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := status, 207; got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+	if _, ok := resp.Errors[host+"/proj/a"]; !ok || len(resp.Errors) != 1 {
+		t.Errorf("expected errors %q to only include %s", resp.Errors, host+"/proj/a")
+	}
+	exp := map[string][]string{host + "/proj/b": {digest}}
+	if got, want := resp.RefsByRepo, exp; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+}
+
+func TestServer_CleanPayload_RecursiveBestEffort(t *testing.T) {
+	t.Parallel()
+
+	digest := "sha256:" + strings.Repeat("1", 64)
+	okSrv := httptest.NewServer(&fakeListRegistry{
+		catalog:   []string{"proj/a"},
+		manifests: []string{digest},
+	})
+	t.Cleanup(okSrv.Close)
+	okHost := strings.TrimPrefix(okSrv.URL, "http://")
+
+	failSrv := httptest.NewServer(&fakeListRegistry{failCatalog: true})
+	t.Cleanup(failSrv.Close)
+	failHost := strings.TrimPrefix(failSrv.URL, "http://")
+
+	server := testServer(t)
+
+	resp, status, err := server.cleanPayload(context.Background(), &Payload{
+		Repos:               sortedStringSlice{okHost + "/proj", failHost + "/proj"},
+		Recursive:           true,
+		RecursiveBestEffort: true,
+		SkipInUseCheck:      true,
+		DryRun:              true,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := status, 207; got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+	if got, want := len(resp.ListWarnings), 1; got != want {
+		t.Fatalf("expected %d warnings to be %d: %q", got, want, resp.ListWarnings)
+	}
+	if got, want := resp.ListWarnings[0], failHost; !strings.Contains(got, want) {
+		t.Errorf("expected %q to contain %q", got, want)
+	}
+	exp := map[string][]string{okHost + "/proj/a": {digest}}
+	if got, want := resp.RefsByRepo, exp; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+}
+
+func TestServer_CleanPayload_RepoTimeout(t *testing.T) {
+	t.Parallel()
+
+	fast := "sha256:" + strings.Repeat("1", 64)
+	slow := "sha256:" + strings.Repeat("2", 64)
+	registry := &fakeListRegistry{
+		manifests:   []string{fast, slow},
+		slowDigests: []string{slow},
+	}
+	srv := httptest.NewServer(registry)
+	t.Cleanup(srv.Close)
+
+	host := strings.TrimPrefix(srv.URL, "http://")
+	server := testServer(t)
+
+	resp, status, err := server.cleanPayload(context.Background(), &Payload{
+		Repos:             sortedStringSlice{host + "/proj/a"},
+		SkipInUseCheck:    true,
+		DeleteMaxAttempts: 1,
+		RepoTimeout:       duration(100 * time.Millisecond),
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := status, 207; got != want {
+		t.Errorf("expected %d to be %d", got, want)
+	}
+	if got := resp.Errors[host+"/proj/a"]; !strings.Contains(got, "timed out") {
+		t.Errorf("expected %q to contain %q", got, "timed out")
+	}
+
+	// The refs deleted before the timeout are still reported.
+	exp := map[string][]string{host + "/proj/a": {fast}}
+	if got, want := resp.RefsByRepo, exp; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+}
+
+func TestServer_CleanPayload_ReposExclude(t *testing.T) {
+	t.Parallel()
+
+	registry := &fakeListRegistry{
+		catalog:   []string{"proj/team", "proj/team/app", "proj/team/legacy", "proj/team/legacy/old"},
+		manifests: []string{"sha256:" + strings.Repeat("1", 64)},
+	}
+	srv := httptest.NewServer(registry)
+	t.Cleanup(srv.Close)
+
+	host := strings.TrimPrefix(srv.URL, "http://")
+	server := testServer(t)
+
+	resp, _, err := server.cleanPayload(context.Background(), &Payload{
+		Repos:          []string{host + "/proj/team"},
+		ReposExclude:   []string{host + "/proj/team/legacy"},
+		Recursive:      true,
+		SkipInUseCheck: true,
+		DryRun:         true,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Excluded repositories are never cleaned, so they are never listed.
+	registry.lock.Lock()
+	listed := append([]string(nil), registry.listed...)
+	registry.lock.Unlock()
+	sort.Strings(listed)
+
+	if got, want := listed, []string{"proj/team", "proj/team/app"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected listed %q to be %q", got, want)
+	}
+
+	repos := make([]string, 0, len(resp.RefsByRepo))
+	for repo := range resp.RefsByRepo {
+		repos = append(repos, repo)
+	}
+	sort.Strings(repos)
+
+	if got, want := repos, []string{host + "/proj/team", host + "/proj/team/app"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected repos %q to be %q", got, want)
+	}
+}
+
+func TestPayload_Since(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+	before := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		name    string
+		payload *Payload
+		exp     time.Time
+	}{
+		{
+			name:    "default",
+			payload: &Payload{},
+			exp:     now,
+		},
+		{
+			name:    "grace",
+			payload: &Payload{Grace: duration(48 * time.Hour)},
+			exp:     now.Add(-48 * time.Hour),
+		},
+		{
+			name:    "before",
+			payload: &Payload{Before: timestamp(before)},
+			exp:     before,
+		},
+		{
+			name:    "before_takes_precedence",
+			payload: &Payload{Grace: duration(48 * time.Hour), Before: timestamp(before)},
+			exp:     before,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got, want := tc.payload.since(now), tc.exp; !got.Equal(want) {
+				t.Errorf("expected %s to be %s", got, want)
+			}
+		})
+	}
+}
+
+func TestServer_Clean_InvalidBefore(t *testing.T) {
+	t.Parallel()
+
+	server := testServer(t)
+
+	body := io.NopCloser(strings.NewReader(`{"before": "2024-01-01", "skip_in_use_check": true}`))
+	_, _, err := server.clean(context.Background(), body, nil)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if got, want := err.Error(), `invalid timestamp "2024-01-01": must be RFC3339`; !strings.Contains(got, want) {
+		t.Errorf("expected %q to contain %q", got, want)
+	}
+}
+
+func TestServer_CleanSummary(t *testing.T) {
+	t.Parallel()
+
+	var logs bytes.Buffer
+	logger := NewLogger("info", &logs, &logs)
+	cleaner, err := NewCleaner(nil, logger, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewServer(cleaner)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := io.NopCloser(strings.NewReader(`{"skip_in_use_check": true, "dry_run": true}`))
+	if _, _, err := server.clean(context.Background(), body, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var summary map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var entry map[string]any
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatal(err)
+		}
+		if entry["message"] == "clean summary" {
+			summary = entry
+		}
+	}
+	if summary == nil {
+		t.Fatalf("expected a clean summary log: %s", logs.String())
+	}
+
+	for _, key := range []string{"repos", "deleted", "kept", "skipped_in_use", "bytes_freed", "duration", "dry_run"} {
+		if _, ok := summary[key]; !ok {
+			t.Errorf("expected summary to have %q: %v", key, summary)
+		}
+	}
+	if got, want := summary["dry_run"], true; got != want {
+		t.Errorf("expected dry_run %v to be %v", got, want)
+	}
+}
+
+func TestServer_CleanPubSub_Timeout(t *testing.T) {
+	t.Parallel()
+
+	var logs bytes.Buffer
+	logger := NewLogger("info", &logs, &logs)
+	cleaner, err := NewCleaner(nil, logger, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewServer(cleaner, WithPubSubTimeout(time.Nanosecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := io.NopCloser(strings.NewReader(`{"repos": ["gcr.io/my-project/my-image"], "skip_in_use_check": true}`))
+	server.cleanPubSub(body)
+
+	got := logs.String()
+	for _, want := range []string{`"message":"timed out cleaning"`, `"timeout":"1ns"`, `"repos_total":1`} {
+		if !strings.Contains(got, want) {
+			t.Errorf("expected logs to contain %q: %s", want, got)
+		}
+	}
+}
+
+type testResultSink struct {
+	lock      sync.Mutex
+	summaries []*CleanSummary
+}
+
+func (s *testResultSink) Report(_ context.Context, summary *CleanSummary) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.summaries = append(s.summaries, summary)
+	return nil
+}
+
+func TestServer_CleanPubSub_ResultSink(t *testing.T) {
+	t.Parallel()
+
+	cleaner, err := NewCleaner(nil, NewLogger("error", io.Discard, io.Discard), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sink := new(testResultSink)
+	server, err := NewServer(cleaner,
+		WithPubSubTimeout(time.Nanosecond),
+		WithResultSink(sink))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := io.NopCloser(strings.NewReader(`{"repos": ["gcr.io/my-project/my-image"], "skip_in_use_check": true}`))
+	server.forRequest("abc123").cleanPubSub(body)
+
+	if got, want := len(sink.summaries), 1; got != want {
+		t.Fatalf("expected %d summaries to be %d", got, want)
+	}
+
+	summary := sink.summaries[0]
+	if got, want := summary.RequestID, "abc123"; got != want {
+		t.Errorf("expected request id %q to be %q", got, want)
+	}
+	if summary.Success {
+		t.Errorf("expected summary to not be successful")
+	}
+	if got, want := summary.Error, "deadline exceeded"; !strings.Contains(got, want) {
+		t.Errorf("expected error %q to contain %q", got, want)
+	}
+}
+
+func TestServer_Clean_Notifier(t *testing.T) {
+	t.Parallel()
+
+	cleaner, err := NewCleaner(nil, NewLogger("error", io.Discard, io.Discard), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	summaries := make(chan *CleanSummary, 1)
+	server, err := NewServer(cleaner, WithNotifier(resultSinkFunc(func(_ context.Context, summary *CleanSummary) error {
+		summaries <- summary
+		return nil
+	})))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := io.NopCloser(strings.NewReader(`{"skip_in_use_check": true, "dry_run": true}`))
+	if _, _, err := server.forRequest("abc123").clean(context.Background(), body, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case summary := <-summaries:
+		if got, want := summary.RequestID, "abc123"; got != want {
+			t.Errorf("expected request id %q to be %q", got, want)
+		}
+		if !summary.Success {
+			t.Errorf("expected summary to be successful: %s", summary.Error)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a summary")
+	}
+}
+
+type resultSinkFunc func(ctx context.Context, summary *CleanSummary) error
+
+func (f resultSinkFunc) Report(ctx context.Context, summary *CleanSummary) error {
+	return f(ctx, summary)
+}
+
+func TestWebhookResultSink(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name     string
+		statuses []int
+		calls    int32
+		err      string
+	}{
+		{
+			name:     "success",
+			statuses: []int{200},
+			calls:    1,
+		},
+		{
+			name:     "retries_server_errors",
+			statuses: []int{503, 500, 204},
+			calls:    3,
+		},
+		{
+			name:     "gives_up",
+			statuses: []int{500, 500, 500, 200},
+			calls:    3,
+			err:      "after 3 attempts",
+		},
+		{
+			name:     "no_retry_client_error",
+			statuses: []int{400, 200},
+			calls:    1,
+			err:      "status 400",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			var calls int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := atomic.AddInt32(&calls, 1)
+
+				var summary CleanSummary
+				if err := json.NewDecoder(r.Body).Decode(&summary); err != nil {
+					t.Errorf("failed to decode summary: %s", err)
+				}
+				if got, want := summary.RequestID, "abc123"; got != want {
+					t.Errorf("expected request id %q to be %q", got, want)
+				}
+				w.WriteHeader(tc.statuses[n-1])
+			}))
+			t.Cleanup(srv.Close)
+
+			sink, err := NewWebhookResultSink(srv.URL, WithWebhookRetries(3, time.Millisecond))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = sink.Report(context.Background(), &CleanSummary{RequestID: "abc123"})
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Errorf("expected error %v to contain %q", err, tc.err)
+				}
+			} else if err != nil {
+				t.Error(err)
+			}
+
+			if got, want := atomic.LoadInt32(&calls), tc.calls; got != want {
+				t.Errorf("expected %d calls to be %d", got, want)
+			}
+		})
+	}
+}
+
+func TestWebhookResultSink_RedactsURL(t *testing.T) {
+	t.Parallel()
+
+	const secret = "/hooks/T000/B000/s3cr3t?token=s3cr3t"
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	t.Cleanup(srv.Close)
+
+	// A closed server fails to connect, which returns a *url.Error.
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	for _, base := range []string{srv.URL, closed.URL} {
+		sink, err := NewWebhookResultSink(base+secret, WithWebhookRetries(1, time.Millisecond))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = sink.Report(context.Background(), &CleanSummary{RequestID: "abc123"})
+		if err == nil {
+			t.Fatalf("expected error for %s", base)
+		}
+		if strings.Contains(err.Error(), "s3cr3t") {
+			t.Errorf("expected error %q to not contain the webhook path", err)
+		}
+		if !strings.Contains(err.Error(), base) {
+			t.Errorf("expected error %q to contain %q", err, base)
+		}
+	}
+}
+
+func TestNewWebhookResultSink_InvalidURL(t *testing.T) {
+	t.Parallel()
+
+	for _, u := range []string{"", "ftp://example.com", "example.com/hook"} {
+		if _, err := NewWebhookResultSink(u); err == nil {
+			t.Errorf("expected error for %q", u)
+		}
+	}
+}
+
+func TestServer_PubSubHandler_AllowedSubscriptions(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name         string
+		allowed      []string
+		subscription string
+		err          string
+	}{
+		{
+			name:         "default_allows_all",
+			subscription: "projects/my-project/subscriptions/other",
+			err:          "missing data",
+		},
+		{
+			name:         "allowed",
+			allowed:      []string{"projects/my-project/subscriptions/cleaner"},
+			subscription: "projects/my-project/subscriptions/cleaner",
+			err:          "missing data",
+		},
+		{
+			name:         "not_allowed",
+			allowed:      []string{"projects/my-project/subscriptions/cleaner"},
+			subscription: "projects/my-project/subscriptions/other",
+			err:          "is not allowed",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			server := testServer(t)
+			WithAllowedSubscriptions(tc.allowed...)(server)
+
+			cache := NewTimerCache(0)
+			t.Cleanup(cache.Stop)
+
+			// The message has no data, so an allowed subscription fails later with
+			// a different error and nothing is cleaned.
+			body := fmt.Sprintf(`{"subscription": %q, "message": {"message_id": "1"}}`, tc.subscription)
+
+			w := httptest.NewRecorder()
+			server.PubSubHandler(cache).ServeHTTP(w, httptest.NewRequest("POST", "/pubsub", strings.NewReader(body)))
+
+			if got, want := w.Code, 400; got != want {
+				t.Fatalf("expected status %d to be %d", got, want)
+			}
+			if got, want := w.Body.String(), tc.err; !strings.Contains(got, want) {
+				t.Errorf("expected body %q to contain %q", got, want)
+			}
+		})
+	}
+}
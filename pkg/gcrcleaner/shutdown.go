@@ -0,0 +1,99 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// errShuttingDown is returned when a background clean is started after
+// Shutdown.
+var errShuttingDown = fmt.Errorf("server is shutting down")
+
+// backgroundTracker tracks the work the server does in the background, such as
+// cleans started by pubsub requests and jobs, so it can be drained on shutdown.
+type backgroundTracker struct {
+	lock   sync.Mutex
+	active int
+	closed bool
+
+	drained     chan struct{}
+	drainedOnce sync.Once
+}
+
+// newBackgroundTracker creates a tracker with nothing in progress.
+func newBackgroundTracker() *backgroundTracker {
+	return &backgroundTracker{
+		drained: make(chan struct{}),
+	}
+}
+
+// start registers new background work. It returns errShuttingDown if the
+// tracker is closed, unless force is true, which is for work that finishes
+// work that is already tracked, such as notifications. Each successful call
+// must be followed by a call to done.
+func (b *backgroundTracker) start(force bool) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.closed && !force {
+		return errShuttingDown
+	}
+	b.active++
+	return nil
+}
+
+// done marks background work as finished.
+func (b *backgroundTracker) done() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.active--
+	if b.closed && b.active == 0 {
+		b.drainedOnce.Do(func() { close(b.drained) })
+	}
+}
+
+// close stops new background work from starting, and returns a channel that is
+// closed once all background work has finished.
+func (b *backgroundTracker) close() <-chan struct{} {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.closed = true
+	if b.active == 0 {
+		b.drainedOnce.Do(func() { close(b.drained) })
+	}
+	return b.drained
+}
+
+// Shutdown stops the server from starting new background cleans, and waits
+// for the cleans already running in the background, such as those started by
+// pubsub requests and jobs, to finish. Afterwards, pubsub requests and new jobs
+// are rejected with a 503, so pubsub redelivers them to another instance. If
+// ctx is done first, the cleans are abandoned and an error is returned.
+//
+// It does not stop the HTTP server, which can be shut down at the same time,
+// since requests that would start background cleans are rejected.
+func (s *Server) Shutdown(ctx context.Context) error {
+	select {
+	case <-s.background.close():
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("failed to wait for background cleans: %w", ctx.Err())
+	}
+}
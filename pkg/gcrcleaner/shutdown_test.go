@@ -0,0 +1,118 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServer_Shutdown(t *testing.T) {
+	t.Parallel()
+
+	t.Run("waits_for_background", func(t *testing.T) {
+		t.Parallel()
+
+		server := testServer(t)
+		if err := server.background.start(false); err != nil {
+			t.Fatal(err)
+		}
+
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- server.Shutdown(context.Background())
+		}()
+
+		select {
+		case err := <-errCh:
+			t.Fatalf("expected shutdown to wait, returned %v", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		server.background.done()
+
+		select {
+		case err := <-errCh:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected shutdown to return")
+		}
+	})
+
+	t.Run("idle", func(t *testing.T) {
+		t.Parallel()
+
+		server := testServer(t)
+		if err := server.Shutdown(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		// Shutting down again returns immediately.
+		if err := server.Shutdown(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("deadline", func(t *testing.T) {
+		t.Parallel()
+
+		server := testServer(t)
+		if err := server.background.start(false); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(server.background.done)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+
+		err := server.Shutdown(ctx)
+		if got, want := fmt.Sprint(err), "deadline exceeded"; !strings.Contains(got, want) {
+			t.Errorf("expected %q to contain %q", got, want)
+		}
+	})
+
+	t.Run("rejects_pubsub", func(t *testing.T) {
+		t.Parallel()
+
+		server := testServer(t)
+		if err := server.Shutdown(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		cache := NewTimerCache(0)
+		t.Cleanup(cache.Stop)
+
+		data := base64.StdEncoding.EncodeToString([]byte(`{"repos": ["gcr.io/my-project/my-image"]}`))
+		body := fmt.Sprintf(`{"subscription": "sub", "message": {"message_id": "1", "data": %q}}`, data)
+
+		w := httptest.NewRecorder()
+		server.PubSubHandler(cache).ServeHTTP(w, httptest.NewRequest("POST", "/pubsub", strings.NewReader(body)))
+		if got, want := w.Code, 503; got != want {
+			t.Errorf("expected status %d to be %d", got, want)
+		}
+
+		// The message was not marked as processed, so a redelivery is accepted.
+		if exists := cache.Insert("sub/1"); exists {
+			t.Errorf("expected message to not be marked as processed")
+		}
+	})
+}
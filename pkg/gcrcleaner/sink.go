@@ -0,0 +1,344 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"time"
+
+	"google.golang.org/api/option"
+	pubsub "google.golang.org/api/pubsub/v1"
+)
+
+// defaultReportTimeout is the maximum duration of reporting a result to the
+// result sink.
+const defaultReportTimeout = 30 * time.Second
+
+// CleanSummary is a summary of a single clean.
+type CleanSummary struct {
+	// RequestID is the ID of the request. For pubsub requests, it is the
+	// message ID.
+	RequestID string `json:"request_id"`
+
+	// Success is true if the clean finished without an error, and every
+	// repository was cleaned.
+	Success bool `json:"success"`
+
+	// Error is the error message if the clean failed.
+	Error string `json:"error,omitempty"`
+
+	// RepoErrors is the error message for each repository that failed to clean,
+	// keyed by repository. The remaining repositories were still cleaned.
+	RepoErrors map[string]string `json:"repo_errors,omitempty"`
+
+	// Deleted is the number of refs deleted. If the clean failed, it is the
+	// number of refs deleted before the failure.
+	Deleted int `json:"deleted"`
+
+	// DeletedByRepo is the number of refs deleted, keyed by repository. It is
+	// only set if the clean finished.
+	DeletedByRepo map[string]int `json:"deleted_by_repo,omitempty"`
+
+	// BytesFreed is the estimated storage reclaimed. It is only set if the clean
+	// finished.
+	BytesFreed *FreedBytes `json:"bytes_freed,omitempty"`
+
+	// DryRun is true if nothing was deleted, and the counts are what would have
+	// been deleted. It is only set if the clean finished.
+	DryRun bool `json:"dry_run,omitempty"`
+
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+}
+
+// newCleanSummary builds a summary from the result of a clean. If the clean
+// failed, progress is used for the partial counts.
+func newCleanSummary(requestID string, startedAt time.Time, resp *CleanResponse, progress cleanProgress, err error) *CleanSummary {
+	summary := &CleanSummary{
+		RequestID:  requestID,
+		Success:    err == nil,
+		Deleted:    progress.Deleted,
+		StartedAt:  startedAt,
+		FinishedAt: time.Now().UTC(),
+	}
+
+	if err != nil {
+		summary.Error = err.Error()
+		return summary
+	}
+
+	if resp != nil {
+		summary.Deleted = resp.deletedCount()
+		summary.DeletedByRepo = make(map[string]int, len(resp.CountByRepo))
+		for repo, n := range resp.CountByRepo {
+			summary.DeletedByRepo[repo] = n
+		}
+		summary.BytesFreed = resp.BytesFreed
+		summary.DryRun = resp.dryRun
+		summary.RepoErrors = resp.Errors
+		summary.Success = len(resp.Errors) == 0
+	}
+	return summary
+}
+
+// ResultSink receives a summary of each clean started by a pubsub request, so
+// that scheduled cleans can be monitored.
+type ResultSink interface {
+	Report(ctx context.Context, summary *CleanSummary) error
+}
+
+// WithResultSink sets the sink that receives a summary of each clean started
+// by a pubsub request. The default is no sink.
+func WithResultSink(sink ResultSink) ServerOption {
+	return func(s *Server) {
+		s.resultSink = sink
+	}
+}
+
+// reportResult reports the summary to the result sink, if any. Errors are
+// logged, since the clean has already finished.
+func (s *Server) reportResult(summary *CleanSummary) {
+	if s.resultSink == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultReportTimeout)
+	defer cancel()
+
+	if err := s.resultSink.Report(ctx, summary); err != nil {
+		s.logger.Error("failed to report clean result", "error", err)
+	}
+}
+
+// WithNotifier adds a sink that receives a summary of every clean, whether it
+// was started by an HTTP, streaming, job, or pubsub request. Unlike the result
+// sink, notifiers are called in the background, so a slow notifier never delays
+// the response.
+func WithNotifier(sink ResultSink) ServerOption {
+	return func(s *Server) {
+		s.notifiers = append(s.notifiers, sink)
+	}
+}
+
+// notifyResult notifies the notifiers, if any, of the result of a clean in the
+// background.
+func (s *Server) notifyResult(startedAt time.Time, resp *CleanResponse, progress cleanProgress, err error) {
+	if len(s.notifiers) == 0 {
+		return
+	}
+	// Notifications finish a clean, so they are sent even while shutting down.
+	summary := newCleanSummary(s.requestID, startedAt.UTC(), resp, progress, err)
+	_ = s.background.start(true)
+	go func() {
+		defer s.background.done()
+		s.notify(summary)
+	}()
+}
+
+// notify reports the summary to each notifier. Errors are logged, since the
+// clean has already finished.
+func (s *Server) notify(summary *CleanSummary) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultReportTimeout)
+	defer cancel()
+
+	for _, n := range s.notifiers {
+		if err := n.Report(ctx, summary); err != nil {
+			s.logger.Error("failed to notify clean result", "error", err)
+		}
+	}
+}
+
+// pubSubTopicRe matches a fully-qualified Pub/Sub topic name.
+var pubSubTopicRe = regexp.MustCompile(`^projects/[^/]+/topics/[^/]+$`)
+
+// PubSubResultSink is a ResultSink that publishes each summary as JSON to a
+// Pub/Sub topic.
+type PubSubResultSink struct {
+	service *pubsub.Service
+	topic   string
+}
+
+// NewPubSubResultSink creates a sink that publishes to the given topic, in the
+// form "projects/<project>/topics/<topic>". It uses the default credentials
+// unless other options are given.
+func NewPubSubResultSink(ctx context.Context, topic string, opts ...option.ClientOption) (*PubSubResultSink, error) {
+	if !pubSubTopicRe.MatchString(topic) {
+		return nil, fmt.Errorf("invalid topic %q: must be projects/<project>/topics/<topic>", topic)
+	}
+
+	service, err := pubsub.NewService(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create pubsub client: %w", err)
+	}
+
+	return &PubSubResultSink{
+		service: service,
+		topic:   topic,
+	}, nil
+}
+
+// Report publishes the summary to the topic. The message has a "success"
+// attribute, so subscriptions can filter on failures.
+func (s *PubSubResultSink) Report(ctx context.Context, summary *CleanSummary) error {
+	b, err := json.Marshal(summary)
+	if err != nil {
+		return fmt.Errorf("failed to marshal summary: %w", err)
+	}
+
+	if _, err := s.service.Projects.Topics.Publish(s.topic, &pubsub.PublishRequest{
+		Messages: []*pubsub.PubsubMessage{
+			{
+				Data: base64.StdEncoding.EncodeToString(b),
+				Attributes: map[string]string{
+					"request_id": summary.RequestID,
+					"success":    fmt.Sprintf("%t", summary.Success),
+				},
+			},
+		},
+	}).Context(ctx).Do(); err != nil {
+		return fmt.Errorf("failed to publish to %s: %w", s.topic, err)
+	}
+	return nil
+}
+
+// WebhookResultSink is a ResultSink that POSTs each summary as JSON to a URL.
+// Failed deliveries are retried with exponential backoff.
+type WebhookResultSink struct {
+	url    string
+	client *http.Client
+
+	// redacted is the scheme and host of the URL. Webhook URLs often carry a
+	// secret in the path or query, so only this is included in errors.
+	redacted string
+
+	attempts int
+	backoff  time.Duration
+}
+
+// WebhookOption is an option to NewWebhookResultSink.
+type WebhookOption func(s *WebhookResultSink)
+
+// WithWebhookHTTPClient sets the client used to deliver the webhook. The
+// default is http.DefaultClient.
+func WithWebhookHTTPClient(client *http.Client) WebhookOption {
+	return func(s *WebhookResultSink) {
+		s.client = client
+	}
+}
+
+// WithWebhookRetries sets the number of delivery attempts and the backoff
+// before the first retry, which doubles for each later retry. The default is 3
+// attempts with a backoff of 1s.
+func WithWebhookRetries(attempts int, backoff time.Duration) WebhookOption {
+	return func(s *WebhookResultSink) {
+		s.attempts = attempts
+		s.backoff = backoff
+	}
+}
+
+// NewWebhookResultSink creates a sink that POSTs to the given http or https
+// URL.
+func NewWebhookResultSink(rawURL string, opts ...WebhookOption) (*WebhookResultSink, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid webhook url %q: %w", rawURL, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid webhook url %q: must be an http or https url", rawURL)
+	}
+
+	s := &WebhookResultSink{
+		url:      rawURL,
+		redacted: u.Scheme + "://" + u.Host,
+		client:   http.DefaultClient,
+		attempts: 3,
+		backoff:  time.Second,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	if s.attempts < 1 {
+		return nil, fmt.Errorf("webhook attempts must be at least 1")
+	}
+	return s, nil
+}
+
+// Report POSTs the summary to the URL. Network errors, 429, and 5xx responses
+// are retried; other responses are not.
+func (s *WebhookResultSink) Report(ctx context.Context, summary *CleanSummary) error {
+	b, err := json.Marshal(summary)
+	if err != nil {
+		return fmt.Errorf("failed to marshal summary: %w", err)
+	}
+	return s.deliver(ctx, b)
+}
+
+// deliver POSTs the JSON body to the URL, retrying as described in Report.
+func (s *WebhookResultSink) deliver(ctx context.Context, body []byte) error {
+	backoff := s.backoff
+	for attempt := 1; ; attempt++ {
+		retry, err := s.post(ctx, body)
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt >= s.attempts {
+			return fmt.Errorf("failed to deliver webhook after %d attempts: %w", attempt, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("failed to deliver webhook: %w", ctx.Err())
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// post makes a single delivery attempt. It returns whether a failure should be
+// retried.
+func (s *WebhookResultSink) post(ctx context.Context, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return false, fmt.Errorf("failed to build request: %w", err)
+	}
+	req.Header.Set(contentTypeHeader, contentTypeJSON)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			uerr.URL = s.redacted
+		}
+		return ctx.Err() == nil, fmt.Errorf("failed to post to %s: %w", s.redacted, err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retry, fmt.Errorf("webhook %s returned status %d", s.redacted, resp.StatusCode)
+}
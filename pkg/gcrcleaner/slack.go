@@ -0,0 +1,144 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// slackMaxRepos is the maximum number of repositories listed in a Slack
+// message. The rest are summarized as a count.
+const slackMaxRepos = 10
+
+// SlackResultSink is a ResultSink that posts a human-readable summary to a
+// Slack incoming webhook.
+type SlackResultSink struct {
+	webhook *WebhookResultSink
+}
+
+// NewSlackResultSink creates a sink that posts to the given Slack incoming
+// webhook URL. Delivery is retried like a WebhookResultSink, and the same
+// options apply.
+func NewSlackResultSink(webhookURL string, opts ...WebhookOption) (*SlackResultSink, error) {
+	webhook, err := NewWebhookResultSink(webhookURL, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &SlackResultSink{webhook: webhook}, nil
+}
+
+// Report posts the summary to Slack.
+func (s *SlackResultSink) Report(ctx context.Context, summary *CleanSummary) error {
+	b, err := json.Marshal(map[string]string{
+		"text": renderSlackMessage(summary),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal slack message: %w", err)
+	}
+	return s.webhook.deliver(ctx, b)
+}
+
+// renderSlackMessage renders the summary as Slack mrkdwn, such as "Cleaned 342
+// images across 12 repos, freed 18.0 GB", followed by the repositories with
+// the most deleted images and any errors.
+func renderSlackMessage(summary *CleanSummary) string {
+	var b strings.Builder
+
+	prefix := ""
+	if summary.DryRun {
+		prefix = "[dry run] "
+	}
+
+	if summary.Error != "" {
+		fmt.Fprintf(&b, "%s:x: *Clean failed* after deleting %s: %s\n",
+			prefix, plural(summary.Deleted, "image"), summary.Error)
+	} else {
+		verb := "Cleaned"
+		if summary.DryRun {
+			verb = "Would clean"
+		}
+		fmt.Fprintf(&b, "%s%s %s across %s",
+			prefix, verb, plural(summary.Deleted, "image"), plural(len(summary.DeletedByRepo), "repo"))
+		if summary.BytesFreed != nil {
+			fmt.Fprintf(&b, ", freeing %s", formatBytes(summary.BytesFreed.Bytes))
+		}
+		b.WriteString("\n")
+	}
+
+	repos := make([]string, 0, len(summary.DeletedByRepo))
+	for repo, n := range summary.DeletedByRepo {
+		if n > 0 {
+			repos = append(repos, repo)
+		}
+	}
+	sort.Slice(repos, func(i, j int) bool {
+		ni, nj := summary.DeletedByRepo[repos[i]], summary.DeletedByRepo[repos[j]]
+		if ni != nj {
+			return ni > nj
+		}
+		return repos[i] < repos[j]
+	})
+	for i, repo := range repos {
+		if i == slackMaxRepos {
+			fmt.Fprintf(&b, "• …and %s\n", plural(len(repos)-slackMaxRepos, "more repo"))
+			break
+		}
+		fmt.Fprintf(&b, "• `%s`: %d\n", repo, summary.DeletedByRepo[repo])
+	}
+
+	if len(summary.RepoErrors) > 0 {
+		fmt.Fprintf(&b, ":warning: %s failed:\n", plural(len(summary.RepoErrors), "repo"))
+
+		failed := make([]string, 0, len(summary.RepoErrors))
+		for repo := range summary.RepoErrors {
+			failed = append(failed, repo)
+		}
+		sort.Strings(failed)
+		for _, repo := range failed {
+			fmt.Fprintf(&b, "• `%s`: %s\n", repo, summary.RepoErrors[repo])
+		}
+	}
+
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// plural returns the count followed by the noun, with an "s" unless the count
+// is 1.
+func plural(n int, noun string) string {
+	if n == 1 {
+		return fmt.Sprintf("%d %s", n, noun)
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
+
+// formatBytes formats the number of bytes with a decimal unit, such as
+// "18.0 GB".
+func formatBytes(n uint64) string {
+	const unit = 1000
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := uint64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "kMGTPE"[exp])
+}
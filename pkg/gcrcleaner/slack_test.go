@@ -0,0 +1,166 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRenderSlackMessage(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name    string
+		summary *CleanSummary
+		exp     string
+	}{
+		{
+			name: "cleaned",
+			summary: &CleanSummary{
+				Deleted: 342,
+				DeletedByRepo: map[string]int{
+					"gcr.io/p/a": 2,
+					"gcr.io/p/b": 340,
+					"gcr.io/p/c": 0,
+				},
+				BytesFreed: &FreedBytes{Bytes: 18_000_000_000},
+			},
+			exp: "Cleaned 342 images across 3 repos, freeing 18.0 GB\n" +
+				"• `gcr.io/p/b`: 340\n" +
+				"• `gcr.io/p/a`: 2",
+		},
+		{
+			name: "dry_run",
+			summary: &CleanSummary{
+				Deleted:       1,
+				DeletedByRepo: map[string]int{"gcr.io/p/a": 1},
+				BytesFreed:    &FreedBytes{Bytes: 512},
+				DryRun:        true,
+			},
+			exp: "[dry run] Would clean 1 image across 1 repo, freeing 512 B\n" +
+				"• `gcr.io/p/a`: 1",
+		},
+		{
+			name: "repo_errors",
+			summary: &CleanSummary{
+				DeletedByRepo: map[string]int{"gcr.io/p/a": 0},
+				RepoErrors:    map[string]string{"gcr.io/p/b": "denied"},
+			},
+			exp: "Cleaned 0 images across 1 repo\n" +
+				":warning: 1 repo failed:\n" +
+				"• `gcr.io/p/b`: denied",
+		},
+		{
+			name: "failed",
+			summary: &CleanSummary{
+				Deleted: 3,
+				Error:   "deadline exceeded",
+			},
+			exp: ":x: *Clean failed* after deleting 3 images: deadline exceeded",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got, want := renderSlackMessage(tc.summary), tc.exp; got != want {
+				t.Errorf("expected %q to be %q", got, want)
+			}
+		})
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		in  uint64
+		exp string
+	}{
+		{0, "0 B"},
+		{999, "999 B"},
+		{1500, "1.5 kB"},
+		{18_000_000_000, "18.0 GB"},
+	}
+
+	for _, tc := range cases {
+		if got, want := formatBytes(tc.in), tc.exp; got != want {
+			t.Errorf("expected %q to be %q", got, want)
+		}
+	}
+}
+
+func TestSlackResultSink(t *testing.T) {
+	t.Parallel()
+
+	texts := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msg struct {
+			Text string `json:"text"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			t.Errorf("failed to decode message: %s", err)
+		}
+		texts <- msg.Text
+	}))
+	t.Cleanup(srv.Close)
+
+	sink, err := NewSlackResultSink(srv.URL, WithWebhookRetries(1, time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	summary := &CleanSummary{Deleted: 1, DeletedByRepo: map[string]int{"gcr.io/p/a": 1}}
+	if err := sink.Report(context.Background(), summary); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := <-texts, renderSlackMessage(summary); got != want {
+		t.Errorf("expected %q to be %q", got, want)
+	}
+}
+
+func TestSlackResultSink_RedactsURL(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	t.Cleanup(srv.Close)
+
+	// The path of a Slack incoming webhook is its credential.
+	const path = "/services/T000/B000/XXXXXXXXXXXXXXXXXXXXXXXX"
+	sink, err := NewSlackResultSink(srv.URL+path, WithWebhookRetries(1, time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = sink.Report(context.Background(), &CleanSummary{})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if strings.Contains(err.Error(), path) {
+		t.Errorf("expected error %q to not contain the webhook path", err)
+	}
+}
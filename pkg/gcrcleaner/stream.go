@@ -0,0 +1,132 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+const (
+	contentTypeEventStream = "text/event-stream"
+
+	streamEventProgress = "progress"
+	streamEventResult   = "result"
+	streamEventError    = "error"
+)
+
+// StreamHandler is an http handler that invokes the cleaner with the given
+// parameters and streams progress as server-sent events. A "progress" event is
+// sent once the repositories are known and again as each repository is
+// cleaned. The final event is either "result", with the same response as
+// HTTPHandler, or "error". If the client disconnects, cleaning is cancelled.
+//
+// Errors that occur before the first event, such as an invalid payload, are
+// returned as regular JSON errors with the appropriate status code.
+func (s *Server) StreamHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			err := fmt.Errorf("streaming is not supported")
+			s.handleError(w, err, 500)
+			return
+		}
+
+		requestID, err := requestIDFromHeader(r)
+		if err != nil {
+			s.handleError(w, err, 500)
+			return
+		}
+		w.Header().Set(requestIDHeader, requestID)
+		rs := s.forRequest(requestID)
+
+		// The request context is cancelled when the client disconnects. It is
+		// also cancelled if an event cannot be written.
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+
+		stream := &eventStream{w: w, flusher: flusher}
+
+		resp, status, err := rs.clean(ctx, r.Body, func(p cleanProgress) {
+			if err := stream.send(streamEventProgress, p); err != nil {
+				rs.logger.Debug("failed to send progress event, cancelling", "error", err)
+				cancel()
+			}
+		})
+		if err != nil {
+			if !stream.isStarted() {
+				rs.handleError(w, err, status)
+				return
+			}
+
+			rs.logger.Error(err.Error(), "error", err)
+			if err := stream.send(streamEventError, &errorResp{
+				Error:     err.Error(),
+				ErrorCode: errorCodeFor(err, status),
+			}); err != nil {
+				rs.logger.Debug("failed to send error event", "error", err)
+			}
+			return
+		}
+
+		if err := stream.send(streamEventResult, resp); err != nil {
+			rs.logger.Debug("failed to send result event", "error", err)
+		}
+	}
+}
+
+// eventStream writes server-sent events. The headers are written with the
+// first event. It is safe for concurrent use.
+type eventStream struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+
+	lock    sync.Mutex
+	started bool
+}
+
+// send writes a single event with the given value encoded as JSON.
+func (e *eventStream) send(event string, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to marshal JSON event: %w", err)
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if !e.started {
+		e.w.Header().Set(contentTypeHeader, contentTypeEventStream)
+		e.w.Header().Set("Cache-Control", "no-cache")
+		e.w.WriteHeader(http.StatusOK)
+		e.started = true
+	}
+
+	if _, err := fmt.Fprintf(e.w, "event: %s\ndata: %s\n\n", event, b); err != nil {
+		return fmt.Errorf("failed to write event: %w", err)
+	}
+	e.flusher.Flush()
+	return nil
+}
+
+// isStarted returns true if any event has been sent.
+func (e *eventStream) isStarted() bool {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.started
+}
@@ -0,0 +1,69 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServer_StreamHandler(t *testing.T) {
+	t.Parallel()
+
+	server := testServer(t)
+
+	t.Run("invalid_json", func(t *testing.T) {
+		t.Parallel()
+
+		w := httptest.NewRecorder()
+		server.StreamHandler().ServeHTTP(w, httptest.NewRequest("POST", "/stream", strings.NewReader("not json")))
+
+		if got, want := w.Code, 500; got != want {
+			t.Errorf("expected status %d to be %d", got, want)
+		}
+		if got, want := w.Header().Get(contentTypeHeader), contentTypeEventStream; got == want {
+			t.Errorf("expected content type to not be %q", want)
+		}
+	})
+
+	t.Run("events", func(t *testing.T) {
+		t.Parallel()
+
+		w := httptest.NewRecorder()
+		body := strings.NewReader(`{"repos": [], "skip_in_use_check": true}`)
+		server.StreamHandler().ServeHTTP(w, httptest.NewRequest("POST", "/stream", body))
+
+		if got, want := w.Code, 200; got != want {
+			t.Fatalf("expected status %d to be %d: %s", got, want, w.Body.String())
+		}
+		if got, want := w.Header().Get(contentTypeHeader), contentTypeEventStream; got != want {
+			t.Errorf("expected content type %q to be %q", got, want)
+		}
+
+		got := w.Body.String()
+		for _, want := range []string{
+			"event: progress\ndata: {\"repos_total\":0,\"repos_done\":0,\"deleted\":0}\n\n",
+			"event: result\ndata: {",
+		} {
+			if !strings.Contains(got, want) {
+				t.Errorf("expected %q to contain %q", got, want)
+			}
+		}
+		if idx := strings.Index(got, "event: result"); idx < strings.Index(got, "event: progress") {
+			t.Errorf("expected result to be the last event: %q", got)
+		}
+	})
+}
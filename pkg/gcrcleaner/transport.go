@@ -0,0 +1,107 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+
+	gcrremote "github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// WithHTTPClient makes the cleaner use the client's transport for every call
+// to a registry, including the token exchanges made to authenticate to the
+// registry. If the client has a timeout, it limits each request, including
+// reading the response body. If the client does not have a transport, the
+// default transport is used, which honors HTTPS_PROXY and NO_PROXY.
+//
+// The client is not used for Google APIs such as BigQuery and the IAM
+// Credentials API, or for fetching OAuth tokens, since those clients construct
+// their own transports. They still honor HTTPS_PROXY and NO_PROXY.
+func WithHTTPClient(client *http.Client) CleanerOption {
+	return func(c *cleanerConfig) {
+		c.httpClient = client
+	}
+}
+
+// registryTransport returns the transport for registry calls built from the
+// client given to WithHTTPClient, or nil if none was given.
+func (c *cleanerConfig) registryTransport() http.RoundTripper {
+	if c.httpClient == nil {
+		return nil
+	}
+
+	transport := c.httpClient.Transport
+	if transport == nil {
+		transport = gcrremote.DefaultTransport
+	}
+	if timeout := c.httpClient.Timeout; timeout > 0 {
+		transport = &timeoutTransport{inner: transport, timeout: timeout}
+	}
+	return transport
+}
+
+// httpTransport returns the transport for registry calls.
+func (c *Cleaner) httpTransport() http.RoundTripper {
+	if c.transport == nil {
+		return gcrremote.DefaultTransport
+	}
+	return c.transport
+}
+
+// remoteOptions returns the options for calls to a registry.
+func (c *Cleaner) remoteOptions(ctx context.Context) []gcrremote.Option {
+	return []gcrremote.Option{
+		gcrremote.WithContext(ctx),
+		gcrremote.WithUserAgent(userAgent),
+		gcrremote.WithAuthFromKeychain(c.keychain),
+		gcrremote.WithTransport(c.httpTransport()),
+	}
+}
+
+// timeoutTransport limits each request to the timeout, like http.Client does.
+// The timeout includes reading the response body.
+type timeoutTransport struct {
+	inner   http.RoundTripper
+	timeout time.Duration
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *timeoutTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(r.Context(), t.timeout)
+	resp, err := t.inner.RoundTrip(r.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// cancelBody cancels the request's context when the body is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+// Close implements io.Closer.
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
@@ -0,0 +1,130 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	gcrauthn "github.com/google/go-containerregistry/pkg/authn"
+)
+
+// countingTransport counts the requests made through it.
+type countingTransport struct {
+	count int32
+}
+
+func (t *countingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&t.count, 1)
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func TestNewCleaner_WithHTTPClient(t *testing.T) {
+	t.Parallel()
+
+	digest := "sha256:" + strings.Repeat("1", 64)
+	registry := &fakeListRegistry{
+		manifests: []string{digest},
+	}
+	srv := httptest.NewServer(registry)
+	t.Cleanup(srv.Close)
+
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	transport := &countingTransport{}
+	cleaner, err := NewCleaner(gcrauthn.NewMultiKeychain(), NewLogger("error", io.Discard, io.Discard), 1,
+		WithHTTPClient(&http.Client{Transport: transport, Timeout: time.Minute}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := cleaner.DeleteManifest(context.Background(), host+"/proj/a", digest, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if atomic.LoadInt32(&transport.count) == 0 {
+		t.Errorf("expected requests to use the client's transport")
+	}
+	if got, want := atomic.LoadInt32(&registry.deletes), int32(1); got != want {
+		t.Errorf("expected %d deletes to be %d", got, want)
+	}
+}
+
+func TestTimeoutTransport(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name  string
+		delay time.Duration
+		err   bool
+	}{
+		{
+			name: "fast",
+		},
+		{
+			name:  "slow",
+			delay: 5 * time.Second,
+			err:   true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				select {
+				case <-r.Context().Done():
+				case <-time.After(tc.delay):
+				}
+				io.WriteString(w, "ok")
+			}))
+			t.Cleanup(srv.Close)
+
+			client := &http.Client{
+				Transport: &timeoutTransport{inner: http.DefaultTransport, timeout: 100 * time.Millisecond},
+			}
+
+			resp, err := client.Get(srv.URL)
+			if tc.err {
+				if err == nil {
+					resp.Body.Close()
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			b, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := string(b), "ok"; got != want {
+				t.Errorf("expected %q to be %q", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,273 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	gcrname "github.com/google/go-containerregistry/pkg/name"
+)
+
+// FieldError is an error for a single payload field.
+type FieldError struct {
+	// Field is the JSON name of the field, such as "tag_filter_any".
+	Field string
+
+	// Err is the underlying error.
+	Err error
+}
+
+// Error implements error.
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Field, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// ValidationError is returned by Payload.Validate. It lists every invalid
+// field.
+type ValidationError struct {
+	Errors []*FieldError
+}
+
+// Error implements error.
+func (e *ValidationError) Error() string {
+	msgs := make([]string, 0, len(e.Errors))
+	for _, fe := range e.Errors {
+		msgs = append(msgs, fe.Error())
+	}
+	return "invalid payload: " + strings.Join(msgs, "; ")
+}
+
+// filterOptions returns the options used to build all of the payload's item
+// filters.
+func (p *Payload) filterOptions() []ItemFilterOption {
+	return []ItemFilterOption{
+		WithPatternKind(p.PatternKind),
+		WithGlobMatchSlash(p.GlobMatchSlash),
+		WithCaseInsensitive(p.CaseInsensitive),
+		WithAllMatchEmpty(p.TagFilterAllMatchEmpty),
+	}
+}
+
+// Validate eagerly builds every filter and checks every option in the payload.
+// If any are invalid, it returns a *ValidationError listing each invalid field.
+func (p *Payload) Validate() error {
+	var errs []*FieldError
+	add := func(field string, err error) {
+		if err != nil {
+			errs = append(errs, &FieldError{Field: field, Err: err})
+		}
+	}
+
+	for i, repo := range p.Repos {
+		if repo = strings.TrimSpace(repo); isRepositoryPattern(repo) {
+			_, _, err := parseRepositoryPattern(repo)
+			add(fmt.Sprintf("repos[%d]", i), err)
+		}
+	}
+
+	for i, repo := range p.ReposExclude {
+		if repo = strings.TrimSpace(repo); isRepositoryPattern(repo) {
+			_, _, err := parseRepositoryPattern(repo)
+			add(fmt.Sprintf("repos_exclude[%d]", i), err)
+		}
+	}
+
+	// Every pattern depends on the pattern kind, so they can only be checked if
+	// it is valid.
+	switch p.PatternKind {
+	case PatternKindRegex, PatternKindGlob, "":
+		filterOpts := p.filterOptions()
+
+		buildAny := func(field, pattern string) {
+			_, err := BuildItemFilter(pattern, "", filterOpts...)
+			add(field, err)
+		}
+		buildAny("repo_keep_filter", p.RepoKeepFilterAny)
+		buildAny("repository_match_prefix", p.RepoMatchPrefixFilter)
+		buildAny("tag_keep_any", p.TagKeepAny)
+		buildAny("platform_filter", p.PlatformFilter)
+
+		_, err := BuildItemFilter(p.TagFilterAny, "", filterOpts...)
+		add("tag_filter_any", err)
+		for i, pattern := range p.TagFilterAnyOf {
+			_, err := BuildItemFilterAny([]string{pattern}, filterOpts...)
+			add(fmt.Sprintf("tag_filter_any_of[%d]", i), err)
+		}
+		_, err = BuildItemFilter("", p.TagFilterAll, filterOpts...)
+		add("tag_filter_all", err)
+		_, err = BuildItemFilter("", "", append([]ItemFilterOption{WithNone(p.TagFilterNone)}, filterOpts...)...)
+		add("tag_filter_none", err)
+
+		for i, clause := range p.TagFilterClauses {
+			_, err := clause.build(filterOpts...)
+			add(fmt.Sprintf("tag_filter_clauses[%d]", i), err)
+		}
+
+		for i, rule := range p.RepoRules {
+			_, err := rule.build(time.Now(), filterOpts...)
+			add(fmt.Sprintf("repo_rules[%d]", i), err)
+		}
+	default:
+		add("pattern_kind", fmt.Errorf("unknown pattern kind %q", p.PatternKind))
+	}
+
+	// The top-level tag filters are mutually exclusive.
+	var numberPattern string
+	if p.TagFilterNumber != nil {
+		numberPattern = p.TagFilterNumber.Pattern
+	}
+
+	given := make([]string, 0, 5)
+	for _, f := range []struct {
+		field, value string
+	}{
+		{"tag_filter_any", strings.Join(p.tagFilterAnyPatterns(), "|")},
+		{"tag_filter_all", p.TagFilterAll},
+		{"tag_filter_none", p.TagFilterNone},
+		{"tag_filter_semver", p.TagFilterSemver},
+		{"tag_filter_number", numberPattern},
+	} {
+		if f.value != "" {
+			given = append(given, f.field)
+		}
+	}
+	if len(given) > 1 {
+		add(given[1], fmt.Errorf("only one tag filter type may be specified, got %s",
+			strings.Join(given, ", ")))
+	}
+
+	_, err := BuildSemverFilter(p.TagFilterSemver)
+	add("tag_filter_semver", err)
+
+	_, err = p.TagFilterNumber.build()
+	add("tag_filter_number", err)
+
+	_, err = BuildSemverFilter(p.TagKeepSemver)
+	add("tag_keep_semver", err)
+	if p.TagKeepAny != "" && p.TagKeepSemver != "" {
+		add("tag_keep_semver", fmt.Errorf("cannot be combined with tag_keep_any"))
+	}
+
+	if p.KeepGroupBy != "" {
+		_, err := regexp.Compile(p.KeepGroupBy)
+		add("keep_group_by", err)
+	}
+
+	add("time_source", p.TimeSource.Validate())
+	if p.TimeSource == TimeSourcePulled {
+		add("time_source", fmt.Errorf("%q is only supported by the Go library", TimeSourcePulled))
+	}
+	add("keep_scope", p.KeepScope.Validate())
+	if p.KeepScope == KeepScopeAll && p.KeepAcrossRepos {
+		add("keep_scope", fmt.Errorf("%q cannot be combined with keep_across_repos", KeepScopeAll))
+	}
+
+	after, before := time.Time(p.UploadedAfter), time.Time(p.UploadedBefore)
+	if !after.IsZero() && !before.IsZero() && !after.Before(before) {
+		add("uploaded_after", fmt.Errorf("must be before uploaded_before"))
+	}
+
+	if p.LogLevel != "" {
+		_, err := parseSeverity(p.LogLevel)
+		add("log_level", err)
+	}
+
+	if p.KeepTagged != nil && *p.KeepTagged < 0 {
+		add("keep_tagged", fmt.Errorf("must not be negative"))
+	}
+	if p.KeepUntagged != nil && *p.KeepUntagged < 0 {
+		add("keep_untagged", fmt.Errorf("must not be negative"))
+	}
+
+	if _, err := ParseKeepLabels(p.KeepLabels); err != nil {
+		add("keep_labels", err)
+	}
+
+	if p.MaxDelete < 0 {
+		add("max_delete", fmt.Errorf("must not be negative"))
+	}
+
+	if p.TagKeepSemverHighest < 0 {
+		add("tag_keep_semver_highest", fmt.Errorf("must not be negative"))
+	}
+
+	if p.MinManifests < 0 {
+		add("min_manifests", fmt.Errorf("must not be negative"))
+	}
+
+	if p.ResponseVersion < 0 || p.ResponseVersion > responseVersionRefCount {
+		add("response_version", fmt.Errorf("must be %d or %d",
+			responseVersionRepoCount, responseVersionRefCount))
+	}
+
+	if p.RepoTimeout < 0 {
+		add("repo_timeout", fmt.Errorf("must not be negative"))
+	}
+
+	if p.DeleteJitter < 0 {
+		add("delete_jitter", fmt.Errorf("must not be negative"))
+	}
+
+	if p.MinAge < 0 {
+		add("min_age", fmt.Errorf("must not be negative"))
+	}
+
+	if p.RecursiveBestEffort && !p.Recursive {
+		add("recursive_best_effort", fmt.Errorf("requires recursive"))
+	}
+
+	if p.OrphanedSignaturesOnly && p.UntaggedOnly {
+		add("orphaned_signatures_only", fmt.Errorf("cannot be combined with untagged_only"))
+	}
+
+	if p.MaxDepth != nil && *p.MaxDepth < 0 {
+		add("max_depth", fmt.Errorf("must not be negative"))
+	}
+
+	if p.KeepAcrossRepos && !p.Recursive {
+		add("keep_across_repos", fmt.Errorf("requires recursive"))
+	}
+
+	if p.CountsOnly && p.VerboseDryRun {
+		add("counts_only", fmt.Errorf("cannot be combined with verbose_dry_run"))
+	}
+
+	for i, image := range p.InUseImages {
+		_, err := gcrname.ParseReference(strings.TrimSpace(image))
+		add(fmt.Sprintf("in_use_images[%d]", i), err)
+	}
+
+	if !p.SkipInUseCheck && len(p.InUseImages) == 0 {
+		_, _, err := resolveInUseAssetTypes(p.InUseAssetTypes, p.InUseAssetPaths)
+		add("in_use_asset_types", err)
+		add("in_use_scope", validateInUseScope(p.InUseScope))
+		if p.InUsePageSize < 0 {
+			add("in_use_page_size", fmt.Errorf("must not be negative"))
+		}
+	}
+
+	if len(errs) > 0 {
+		return &ValidationError{Errors: errs}
+	}
+	return nil
+}
@@ -0,0 +1,405 @@
+// Copyright 2024 The GCR Cleaner Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcrcleaner
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPayload_Validate(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name    string
+		payload *Payload
+		fields  []string
+	}{
+		{
+			name:    "empty",
+			payload: &Payload{SkipInUseCheck: true},
+		},
+		{
+			name: "valid",
+			payload: &Payload{
+				TagFilterAny:   "^dev-",
+				TagKeepAny:     "^prod$",
+				KeepGroupBy:    "^(.+)-[0-9a-f]+$",
+				TimeSource:     TimeSourceCreated,
+				SkipInUseCheck: true,
+			},
+		},
+		{
+			name: "invalid_regexes",
+			payload: &Payload{
+				RepoKeepFilterAny: "(",
+				TagFilterAny:      "[",
+				TagKeepAny:        "^ok$",
+				KeepGroupBy:       "*",
+				SkipInUseCheck:    true,
+			},
+			fields: []string{"repo_keep_filter", "tag_filter_any", "keep_group_by"},
+		},
+		{
+			name: "invalid_clause",
+			payload: &Payload{
+				TagFilterClauses: []*TagFilterClause{
+					{Any: "^ok$"},
+					{All: "("},
+				},
+				SkipInUseCheck: true,
+			},
+			fields: []string{"tag_filter_clauses[1]"},
+		},
+		{
+			name: "multiple_tag_filters",
+			payload: &Payload{
+				TagFilterAny:    "^a",
+				TagFilterSemver: "< 1.0.0",
+				SkipInUseCheck:  true,
+			},
+			fields: []string{"tag_filter_semver"},
+		},
+		{
+			name: "invalid_tag_filter_number",
+			payload: &Payload{
+				TagFilterNumber: &NumberRange{Pattern: `^build-\d+$`},
+				SkipInUseCheck:  true,
+			},
+			fields: []string{"tag_filter_number"},
+		},
+		{
+			name: "tag_filter_number_and_semver",
+			payload: &Payload{
+				TagFilterSemver: "< 1.0.0",
+				TagFilterNumber: &NumberRange{Pattern: `^build-(\d+)$`, Max: func() *int64 { v := int64(999); return &v }()},
+				SkipInUseCheck:  true,
+			},
+			fields: []string{"tag_filter_number"},
+		},
+		{
+			name: "negative_min_manifests",
+			payload: &Payload{
+				MinManifests:   -1,
+				SkipInUseCheck: true,
+			},
+			fields: []string{"min_manifests"},
+		},
+		{
+			name: "best_effort_without_recursive",
+			payload: &Payload{
+				RecursiveBestEffort: true,
+				SkipInUseCheck:      true,
+			},
+			fields: []string{"recursive_best_effort"},
+		},
+		{
+			name: "orphaned_signatures_with_untagged_only",
+			payload: &Payload{
+				OrphanedSignaturesOnly: true,
+				UntaggedOnly:           true,
+				SkipInUseCheck:         true,
+			},
+			fields: []string{"orphaned_signatures_only"},
+		},
+		{
+			name: "invalid_pattern_kind",
+			payload: &Payload{
+				TagFilterAny:   "(",
+				PatternKind:    "wildcard",
+				SkipInUseCheck: true,
+			},
+			fields: []string{"pattern_kind"},
+		},
+		{
+			name: "invalid_options",
+			payload: &Payload{
+				TimeSource:      "modified",
+				InUseAssetTypes: []string{"example.com/Unknown"},
+				InUseScope:      "nope",
+			},
+			fields: []string{"time_source", "in_use_asset_types", "in_use_scope"},
+		},
+		{
+			name: "time_source_pulled",
+			payload: &Payload{
+				TimeSource:     TimeSourcePulled,
+				SkipInUseCheck: true,
+			},
+			fields: []string{"time_source"},
+		},
+		{
+			name: "invalid_repo_pattern",
+			payload: &Payload{
+				Repos:          []string{"gcr.io/my-project/app", "*.gcr.io/my-project"},
+				SkipInUseCheck: true,
+			},
+			fields: []string{"repos[1]"},
+		},
+		{
+			name: "invalid_repos_exclude",
+			payload: &Payload{
+				ReposExclude:   []string{"gcr.io/my-project/legacy-*", "*.gcr.io/my-project"},
+				SkipInUseCheck: true,
+			},
+			fields: []string{"repos_exclude[1]"},
+		},
+		{
+			name: "negative_max_delete",
+			payload: &Payload{
+				MaxDelete:      -1,
+				SkipInUseCheck: true,
+			},
+			fields: []string{"max_delete"},
+		},
+		{
+			name: "negative_keep_tagged_untagged",
+			payload: &Payload{
+				KeepTagged:     func() *int64 { v := int64(-1); return &v }(),
+				KeepUntagged:   func() *int64 { v := int64(-1); return &v }(),
+				SkipInUseCheck: true,
+			},
+			fields: []string{"keep_tagged", "keep_untagged"},
+		},
+		{
+			name: "invalid_response_version",
+			payload: &Payload{
+				ResponseVersion: 3,
+				SkipInUseCheck:  true,
+			},
+			fields: []string{"response_version"},
+		},
+		{
+			name: "negative_repo_timeout",
+			payload: &Payload{
+				RepoTimeout:    duration(-time.Minute),
+				SkipInUseCheck: true,
+			},
+			fields: []string{"repo_timeout"},
+		},
+		{
+			name: "negative_min_age",
+			payload: &Payload{
+				MinAge:         duration(-time.Hour),
+				SkipInUseCheck: true,
+			},
+			fields: []string{"min_age"},
+		},
+		{
+			name: "negative_delete_jitter",
+			payload: &Payload{
+				DeleteJitter:   duration(-time.Second),
+				SkipInUseCheck: true,
+			},
+			fields: []string{"delete_jitter"},
+		},
+		{
+			name: "invalid_in_use_images",
+			payload: &Payload{
+				InUseImages:    sortedStringSlice{"gcr.io/p/ok:v1", "gcr.io/p/bad:bad tag"},
+				SkipInUseCheck: true,
+			},
+			fields: []string{"in_use_images[1]"},
+		},
+		{
+			name: "negative_in_use_page_size",
+			payload: &Payload{
+				InUsePageSize: -1,
+			},
+			fields: []string{"in_use_page_size"},
+		},
+		{
+			name: "invalid_platform_filter",
+			payload: &Payload{
+				PlatformFilter: "linux/(",
+				SkipInUseCheck: true,
+			},
+			fields: []string{"platform_filter"},
+		},
+		{
+			name: "invalid_keep_scope",
+			payload: &Payload{
+				KeepScope:      "newest",
+				SkipInUseCheck: true,
+			},
+			fields: []string{"keep_scope"},
+		},
+		{
+			name: "invalid_keep_labels",
+			payload: &Payload{
+				KeepLabels:     sortedStringSlice{"keep"},
+				SkipInUseCheck: true,
+			},
+			fields: []string{"keep_labels"},
+		},
+		{
+			name: "negative_max_depth",
+			payload: &Payload{
+				MaxDepth:       func() *int { v := -1; return &v }(),
+				SkipInUseCheck: true,
+			},
+			fields: []string{"max_depth"},
+		},
+		{
+			name: "invalid_tag_filter_any_of",
+			payload: &Payload{
+				TagFilterAnyOf: sortedStringSlice{"^pr-", "("},
+				SkipInUseCheck: true,
+			},
+			fields: []string{"tag_filter_any_of[1]"},
+		},
+		{
+			name: "tag_filter_any_of_and_all",
+			payload: &Payload{
+				TagFilterAnyOf: sortedStringSlice{"^pr-"},
+				TagFilterAll:   "^tmp-",
+				SkipInUseCheck: true,
+			},
+			fields: []string{"tag_filter_all"},
+		},
+		{
+			name: "invalid_repo_rules",
+			payload: &Payload{
+				RepoRules: []*RepoRule{
+					{Repo: "gcr.io/my-project/a", Keep: func() *int64 { v := int64(1); return &v }()},
+					{Keep: func() *int64 { v := int64(1); return &v }()},
+					{Repo: "gcr.io/my-project/*", TagFilterAny: "("},
+					{Repo: "gcr.io/my-project/c", Keep: func() *int64 { v := int64(-1); return &v }()},
+				},
+				SkipInUseCheck: true,
+			},
+			fields: []string{"repo_rules[1]", "repo_rules[2]", "repo_rules[3]"},
+		},
+		{
+			name: "keep_across_repos_without_recursive",
+			payload: &Payload{
+				KeepAcrossRepos: true,
+				SkipInUseCheck:  true,
+			},
+			fields: []string{"keep_across_repos"},
+		},
+		{
+			name: "counts_only_and_verbose_dry_run",
+			payload: &Payload{
+				CountsOnly:     true,
+				VerboseDryRun:  true,
+				SkipInUseCheck: true,
+			},
+			fields: []string{"counts_only"},
+		},
+		{
+			name: "uploaded_window_reversed",
+			payload: &Payload{
+				UploadedAfter:  timestamp(time.Date(2024, time.February, 1, 0, 0, 0, 0, time.UTC)),
+				UploadedBefore: timestamp(time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)),
+				SkipInUseCheck: true,
+			},
+			fields: []string{"uploaded_after"},
+		},
+		{
+			name: "uploaded_window_empty",
+			payload: &Payload{
+				UploadedAfter:  timestamp(time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)),
+				UploadedBefore: timestamp(time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)),
+				SkipInUseCheck: true,
+			},
+			fields: []string{"uploaded_after"},
+		},
+		{
+			name: "uploaded_window",
+			payload: &Payload{
+				UploadedAfter:  timestamp(time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)),
+				UploadedBefore: timestamp(time.Date(2024, time.February, 1, 0, 0, 0, 0, time.UTC)),
+				SkipInUseCheck: true,
+			},
+		},
+		{
+			name: "in_use_skipped",
+			payload: &Payload{
+				InUseAssetTypes: []string{"example.com/Unknown"},
+				SkipInUseCheck:  true,
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			err := tc.payload.Validate()
+			if len(tc.fields) == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+
+			var verr *ValidationError
+			if !errors.As(err, &verr) {
+				t.Fatalf("expected %v to be a validation error", err)
+			}
+
+			fields := make([]string, 0, len(verr.Errors))
+			for _, fe := range verr.Errors {
+				fields = append(fields, fe.Field)
+			}
+			if !reflect.DeepEqual(fields, tc.fields) {
+				t.Errorf("expected fields %q to be %q", fields, tc.fields)
+			}
+		})
+	}
+}
+
+func TestServer_HTTPHandler_ValidationError(t *testing.T) {
+	t.Parallel()
+
+	server := testServer(t)
+
+	w := httptest.NewRecorder()
+	body := strings.NewReader(`{"tag_filter_any": "(", "keep_group_by": "*", "skip_in_use_check": true}`)
+	server.HTTPHandler().ServeHTTP(w, httptest.NewRequest("POST", "/http", body))
+
+	if got, want := w.Code, 400; got != want {
+		t.Fatalf("expected status %d to be %d", got, want)
+	}
+
+	var resp errorResp
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := resp.ErrorCode, ErrorCodeInvalidPayload; got != want {
+		t.Errorf("expected error code %q to be %q", got, want)
+	}
+	if got, want := len(resp.Fields), 2; got != want {
+		t.Fatalf("expected %d fields to be %d: %#v", got, want, resp.Fields)
+	}
+	if got, want := resp.Fields[0].Field, "tag_filter_any"; got != want {
+		t.Errorf("expected field %q to be %q", got, want)
+	}
+	if got, want := resp.Fields[0].Error, "missing closing )"; !strings.Contains(got, want) {
+		t.Errorf("expected error %q to contain %q", got, want)
+	}
+	if got, want := resp.Fields[1].Field, "keep_group_by"; got != want {
+		t.Errorf("expected field %q to be %q", got, want)
+	}
+}